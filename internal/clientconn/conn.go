@@ -143,6 +143,8 @@ func (c *conn) run(ctx context.Context) (err error) {
 			err = e
 		}
 
+		c.h.Close()
+
 		if c.proxy != nil {
 			c.proxy.Close()
 		}
@@ -258,6 +258,19 @@ func TestMarshalJSONHANA(t *testing.T) {
 		assert.Equal(t, expected, actual)
 	})
 
+	t.Run("MarshalJSONHANA date", func(t *testing.T) {
+		t.Parallel()
+
+		document := convertDocument(types.MustMakeDocument(
+			"date", time.Date(2021, 11, 1, 10, 18, 42, 123000000, time.UTC),
+		))
+
+		actual, err := document.MarshalJSONHANA()
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{"date":{"$da":1635761922123}}`, string(actual))
+	})
+
 	t.Run("MarshalJSONHANA unsupported datatype", func(t *testing.T) {
 		t.Parallel()
 
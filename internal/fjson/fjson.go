@@ -172,6 +172,8 @@ func toFJSONHANA(v any) (fjsontype, error) {
 		return pointer.To(ObjectID(v)), nil
 	case bool:
 		return pointer.To(Bool(v)), nil
+	case time.Time:
+		return pointer.To(DateTime(v)), nil
 	case nil:
 		return nil, nil
 	case int64:
@@ -209,6 +209,36 @@ var commands = map[string]command{
 		help:           "find one document, modifies it and return either the old document or the new document.",
 		storageHandler: (common.Storage).MsgFindAndModify,
 	},
+	"aggregate": {
+		// db.collection.aggregate()
+		name:           "aggregate",
+		help:           "Performs aggregation tasks such as filter, sort and project.",
+		storageHandler: (common.Storage).MsgAggregate,
+	},
+	"distinct": {
+		// db.collection.distinct()
+		name:           "distinct",
+		help:           "Returns the distinct values of a field for the documents matched by the query.",
+		storageHandler: (common.Storage).MsgDistinct,
+	},
+	"explain": {
+		// db.collection.explain()
+		name:           "explain",
+		help:           "Returns the SQL statements of a command and their SAP HANA execution plans.",
+		storageHandler: (common.Storage).MsgExplain,
+	},
+	"getMore": {
+		// Used by drivers to retrieve the next batch of a cursor
+		name:           "getMore",
+		help:           "Returns the next batch of documents of a cursor.",
+		storageHandler: (common.Storage).MsgGetMore,
+	},
+	"killCursors": {
+		// db.runCommand({killCursors: "collection", cursors: [id]})
+		name:           "killCursors",
+		help:           "Closes the given cursors.",
+		storageHandler: (common.Storage).MsgKillCursors,
+	},
 	"count": {
 		// db.collection.find().count()
 		name:           "count",
@@ -112,6 +112,21 @@ func TestSupportedCommands(t *testing.T) {
 			"update", types.MustMakeDocument(
 				"help", "Updates documents that are matched by the query.",
 			),
+			"aggregate", types.MustMakeDocument(
+				"help", "Performs aggregation tasks such as filter, sort and project.",
+			),
+			"distinct", types.MustMakeDocument(
+				"help", "Returns the distinct values of a field for the documents matched by the query.",
+			),
+			"explain", types.MustMakeDocument(
+				"help", "Returns the SQL statements of a command and their SAP HANA execution plans.",
+			),
+			"getMore", types.MustMakeDocument(
+				"help", "Returns the next batch of documents of a cursor.",
+			),
+			"killCursors", types.MustMakeDocument(
+				"help", "Closes the given cursors.",
+			),
 			"listDatabases", types.MustMakeDocument(
 				"help", "Returns a summary of all the databases.",
 			),
@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"math"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// bitPositions returns the bit positions of the argument of a bitwise query operator like $bitsAllSet.
+// The argument is a non-negative number used as bitmask, an array of bit positions or BinData.
+func bitPositions(op string, value any) (positions []int, err error) {
+	switch value := value.(type) {
+	case int32, int64, float64:
+		f := toFloat64(value)
+		if f != math.Trunc(f) || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, NewErrorMessage(ErrBadValue, "Expected an integer: %s: %v", op, value)
+		}
+		if f < 0 {
+			return nil, NewErrorMessage(ErrBadValue, "Expected a positive number in: %s: %v", op, value)
+		}
+		if f >= math.MaxInt64 {
+			return nil, NewErrorMessage(ErrBadValue, "Cannot represent as a 64-bit integer: %s: %v", op, value)
+		}
+
+		mask := toInt64(value)
+		for i := 0; i < 63; i++ {
+			if mask&(1<<i) != 0 {
+				positions = append(positions, i)
+			}
+		}
+
+	case *types.Array:
+		for _, element := range arrayValues(value) {
+			position, ok := constantIndex(element)
+			if !ok || !isNumber(element) {
+				return nil, NewErrorMessage(ErrBadValue, "bit positions must be non-negative integers: %s: %v", op, element)
+			}
+			positions = append(positions, int(position))
+		}
+
+	case types.Binary:
+		for i := 0; i < len(value.B)*8; i++ {
+			if value.B[i/8]&(1<<(i%8)) != 0 {
+				positions = append(positions, i)
+			}
+		}
+
+	default:
+		return nil, NewErrorMessage(ErrBadValue, "%s takes an Array, a number, or a BinData but received: %v", op, value)
+	}
+
+	return positions, nil
+}
+
+// bitSet returns the bit at the position of an integral number or BinData. Numbers are
+// in two's complement, so bits above 63 are set for negative numbers. It returns false
+// as second value for all other values.
+func bitSet(value any, position int) (set bool, ok bool) {
+	switch value := value.(type) {
+	case int32, int64, float64:
+		f := toFloat64(value)
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return false, false
+		}
+
+		n := toInt64(value)
+		if position > 63 {
+			return n < 0, true
+		}
+		return n&(1<<position) != 0, true
+
+	case types.Binary:
+		if position >= len(value.B)*8 {
+			return false, true
+		}
+		return value.B[position/8]&(1<<(position%8)) != 0, true
+
+	default:
+		return false, false
+	}
+}
+
+// matchBitsValue evaluates a bitwise query operator on a single value.
+func matchBitsValue(value any, op string, positions []int) bool {
+	if _, ok := bitSet(value, 0); !ok {
+		return false
+	}
+
+	for _, position := range positions {
+		set, _ := bitSet(value, position)
+		switch {
+		case op == "$bitsallset" && !set, op == "$bitsallclear" && set:
+			return false
+		case op == "$bitsanyset" && set, op == "$bitsanyclear" && !set:
+			return true
+		}
+	}
+
+	return op == "$bitsallset" || op == "$bitsallclear"
+}
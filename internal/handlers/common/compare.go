@@ -0,0 +1,380 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// The results of types.CompareScalars.
+const (
+	equal    = types.Equal
+	less     = types.Less
+	greater  = types.Greater
+	notEqual = types.NotEqual
+)
+
+// missingType marks a field which does not exist in a document.
+type missingType struct{}
+
+// missing is used for fields not found in a document when values are resolved in memory.
+var missing = missingType{}
+
+// typeOrder returns the position of the value's type in the BSON comparison order.
+// Numbers share one position, as do null and missing fields.
+func typeOrder(value any) int {
+	switch value.(type) {
+	case nil, missingType, types.NullType:
+		return 1
+	case float64, int32, int64:
+		return 2
+	case string, types.CString:
+		return 3
+	case types.Document:
+		return 4
+	case *types.Array:
+		return 5
+	case types.Binary:
+		return 6
+	case types.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case types.Timestamp:
+		return 10
+	case types.Regex:
+		return 11
+	default:
+		return 12
+	}
+}
+
+// sqlTypeOrder are the types which can be checked by SAP HANA with their position in the BSON comparison order.
+var sqlTypeOrder = []struct {
+	alias string
+	order int
+}{
+	{"number", 2},
+	{"string", 3},
+	{"object", 4},
+	{"array", 5},
+	{"objectId", 7},
+	{"bool", 8},
+}
+
+// TypeOrderSQL returns the SQL of the position of the field's type in the BSON comparison order like typeOrder.
+// SAP HANA does not order values of different types like MongoDB, so they are ordered by it first.
+func TypeOrderSQL(kSQL string) string {
+	sql := "CASE WHEN " + kSQL + " IS NULL THEN 1"
+	for _, t := range sqlTypeOrder {
+		sql += " WHEN " + fmt.Sprintf(sqlTypeChecks[t.alias], kSQL) + " THEN " + strconv.Itoa(t.order)
+	}
+
+	return sql + " ELSE 12 END"
+}
+
+// aliasFromType returns the BSON type alias of a value like "string" or "objectId" used in error messages.
+func aliasFromType(value any) string {
+	switch value.(type) {
+	case nil, types.NullType:
+		return "null"
+	case missingType:
+		return "missing"
+	case float64:
+		return "double"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case string, types.CString:
+		return "string"
+	case types.Document:
+		return "object"
+	case *types.Array:
+		return "array"
+	case types.Binary:
+		return "binData"
+	case types.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "date"
+	case types.Timestamp:
+		return "timestamp"
+	case types.Regex:
+		return "regex"
+	default:
+		return "unknown"
+	}
+}
+
+// typeCodes are the numeric codes of the BSON types used by $type.
+var typeCodes = map[int64]string{
+	1:   "double",
+	2:   "string",
+	3:   "object",
+	4:   "array",
+	5:   "binData",
+	6:   "undefined",
+	7:   "objectId",
+	8:   "bool",
+	9:   "date",
+	10:  "null",
+	11:  "regex",
+	12:  "dbPointer",
+	13:  "javascript",
+	14:  "symbol",
+	15:  "javascriptWithScope",
+	16:  "int",
+	17:  "timestamp",
+	18:  "long",
+	19:  "decimal",
+	-1:  "minKey",
+	127: "maxKey",
+}
+
+// typeAliases returns the type aliases of the argument of $type which is an alias, a numeric code
+// or an array of them. The alias "number" stands for all numeric types.
+func typeAliases(value any) ([]string, error) {
+	values := []any{value}
+	if array, ok := value.(*types.Array); ok {
+		values = arrayValues(array)
+		if len(values) == 0 {
+			return nil, NewErrorMessage(ErrBadValue, "$type must match at least one type")
+		}
+	}
+
+	aliases := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			if _, ok := typeCodeOf(v); !ok && v != "number" {
+				return nil, NewErrorMessage(ErrBadValue, "Unknown type name alias: %s", v)
+			}
+			aliases[i] = v
+
+		case int32, int64, float64:
+			code := toInt64(v)
+			alias, ok := typeCodes[code]
+			if !ok || toFloat64(v) != float64(code) {
+				return nil, NewErrorMessage(ErrBadValue, "Invalid numerical type code: %v", v)
+			}
+			aliases[i] = alias
+
+		default:
+			return nil, NewErrorMessage(ErrTypeMismatch, "type must be represented as a number or a string")
+		}
+	}
+
+	return aliases, nil
+}
+
+// typeCodeOf returns the numeric code of a type alias.
+func typeCodeOf(alias string) (int64, bool) {
+	for code, a := range typeCodes {
+		if a == alias {
+			return code, true
+		}
+	}
+
+	return 0, false
+}
+
+// hasType checks if the value is of the type with the given alias.
+func hasType(value any, alias string) bool {
+	if alias == "number" {
+		return isNumber(value)
+	}
+
+	return aliasFromType(value) == alias
+}
+
+// compareValues compares two values of the same type bracket the way MongoDB does.
+// Values of different type brackets are notEqual.
+func compareValues(a, b any) types.CompareResult {
+	if typeOrder(a) != typeOrder(b) {
+		return notEqual
+	}
+
+	switch a := a.(type) {
+	case nil, missingType, types.NullType:
+		return equal
+
+	case types.Document:
+		b := b.(types.Document)
+		aKeys, bKeys := a.Keys(), b.Keys()
+		for i := 0; i < len(aKeys) && i < len(bKeys); i++ {
+			if res := compareTotal(aKeys[i], bKeys[i]); res != equal {
+				return res
+			}
+			if res := compareTotal(a.Map()[aKeys[i]], b.Map()[bKeys[i]]); res != equal {
+				return res
+			}
+		}
+		return compareLen(len(aKeys), len(bKeys))
+
+	case *types.Array:
+		b := b.(*types.Array)
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			aValue, _ := a.Get(i)
+			bValue, _ := b.Get(i)
+			if res := compareTotal(aValue, bValue); res != equal {
+				return res
+			}
+		}
+		return compareLen(a.Len(), b.Len())
+
+	case types.Binary:
+		b := b.(types.Binary)
+		if res := compareLen(len(a.B), len(b.B)); res != equal {
+			return res
+		}
+		if a.Subtype != b.Subtype {
+			return compareLen(int(a.Subtype), int(b.Subtype))
+		}
+		return compareLen(bytes.Compare(a.B, b.B), 0)
+
+	case types.CString:
+		return types.CompareScalars(string(a), toString(b))
+
+	case string:
+		return types.CompareScalars(a, toString(b))
+
+	case types.Regex:
+		b := b.(types.Regex)
+		if res := types.CompareScalars(a.Pattern, b.Pattern); res != equal {
+			return res
+		}
+		return types.CompareScalars(a.Options, b.Options)
+
+	default:
+		return types.CompareScalars(a, b)
+	}
+}
+
+// compareTotal compares two values of any type using the BSON comparison order.
+func compareTotal(a, b any) types.CompareResult {
+	if aOrder, bOrder := typeOrder(a), typeOrder(b); aOrder != bOrder {
+		return compareLen(aOrder, bOrder)
+	}
+
+	return compareValues(a, b)
+}
+
+// compareLen compares two integers.
+func compareLen(a, b int) types.CompareResult {
+	switch {
+	case a < b:
+		return less
+	case a > b:
+		return greater
+	default:
+		return equal
+	}
+}
+
+// toString returns the string of a string or types.CString.
+func toString(value any) string {
+	if s, ok := value.(types.CString); ok {
+		return string(s)
+	}
+
+	return value.(string)
+}
+
+// sortKey returns the value of the field used to sort a document. For arrays the smallest element
+// is used for an ascending and the largest element for a descending sort.
+func sortKey(doc types.Document, key string, descending bool) any {
+	values := pathValues(doc, strings.Split(key, "."))
+
+	var res any = missing
+	first := true
+	for _, value := range values {
+		elements := []any{value}
+		if array, ok := value.(*types.Array); ok && array.Len() != 0 {
+			elements = arrayValues(array)
+		}
+
+		for _, element := range elements {
+			if first {
+				res = element
+				first = false
+				continue
+			}
+
+			cmp := compareTotal(element, res)
+			if (descending && cmp == greater) || (!descending && cmp == less) {
+				res = element
+			}
+		}
+	}
+
+	return res
+}
+
+// SortDocuments sorts documents in memory by the given sort document like {field: 1, other: -1}.
+// It stops with the error of the context when the context is done.
+func SortDocuments(ctx context.Context, docs []types.Document, sortDoc types.Document) error {
+	descending := make([]bool, len(sortDoc.Keys()))
+	for i, key := range sortDoc.Keys() {
+		var order int64
+		switch value := sortDoc.Map()[key].(type) {
+		case int32:
+			order = int64(value)
+		case int64:
+			order = value
+		case float64:
+			order = int64(value)
+			if float64(order) != value {
+				return NewErrorMessage(ErrSortBadValue, "cannot use value %v for sort", value)
+			}
+		default:
+			return NewErrorMessage(ErrSortBadValue, "cannot use type %T for sort", value)
+		}
+
+		switch order {
+		case 1:
+		case -1:
+			descending[i] = true
+		default:
+			return NewErrorMessage(ErrSortBadValue, "cannot use value %d for sort", order)
+		}
+	}
+
+	// once the context is done, all documents compare equal, so the sort finishes quickly
+	var err error
+	var comparisons int
+	sort.SliceStable(docs, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		if comparisons++; checkContext(ctx, comparisons) != nil {
+			err = ctx.Err()
+			return false
+		}
+
+		for k, key := range sortDoc.Keys() {
+			cmp := compareTotal(sortKey(docs[i], key, descending[k]), sortKey(docs[j], key, descending[k]))
+			if cmp == equal || cmp == notEqual {
+				continue
+			}
+			return (cmp == less) != descending[k]
+		}
+		return false
+	})
+
+	return err
+}
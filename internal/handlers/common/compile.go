@@ -0,0 +1,414 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// sqlComparisonOperators are the SQL operators of the comparison expressions.
+var sqlComparisonOperators = map[string]string{
+	"$eq":  "=",
+	"$ne":  "<>",
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+// flippedComparisonOperators are the comparison expressions with swapped arguments.
+var flippedComparisonOperators = map[string]string{
+	"$eq":  "$eq",
+	"$ne":  "$ne",
+	"$gt":  "$lt",
+	"$gte": "$lte",
+	"$lt":  "$gt",
+	"$lte": "$gte",
+}
+
+// CompileExpression converts an aggregation expression to SQL. It returns false if the
+// expression can not be expressed in SQL with the same result and has to be evaluated in memory.
+func CompileExpression(expr any) (string, bool) {
+	switch expr := expr.(type) {
+	case string:
+		if strings.HasPrefix(expr, "$") {
+			return fieldPathSQL(expr)
+		}
+		return compileLiteral(expr)
+
+	case types.Document:
+		keys := expr.Keys()
+		if len(keys) == 1 && strings.HasPrefix(keys[0], "$") {
+			return compileOperator(keys[0], expr.Map()[keys[0]])
+		}
+
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			if !isSQLName(k) || strings.HasPrefix(k, "$") {
+				return "", false
+			}
+
+			value, ok := CompileExpression(expr.Map()[k])
+			if !ok {
+				return "", false
+			}
+			fields[i] = fmt.Sprintf("\"%s\": %s", k, value)
+		}
+		if len(fields) == 0 {
+			return "", false
+		}
+		return "{" + strings.Join(fields, ", ") + "}", true
+
+	default:
+		return compileLiteral(expr)
+	}
+}
+
+// compileLiteral converts a constant to SQL.
+func compileLiteral(value any) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'", true
+	case int32, int64:
+		return fmt.Sprintf("%d", value), true
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return fmt.Sprintf("to_json_boolean(%t)", value), true
+	case nil:
+		return "NULL", true
+	default:
+		return "", false
+	}
+}
+
+// compileOperator converts an expression operator to SQL.
+func compileOperator(op string, arg any) (string, bool) {
+	if op == "$literal" {
+		return compileLiteral(arg)
+	}
+
+	if _, ok := sqlComparisonOperators[op]; ok || op == "$and" || op == "$or" || op == "$not" {
+		predicate, ok := compilePredicate(types.MustMakeDocument(op, arg))
+		if !ok {
+			return "", false
+		}
+		return "CASE WHEN " + predicate + " THEN to_json_boolean(true) ELSE to_json_boolean(false) END", true
+	}
+
+	switch op {
+	case "$cond":
+		var ifExpr, thenExpr, elseExpr any
+		switch arg := arg.(type) {
+		case *types.Array:
+			if arg.Len() != 3 {
+				return "", false
+			}
+			values := arrayValues(arg)
+			ifExpr, thenExpr, elseExpr = values[0], values[1], values[2]
+		case types.Document:
+			for _, k := range []string{"if", "then", "else"} {
+				if _, ok := arg.Map()[k]; !ok {
+					return "", false
+				}
+			}
+			ifExpr, thenExpr, elseExpr = arg.Map()["if"], arg.Map()["then"], arg.Map()["else"]
+		default:
+			return "", false
+		}
+
+		args, ok := compileArguments([]any{thenExpr, elseExpr})
+		if !ok {
+			return "", false
+		}
+		predicate, ok := compilePredicate(ifExpr)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("CASE WHEN %s THEN %s ELSE %s END", predicate, args[0], args[1]), true
+
+	case "$switch":
+		branches, defaultExpr, hasDefault, err := switchArguments(arg)
+		if err != nil || !hasDefault {
+			// without default an error is returned in memory if no branch matches
+			return "", false
+		}
+
+		sql := "CASE"
+		for _, branch := range branches {
+			predicate, ok := compilePredicate(branch[0])
+			if !ok {
+				return "", false
+			}
+			then, ok := CompileExpression(branch[1])
+			if !ok {
+				return "", false
+			}
+			sql += fmt.Sprintf(" WHEN %s THEN %s", predicate, then)
+		}
+
+		defaultSQL, ok := CompileExpression(defaultExpr)
+		if !ok {
+			return "", false
+		}
+		return sql + " ELSE " + defaultSQL + " END", true
+	}
+
+	argsArray, ok := arg.(*types.Array)
+	if !ok {
+		argsArray = types.MustNewArray(arg)
+	}
+	args, ok := compileArguments(arrayValues(argsArray))
+	if !ok {
+		return "", false
+	}
+
+	switch op {
+	case "$add":
+		if len(args) == 0 {
+			return "", false
+		}
+		return "(" + strings.Join(args, " + ") + ")", true
+
+	case "$multiply":
+		if len(args) == 0 {
+			return "", false
+		}
+		return "(" + strings.Join(args, " * ") + ")", true
+
+	case "$subtract":
+		if len(args) != 2 {
+			return "", false
+		}
+		return fmt.Sprintf("(%s - %s)", args[0], args[1]), true
+
+	case "$divide":
+		if len(args) != 2 {
+			return "", false
+		}
+		return fmt.Sprintf("(TO_DOUBLE(%s) / %s)", args[0], args[1]), true
+
+	case "$concat":
+		if len(args) == 0 {
+			return "", false
+		}
+		return "(" + strings.Join(args, " || ") + ")", true
+
+	case "$toUpper", "$toLower":
+		if len(args) != 1 {
+			return "", false
+		}
+		function := "UPPER"
+		if op == "$toLower" {
+			function = "LOWER"
+		}
+		// null results in an empty string
+		return fmt.Sprintf("%s(COALESCE(%s, ''))", function, args[0]), true
+
+	case "$substrCP":
+		if len(args) != 3 {
+			return "", false
+		}
+		values := arrayValues(argsArray)
+		start, ok := constantIndex(values[1])
+		if !ok {
+			return "", false
+		}
+		length, ok := constantIndex(values[2])
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("SUBSTRING(COALESCE(%s, ''), %d, %d)", args[0], start+1, length), true
+
+	case "$ifNull":
+		if len(args) < 2 {
+			return "", false
+		}
+		return "COALESCE(" + strings.Join(args, ", ") + ")", true
+
+	case "$cmp":
+		if len(args) != 2 {
+			return "", false
+		}
+		less, ok := compilePredicate(types.MustMakeDocument("$lt", argsArray))
+		if !ok {
+			return "", false
+		}
+		greater, ok := compilePredicate(types.MustMakeDocument("$gt", argsArray))
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("CASE WHEN %s THEN -1 WHEN %s THEN 1 ELSE 0 END", less, greater), true
+
+	default:
+		return "", false
+	}
+}
+
+// compileArguments converts the arguments of an operator to SQL.
+func compileArguments(values []any) ([]string, bool) {
+	args := make([]string, len(values))
+	for i, v := range values {
+		arg, ok := CompileExpression(v)
+		if !ok {
+			return nil, false
+		}
+		args[i] = arg
+	}
+
+	return args, true
+}
+
+// compilePredicate converts an expression used as a condition to an SQL predicate which is either
+// true or false, but never unknown. Only comparisons with a constant number or string,
+// $and, $or, $not and boolean constants are supported.
+func compilePredicate(expr any) (string, bool) {
+	switch expr := expr.(type) {
+	case bool:
+		if expr {
+			return "1 = 1", true
+		}
+		return "1 = 0", true
+
+	case types.Document:
+		keys := expr.Keys()
+		if len(keys) != 1 {
+			return "", false
+		}
+		op, arg := keys[0], expr.Map()[keys[0]]
+
+		argsArray, ok := arg.(*types.Array)
+		if !ok {
+			argsArray = types.MustNewArray(arg)
+		}
+		args := arrayValues(argsArray)
+
+		switch op {
+		case "$and", "$or":
+			if len(args) == 0 {
+				return "", false
+			}
+			predicates := make([]string, len(args))
+			for i, a := range args {
+				if predicates[i], ok = compilePredicate(a); !ok {
+					return "", false
+				}
+			}
+			return "(" + strings.Join(predicates, " "+strings.ToUpper(op[1:])+" ") + ")", true
+
+		case "$not":
+			if len(args) != 1 {
+				return "", false
+			}
+			predicate, ok := compilePredicate(args[0])
+			if !ok {
+				return "", false
+			}
+			return "NOT " + predicate, true
+
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			if len(args) != 2 {
+				return "", false
+			}
+
+			value, constant := args[0], args[1]
+			if isComparisonConstant(value) {
+				value, constant = constant, value
+				op = flippedComparisonOperators[op]
+			}
+			if !isComparisonConstant(constant) || isComparisonConstant(value) {
+				return "", false
+			}
+
+			valueSQL, ok := CompileExpression(value)
+			if !ok {
+				return "", false
+			}
+			constantSQL, _ := CompileExpression(constant)
+
+			return bracketedComparison(op, valueSQL, constantSQL, constant), true
+		}
+	}
+
+	return "", false
+}
+
+// bracketedComparison compares a value with a number or string constant in the BSON comparison order.
+// Values of the type bracket of the constant are compared as they are, values of other types are less
+// or greater than the constant depending on their type: only null and missing and, for a string,
+// numbers are less than the constant.
+func bracketedComparison(op, valueSQL, constantSQL string, constant any) string {
+	check := fmt.Sprintf(sqlTypeChecks["number"], valueSQL)
+	less := valueSQL + " IS NULL"
+	if isStringConstant(constant) {
+		check = fmt.Sprintf(sqlTypeChecks["string"], valueSQL)
+		less = "(" + less + " OR " + fmt.Sprintf(sqlTypeChecks["number"], valueSQL) + ")"
+	}
+
+	same := fmt.Sprintf("(%s AND %s %s %s)", check, valueSQL, sqlComparisonOperators[op], constantSQL)
+	switch op {
+	case "$eq":
+		return same
+	case "$ne":
+		return "NOT " + fmt.Sprintf("(%s AND %s = %s)", check, valueSQL, constantSQL)
+	case "$lt", "$lte":
+		return "(" + same + " OR " + less + ")"
+	default:
+		return "(" + same + " OR NOT (" + check + " OR " + less + "))"
+	}
+}
+
+// isStringConstant checks if the comparison constant is a string.
+func isStringConstant(constant any) bool {
+	if doc, ok := constant.(types.Document); ok {
+		constant = doc.Map()["$literal"]
+	}
+
+	_, ok := constant.(string)
+	return ok
+}
+
+// isComparisonConstant checks if the expression is a number or a string which is not a field path.
+func isComparisonConstant(expr any) bool {
+	if doc, ok := expr.(types.Document); ok && len(doc.Keys()) == 1 && doc.Keys()[0] == "$literal" {
+		expr = doc.Map()["$literal"]
+		if _, ok := expr.(string); ok {
+			return true
+		}
+	}
+
+	switch expr := expr.(type) {
+	case string:
+		return !strings.HasPrefix(expr, "$")
+	case int32, int64:
+		return true
+	case float64:
+		return !math.IsNaN(expr) && !math.IsInf(expr, 0)
+	default:
+		return false
+	}
+}
+
+// constantIndex returns the value of a constant non-negative integer.
+func constantIndex(expr any) (int64, bool) {
+	switch expr := expr.(type) {
+	case int32:
+		return int64(expr), expr >= 0
+	case int64:
+		return expr, expr >= 0
+	case float64:
+		return int64(expr), expr >= 0 && expr == math.Trunc(expr) && expr <= math.MaxInt32
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// distinctField is the field of the selected documents which contains the value of the distinct key.
+const distinctField = "value"
+
+// DistinctProjection creates the projection of the SELECT DISTINCT statement of a distinct command.
+// The top-level field of the key is returned in a document with the single field "value". The rest
+// of a dotted key is resolved by DistinctValues, because it can go through arrays of documents.
+func DistinctProjection(key string) (string, error) {
+	path := strings.Split(key, ".")
+	for _, k := range path {
+		if !isSQLName(k) || strings.HasPrefix(k, "$") {
+			return "", NewErrorMessage(ErrBadValue, "FieldPath field names may not be empty, start with '$' or contain quotes: %s", key)
+		}
+	}
+
+	keySQL, err := whereKey(path[0])
+	if err != nil {
+		return "", err
+	}
+
+	return "{\"" + distinctField + "\": " + keySQL + "}", nil
+}
+
+// DistinctDocuments converts documents, which are filtered in memory, to the documents selected with DistinctProjection.
+func DistinctDocuments(docs []types.Document, key string) []types.Document {
+	field := strings.Split(key, ".")[0]
+
+	res := make([]types.Document, 0, len(docs))
+	for _, doc := range docs {
+		value, err := doc.Get(field)
+		if err != nil {
+			continue
+		}
+		res = append(res, types.MustMakeDocument(distinctField, value))
+	}
+
+	return res
+}
+
+// DistinctValues returns the distinct values of the key in the documents selected with DistinctProjection.
+// Like in MongoDB arrays of documents on the path are traversed, arrays are replaced by their elements
+// and documents without the key are skipped.
+func DistinctValues(docs []types.Document, key string) (*types.Array, error) {
+	path := strings.Split(key, ".")[1:]
+
+	res := types.MakeArray(len(docs))
+	seen := map[string][]any{}
+	for _, doc := range docs {
+		value, err := doc.Get(distinctField)
+		if err != nil {
+			continue
+		}
+
+		var values []any
+		for _, v := range pathValues(value, path) {
+			if IsMissing(v) {
+				continue
+			}
+			if array, ok := v.(*types.Array); ok {
+				values = append(values, arrayValues(array)...)
+				continue
+			}
+			values = append(values, v)
+		}
+
+	valuesLoop:
+		for _, v := range values {
+			key := groupHashKey(v)
+			for _, existing := range seen[key] {
+				if compareTotal(existing, v) == equal {
+					continue valuesLoop
+				}
+			}
+
+			seen[key] = append(seen[key], v)
+			if err = res.Append(v); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+	}
+
+	return res, nil
+}
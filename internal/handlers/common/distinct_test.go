@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistinct(t *testing.T) {
+	projectionSQL, err := DistinctProjection("items.sku")
+	require.NoError(t, err)
+	assert.Equal(t, "{\"value\": \"items\"}", projectionSQL)
+
+	_, err = DistinctProjection("items.$sku")
+	assert.Error(t, err)
+
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray(
+			types.MustMakeDocument("sku", "a"),
+			types.MustMakeDocument("sku", types.MustNewArray("b", "a")),
+			types.MustMakeDocument("qty", int32(1)),
+			"c",
+		)),
+		types.MustMakeDocument("_id", int32(2), "items", types.MustMakeDocument("sku", int32(1))),
+		types.MustMakeDocument("_id", int32(3), "items", types.MustMakeDocument("sku", nil)),
+		types.MustMakeDocument("_id", int32(4), "items", types.MustNewArray()),
+		types.MustMakeDocument("_id", int32(5)),
+	}
+
+	selected := DistinctDocuments(docs, "items.sku")
+	assert.Len(t, selected, 4)
+
+	values, err := DistinctValues(selected, "items.sku")
+	require.NoError(t, err)
+	assert.Equal(t, types.MustNewArray("a", "b", int32(1), nil), values)
+
+	values, err = DistinctValues(DistinctDocuments(docs, "items.0.sku"), "items.0.sku")
+	require.NoError(t, err)
+	assert.Equal(t, types.MustNewArray("a"), values)
+
+	values, err = DistinctValues(DistinctDocuments(docs, "items"), "items")
+	require.NoError(t, err)
+	assert.Equal(t, 6, values.Len())
+}
@@ -19,6 +19,7 @@
 package common
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -36,15 +37,25 @@ const (
 	// For ProtocolError only.
 	errInternalError = ErrorCode(1) // InternalError
 
-	ErrBadValue          = ErrorCode(2)     // BadValue
-	ErrNamespaceNotFound = ErrorCode(26)    // NamespaceNotFound
-	ErrNamespaceExists   = ErrorCode(48)    // NamespaceExists
-	ErrCommandNotFound   = ErrorCode(59)    // CommandNotFound
-	ErrNotImplemented    = ErrorCode(238)   // NotImplemented
-	ErrSortBadValue      = ErrorCode(15974) // SortBadValue
-	ErrProjectionInEx    = ErrorCode(31253) // Location31253
-	ErrProjectionExIn    = ErrorCode(31254) // Location31254
-	ErrRegexOptions      = ErrorCode(51075) // Location51075
+	ErrBadValue                   = ErrorCode(2)     // BadValue
+	ErrFailedToParse              = ErrorCode(9)     // FailedToParse
+	ErrUnauthorized               = ErrorCode(13)    // Unauthorized
+	ErrTypeMismatch               = ErrorCode(14)    // TypeMismatch
+	ErrNamespaceNotFound          = ErrorCode(26)    // NamespaceNotFound
+	ErrPathNotViable              = ErrorCode(28)    // PathNotViable
+	ErrConflictingUpdateOperators = ErrorCode(40)    // ConflictingUpdateOperators
+	ErrCursorNotFound             = ErrorCode(43)    // CursorNotFound
+	ErrNamespaceExists            = ErrorCode(48)    // NamespaceExists
+	ErrMaxTimeMSExpired           = ErrorCode(50)    // MaxTimeMSExpired
+	ErrCommandNotFound            = ErrorCode(59)    // CommandNotFound
+	ErrNotImplemented             = ErrorCode(238)   // NotImplemented
+	ErrSortBadValue               = ErrorCode(15974) // SortBadValue
+	ErrProjectionInEx             = ErrorCode(31253) // Location31253
+	ErrProjectionExIn             = ErrorCode(31254) // Location31254
+	ErrStageSpecification         = ErrorCode(40323) // Location40323
+	ErrStageUnrecognized          = ErrorCode(40324) // Location40324
+	ErrRegexOptions               = ErrorCode(51075) // Location51075
+	ErrRegexNullByte              = ErrorCode(51091) // Location51091
 )
 
 // Error represents wire protocol error.
@@ -102,6 +113,7 @@ func (e *Error) Document() types.Document {
 // ProtocolError converts any error to wire protocol error.
 //
 // Nil panics, *Error (possibly wrapped) is returned unwrapped with true,
+// an exceeded deadline set by maxTimeMS is returned as MaxTimeMSExpired with true,
 // any other value is wrapped with InternalError and returned with false.
 func ProtocolError(err error) (*Error, bool) {
 	if err == nil {
@@ -113,9 +125,26 @@ func ProtocolError(err error) (*Error, bool) {
 		return e, true
 	}
 
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewErrorMessage(ErrMaxTimeMSExpired, "operation exceeded time limit").(*Error), true
+	}
+
 	return NewError(errInternalError, err).(*Error), false
 }
 
+// contextCheckInterval is the number of steps of an in-memory operation after which checkContext checks the context.
+const contextCheckInterval = 1024
+
+// checkContext returns the error of the context if the step is a multiple of contextCheckInterval, so loops
+// processing documents in memory stop when the time limit set by maxTimeMS is exceeded.
+func checkContext(ctx context.Context, step int) error {
+	if step%contextCheckInterval != 0 {
+		return nil
+	}
+
+	return ctx.Err()
+}
+
 // check interfaces
 var (
 	_ error = (*Error)(nil)
@@ -10,53 +10,54 @@ func _() {
 	var x [1]struct{}
 	_ = x[errInternalError-1]
 	_ = x[ErrBadValue-2]
+	_ = x[ErrFailedToParse-9]
+	_ = x[ErrUnauthorized-13]
+	_ = x[ErrTypeMismatch-14]
 	_ = x[ErrNamespaceNotFound-26]
+	_ = x[ErrPathNotViable-28]
+	_ = x[ErrConflictingUpdateOperators-40]
+	_ = x[ErrCursorNotFound-43]
+	_ = x[ErrMaxTimeMSExpired-50]
 	_ = x[ErrNamespaceExists-48]
 	_ = x[ErrCommandNotFound-59]
 	_ = x[ErrNotImplemented-238]
 	_ = x[ErrSortBadValue-15974]
 	_ = x[ErrProjectionInEx-31253]
 	_ = x[ErrProjectionExIn-31254]
+	_ = x[ErrStageSpecification-40323]
+	_ = x[ErrStageUnrecognized-40324]
 	_ = x[ErrRegexOptions-51075]
+	_ = x[ErrRegexNullByte-51091]
 }
 
-const (
-	_ErrorCode_name_0 = "InternalErrorBadValue"
-	_ErrorCode_name_1 = "NamespaceNotFound"
-	_ErrorCode_name_2 = "NamespaceExists"
-	_ErrorCode_name_3 = "CommandNotFound"
-	_ErrorCode_name_4 = "NotImplemented"
-	_ErrorCode_name_5 = "SortBadValue"
-	_ErrorCode_name_6 = "Location31253Location31254"
-	_ErrorCode_name_7 = "Location51075"
-)
+const _ErrorCode_name = "InternalErrorBadValueFailedToParseUnauthorizedTypeMismatchNamespaceNotFoundPathNotViableConflictingUpdateOperatorsCursorNotFoundNamespaceExistsMaxTimeMSExpiredCommandNotFoundNotImplementedSortBadValueLocation31253Location31254Location40323Location40324Location51075Location51091"
 
-var (
-	_ErrorCode_index_0 = [...]uint8{0, 13, 21}
-	_ErrorCode_index_6 = [...]uint8{0, 13, 26}
-)
+var _ErrorCode_map = map[ErrorCode]string{
+	1:     _ErrorCode_name[0:13],
+	2:     _ErrorCode_name[13:21],
+	9:     _ErrorCode_name[21:34],
+	13:    _ErrorCode_name[34:46],
+	14:    _ErrorCode_name[46:58],
+	26:    _ErrorCode_name[58:75],
+	28:    _ErrorCode_name[75:88],
+	40:    _ErrorCode_name[88:114],
+	43:    _ErrorCode_name[114:128],
+	48:    _ErrorCode_name[128:143],
+	50:    _ErrorCode_name[143:159],
+	59:    _ErrorCode_name[159:174],
+	238:   _ErrorCode_name[174:188],
+	15974: _ErrorCode_name[188:200],
+	31253: _ErrorCode_name[200:213],
+	31254: _ErrorCode_name[213:226],
+	40323: _ErrorCode_name[226:239],
+	40324: _ErrorCode_name[239:252],
+	51075: _ErrorCode_name[252:265],
+	51091: _ErrorCode_name[265:278],
+}
 
 func (i ErrorCode) String() string {
-	switch {
-	case 1 <= i && i <= 2:
-		i -= 1
-		return _ErrorCode_name_0[_ErrorCode_index_0[i]:_ErrorCode_index_0[i+1]]
-	case i == 26:
-		return _ErrorCode_name_1
-	case i == 48:
-		return _ErrorCode_name_2
-	case i == 59:
-		return _ErrorCode_name_3
-	case i == 238:
-		return _ErrorCode_name_4
-	case i == 15974:
-		return _ErrorCode_name_5
-	case 31253 <= i && i <= 31254:
-		i -= 31253
-		return _ErrorCode_name_6[_ErrorCode_index_6[i]:_ErrorCode_index_6[i+1]]
-	case i == 51075:
-		return _ErrorCode_name_7
-	default:
-		return "ErrorCode(" + strconv.FormatInt(int64(i), 10) + ")"
+	if str, ok := _ErrorCode_map[i]; ok {
+		return str
 	}
+	return "ErrorCode(" + strconv.FormatInt(int64(i), 10) + ")"
 }
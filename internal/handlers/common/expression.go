@@ -0,0 +1,574 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// EvaluateExpression evaluates an aggregation expression like "$field" or {$add: ["$a", 1]} on a document in memory.
+// A field path which does not exist in the document results in a value for which IsMissing returns true.
+func EvaluateExpression(doc types.Document, expr any) (any, error) {
+	switch expr := expr.(type) {
+	case string:
+		switch {
+		case expr == "$$ROOT" || expr == "$$CURRENT":
+			return doc, nil
+		case strings.HasPrefix(expr, "$$ROOT.") || strings.HasPrefix(expr, "$$CURRENT."):
+			return fieldPathValue(doc, strings.Split(expr, ".")[1:]), nil
+		case expr == "$$REMOVE":
+			return missing, nil
+		case strings.HasPrefix(expr, "$$"):
+			return nil, NewErrorMessage(ErrNotImplemented, "support for variable %s is not implemented yet", expr)
+		case strings.HasPrefix(expr, "$"):
+			return fieldPathValue(doc, strings.Split(expr[1:], ".")), nil
+		default:
+			return expr, nil
+		}
+
+	case types.Document:
+		keys := expr.Keys()
+		if len(keys) != 0 && strings.HasPrefix(keys[0], "$") {
+			if len(keys) != 1 {
+				return nil, NewErrorMessage(ErrBadValue, "an expression specification must contain exactly one field, the name of the expression. Found %d fields in %v", len(keys), keys)
+			}
+			return evaluateOperator(doc, keys[0], expr.Map()[keys[0]])
+		}
+
+		res := types.MustMakeDocument()
+		for _, k := range keys {
+			value, err := EvaluateExpression(doc, expr.Map()[k])
+			if err != nil {
+				return nil, err
+			}
+
+			if IsMissing(value) {
+				continue
+			}
+
+			if err = res.Set(k, value); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		return res, nil
+
+	case *types.Array:
+		res := types.MakeArray(expr.Len())
+		for _, element := range arrayValues(expr) {
+			value, err := EvaluateExpression(doc, element)
+			if err != nil {
+				return nil, err
+			}
+
+			if IsMissing(value) {
+				value = nil
+			}
+
+			if err = res.Append(value); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		return res, nil
+
+	default:
+		return expr, nil
+	}
+}
+
+// IsMissing returns true if the value is the result of a field path which does not exist in a document.
+func IsMissing(value any) bool {
+	return value == missing
+}
+
+// evaluateOperator evaluates an expression operator like $add.
+func evaluateOperator(doc types.Document, op string, arg any) (any, error) {
+	if op == "$literal" {
+		return arg, nil
+	}
+
+	if op == "$cond" || op == "$switch" {
+		return evaluateConditional(doc, op, arg)
+	}
+
+	args, err := evaluateArguments(doc, op, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "$add", "$multiply":
+		var res any = int32(0)
+		if op == "$multiply" {
+			res = int32(1)
+		}
+
+		for _, v := range args {
+			if v == nil || IsMissing(v) {
+				return nil, nil
+			}
+			if !isNumber(v) {
+				return nil, NewErrorMessage(ErrTypeMismatch, "%s only supports numeric types, not %s", op, aliasFromType(v))
+			}
+
+			if op == "$add" {
+				res = addNumbers(res, v)
+			} else {
+				res = multiplyNumbers(res, v)
+			}
+		}
+		return res, nil
+
+	case "$subtract", "$divide":
+		if len(args) != 2 {
+			return nil, NewErrorMessage(ErrBadValue, "Expression %s takes exactly 2 arguments. %d were passed in.", op, len(args))
+		}
+
+		a, b := args[0], args[1]
+		if a == nil || IsMissing(a) || b == nil || IsMissing(b) {
+			return nil, nil
+		}
+		if !isNumber(a) || !isNumber(b) {
+			return nil, NewErrorMessage(ErrTypeMismatch, "%s only supports numeric types, not %s and %s", op, aliasFromType(a), aliasFromType(b))
+		}
+
+		if op == "$subtract" {
+			return addNumbers(a, negateNumber(b)), nil
+		}
+
+		if toFloat64(b) == 0 {
+			return nil, NewErrorMessage(ErrBadValue, "can't $divide by zero")
+		}
+		return toFloat64(a) / toFloat64(b), nil
+
+	case "$concat":
+		var sb strings.Builder
+		for _, v := range args {
+			if v == nil || IsMissing(v) {
+				return nil, nil
+			}
+			s, ok := v.(string)
+			if !ok {
+				return nil, NewErrorMessage(ErrTypeMismatch, "$concat only supports strings, not %s", aliasFromType(v))
+			}
+			sb.WriteString(s)
+		}
+		return sb.String(), nil
+
+	case "$toUpper", "$toLower":
+		if len(args) != 1 {
+			return nil, NewErrorMessage(ErrBadValue, "Expression %s takes exactly 1 arguments. %d were passed in.", op, len(args))
+		}
+
+		s, err := expressionString(op, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if op == "$toUpper" {
+			return strings.ToUpper(s), nil
+		}
+		return strings.ToLower(s), nil
+
+	case "$substrCP":
+		if len(args) != 3 {
+			return nil, NewErrorMessage(ErrBadValue, "Expression $substrCP takes exactly 3 arguments. %d were passed in.", len(args))
+		}
+
+		s, err := expressionString(op, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if !isNumber(args[1]) || !isNumber(args[2]) {
+			return nil, NewErrorMessage(ErrTypeMismatch, "$substrCP: starting index and length must be numeric")
+		}
+
+		start, length := toFloat64(args[1]), toFloat64(args[2])
+		if start < 0 || start != math.Trunc(start) || length < 0 || length != math.Trunc(length) {
+			return nil, NewErrorMessage(ErrBadValue, "$substrCP: starting index and length must be non-negative integers")
+		}
+
+		runes := []rune(s)
+		if int(start) >= len(runes) {
+			return "", nil
+		}
+
+		end := int(start) + int(length)
+		if end > len(runes) {
+			end = len(runes)
+		}
+		return string(runes[int(start):end]), nil
+
+	case "$ifNull":
+		if len(args) < 2 {
+			return nil, NewErrorMessage(ErrBadValue, "$ifNull needs at least two arguments, had: %d", len(args))
+		}
+
+		for _, v := range args[:len(args)-1] {
+			if v != nil && !IsMissing(v) {
+				return v, nil
+			}
+		}
+		return args[len(args)-1], nil
+
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		if len(args) != 2 {
+			return nil, NewErrorMessage(ErrBadValue, "Expression %s takes exactly 2 arguments. %d were passed in.", op, len(args))
+		}
+
+		cmp := compareExpressionValues(args[0], args[1])
+		switch op {
+		case "$eq":
+			return cmp == equal, nil
+		case "$ne":
+			return cmp != equal, nil
+		case "$gt":
+			return cmp == greater, nil
+		case "$gte":
+			return cmp == greater || cmp == equal, nil
+		case "$lt":
+			return cmp == less, nil
+		case "$lte":
+			return cmp == less || cmp == equal, nil
+		default:
+			switch cmp {
+			case less:
+				return int32(-1), nil
+			case greater:
+				return int32(1), nil
+			default:
+				return int32(0), nil
+			}
+		}
+
+	case "$and":
+		for _, v := range args {
+			if !isTrue(v) {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "$or":
+		for _, v := range args {
+			if isTrue(v) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$not":
+		if len(args) != 1 {
+			return nil, NewErrorMessage(ErrBadValue, "Expression $not takes exactly 1 arguments. %d were passed in.", len(args))
+		}
+		return !isTrue(args[0]), nil
+
+	default:
+		return nil, NewErrorMessage(ErrNotImplemented, "support for %s is not implemented yet", op)
+	}
+}
+
+// evaluateArguments evaluates the arguments of an operator. A single argument may be given without an array.
+func evaluateArguments(doc types.Document, op string, arg any) ([]any, error) {
+	argsArray, ok := arg.(*types.Array)
+	if !ok {
+		argsArray = types.MustNewArray(arg)
+	}
+
+	args := make([]any, argsArray.Len())
+	for i, a := range arrayValues(argsArray) {
+		v, err := EvaluateExpression(doc, a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	return args, nil
+}
+
+// evaluateConditional evaluates $cond and $switch. Only the chosen branch is evaluated.
+func evaluateConditional(doc types.Document, op string, arg any) (any, error) {
+	if op == "$cond" {
+		var ifExpr, thenExpr, elseExpr any
+		switch arg := arg.(type) {
+		case *types.Array:
+			if arg.Len() != 3 {
+				return nil, NewErrorMessage(ErrBadValue, "Expression $cond takes exactly 3 arguments. %d were passed in.", arg.Len())
+			}
+			values := arrayValues(arg)
+			ifExpr, thenExpr, elseExpr = values[0], values[1], values[2]
+
+		case types.Document:
+			for _, k := range []string{"if", "then", "else"} {
+				if _, ok := arg.Map()[k]; !ok {
+					return nil, NewErrorMessage(ErrBadValue, "Missing '%s' parameter to $cond", k)
+				}
+			}
+			ifExpr, thenExpr, elseExpr = arg.Map()["if"], arg.Map()["then"], arg.Map()["else"]
+
+		default:
+			return nil, NewErrorMessage(ErrBadValue, "$cond needs an array or an object")
+		}
+
+		condition, err := EvaluateExpression(doc, ifExpr)
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue(condition) {
+			return EvaluateExpression(doc, thenExpr)
+		}
+		return EvaluateExpression(doc, elseExpr)
+	}
+
+	branches, defaultExpr, hasDefault, err := switchArguments(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, branch := range branches {
+		condition, err := EvaluateExpression(doc, branch[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue(condition) {
+			return EvaluateExpression(doc, branch[1])
+		}
+	}
+
+	if !hasDefault {
+		return nil, NewErrorMessage(ErrBadValue, "$switch could not find a matching branch for an input, and no default was specified.")
+	}
+
+	return EvaluateExpression(doc, defaultExpr)
+}
+
+// switchArguments returns the case and then expressions of the branches of $switch and its default.
+func switchArguments(arg any) (branches [][2]any, defaultExpr any, hasDefault bool, err error) {
+	spec, ok := arg.(types.Document)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "$switch requires an object as an argument, found: %s", aliasFromType(arg))
+		return
+	}
+
+	branchesArray, ok := spec.Map()["branches"].(*types.Array)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "$switch expected an array for 'branches'")
+		return
+	}
+
+	for _, b := range arrayValues(branchesArray) {
+		branch, ok := b.(types.Document)
+		if !ok {
+			err = NewErrorMessage(ErrBadValue, "$switch expected each branch to be an object")
+			return
+		}
+
+		caseExpr, hasCase := branch.Map()["case"]
+		thenExpr, hasThen := branch.Map()["then"]
+		if !hasCase || !hasThen {
+			err = NewErrorMessage(ErrBadValue, "$switch requires each branch have a 'case' and a 'then' expression")
+			return
+		}
+
+		branches = append(branches, [2]any{caseExpr, thenExpr})
+	}
+
+	if len(branches) == 0 {
+		err = NewErrorMessage(ErrBadValue, "$switch requires at least one branch")
+		return
+	}
+
+	defaultExpr, hasDefault = spec.Map()["default"]
+	return
+}
+
+// expressionString converts the argument of a string operator to a string. Null is the empty string.
+func expressionString(op string, value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case nil, missingType:
+		return "", nil
+	case int32, int64:
+		return fmt.Sprintf("%d", value), nil
+	case float64:
+		return fmt.Sprintf("%v", value), nil
+	default:
+		return "", NewErrorMessage(ErrTypeMismatch, "%s requires a string argument, found: %s", op, aliasFromType(value))
+	}
+}
+
+// compareExpressionValues compares two values in an expression. Unlike in a filter,
+// a missing field is less than null.
+func compareExpressionValues(a, b any) types.CompareResult {
+	switch {
+	case IsMissing(a) && IsMissing(b):
+		return equal
+	case IsMissing(a):
+		return less
+	case IsMissing(b):
+		return greater
+	default:
+		return compareTotal(a, b)
+	}
+}
+
+// fieldPathValue resolves a field path of an expression. Unlike in a filter, an array on the path
+// results in an array of the values found in its elements.
+func fieldPathValue(value any, path []string) any {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch value := value.(type) {
+	case types.Document:
+		next, err := value.Get(path[0])
+		if err != nil {
+			return missing
+		}
+		return fieldPathValue(next, path[1:])
+
+	case *types.Array:
+		res := types.MakeArray(value.Len())
+		for _, element := range arrayValues(value) {
+			switch element.(type) {
+			case types.Document, *types.Array:
+			default:
+				continue
+			}
+
+			if v := fieldPathValue(element, path); !IsMissing(v) {
+				_ = res.Append(v)
+			}
+		}
+		return res
+
+	default:
+		return missing
+	}
+}
+
+// addNumbers adds two numbers. An int32 overflowing is converted to int64 and an int64 overflowing to float64.
+func addNumbers(a, b any) any {
+	switch a := a.(type) {
+	case float64:
+		return a + toFloat64(b)
+
+	case int32:
+		switch b := b.(type) {
+		case float64:
+			return float64(a) + b
+		case int64:
+			return addNumbers(int64(a), b)
+		case int32:
+			sum := int64(a) + int64(b)
+			if sum == int64(int32(sum)) {
+				return int32(sum)
+			}
+			return sum
+		}
+
+	case int64:
+		switch b := b.(type) {
+		case float64:
+			return float64(a) + b
+		case int32:
+			return addNumbers(a, int64(b))
+		case int64:
+			sum := a + b
+			if (b > 0 && sum < a) || (b < 0 && sum > a) {
+				return float64(a) + float64(b)
+			}
+			return sum
+		}
+	}
+
+	return math.NaN()
+}
+
+// multiplyNumbers multiplies two numbers with the same conversions as addNumbers.
+func multiplyNumbers(a, b any) any {
+	if _, ok := a.(float64); ok {
+		return toFloat64(a) * toFloat64(b)
+	}
+	if _, ok := b.(float64); ok {
+		return toFloat64(a) * toFloat64(b)
+	}
+
+	x, y := toInt64(a), toInt64(b)
+	product := x * y
+	if x != 0 && (product/x != y || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64)) {
+		return float64(x) * float64(y)
+	}
+
+	_, aIsInt32 := a.(int32)
+	_, bIsInt32 := b.(int32)
+	if aIsInt32 && bIsInt32 && product == int64(int32(product)) {
+		return int32(product)
+	}
+	return product
+}
+
+// negateNumber returns the negative number. The smallest int32 and int64 are converted to the bigger type.
+func negateNumber(value any) any {
+	switch value := value.(type) {
+	case int32:
+		if value == math.MinInt32 {
+			return -int64(value)
+		}
+		return -value
+	case int64:
+		if value == math.MinInt64 {
+			return -float64(value)
+		}
+		return -value
+	default:
+		return -toFloat64(value)
+	}
+}
+
+// isNumber returns true for int32, int64 and float64.
+func isNumber(value any) bool {
+	switch value.(type) {
+	case int32, int64, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// toFloat64 converts a number to float64.
+func toFloat64(value any) float64 {
+	switch value := value.(type) {
+	case float64:
+		return value
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	default:
+		return math.NaN()
+	}
+}
+
+// toInt64 converts an integer to int64.
+func toInt64(value any) int64 {
+	switch value := value.(type) {
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	default:
+		return int64(toFloat64(value))
+	}
+}
@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	doc := types.MustMakeDocument(
+		"_id", int32(1),
+		"name", "Ångström",
+		"qty", int32(3),
+		"price", float64(2.5),
+		"big", int32(2147483647),
+		"tags", types.MustNewArray("a", "b"),
+		"empty", nil,
+	)
+
+	evaluateTestCases := []struct {
+		name     string
+		expr     any
+		expected any
+		err      string
+	}{
+		{"field path", "$qty", int32(3), ""},
+		{"add", types.MustMakeDocument("$add", types.MustNewArray("$qty", int32(1), "$price")), float64(6.5), ""},
+		{"add int32 overflow", types.MustMakeDocument("$add", types.MustNewArray("$big", int32(1))), int64(2147483648), ""},
+		{"add null", types.MustMakeDocument("$add", types.MustNewArray("$qty", "$missing")), nil, ""},
+		{"add string", types.MustMakeDocument("$add", types.MustNewArray("$qty", "$name")), nil, "$add only supports numeric types, not string"},
+		{"subtract", types.MustMakeDocument("$subtract", types.MustNewArray("$qty", int32(5))), int32(-2), ""},
+		{"multiply", types.MustMakeDocument("$multiply", types.MustNewArray("$qty", "$price")), float64(7.5), ""},
+		{"divide", types.MustMakeDocument("$divide", types.MustNewArray("$qty", int32(2))), float64(1.5), ""},
+		{"divide by zero", types.MustMakeDocument("$divide", types.MustNewArray("$qty", int32(0))), nil, "can't $divide by zero"},
+		{"concat", types.MustMakeDocument("$concat", types.MustNewArray("$name", "-", "x")), "Ångström-x", ""},
+		{"concat null", types.MustMakeDocument("$concat", types.MustNewArray("$name", "$empty")), nil, ""},
+		{"substrCP", types.MustMakeDocument("$substrCP", types.MustNewArray("$name", int32(0), int32(3))), "Ång", ""},
+		{"toUpper", types.MustMakeDocument("$toUpper", "$name"), "ÅNGSTRÖM", ""},
+		{"toLower null", types.MustMakeDocument("$toLower", "$missing"), "", ""},
+		{"cond", types.MustMakeDocument("$cond", types.MustNewArray(types.MustMakeDocument("$gte", types.MustNewArray("$qty", int32(3))), "many", "few")), "many", ""},
+		{"cond document", types.MustMakeDocument("$cond", types.MustMakeDocument("if", "$missing", "then", int32(1), "else", int32(2))), int32(2), ""},
+		{"ifNull", types.MustMakeDocument("$ifNull", types.MustNewArray("$empty", "$missing", "default")), "default", ""},
+		{
+			"switch",
+			types.MustMakeDocument("$switch", types.MustMakeDocument(
+				"branches", types.MustNewArray(
+					types.MustMakeDocument("case", types.MustMakeDocument("$lt", types.MustNewArray("$qty", int32(2))), "then", "low"),
+					types.MustMakeDocument("case", types.MustMakeDocument("$lt", types.MustNewArray("$qty", int32(5))), "then", "medium"),
+				),
+				"default", "high",
+			)),
+			"medium", "",
+		},
+		{
+			"switch without match",
+			types.MustMakeDocument("$switch", types.MustMakeDocument(
+				"branches", types.MustNewArray(types.MustMakeDocument("case", false, "then", int32(1))),
+			)),
+			nil, "$switch could not find a matching branch for an input, and no default was specified.",
+		},
+		{"missing less than null", types.MustMakeDocument("$lt", types.MustNewArray("$missing", nil)), true, ""},
+		{"cmp", types.MustMakeDocument("$cmp", types.MustNewArray("$name", int32(1))), int32(1), ""},
+		{"and", types.MustMakeDocument("$and", types.MustNewArray("$qty", "$tags")), true, ""},
+		{"or", types.MustMakeDocument("$or", types.MustNewArray("$empty", int32(0))), false, ""},
+		{"not", types.MustMakeDocument("$not", types.MustNewArray("$missing")), true, ""},
+		{"literal", types.MustMakeDocument("$literal", "$qty"), "$qty", ""},
+		{"unknown operator", types.MustMakeDocument("$foo", int32(1)), nil, "support for $foo is not implemented yet"},
+	}
+
+	for _, tc := range evaluateTestCases {
+		actual, err := EvaluateExpression(doc, tc.expr)
+		if tc.err != "" {
+			require.Error(t, err, tc.name)
+			assert.Equal(t, tc.err, err.(*Error).err.Error(), tc.name)
+			continue
+		}
+
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestCompileExpression(t *testing.T) {
+	compileTestCases := []struct {
+		name     string
+		expr     any
+		expected string
+		ok       bool
+	}{
+		{"field path", "$a", "\"a\"", true},
+		{"dotted field path", "$a.b", "", false},
+		{"string", "it's", "'it''s'", true},
+		{"arithmetic", types.MustMakeDocument("$divide", types.MustNewArray(types.MustMakeDocument("$add", types.MustNewArray("$a", int32(1))), float64(2.5))), "(TO_DOUBLE((\"a\" + 1)) / 2.5)", true},
+		{"concat", types.MustMakeDocument("$concat", types.MustNewArray("$first", " ", "$last")), "(\"first\" || ' ' || \"last\")", true},
+		{"substrCP", types.MustMakeDocument("$substrCP", types.MustNewArray("$name", int32(1), int32(2))), "SUBSTRING(COALESCE(\"name\", ''), 2, 2)", true},
+		{"ifNull", types.MustMakeDocument("$ifNull", types.MustNewArray("$a", int32(0))), "COALESCE(\"a\", 0)", true},
+		{
+			"cond",
+			types.MustMakeDocument("$cond", types.MustNewArray(types.MustMakeDocument("$gt", types.MustNewArray("$qty", int32(10))), "$price", nil)),
+			"CASE WHEN ((IS_NUMBER(\"qty\") AND \"qty\" > 10) OR NOT (IS_NUMBER(\"qty\") OR \"qty\" IS NULL)) THEN \"price\" ELSE NULL END", true,
+		},
+		{
+			"comparison as value",
+			types.MustMakeDocument("$lt", types.MustNewArray(int32(5), "$qty")),
+			"CASE WHEN ((IS_NUMBER(\"qty\") AND \"qty\" > 5) OR NOT (IS_NUMBER(\"qty\") OR \"qty\" IS NULL)) THEN to_json_boolean(true) ELSE to_json_boolean(false) END", true,
+		},
+		{
+			"boolean operators",
+			types.MustMakeDocument("$not", types.MustNewArray(types.MustMakeDocument("$or", types.MustNewArray(
+				types.MustMakeDocument("$eq", types.MustNewArray("$a", "x")),
+				types.MustMakeDocument("$lte", types.MustNewArray("$b", int32(1))),
+			)))),
+			"CASE WHEN NOT ((IS_STRING(\"a\") AND \"a\" = 'x') OR ((IS_NUMBER(\"b\") AND \"b\" <= 1) OR \"b\" IS NULL)) THEN to_json_boolean(true) ELSE to_json_boolean(false) END", true,
+		},
+		{"comparison of fields", types.MustMakeDocument("$eq", types.MustNewArray("$a", "$b")), "", false},
+		{"comparison with null", types.MustMakeDocument("$eq", types.MustNewArray("$a", nil)), "", false},
+		{"switch without default", types.MustMakeDocument("$switch", types.MustMakeDocument("branches", types.MustNewArray(types.MustMakeDocument("case", true, "then", int32(1))))), "", false},
+		{"variable", "$$ROOT", "", false},
+		{"array index", "$a.0", "", false},
+	}
+
+	for _, tc := range compileTestCases {
+		actual, ok := CompileExpression(tc.expr)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestProject(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "item", "abc", "qty", int32(5), "price", float64(2)),
+		types.MustMakeDocument("_id", int32(2), "item", "xyz", "price", float64(3)),
+	}
+
+	p, err := NewProject(types.MustMakeDocument("item", int32(1), "total", types.MustMakeDocument("$multiply", types.MustNewArray("$qty", "$price"))))
+	require.NoError(t, err)
+
+	sql, exclusion, ok := p.SQL()
+	assert.True(t, ok)
+	assert.False(t, exclusion)
+	assert.Equal(t, "{\"_id\": \"_id\", \"item\": \"item\", \"total\": (\"qty\" * \"price\")}", sql)
+
+	actual, err := p.Documents(docs)
+	require.NoError(t, err)
+	assert.Equal(t, []types.Document{
+		types.MustMakeDocument("_id", int32(1), "item", "abc", "total", float64(10)),
+		types.MustMakeDocument("_id", int32(2), "item", "xyz", "total", nil),
+	}, actual)
+
+	_, err = NewProject(types.MustMakeDocument("item", int32(0), "total", "$qty"))
+	require.Error(t, err)
+
+	a, err := NewAddFields("$addFields", types.MustMakeDocument("info.upper", types.MustMakeDocument("$toUpper", "$item"), "qty", "$$REMOVE"))
+	require.NoError(t, err)
+
+	actual, err = a.Documents(docs[:1])
+	require.NoError(t, err)
+	assert.Equal(t, []types.Document{
+		types.MustMakeDocument("_id", int32(1), "item", "abc", "price", float64(2), "info", types.MustMakeDocument("upper", "ABC")),
+	}, actual)
+}
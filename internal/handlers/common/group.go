@@ -0,0 +1,385 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// Group is a $group stage of an aggregation pipeline.
+type Group struct {
+	id     any
+	fields []groupField
+}
+
+// groupField is an output field of a $group stage like {total: {$sum: "$qty"}}.
+type groupField struct {
+	name        string
+	accumulator string
+	expr        any
+}
+
+// accumulators are the supported accumulators of $group and their SQL aggregate functions.
+// An empty function means the accumulator is only processed in memory. $min and $max compare
+// values of different types in the BSON comparison order, which MIN and MAX of SQL do not.
+var accumulators = map[string]string{
+	"$sum":      "SUM",
+	"$avg":      "AVG",
+	"$min":      "",
+	"$max":      "",
+	"$count":    "COUNT",
+	"$first":    "",
+	"$last":     "",
+	"$push":     "",
+	"$addToSet": "",
+}
+
+// NewGroup validates the specification of a $group stage.
+func NewGroup(spec any) (*Group, error) {
+	doc, ok := spec.(types.Document)
+	if !ok {
+		return nil, NewErrorMessage(ErrBadValue, "a group's fields must be specified in an object")
+	}
+
+	id, ok := doc.Map()["_id"]
+	if !ok {
+		return nil, NewErrorMessage(ErrBadValue, "a group specification must include an _id")
+	}
+
+	g := Group{id: id}
+	for _, name := range doc.Keys() {
+		if name == "_id" {
+			continue
+		}
+
+		if strings.Contains(name, ".") {
+			return nil, NewErrorMessage(ErrBadValue, "the group aggregate field name '%s' cannot be used because $group's field names cannot contain '.'", name)
+		}
+
+		field, ok := doc.Map()[name].(types.Document)
+		if !ok || len(field.Keys()) != 1 {
+			return nil, NewErrorMessage(ErrBadValue, "the group aggregate field '%s' must be defined as an expression inside an object", name)
+		}
+
+		accumulator := field.Keys()[0]
+		if _, ok := accumulators[accumulator]; !ok {
+			return nil, NewErrorMessage(ErrBadValue, "unknown group operator '%s'", accumulator)
+		}
+
+		expr := field.Map()[accumulator]
+		if accumulator == "$count" {
+			if countDoc, ok := expr.(types.Document); !ok || len(countDoc.Keys()) != 0 {
+				return nil, NewErrorMessage(ErrBadValue, "$count takes no arguments, i.e. $count:{}")
+			}
+		}
+
+		g.fields = append(g.fields, groupField{name: name, accumulator: accumulator, expr: expr})
+	}
+
+	return &g, nil
+}
+
+// SQL returns the projection and the GROUP BY clause of the SQL statement for the stage.
+// It returns false if the grouping or an accumulator can not be expressed in SQL.
+func (g *Group) SQL() (projectionSQL string, groupBySQL string, ok bool) {
+	var idSQL string
+	var groupBy []string
+	switch id := g.id.(type) {
+	case nil:
+		idSQL = "NULL"
+
+	case types.Document:
+		keys := id.Keys()
+		if len(keys) == 0 {
+			return "", "", false
+		}
+
+		if strings.HasPrefix(keys[0], "$") {
+			expr, ok := CompileExpression(id)
+			if !ok {
+				return "", "", false
+			}
+			idSQL = expr
+			groupBy = append(groupBy, expr)
+			break
+		}
+
+		var fields []string
+		for _, k := range keys {
+			if !isSQLName(k) || strings.HasPrefix(k, "$") {
+				return "", "", false
+			}
+
+			expr, ok := CompileExpression(id.Map()[k])
+			if !ok {
+				return "", "", false
+			}
+			fields = append(fields, fmt.Sprintf("\"%s\": %s", k, expr))
+			groupBy = append(groupBy, expr)
+		}
+		idSQL = "{" + strings.Join(fields, ", ") + "}"
+
+	default:
+		expr, ok := CompileExpression(id)
+		if !ok {
+			return "", "", false
+		}
+		idSQL = expr
+
+		// a constant puts all documents into one group
+		if s, isString := id.(string); isString && strings.HasPrefix(s, "$") {
+			groupBy = append(groupBy, expr)
+		}
+	}
+
+	projectionSQL = "{\"_id\": " + idSQL
+	for _, field := range g.fields {
+		function := accumulators[field.accumulator]
+		if function == "" || !isSQLName(field.name) {
+			return "", "", false
+		}
+
+		var argument string
+		switch expr := field.expr.(type) {
+		case types.Document:
+			if field.accumulator == "$count" {
+				argument = "*"
+				break
+			}
+
+			compiled, ok := CompileExpression(expr)
+			if !ok {
+				return "", "", false
+			}
+			argument = compiled
+		case int32, int64:
+			if field.accumulator != "$sum" || types.CompareScalars(expr, int32(1)) != equal {
+				return "", "", false
+			}
+			function = "COUNT"
+			argument = "*"
+		case string:
+			path, ok := fieldPathSQL(expr)
+			if !ok {
+				return "", "", false
+			}
+
+			// like in MongoDB, values which are no numbers are ignored
+			argument = path
+			if field.accumulator == "$sum" || field.accumulator == "$avg" {
+				argument = fmt.Sprintf("CASE WHEN IS_NUMBER(%s) THEN %s END", path, path)
+			}
+		default:
+			compiled, ok := CompileExpression(expr)
+			if !ok {
+				return "", "", false
+			}
+			argument = compiled
+		}
+
+		aggregateSQL := fmt.Sprintf("%s(%s)", function, argument)
+		if function == "SUM" {
+			// the sum of no numbers is 0 in MongoDB
+			aggregateSQL = fmt.Sprintf("COALESCE(%s, 0)", aggregateSQL)
+		}
+		projectionSQL += fmt.Sprintf(", \"%s\": %s", field.name, aggregateSQL)
+	}
+	projectionSQL += "}"
+
+	if len(groupBy) != 0 {
+		groupBySQL = " GROUP BY " + strings.Join(groupBy, ", ")
+	} else {
+		// without GROUP BY an aggregate returns a row for no documents, MongoDB returns no group
+		groupBySQL = " HAVING COUNT(*) > 0"
+	}
+
+	return projectionSQL, groupBySQL, true
+}
+
+// Documents groups the documents in memory. It stops with the error of the context when the context is done.
+func (g *Group) Documents(ctx context.Context, docs []types.Document) ([]types.Document, error) {
+	type group struct {
+		id     any
+		values [][]any
+	}
+
+	var groups []*group
+	buckets := map[string][]*group{}
+	for i, doc := range docs {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+
+		id, err := EvaluateExpression(doc, g.id)
+		if err != nil {
+			return nil, err
+		}
+		if IsMissing(id) {
+			id = nil
+		}
+
+		// documents are put into buckets first, so only few ids have to be compared
+		key := groupHashKey(id)
+		var current *group
+		for _, candidate := range buckets[key] {
+			if compareTotal(candidate.id, id) == equal {
+				current = candidate
+				break
+			}
+		}
+
+		if current == nil {
+			current = &group{id: id, values: make([][]any, len(g.fields))}
+			buckets[key] = append(buckets[key], current)
+			groups = append(groups, current)
+		}
+
+		for i, field := range g.fields {
+			var value any
+			if field.accumulator != "$count" {
+				if value, err = EvaluateExpression(doc, field.expr); err != nil {
+					return nil, err
+				}
+			}
+			current.values[i] = append(current.values[i], value)
+		}
+	}
+
+	res := make([]types.Document, len(groups))
+	for i, current := range groups {
+		doc := types.MustMakeDocument("_id", current.id)
+		for j, field := range g.fields {
+			value, err := accumulate(field.accumulator, current.values[j])
+			if err != nil {
+				return nil, err
+			}
+
+			if err = doc.Set(field.name, value); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		res[i] = doc
+	}
+
+	return res, nil
+}
+
+// accumulate computes the result of an accumulator for the values of one group.
+func accumulate(accumulator string, values []any) (any, error) {
+	switch accumulator {
+	case "$sum":
+		var sum any = int32(0)
+		for _, v := range values {
+			if isNumber(v) {
+				sum = addNumbers(sum, v)
+			}
+		}
+		return sum, nil
+
+	case "$count":
+		return int32(len(values)), nil
+
+	case "$avg":
+		var sum float64
+		var n int
+		for _, v := range values {
+			if isNumber(v) {
+				sum += toFloat64(v)
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return sum / float64(n), nil
+
+	case "$min", "$max":
+		var res any
+		for _, v := range values {
+			if v == nil || IsMissing(v) {
+				continue
+			}
+
+			cmp := compareTotal(v, res)
+			if res == nil || (accumulator == "$min" && cmp == less) || (accumulator == "$max" && cmp == greater) {
+				res = v
+			}
+		}
+		return res, nil
+
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+
+		v := values[0]
+		if accumulator == "$last" {
+			v = values[len(values)-1]
+		}
+		if IsMissing(v) {
+			v = nil
+		}
+		return v, nil
+
+	case "$push", "$addToSet":
+		res := types.MakeArray(0)
+	valuesLoop:
+		for _, v := range values {
+			if IsMissing(v) {
+				continue
+			}
+
+			if accumulator == "$addToSet" {
+				for _, existing := range arrayValues(res) {
+					if compareTotal(existing, v) == equal {
+						continue valuesLoop
+					}
+				}
+			}
+
+			if err := res.Append(v); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		return res, nil
+
+	default:
+		return nil, lazyerrors.Errorf("unexpected accumulator %s", accumulator)
+	}
+}
+
+// groupHashKey returns a key which is equal for equal values. Different values might have the same key.
+func groupHashKey(value any) string {
+	if isNumber(value) {
+		return fmt.Sprintf("%d:%v", typeOrder(value), toFloat64(value))
+	}
+
+	return fmt.Sprintf("%d:%v", typeOrder(value), value)
+}
+
+// fieldPathSQL converts a field path like "$a" to SQL. It returns false if the expression is not a field path
+// or a dotted path. MongoDB resolves a path through an array to the values of its elements, but SQL to null.
+func fieldPathSQL(expr string) (string, bool) {
+	if !strings.HasPrefix(expr, "$") || strings.HasPrefix(expr, "$$") {
+		return "", false
+	}
+
+	field := expr[1:]
+	if !isSQLName(field) || strings.Contains(field, ".") {
+		return "", false
+	}
+
+	return "\"" + field + "\"", true
+}
+
+// isSQLName checks if a field name can be used as a quoted name in SQL.
+func isSQLName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "\"'\\")
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupSQL(t *testing.T) {
+	groupTestCases := []struct {
+		name       string
+		spec       types.Document
+		projection string
+		groupBy    string
+		ok         bool
+	}{
+		{
+			name:       "group by field",
+			spec:       types.MustMakeDocument("_id", "$customer", "total", types.MustMakeDocument("$sum", "$qty"), "n", types.MustMakeDocument("$sum", int32(1))),
+			projection: "{\"_id\": \"customer\", \"total\": COALESCE(SUM(CASE WHEN IS_NUMBER(\"qty\") THEN \"qty\" END), 0), \"n\": COUNT(*)}",
+			groupBy:    " GROUP BY \"customer\"",
+			ok:         true,
+		},
+		{
+			name:       "compound _id",
+			spec:       types.MustMakeDocument("_id", types.MustMakeDocument("c", "$customer", "s", "$status"), "avg", types.MustMakeDocument("$avg", "$price"), "n", types.MustMakeDocument("$count", types.MustMakeDocument())),
+			projection: "{\"_id\": {\"c\": \"customer\", \"s\": \"status\"}, \"avg\": AVG(CASE WHEN IS_NUMBER(\"price\") THEN \"price\" END), \"n\": COUNT(*)}",
+			groupBy:    " GROUP BY \"customer\", \"status\"",
+			ok:         true,
+		},
+		{
+			name:       "null _id",
+			spec:       types.MustMakeDocument("_id", nil, "total", types.MustMakeDocument("$sum", "$price"), "n", types.MustMakeDocument("$count", types.MustMakeDocument())),
+			projection: "{\"_id\": NULL, \"total\": COALESCE(SUM(CASE WHEN IS_NUMBER(\"price\") THEN \"price\" END), 0), \"n\": COUNT(*)}",
+			groupBy:    " HAVING COUNT(*) > 0",
+			ok:         true,
+		},
+		{
+			name: "max in memory",
+			spec: types.MustMakeDocument("_id", nil, "max", types.MustMakeDocument("$max", "$price")),
+		},
+		{
+			name:       "expressions",
+			spec:       types.MustMakeDocument("_id", types.MustMakeDocument("$toUpper", "$item"), "revenue", types.MustMakeDocument("$sum", types.MustMakeDocument("$multiply", types.MustNewArray("$price", "$qty")))),
+			projection: "{\"_id\": UPPER(COALESCE(\"item\", '')), \"revenue\": COALESCE(SUM((\"price\" * \"qty\")), 0)}",
+			groupBy:    " GROUP BY UPPER(COALESCE(\"item\", ''))",
+			ok:         true,
+		},
+		{
+			name: "accumulator only in memory",
+			spec: types.MustMakeDocument("_id", "$customer", "items", types.MustMakeDocument("$push", "$item")),
+		},
+		{
+			name: "array index",
+			spec: types.MustMakeDocument("_id", "$items.0", "n", types.MustMakeDocument("$count", types.MustMakeDocument())),
+		},
+		{
+			name: "dotted path",
+			spec: types.MustMakeDocument("_id", "$items.sku", "n", types.MustMakeDocument("$count", types.MustMakeDocument())),
+		},
+		{
+			name: "dotted path in accumulator",
+			spec: types.MustMakeDocument("_id", "$customer", "total", types.MustMakeDocument("$sum", "$items.qty")),
+		},
+	}
+
+	for _, tc := range groupTestCases {
+		g, err := NewGroup(tc.spec)
+		require.NoError(t, err, tc.name)
+
+		projection, groupBy, ok := g.SQL()
+		if ok != tc.ok || !strings.EqualFold(projection, tc.projection) || !strings.EqualFold(groupBy, tc.groupBy) {
+			t.Errorf("%s: SQL() FAILED. Expected %s, %s, %t got %s, %s, %t", tc.name, tc.projection, tc.groupBy, tc.ok, projection, groupBy, ok)
+		}
+	}
+}
+
+func TestGroupDocuments(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "item", "a", "price", int32(10), "qty", int32(2)),
+		types.MustMakeDocument("_id", int32(2), "item", "b", "price", float64(20), "qty", int32(1)),
+		types.MustMakeDocument("_id", int32(3), "item", "a", "price", int64(5), "qty", int32(10)),
+		types.MustMakeDocument("_id", int32(4), "item", "c", "price", float64(10)),
+		types.MustMakeDocument("_id", int32(5), "price", int32(7)),
+	}
+
+	g, err := NewGroup(types.MustMakeDocument(
+		"_id", "$item",
+		"total", types.MustMakeDocument("$sum", "$qty"),
+		"avg", types.MustMakeDocument("$avg", "$price"),
+		"min", types.MustMakeDocument("$min", "$price"),
+		"first", types.MustMakeDocument("$first", "$_id"),
+		"last", types.MustMakeDocument("$last", "$_id"),
+		"prices", types.MustMakeDocument("$push", "$price"),
+		"qtys", types.MustMakeDocument("$addToSet", "$qty"),
+		"n", types.MustMakeDocument("$count", types.MustMakeDocument()),
+	))
+	require.NoError(t, err)
+
+	actual, err := g.Documents(context.Background(), docs)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = g.Documents(ctx, docs)
+	assert.Equal(t, context.Canceled, err)
+
+	expected := []types.Document{
+		types.MustMakeDocument(
+			"_id", "a", "total", int32(12), "avg", float64(7.5), "min", int64(5), "first", int32(1), "last", int32(3),
+			"prices", types.MustNewArray(int32(10), int64(5)), "qtys", types.MustNewArray(int32(2), int32(10)), "n", int32(2),
+		),
+		types.MustMakeDocument(
+			"_id", "b", "total", int32(1), "avg", float64(20), "min", float64(20), "first", int32(2), "last", int32(2),
+			"prices", types.MustNewArray(float64(20)), "qtys", types.MustNewArray(int32(1)), "n", int32(1),
+		),
+		types.MustMakeDocument(
+			"_id", "c", "total", int32(0), "avg", float64(10), "min", float64(10), "first", int32(4), "last", int32(4),
+			"prices", types.MustNewArray(float64(10)), "qtys", types.MustNewArray(), "n", int32(1),
+		),
+		types.MustMakeDocument(
+			"_id", nil, "total", int32(0), "avg", float64(7), "min", int32(7), "first", int32(5), "last", int32(5),
+			"prices", types.MustNewArray(int32(7)), "qtys", types.MustNewArray(), "n", int32(1),
+		),
+	}
+	assert.Equal(t, expected, actual)
+
+	_, err = NewGroup(types.MustMakeDocument("total", types.MustMakeDocument("$sum", "$qty")))
+	assert.EqualError(t, err, "BadValue (2): a group specification must include an _id")
+
+	_, err = NewGroup(types.MustMakeDocument("_id", nil, "total", types.MustMakeDocument("$foo", "$qty")))
+	assert.EqualError(t, err, "BadValue (2): unknown group operator '$foo'")
+}
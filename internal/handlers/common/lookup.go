@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// LookupValues returns the distinct values of the local field of a $lookup. Elements of arrays are
+// returned instead of the arrays, a missing field is returned as null.
+func LookupValues(docs []types.Document, localField string) []any {
+	var res []any
+	seen := map[string][]any{}
+	for _, doc := range docs {
+	valuesLoop:
+		for _, v := range joinValues(doc, localField) {
+			key := groupHashKey(v)
+			for _, existing := range seen[key] {
+				if compareTotal(existing, v) == equal {
+					continue valuesLoop
+				}
+			}
+
+			seen[key] = append(seen[key], v)
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+// LookupSubqueryValues returns the distinct values of the local field of a $lookup which are not selected
+// by a subquery of the field. SQL selects the stored value as it is, so the elements of arrays, embedded
+// documents and the null of missing fields have to be compared separately.
+func LookupSubqueryValues(docs []types.Document, localField string) []any {
+	var unselected []types.Document
+	for _, doc := range docs {
+		if !selectedValue(doc, strings.Split(localField, ".")) {
+			unselected = append(unselected, doc)
+		}
+	}
+
+	return LookupValues(unselected, localField)
+}
+
+// LookupWhereClause creates the WHERE-clause which selects the foreign documents of a $lookup whose foreign
+// field equals a value of the local field selected by the subquery or one of the given values. Like in a
+// filter every value found at the foreign field is compared, which includes the elements of arrays.
+func LookupWhereClause(localField, foreignField string, subquery func(columnSQL string) (string, error), values []any) (string, error) {
+	columnSQL, err := whereKey(localField)
+	if err != nil {
+		return "", err
+	}
+
+	subquerySQL, err := subquery(columnSQL)
+	if err != nil {
+		return "", err
+	}
+
+	sql, err := pathSQL(foreignField, func(kSQL string) (string, error) {
+		return anyElement(kSQL, " IN ", "("+subquerySQL+")"), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range values {
+		kvSQL, err := wherePair(foreignField, types.MustMakeDocument("$eq", v), false)
+		if err != nil {
+			return "", err
+		}
+		sql += " OR " + kvSQL
+	}
+
+	return " WHERE (" + sql + ")", nil
+}
+
+// selectedValue returns true if SQL selects the value at the path like MongoDB. These are scalar values
+// which are found without traversing arrays.
+func selectedValue(value any, path []string) bool {
+	for _, part := range path {
+		switch v := value.(type) {
+		case types.Document:
+			// numeric parts are array indexes in SQL
+			if _, err := strconv.Atoi(part); err == nil {
+				return false
+			}
+			next, err := v.Get(part)
+			if err != nil {
+				return false
+			}
+			value = next
+
+		case *types.Array:
+			index, err := strconv.Atoi(part)
+			if err != nil {
+				return false
+			}
+			if value, err = v.Get(index); err != nil {
+				return false
+			}
+
+		default:
+			return false
+		}
+	}
+
+	switch value.(type) {
+	case nil, types.NullType, types.Document, *types.Array:
+		return false
+	default:
+		return true
+	}
+}
+
+// LookupDocuments performs the equality match of a $lookup in memory. Each document gets the
+// field as with an array of the foreign documents whose foreign field equals the local field.
+func LookupDocuments(docs, foreign []types.Document, localField, foreignField, as string) ([]types.Document, error) {
+	// foreign documents are indexed by all values they could match
+	index := map[string][]int{}
+	for i, doc := range foreign {
+		values := pathValues(doc, strings.Split(foreignField, "."))
+		if len(values) == 0 {
+			values = []any{nil}
+		}
+
+		for _, v := range values {
+			keys := []any{v}
+			if array, ok := v.(*types.Array); ok {
+				keys = append(keys, arrayValues(array)...)
+			}
+
+			for _, key := range keys {
+				if IsMissing(key) {
+					key = nil
+				}
+				hash := groupHashKey(key)
+				if n := len(index[hash]); n == 0 || index[hash][n-1] != i {
+					index[hash] = append(index[hash], i)
+				}
+			}
+		}
+	}
+
+	res := make([]types.Document, len(docs))
+	for i, doc := range docs {
+		matched := map[int]bool{}
+		for _, v := range joinValues(doc, localField) {
+			for _, j := range index[groupHashKey(v)] {
+				if matched[j] {
+					continue
+				}
+
+				ok, err := matchEqual(pathValues(foreign[j], strings.Split(foreignField, ".")), v)
+				if err != nil {
+					return nil, err
+				}
+				matched[j] = ok
+			}
+		}
+
+		res[i] = doc
+		if err := SetLookupResult(&res[i], foreignSubset(foreign, matched), as); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// SetLookupResult sets the field as of a document to a copy of the given foreign documents.
+func SetLookupResult(doc *types.Document, foreign []types.Document, as string) error {
+	array := types.MakeArray(len(foreign))
+	for _, f := range foreign {
+		if err := array.Append(copyValue(f)); err != nil {
+			return lazyerrors.Error(err)
+		}
+	}
+
+	if err := setPath(doc, strings.Split(as, "."), array); err != nil {
+		return lazyerrors.Error(err)
+	}
+
+	return nil
+}
+
+// CopyDocuments returns deep copies of the documents, so the stages of a pipeline can modify them.
+func CopyDocuments(docs []types.Document) []types.Document {
+	res := make([]types.Document, len(docs))
+	for i, doc := range docs {
+		res[i] = copyValue(doc).(types.Document)
+	}
+
+	return res
+}
+
+// joinValues returns the values of a field used to join documents.
+// Arrays are replaced by their elements and a missing field is null.
+func joinValues(doc types.Document, field string) []any {
+	var res []any
+	for _, v := range pathValues(doc, strings.Split(field, ".")) {
+		switch v := v.(type) {
+		case *types.Array:
+			res = append(res, arrayValues(v)...)
+		case missingType:
+			res = append(res, nil)
+		default:
+			res = append(res, v)
+		}
+	}
+
+	if len(res) == 0 {
+		res = append(res, nil)
+	}
+
+	return res
+}
+
+// foreignSubset returns the matched foreign documents in their original order.
+func foreignSubset(foreign []types.Document, matched map[int]bool) []types.Document {
+	indexes := make([]int, 0, len(matched))
+	for i, ok := range matched {
+		if ok {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	res := make([]types.Document, len(indexes))
+	for i, j := range indexes {
+		res[i] = foreign[j]
+	}
+
+	return res
+}
+
+// setPath sets the value of a dotted path in a document and creates missing embedded documents.
+func setPath(doc *types.Document, path []string, value any) error {
+	if len(path) == 1 {
+		return doc.Set(path[0], value)
+	}
+
+	next, ok := doc.Map()[path[0]].(types.Document)
+	if !ok {
+		next = types.MustMakeDocument()
+	}
+
+	if err := setPath(&next, path[1:], value); err != nil {
+		return err
+	}
+
+	return doc.Set(path[0], next)
+}
+
+// copyValue returns a deep copy of documents and arrays, so they can be modified independently.
+func copyValue(value any) any {
+	switch value := value.(type) {
+	case types.Document:
+		res := types.MustMakeDocument()
+		for _, k := range value.Keys() {
+			_ = res.Set(k, copyValue(value.Map()[k]))
+		}
+		return res
+
+	case *types.Array:
+		res := types.MakeArray(value.Len())
+		for _, element := range arrayValues(value) {
+			_ = res.Append(copyValue(element))
+		}
+		return res
+
+	default:
+		return value
+	}
+}
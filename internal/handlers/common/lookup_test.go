@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupDocuments(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray("a", "b")),
+		types.MustMakeDocument("_id", int32(2), "items", "c"),
+		types.MustMakeDocument("_id", int32(3)),
+	}
+	foreign := []types.Document{
+		types.MustMakeDocument("_id", "x", "sku", "b"),
+		types.MustMakeDocument("_id", "y", "sku", types.MustNewArray("a", "c")),
+		types.MustMakeDocument("_id", "z"),
+	}
+
+	assert.Equal(t, []any{"a", "b", "c", nil}, LookupValues(docs, "items"))
+
+	actual, err := LookupDocuments(docs, foreign, "items", "sku", "info.matches")
+	require.NoError(t, err)
+
+	ids := func(doc types.Document) []any {
+		info := doc.Map()["info"].(types.Document)
+		var res []any
+		for _, f := range arrayValues(info.Map()["matches"].(*types.Array)) {
+			res = append(res, f.(types.Document).Map()["_id"])
+		}
+		return res
+	}
+
+	assert.Equal(t, []any{"x", "y"}, ids(actual[0]))
+	assert.Equal(t, []any{"y"}, ids(actual[1]))
+	assert.Equal(t, []any{"z"}, ids(actual[2]))
+}
+
+func TestLookupSubqueryValues(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray("a", "b")),
+		types.MustMakeDocument("_id", int32(2), "items", "c"),
+		types.MustMakeDocument("_id", int32(3)),
+		types.MustMakeDocument("_id", int32(4), "items", types.MustMakeDocument("sku", "d")),
+	}
+
+	assert.Equal(t, []any{"a", "b", nil, types.MustMakeDocument("sku", "d")}, LookupSubqueryValues(docs, "items"))
+	assert.Equal(t, []any{nil}, LookupSubqueryValues(docs, "items.sku"))
+	assert.Equal(t, []any{nil}, LookupSubqueryValues(docs[:2], "items.0"))
+
+	subquery := func(columnSQL string) (string, error) {
+		return "SELECT " + columnSQL + " FROM \"db\".\"orders\"", nil
+	}
+	whereSQL, err := LookupWhereClause("items", "sku", subquery, []any{"a"})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		" WHERE ((\"sku\" IN (SELECT \"items\" FROM \"db\".\"orders\") OR FOR ANY \"$element\" IN \"sku\" SATISFIES \"$element\" IN (SELECT \"items\" FROM \"db\".\"orders\") END) OR "+
+			"(\"sku\" = 'a' OR FOR ANY \"$element\" IN \"sku\" SATISFIES \"$element\" = 'a' END))",
+		whereSQL,
+	)
+}
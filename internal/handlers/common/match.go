@@ -0,0 +1,516 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// MatchDocument checks in memory if a document matches the filter. It is the counterpart of
+// CreateWhereClause for documents which are not stored in SAP HANA anymore, for instance the
+// intermediate results of an aggregation pipeline.
+func MatchDocument(doc types.Document, filter types.Document) (bool, error) {
+	for _, key := range filter.Keys() {
+		value := filter.Map()[key]
+
+		var ok bool
+		var err error
+		if key == "$expr" {
+			ok, err = matchExpr(doc, value)
+		} else if strings.HasPrefix(key, "$") {
+			ok, err = matchLogicExpression(doc, key, value)
+		} else {
+			ok, err = matchPair(doc, key, value)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchExpr evaluates $expr. The document matches if the aggregation expression is true.
+func matchExpr(doc types.Document, value any) (bool, error) {
+	res, err := EvaluateExpression(doc, value)
+	if err != nil {
+		return false, err
+	}
+
+	return isTrue(res), nil
+}
+
+// matchLogicExpression evaluates $and, $or and $nor.
+func matchLogicExpression(doc types.Document, key string, value any) (bool, error) {
+	lowerKey := strings.ToLower(key)
+	switch lowerKey {
+	case "$and", "$or", "$nor":
+	case "$not":
+		return false, fmt.Errorf("unknown top level: %s. If you are trying to negate an entire expression, use $nor", key)
+	default:
+		return false, NewErrorMessage(ErrNotImplemented, "support for %s is not implemented yet", key)
+	}
+
+	exprs, ok := value.(*types.Array)
+	if !ok {
+		return false, NewErrorMessage(ErrBadValue, "%s must be an array", lowerKey)
+	}
+
+	if exprs.Len() == 0 {
+		return false, NewErrorMessage(ErrBadValue, "%s must be a nonempty array", lowerKey)
+	}
+
+	for i := 0; i < exprs.Len(); i++ {
+		expr, _ := exprs.Get(i)
+		exprDoc, ok := expr.(types.Document)
+		if !ok {
+			return false, lazyerrors.Errorf("Found in array of logicExpression no document but instead the datatype: %T", expr)
+		}
+
+		matches, err := MatchDocument(doc, exprDoc)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case lowerKey == "$and" && !matches:
+			return false, nil
+		case lowerKey == "$or" && matches:
+			return true, nil
+		case lowerKey == "$nor" && matches:
+			return false, nil
+		}
+	}
+
+	return lowerKey != "$or", nil
+}
+
+// matchPair checks a {field: value} pair of a filter.
+func matchPair(doc types.Document, key string, value any) (bool, error) {
+	values := pathValues(doc, strings.Split(key, "."))
+
+	if expr, ok := value.(types.Document); ok && len(expr.Keys()) != 0 && strings.HasPrefix(expr.Keys()[0], "$") {
+		return matchFieldExpression(values, expr)
+	}
+
+	return matchEqual(values, value)
+}
+
+// matchFieldExpression checks all operators of a {field: {$op: value}} expression.
+func matchFieldExpression(values []any, expr types.Document) (bool, error) {
+	for _, op := range expr.Keys() {
+		value := expr.Map()[op]
+
+		var ok bool
+		var err error
+		switch strings.ToLower(op) {
+		case "$eq":
+			ok, err = matchEqual(values, value)
+		case "$ne":
+			ok, err = matchEqual(values, value)
+			ok = !ok
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = matchComparison(values, strings.ToLower(op), value)
+		case "$in":
+			ok, err = matchIn(values, value)
+		case "$nin":
+			ok, err = matchIn(values, value)
+			ok = !ok
+		case "$type":
+			ok, err = matchType(values, value)
+		case "$mod":
+			ok, err = matchMod(values, value)
+		case "$bitsallset", "$bitsanyset", "$bitsallclear", "$bitsanyclear":
+			ok, err = matchBits(values, op, value)
+		case "$exists":
+			ok = matchExists(values, value)
+		case "$size":
+			ok, err = matchSize(values, value)
+		case "$all":
+			ok, err = matchAll(values, value)
+		case "$elemmatch":
+			ok, err = matchElemMatch(values, value)
+		case "$regex":
+			options, _ := expr.Map()["$options"].(string)
+			ok, err = matchRegex(values, value, options)
+		case "$options":
+			if _, ok := expr.Map()["$regex"]; !ok {
+				return false, NewErrorMessage(ErrBadValue, "$options needs a $regex")
+			}
+			continue
+		case "$not":
+			ok, err = matchNot(values, value)
+		default:
+			return false, NewErrorMessage(ErrNotImplemented, "support for %s is not implemented yet", op)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchEqual checks if any of the values or any element of an array value equals the given value.
+func matchEqual(values []any, value any) (bool, error) {
+	if regex, ok := value.(types.Regex); ok {
+		return matchRegex(values, regex, "")
+	}
+
+	if value == nil && len(values) == 0 {
+		return true, nil
+	}
+
+	return anyValue(values, func(v any) bool {
+		return compareValues(v, value) == equal
+	}), nil
+}
+
+// matchIn evaluates $in. Any value or array element has to equal an element or match a regular expression of the list.
+func matchIn(values []any, value any) (bool, error) {
+	list, ok := value.(*types.Array)
+	if !ok {
+		return false, NewErrorMessage(ErrBadValue, "$in needs an array")
+	}
+
+	for _, element := range arrayValues(list) {
+		if doc, ok := element.(types.Document); ok && len(doc.Keys()) != 0 && strings.HasPrefix(doc.Keys()[0], "$") {
+			return false, NewErrorMessage(ErrBadValue, "cannot nest $ under $in")
+		}
+
+		matches, err := matchEqual(values, element)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchType evaluates $type. Arrays match if the array or any of its elements has one of the types.
+func matchType(values []any, value any) (bool, error) {
+	aliases, err := typeAliases(value)
+	if err != nil {
+		return false, err
+	}
+
+	return anyValue(values, func(v any) bool {
+		for _, alias := range aliases {
+			if hasType(v, alias) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// matchMod evaluates $mod. Numbers are truncated to integers.
+func matchMod(values []any, value any) (bool, error) {
+	divisor, remainder, err := modArguments(value)
+	if err != nil {
+		return false, err
+	}
+
+	return anyValue(values, func(v any) bool {
+		if !isNumber(v) {
+			return false
+		}
+		if f := toFloat64(v); math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+		return toInt64(v)%divisor == remainder
+	}), nil
+}
+
+// matchBits evaluates $bitsAllSet, $bitsAnySet, $bitsAllClear and $bitsAnyClear.
+func matchBits(values []any, op string, value any) (bool, error) {
+	positions, err := bitPositions(op, value)
+	if err != nil {
+		return false, err
+	}
+
+	op = strings.ToLower(op)
+	for _, v := range values {
+		if matchBitsValue(v, op, positions) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchComparison evaluates $gt, $gte, $lt and $lte. Only values of the same type bracket are compared.
+func matchComparison(values []any, op string, value any) bool {
+	if value == nil && len(values) == 0 {
+		return op == "$gte" || op == "$lte"
+	}
+
+	return anyValue(values, func(v any) bool {
+		switch compareValues(v, value) {
+		case equal:
+			return op == "$gte" || op == "$lte"
+		case greater:
+			return op == "$gt" || op == "$gte"
+		case less:
+			return op == "$lt" || op == "$lte"
+		default:
+			return false
+		}
+	})
+}
+
+// matchExists evaluates $exists. Any value other than false, 0 and null counts as true.
+func matchExists(values []any, value any) bool {
+	exists := false
+	for _, v := range values {
+		if v != missing {
+			exists = true
+			break
+		}
+	}
+
+	return exists == isTrue(value)
+}
+
+// matchSize evaluates $size.
+func matchSize(values []any, value any) (bool, error) {
+	size, ok := value.(int32)
+	if !ok {
+		if !anyIsInt(value) {
+			return false, NewErrorMessage(ErrBadValue, "$size needs a number")
+		}
+		size = int32(value.(float64))
+	}
+
+	for _, v := range values {
+		if array, ok := v.(*types.Array); ok && int32(array.Len()) == size {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchAll evaluates $all. Every element of the given array has to match.
+func matchAll(values []any, value any) (bool, error) {
+	all, ok := value.(*types.Array)
+	if !ok {
+		return false, NewErrorMessage(ErrBadValue, "$all needs an array")
+	}
+
+	if all.Len() == 0 {
+		return false, nil
+	}
+
+	for i := 0; i < all.Len(); i++ {
+		element, _ := all.Get(i)
+
+		var ok bool
+		var err error
+		if doc, isDoc := element.(types.Document); isDoc && len(doc.Keys()) == 1 && strings.EqualFold(doc.Keys()[0], "$elemMatch") {
+			ok, err = matchElemMatch(values, doc.Map()[doc.Keys()[0]])
+		} else {
+			ok, err = matchEqual(values, element)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchElemMatch evaluates $elemMatch. At least one element of an array has to match all conditions.
+func matchElemMatch(values []any, value any) (bool, error) {
+	filter, ok := value.(types.Document)
+	if !ok {
+		return false, NewErrorMessage(ErrBadValue, "$elemMatch needs an object")
+	}
+
+	for _, v := range values {
+		array, ok := v.(*types.Array)
+		if !ok {
+			continue
+		}
+
+		for _, element := range arrayValues(array) {
+			matches, err := matchElement(element, filter)
+			if err != nil {
+				return false, err
+			}
+			if matches {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// matchElement checks if an element of an array matches the condition of $elemMatch, which is either
+// an expression like {$gt: 5} or a filter of embedded documents.
+func matchElement(element any, filter types.Document) (bool, error) {
+	if len(filter.Keys()) != 0 && strings.HasPrefix(filter.Keys()[0], "$") && !isLogicOperator(filter.Keys()[0]) {
+		return matchFieldExpression([]any{element}, filter)
+	}
+
+	if doc, ok := element.(types.Document); ok {
+		return MatchDocument(doc, filter)
+	}
+
+	return false, nil
+}
+
+// matchRegex checks if any string value matches the regular expression.
+func matchRegex(values []any, value any, options string) (bool, error) {
+	re, err := compileRegex(value, options)
+	if err != nil {
+		return false, err
+	}
+
+	return anyValue(values, func(v any) bool {
+		s, ok := v.(string)
+		return ok && re.MatchString(s)
+	}), nil
+}
+
+// compileRegex compiles a regular expression with MongoDB's options i, m, s and x.
+func compileRegex(value any, options string) (*regexp.Regexp, error) {
+	pattern, flags, err := regexPattern(value, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return goRegexp(pattern, flags)
+}
+
+// matchNot evaluates $not by negating the given expression or regular expression.
+func matchNot(values []any, value any) (bool, error) {
+	var ok bool
+	var err error
+	switch value := value.(type) {
+	case types.Document:
+		ok, err = matchFieldExpression(values, value)
+	case types.Regex:
+		ok, err = matchRegex(values, value, "")
+	default:
+		return false, NewErrorMessage(ErrBadValue, "$not needs a regex or a document")
+	}
+
+	return !ok, err
+}
+
+// pathValues returns the values found at the path of a dotted key. Arrays of documents on the way
+// are traversed, so more than one value can be found. If a document does not contain a field of the
+// path, the result contains missing for it.
+func pathValues(value any, path []string) []any {
+	if len(path) == 0 {
+		return []any{value}
+	}
+
+	switch value := value.(type) {
+	case types.Document:
+		next, err := value.Get(path[0])
+		if err != nil {
+			return []any{missing}
+		}
+		return pathValues(next, path[1:])
+
+	case *types.Array:
+		var res []any
+		if index, err := strconv.Atoi(path[0]); err == nil {
+			if element, err := value.Get(index); err == nil {
+				res = append(res, pathValues(element, path[1:])...)
+			}
+			return res
+		}
+
+		for _, element := range arrayValues(value) {
+			if doc, ok := element.(types.Document); ok {
+				res = append(res, pathValues(doc, path)...)
+			}
+		}
+		return res
+
+	default:
+		return nil
+	}
+}
+
+// arrayValues returns the elements of an array.
+func arrayValues(array *types.Array) []any {
+	res := make([]any, array.Len())
+	for i := range res {
+		res[i], _ = array.Get(i)
+	}
+
+	return res
+}
+
+// anyValue checks if the condition is true for any of the values or any element of an array value.
+func anyValue(values []any, condition func(any) bool) bool {
+	for _, v := range values {
+		if condition(v) {
+			return true
+		}
+
+		if array, ok := v.(*types.Array); ok {
+			for _, element := range arrayValues(array) {
+				if condition(element) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// isLogicOperator returns true for $and, $or and $nor.
+func isLogicOperator(key string) bool {
+	switch strings.ToLower(key) {
+	case "$and", "$or", "$nor":
+		return true
+	default:
+		return false
+	}
+}
+
+// isTrue converts a value to a boolean the way MongoDB does for flags like $exists.
+func isTrue(value any) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case int32:
+		return value != 0
+	case int64:
+		return value != 0
+	case float64:
+		return value != 0
+	case nil, missingType:
+		return false
+	default:
+		return true
+	}
+}
+
+// anyIsInt checks if any is int even if real type is float64. 1.0 would be considered int 1.
+func anyIsInt(n any) bool {
+	f, ok := n.(float64)
+	return ok && f == float64(int32(f))
+}
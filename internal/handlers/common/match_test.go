@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+type testCaseMatch struct {
+	name    string
+	filter  types.Document
+	matches bool
+	err     string
+}
+
+func TestMatchDocument(t *testing.T) {
+	doc := types.MustMakeDocument(
+		"_id", int32(1),
+		"item", "journal",
+		"qty", int32(25),
+		"price", float64(12.5),
+		"tags", types.MustNewArray("blank", "red"),
+		"size", types.MustMakeDocument("h", int32(14), "w", float64(21), "uom", "cm"),
+		"instock", types.MustNewArray(
+			types.MustMakeDocument("warehouse", "A", "qty", int32(5)),
+			types.MustMakeDocument("warehouse", "C", "qty", int32(15)),
+		),
+		"empty", nil,
+	)
+
+	matchTestCases := []testCaseMatch{
+		{name: "empty filter", filter: types.MustMakeDocument(), matches: true},
+		{name: "equal", filter: types.MustMakeDocument("item", "journal", "qty", float64(25)), matches: true},
+		{name: "not equal", filter: types.MustMakeDocument("item", "notebook"), matches: false},
+		{name: "equal array element", filter: types.MustMakeDocument("tags", "red"), matches: true},
+		{name: "equal array", filter: types.MustMakeDocument("tags", types.MustNewArray("blank", "red")), matches: true},
+		{name: "equal document", filter: types.MustMakeDocument("size", types.MustMakeDocument("h", int32(14), "w", int32(21), "uom", "cm")), matches: true},
+		{name: "equal document other order", filter: types.MustMakeDocument("size", types.MustMakeDocument("w", int32(21), "h", int32(14), "uom", "cm")), matches: false},
+		{name: "dotted path", filter: types.MustMakeDocument("size.uom", "cm"), matches: true},
+		{name: "dotted path through array", filter: types.MustMakeDocument("instock.warehouse", "C"), matches: true},
+		{name: "array index", filter: types.MustMakeDocument("instock.0.warehouse", "C"), matches: false},
+		{name: "null matches missing", filter: types.MustMakeDocument("missing", nil), matches: true},
+		{name: "null matches null", filter: types.MustMakeDocument("empty", nil), matches: true},
+		{name: "comparison", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(20), "$lte", int64(25))), matches: true},
+		{name: "comparison different types", filter: types.MustMakeDocument("item", types.MustMakeDocument("$gt", int32(20))), matches: false},
+		{name: "comparison in array", filter: types.MustMakeDocument("instock.qty", types.MustMakeDocument("$gt", int32(10))), matches: true},
+		{name: "comparison with array", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$gt", types.MustNewArray("a"))), matches: true},
+		{name: "ne", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$ne", "red")), matches: false},
+		{name: "exists", filter: types.MustMakeDocument("empty", types.MustMakeDocument("$exists", true), "missing", types.MustMakeDocument("$exists", false)), matches: true},
+		{name: "size", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$size", int32(2))), matches: true},
+		{name: "all", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$all", types.MustNewArray("red", "blank"))), matches: true},
+		{name: "elemMatch", filter: types.MustMakeDocument("instock", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("warehouse", "A", "qty", types.MustMakeDocument("$gt", int32(10))))), matches: false},
+		{name: "regex", filter: types.MustMakeDocument("item", types.MustMakeDocument("$regex", "^J", "$options", "i")), matches: true},
+		{name: "regex extended", filter: types.MustMakeDocument("item", types.MustMakeDocument("$regex", "^j our # comment\n nal$", "$options", "x")), matches: true},
+		{name: "regex options in both", filter: types.MustMakeDocument("item", types.MustMakeDocument("$regex", types.Regex{Pattern: "^J", Options: "i"}, "$options", "i")), err: "BadValue (2): options set in both $regex and $options"},
+		{name: "not", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$not", types.MustMakeDocument("$gt", int32(20)))), matches: false},
+		{name: "in", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$in", types.MustNewArray(int32(5), float64(25)))), matches: true},
+		{name: "in array element", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$in", types.MustNewArray("green", types.Regex{Pattern: "^r"}))), matches: true},
+		{name: "in null matches missing", filter: types.MustMakeDocument("missing", types.MustMakeDocument("$in", types.MustNewArray(nil))), matches: true},
+		{name: "nin", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$nin", types.MustNewArray("red"))), matches: false},
+		{name: "nin missing", filter: types.MustMakeDocument("missing", types.MustMakeDocument("$nin", types.MustNewArray(int32(1)))), matches: true},
+		{name: "type", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$type", "int"), "price", types.MustMakeDocument("$type", int32(1))), matches: true},
+		{name: "type number", filter: types.MustMakeDocument("price", types.MustMakeDocument("$type", "number")), matches: true},
+		{name: "type array element", filter: types.MustMakeDocument("tags", types.MustMakeDocument("$type", types.MustNewArray("long", "string"))), matches: true},
+		{name: "type missing", filter: types.MustMakeDocument("missing", types.MustMakeDocument("$type", "null")), matches: false},
+		{name: "mod", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$mod", types.MustNewArray(int32(10), int32(5)))), matches: true},
+		{name: "mod truncates", filter: types.MustMakeDocument("price", types.MustMakeDocument("$mod", types.MustNewArray(float64(5.9), int32(2)))), matches: true},
+		{name: "bitsAllSet", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$bitsAllSet", types.MustNewArray(int32(0), int32(3), int32(4)))), matches: true},
+		{name: "bitsAnySet", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$bitsAnySet", int32(2))), matches: false},
+		{name: "bitsAllClear binary", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$bitsAllClear", types.Binary{B: []byte{6}})), matches: true},
+		{name: "bitsAnyClear not integral", filter: types.MustMakeDocument("price", types.MustMakeDocument("$bitsAnyClear", int32(1))), matches: false},
+		{name: "invalid type", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$type", int32(42))), err: "BadValue (2): Invalid numerical type code: 42"},
+		{name: "expr comparing fields", filter: types.MustMakeDocument("$expr", types.MustMakeDocument("$gt", types.MustNewArray("$qty", "$price"))), matches: true},
+		{name: "expr with computed value", filter: types.MustMakeDocument("$expr", types.MustMakeDocument("$lt", types.MustNewArray(types.MustMakeDocument("$multiply", types.MustNewArray("$qty", "$price")), int32(300)))), matches: false},
+		{name: "expr missing field", filter: types.MustMakeDocument("$expr", "$missing"), matches: false},
+		{name: "or", filter: types.MustMakeDocument("$or", types.MustNewArray(types.MustMakeDocument("qty", int32(1)), types.MustMakeDocument("item", "journal"))), matches: true},
+		{name: "nor", filter: types.MustMakeDocument("$nor", types.MustNewArray(types.MustMakeDocument("qty", int32(1)), types.MustMakeDocument("item", "journal"))), matches: false},
+		{name: "regex lookbehind", filter: types.MustMakeDocument("item", types.MustMakeDocument("$regex", "(?<!x)journal")), err: "NotImplemented (238): (?<! in regular expressions is not supported"},
+		{name: "regex possessive quantifier", filter: types.MustMakeDocument("item", types.Regex{Pattern: "jo*+urnal"}), err: "NotImplemented (238): *+ in regular expressions is not supported"},
+		{name: "invalid regex options", filter: types.MustMakeDocument("item", types.MustMakeDocument("$regex", "^j", "$options", "g")), err: "Location51075 (51075): invalid flag in regex options: g"},
+		{name: "unsupported operator", filter: types.MustMakeDocument("qty", types.MustMakeDocument("$geoWithin", types.MustNewArray(int32(25)))), err: "NotImplemented (238): support for $geoWithin is not implemented yet"},
+	}
+
+	for _, tc := range matchTestCases {
+		matches, err := MatchDocument(doc, tc.filter)
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: MatchDocument(%v) FAILED. Expected err = %s got err = %v", tc.name, tc.filter, tc.err, err)
+			}
+			continue
+		}
+
+		if err != nil || matches != tc.matches {
+			t.Errorf("%s: MatchDocument(%v) FAILED. Expected %t got %t and err = %v", tc.name, tc.filter, tc.matches, matches, err)
+		}
+	}
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "v", "a"),
+		types.MustMakeDocument("_id", int32(2), "v", types.MustNewArray(int32(5), int32(0))),
+		types.MustMakeDocument("_id", int32(3)),
+		types.MustMakeDocument("_id", int32(4), "v", float64(2.5)),
+	}
+
+	if err := SortDocuments(context.Background(), docs, types.MustMakeDocument("v", int32(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []any
+	for _, doc := range docs {
+		ids = append(ids, doc.Map()["_id"])
+	}
+
+	expected := []any{int32(3), int32(2), int32(4), int32(1)}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("SortDocuments FAILED. Expected order %v got %v", expected, ids)
+		}
+	}
+
+	if err := SortDocuments(context.Background(), docs, types.MustMakeDocument("v", int32(2))); err == nil || err.Error() != "SortBadValue (15974): cannot use value 2 for sort" {
+		t.Errorf("SortDocuments FAILED. Expected SortBadValue got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	many := make([]types.Document, 2*contextCheckInterval)
+	for i := range many {
+		many[i] = types.MustMakeDocument("_id", int32(i), "v", int32(len(many)-i))
+	}
+	if err := SortDocuments(ctx, many, types.MustMakeDocument("v", int32(1))); err != context.DeadlineExceeded {
+		t.Errorf("SortDocuments FAILED. Expected %v got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestTypeOrderSQL(t *testing.T) {
+	expected := "CASE WHEN \"f\" IS NULL THEN 1 WHEN IS_NUMBER(\"f\") THEN 2 WHEN IS_STRING(\"f\") THEN 3 " +
+		"WHEN (IS_OBJECT(\"f\") AND \"f\".\"oid\" IS UNSET) THEN 4 WHEN IS_ARRAY(\"f\") THEN 5 " +
+		"WHEN (IS_OBJECT(\"f\") AND \"f\".\"oid\" IS SET) THEN 7 WHEN IS_BOOLEAN(\"f\") THEN 8 ELSE 12 END"
+
+	if actual := TypeOrderSQL("\"f\""); actual != expected {
+		t.Errorf("TypeOrderSQL FAILED. Expected %s got %s", expected, actual)
+	}
+}
@@ -0,0 +1,655 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// errMemoryUpdate marks an update which can not be translated to SQL, but can be applied in memory by ApplyUpdate.
+var errMemoryUpdate = errors.New("the update can only be applied in memory")
+
+// memoryUpdateError returns the error for an update which can only be applied in memory.
+func memoryUpdateError(update string) error {
+	return NewError(ErrNotImplemented, fmt.Errorf("%s can not be translated to SQL: %w", update, errMemoryUpdate))
+}
+
+// IsMemoryUpdate returns true if the error of Update marks an update which has to be applied in memory.
+func IsMemoryUpdate(err error) bool {
+	return errors.Is(err, errMemoryUpdate)
+}
+
+// updateOperator applies an update operator to the field at the dotted key of the document.
+type updateOperator func(doc types.Document, key string, arg any) (types.Document, error)
+
+// updateOperators are the update operators which can be applied in memory.
+var updateOperators map[string]updateOperator
+
+func init() {
+	updateOperators = map[string]updateOperator{
+		"$set":         applySet,
+		"$unset":       applyUnset,
+		"$inc":         applyArithmetic("$inc"),
+		"$mul":         applyArithmetic("$mul"),
+		"$min":         applyBoundary("$min"),
+		"$max":         applyBoundary("$max"),
+		"$rename":      applyRename,
+		"$currentDate": applyCurrentDate,
+		"$push":        applyPush,
+		"$addToSet":    applyAddToSet,
+		"$pull":        applyPull,
+		"$pullAll":     applyPullAll,
+		"$pop":         applyPop,
+		"$setOnInsert": applySetOnInsert,
+	}
+}
+
+// ApplyUpdate returns a copy of the document with the update operators applied and whether the document
+// was modified. It is used for updates which can not be executed by SAP HANA, the result replaces the
+// stored document. The filter of the update and its arrayFilters resolve the positional operators $ and
+// $[<identifier>].
+func ApplyUpdate(doc types.Document, updateDoc types.Document, filter types.Document, arrayFilters *types.Array) (types.Document, bool, error) {
+	if err := checkConflicts(updateDoc); err != nil {
+		return doc, false, err
+	}
+
+	filters, err := parseArrayFilters(arrayFilters)
+	if err != nil {
+		return doc, false, err
+	}
+
+	res := doc
+	for _, op := range updateDoc.Keys() {
+		apply, ok := updateOperators[op]
+		if !ok {
+			return doc, false, NewErrorMessage(ErrNotImplemented, "update operator %s is not supported", op)
+		}
+
+		fields, ok := updateDoc.Map()[op].(types.Document)
+		if !ok {
+			return doc, false, NewErrorMessage(
+				ErrFailedToParse,
+				"Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %v}",
+				aliasFromType(updateDoc.Map()[op]), op, updateDoc.Map()[op],
+			)
+		}
+
+		for _, key := range fields.Keys() {
+			if key == "_id" || strings.HasPrefix(key, "_id.") {
+				return doc, false, errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+			}
+
+			keys := []string{key}
+			if op != "$rename" && isPositionalPath(key) {
+				if keys, err = positionalPaths(res, key, filter, filters); err != nil {
+					return doc, false, err
+				}
+			}
+
+			for _, k := range keys {
+				if res, err = apply(res, k, fields.Map()[key]); err != nil {
+					return doc, false, err
+				}
+			}
+		}
+	}
+
+	// documents with the same fields in another order are not equal
+	if compareValues(res, doc) == equal {
+		return doc, false, nil
+	}
+
+	return res, true, nil
+}
+
+// applySet implements $set.
+func applySet(doc types.Document, key string, arg any) (types.Document, error) {
+	return withUpdatedField(doc, key, arg)
+}
+
+// applySetOnInsert implements $setOnInsert for stored documents, which are not modified. The fields are
+// only set on documents inserted by an upsert.
+func applySetOnInsert(doc types.Document, key string, arg any) (types.Document, error) {
+	return doc, nil
+}
+
+// applyUnset implements $unset. An element of an array is set to null like in MongoDB.
+func applyUnset(doc types.Document, key string, arg any) (types.Document, error) {
+	if IsMissing(updatePathValue(doc, strings.Split(key, "."))) {
+		return doc, nil
+	}
+
+	return withUpdatedField(doc, key, missing)
+}
+
+// applyArithmetic returns the implementation of $inc or $mul.
+func applyArithmetic(op string) updateOperator {
+	return func(doc types.Document, key string, arg any) (types.Document, error) {
+		if !isNumber(arg) {
+			verb := "increment"
+			if op == "$mul" {
+				verb = "multiply"
+			}
+			return doc, NewErrorMessage(ErrTypeMismatch, "Cannot %s with non-numeric argument: {%s: %v}", verb, key, arg)
+		}
+
+		path := strings.Split(key, ".")
+		current := updatePathValue(doc, path)
+		var value any
+		switch {
+		case IsMissing(current) && op == "$inc":
+			value = arg
+		case IsMissing(current):
+			value = zeroOf(arg)
+		case !isNumber(current):
+			return doc, NewErrorMessage(
+				ErrTypeMismatch,
+				"Cannot apply %s to a value of non-numeric type. {_id: %v} has the field '%s' of non-numeric type %s",
+				op, doc.Map()["_id"], path[len(path)-1], aliasFromType(current),
+			)
+		case op == "$inc":
+			value = addNumbers(current, arg)
+		default:
+			value = multiplyNumbers(current, arg)
+		}
+
+		return withUpdatedField(doc, key, value)
+	}
+}
+
+// applyBoundary returns the implementation of $min or $max. Values of different types are compared
+// in the BSON comparison order.
+func applyBoundary(op string) updateOperator {
+	return func(doc types.Document, key string, arg any) (types.Document, error) {
+		current := updatePathValue(doc, strings.Split(key, "."))
+		if !IsMissing(current) {
+			cmp := compareTotal(arg, current)
+			if (op == "$min" && cmp != less) || (op == "$max" && cmp != greater) {
+				return doc, nil
+			}
+		}
+
+		return withUpdatedField(doc, key, arg)
+	}
+}
+
+// applyRename implements $rename. Like in MongoDB, neither the source nor the target field can be
+// within an array and a missing source field does not change the document.
+func applyRename(doc types.Document, key string, arg any) (types.Document, error) {
+	target, err := renameTarget(key, arg)
+	if err != nil {
+		return doc, err
+	}
+
+	for _, field := range []struct{ name, key string }{{"source", key}, {"destination", target}} {
+		if array := arrayOnPath(doc, strings.Split(field.key, ".")); array != "" {
+			return doc, NewErrorMessage(
+				ErrBadValue,
+				"The %s field cannot be an array element, '%s' in doc with _id: %v has an array field called '%s'",
+				field.name, field.key, doc.Map()["_id"], array,
+			)
+		}
+	}
+
+	value := updatePathValue(doc, strings.Split(key, "."))
+	if IsMissing(value) {
+		return doc, nil
+	}
+
+	if doc, err = withUpdatedField(doc, key, missing); err != nil {
+		return doc, err
+	}
+
+	return withUpdatedField(doc, target, value)
+}
+
+// renameTarget returns the target field of $rename.
+func renameTarget(key string, arg any) (string, error) {
+	target, ok := arg.(string)
+	switch {
+	case !ok:
+		return "", NewErrorMessage(ErrBadValue, "The 'to' field for $rename must be a string: %s: %v", key, arg)
+	case target == "":
+		return "", NewErrorMessage(ErrBadValue, "The update path '%s' contains an empty field name, which is not allowed.", target)
+	case target == key:
+		return "", NewErrorMessage(ErrBadValue, "The source and target field for $rename must differ: %s: %q", key, target)
+	case strings.HasPrefix(target, key+".") || strings.HasPrefix(key, target+"."):
+		return "", NewErrorMessage(ErrBadValue, "The source and target field for $rename must not be on the same path: %s: %q", key, target)
+	case isPositionalPath(key):
+		return "", NewErrorMessage(ErrBadValue, "The source field for $rename may not be dynamic: %s", key)
+	case isPositionalPath(target):
+		return "", NewErrorMessage(ErrBadValue, "The destination field for $rename may not be dynamic: %s", target)
+	case target == "_id" || strings.HasPrefix(target, "_id."):
+		return "", errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+
+	return target, nil
+}
+
+// arrayOnPath returns the dotted key of the first array found before the end of the path.
+func arrayOnPath(doc types.Document, path []string) string {
+	for i := 1; i < len(path); i++ {
+		if _, ok := documentPathValue(doc, path[:i]).(*types.Array); ok {
+			return strings.Join(path[:i], ".")
+		}
+	}
+
+	return ""
+}
+
+// applyCurrentDate implements $currentDate. Timestamps can not be stored, so only dates are supported.
+func applyCurrentDate(doc types.Document, key string, arg any) (types.Document, error) {
+	if err := checkCurrentDate(arg); err != nil {
+		return doc, err
+	}
+
+	// dates are stored with milliseconds
+	return withUpdatedField(doc, key, time.UnixMilli(time.Now().UnixMilli()))
+}
+
+// checkCurrentDate checks the argument of $currentDate, which is true or {$type: "date"}.
+func checkCurrentDate(arg any) error {
+	switch arg := arg.(type) {
+	case bool:
+		return nil
+	case types.Document:
+		t, ok := arg.Map()["$type"]
+		if len(arg.Keys()) != 1 || !ok {
+			return NewErrorMessage(ErrBadValue, "The only valid field of the option is '$type': {$currentDate: {field : {$type: 'date/timestamp'}}}")
+		}
+		switch t {
+		case "date":
+			return nil
+		case "timestamp":
+			return NewErrorMessage(ErrNotImplemented, "$currentDate with $type timestamp is not supported, timestamps can not be stored")
+		default:
+			return NewErrorMessage(ErrBadValue, "The '$type' string field is required to be 'date' or 'timestamp': {$currentDate: {field : {$type: 'date'}}}")
+		}
+	default:
+		return NewErrorMessage(
+			ErrBadValue,
+			"%s is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).",
+			aliasFromType(arg),
+		)
+	}
+}
+
+// arrayField returns the elements of the array at the dotted key and whether the field exists. Like in
+// MongoDB the array operators fail for fields which are no arrays.
+func arrayField(doc types.Document, key, op string) ([]any, bool, error) {
+	value := updatePathValue(doc, strings.Split(key, "."))
+	if IsMissing(value) {
+		return nil, false, nil
+	}
+
+	array, ok := value.(*types.Array)
+	if ok {
+		return arrayValues(array), true, nil
+	}
+
+	switch op {
+	case "$push":
+		return nil, false, NewErrorMessage(
+			ErrBadValue, "The field '%s' must be an array but is of type %s in document {_id: %v}", key, aliasFromType(value), doc.Map()["_id"],
+		)
+	case "$addToSet":
+		return nil, false, NewErrorMessage(ErrBadValue, "Cannot apply $addToSet to non-array field. Field named '%s' has non-array type %s", key, aliasFromType(value))
+	case "$pop":
+		return nil, false, NewErrorMessage(ErrBadValue, "Path '%s' contains an element of non-array type '%s'", key, aliasFromType(value))
+	default:
+		return nil, false, NewErrorMessage(ErrBadValue, "Cannot apply %s to a non-array value", op)
+	}
+}
+
+// eachValues returns the values of {$each: [...]} or the value itself and the remaining modifiers of $push or $addToSet.
+func eachValues(op string, arg any) ([]any, types.Document, error) {
+	modifiers, ok := arg.(types.Document)
+	if !ok {
+		return []any{arg}, types.Document{}, nil
+	}
+
+	each, ok := modifiers.Map()["$each"]
+	if !ok {
+		return []any{arg}, types.Document{}, nil
+	}
+
+	array, ok := each.(*types.Array)
+	if !ok {
+		return nil, modifiers, NewErrorMessage(ErrBadValue, "The argument to $each in %s must be an array but it was of type: %s", op, aliasFromType(each))
+	}
+
+	return arrayValues(array), modifiers, nil
+}
+
+// applyPush implements $push with the modifiers $each, $position, $slice and $sort. The values are inserted
+// at the position first, then the array is sorted and sliced.
+func applyPush(doc types.Document, key string, arg any) (types.Document, error) {
+	values, _, err := arrayField(doc, key, "$push")
+	if err != nil {
+		return doc, err
+	}
+
+	each, modifiers, err := eachValues("$push", arg)
+	if err != nil {
+		return doc, err
+	}
+
+	position := int64(len(values))
+	for _, modifier := range modifiers.Keys() {
+		value := modifiers.Map()[modifier]
+		switch modifier {
+		case "$each":
+		case "$position":
+			n, ok := sliceNumber(value)
+			if !ok {
+				return doc, NewErrorMessage(ErrBadValue, "The value for $position must be an integer value, not of type: %s", aliasFromType(value))
+			}
+			if n < 0 {
+				n += int64(len(values))
+			}
+			if position = n; position < 0 {
+				position = 0
+			} else if position > int64(len(values)) {
+				position = int64(len(values))
+			}
+		case "$slice":
+			if _, ok := sliceNumber(value); !ok {
+				return doc, NewErrorMessage(ErrBadValue, "The value for $slice must be an integer value but was given type: %s", aliasFromType(value))
+			}
+		case "$sort":
+		default:
+			return doc, NewErrorMessage(ErrBadValue, "Unrecognized clause in $push: %s", modifier)
+		}
+	}
+
+	res := make([]any, 0, len(values)+len(each))
+	res = append(res, values[:position]...)
+	res = append(res, each...)
+	res = append(res, values[position:]...)
+
+	if spec, ok := modifiers.Map()["$sort"]; ok {
+		if err = sortElements(res, spec); err != nil {
+			return doc, err
+		}
+	}
+
+	array := types.MustNewArray(res...)
+	if value, ok := modifiers.Map()["$slice"]; ok {
+		n, _ := sliceNumber(value)
+		if n < 0 {
+			array = sliceArray(array, n, -n)
+		} else {
+			array = sliceArray(array, 0, n)
+		}
+	}
+
+	return withUpdatedField(doc, key, array)
+}
+
+// sortElements sorts the elements of an array for the $sort modifier of $push, which is 1 or -1 to sort the
+// elements or a document like {field: 1} to sort embedded documents. Values of different types are sorted
+// in the BSON comparison order.
+func sortElements(values []any, spec any) error {
+	var fields []string
+	var descending []bool
+	if order, ok := sliceNumber(spec); ok {
+		if order != 1 && order != -1 {
+			return NewErrorMessage(ErrBadValue, "The $sort element value must be either 1 or -1")
+		}
+		fields, descending = []string{""}, []bool{order == -1}
+	} else {
+		sortDoc, ok := spec.(types.Document)
+		if !ok || len(sortDoc.Keys()) == 0 {
+			return NewErrorMessage(ErrBadValue, "The $sort is invalid: use 1/-1 to sort the whole element, or {field:1/-1} to sort embedded fields")
+		}
+
+		for _, field := range sortDoc.Keys() {
+			order, ok := sliceNumber(sortDoc.Map()[field])
+			if !ok || (order != 1 && order != -1) {
+				return NewErrorMessage(ErrBadValue, "The $sort element value must be either 1 or -1")
+			}
+			fields = append(fields, field)
+			descending = append(descending, order == -1)
+		}
+	}
+
+	key := func(value any, field string, descending bool) any {
+		if field == "" {
+			return value
+		}
+		if doc, ok := value.(types.Document); ok {
+			return sortKey(doc, field, descending)
+		}
+		return missing
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		for k, field := range fields {
+			cmp := compareTotal(key(values[i], field, descending[k]), key(values[j], field, descending[k]))
+			if cmp == equal || cmp == notEqual {
+				continue
+			}
+			return (cmp == less) != descending[k]
+		}
+		return false
+	})
+
+	return nil
+}
+
+// applyAddToSet implements $addToSet with the modifier $each. Values already in the array are not added.
+func applyAddToSet(doc types.Document, key string, arg any) (types.Document, error) {
+	values, _, err := arrayField(doc, key, "$addToSet")
+	if err != nil {
+		return doc, err
+	}
+
+	each, modifiers, err := eachValues("$addToSet", arg)
+	if err != nil {
+		return doc, err
+	}
+	if len(modifiers.Keys()) > 1 {
+		return doc, NewErrorMessage(ErrBadValue, "Found unexpected fields after $each in $addToSet: %v", modifiers)
+	}
+
+	for _, value := range each {
+		if !containsValue(values, value) {
+			values = append(values, value)
+		}
+	}
+
+	return withUpdatedField(doc, key, types.MustNewArray(values...))
+}
+
+// containsValue checks if one of the values equals the value. Documents are only equal with the same
+// fields in the same order.
+func containsValue(values []any, value any) bool {
+	for _, v := range values {
+		if compareValues(v, value) == equal {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyPull implements $pull. A condition like {$gte: 6} is checked for every element, a condition
+// like {item: "B"} is a filter of embedded documents and any other value is compared with the elements.
+func applyPull(doc types.Document, key string, arg any) (types.Document, error) {
+	values, ok, err := arrayField(doc, key, "$pull")
+	if err != nil || !ok {
+		return doc, err
+	}
+
+	res := make([]any, 0, len(values))
+	for _, value := range values {
+		var matches bool
+		if filter, ok := arg.(types.Document); ok {
+			matches, err = matchElement(value, filter)
+		} else {
+			matches, err = matchEqual([]any{value}, arg)
+		}
+		if err != nil {
+			return doc, err
+		}
+
+		if !matches {
+			res = append(res, value)
+		}
+	}
+
+	return withUpdatedField(doc, key, types.MustNewArray(res...))
+}
+
+// applyPullAll implements $pullAll, which removes all elements equal to one of the values.
+func applyPullAll(doc types.Document, key string, arg any) (types.Document, error) {
+	array, ok := arg.(*types.Array)
+	if !ok {
+		return doc, NewErrorMessage(ErrBadValue, "$pullAll requires an array argument but was given a %s", aliasFromType(arg))
+	}
+
+	values, ok, err := arrayField(doc, key, "$pullAll")
+	if err != nil || !ok {
+		return doc, err
+	}
+
+	res := make([]any, 0, len(values))
+	for _, value := range values {
+		if !containsValue(arrayValues(array), value) {
+			res = append(res, value)
+		}
+	}
+
+	return withUpdatedField(doc, key, types.MustNewArray(res...))
+}
+
+// applyPop implements $pop, which removes the first element for -1 and the last element for 1.
+func applyPop(doc types.Document, key string, arg any) (types.Document, error) {
+	n, ok := sliceNumber(arg)
+	if !ok || (n != 1 && n != -1) {
+		return doc, NewErrorMessage(ErrBadValue, "$pop expects 1 or -1, found: %v", arg)
+	}
+
+	values, ok, err := arrayField(doc, key, "$pop")
+	if err != nil || !ok || len(values) == 0 {
+		return doc, err
+	}
+
+	if n == 1 {
+		values = values[:len(values)-1]
+	} else {
+		values = values[1:]
+	}
+
+	return withUpdatedField(doc, key, types.MustNewArray(values...))
+}
+
+// updatePathValue returns the value at the path. Unlike a filter, numeric parts of the path are indexes
+// of arrays and embedded documents within arrays are not traversed.
+func updatePathValue(value any, path []string) any {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch value := value.(type) {
+	case types.Document:
+		next, err := value.Get(path[0])
+		if err != nil {
+			return missing
+		}
+		return updatePathValue(next, path[1:])
+
+	case *types.Array:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= value.Len() {
+			return missing
+		}
+		next, _ := value.Get(index)
+		return updatePathValue(next, path[1:])
+
+	default:
+		return missing
+	}
+}
+
+// withUpdatedField returns a copy of the document with the value at the dotted key.
+func withUpdatedField(doc types.Document, key string, value any) (types.Document, error) {
+	res, err := withUpdatedPath(doc, "", strings.Split(key, "."), value)
+	if err != nil {
+		return doc, err
+	}
+
+	return res.(types.Document), nil
+}
+
+// withUpdatedPath returns a copy of the document or array with the value at the path. Missing removes
+// the field, elements of arrays are set to null instead. Like in MongoDB missing embedded documents are
+// created and arrays are padded with null, but no field can be created within other values.
+func withUpdatedPath(container any, name string, path []string, value any) (any, error) {
+	var current any = missing
+	switch c := container.(type) {
+	case types.Document:
+		if v, err := c.Get(path[0]); err == nil {
+			current = v
+		}
+	case *types.Array:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 {
+			return nil, NewErrorMessage(ErrPathNotViable, "Cannot create field '%s' in element {%s: %v}", path[0], name, c)
+		}
+		if index < c.Len() {
+			current, _ = c.Get(index)
+		}
+	default:
+		return nil, NewErrorMessage(ErrPathNotViable, "Cannot create field '%s' in element {%s: %v}", path[0], name, c)
+	}
+
+	next := value
+	if len(path) > 1 {
+		if IsMissing(current) {
+			if IsMissing(value) {
+				return container, nil
+			}
+			current = types.MustMakeDocument()
+		}
+
+		var err error
+		if next, err = withUpdatedPath(current, path[0], path[1:], value); err != nil {
+			return nil, err
+		}
+	}
+
+	if array, ok := container.(*types.Array); ok {
+		index, _ := strconv.Atoi(path[0])
+		if IsMissing(next) {
+			if index >= array.Len() {
+				return array, nil
+			}
+			next = nil
+		}
+
+		values := arrayValues(array)
+		for len(values) <= index {
+			values = append(values, nil)
+		}
+		values[index] = next
+		return types.MustNewArray(values...), nil
+	}
+
+	res, err := withPathValue(container.(types.Document), path[:1], next)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,242 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCaseApplyUpdate struct {
+	name     string
+	update   types.Document
+	expected types.Document
+	modified bool
+	err      string
+}
+
+func TestApplyUpdate(t *testing.T) {
+	newDoc := func() types.Document {
+		return types.MustMakeDocument(
+			"_id", int32(1),
+			"item", "journal",
+			"qty", int32(25),
+			"size", types.MustMakeDocument("h", int32(14), "uom", "cm"),
+			"tags", types.MustNewArray("blank", "red"),
+		)
+	}
+
+	applyUpdateTestCases := []testCaseApplyUpdate{
+		{
+			name:     "set and unset",
+			update:   types.MustMakeDocument("$set", types.MustMakeDocument("size.w", int32(21), "tags.3", "new"), "$unset", types.MustMakeDocument("item", "", "tags.0", "")),
+			expected: types.MustMakeDocument("_id", int32(1), "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm", "w", int32(21)), "tags", types.MustNewArray(nil, "red", nil, "new")),
+			modified: true,
+		},
+		{
+			name:     "set equal value",
+			update:   types.MustMakeDocument("$set", types.MustMakeDocument("qty", float64(25))),
+			expected: newDoc(),
+		},
+		{
+			name:   "set within a value",
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("item.name", "journal")),
+			err:    "PathNotViable (28): Cannot create field 'name' in element {item: journal}",
+		},
+		{
+			name:     "increment and multiply",
+			update:   types.MustMakeDocument("$inc", types.MustMakeDocument("qty", int32(-5), "stats.views", int64(1)), "$mul", types.MustMakeDocument("size.h", float64(0.5))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(20), "size", types.MustMakeDocument("h", float64(7), "uom", "cm"), "tags", types.MustNewArray("blank", "red"), "stats", types.MustMakeDocument("views", int64(1))),
+			modified: true,
+		},
+		{
+			name:   "increment string",
+			update: types.MustMakeDocument("$inc", types.MustMakeDocument("item", int32(1))),
+			err:    "TypeMismatch (14): Cannot apply $inc to a value of non-numeric type. {_id: 1} has the field 'item' of non-numeric type string",
+		},
+		{
+			name:     "min and max",
+			update:   types.MustMakeDocument("$min", types.MustMakeDocument("qty", int32(10), "low", int32(3)), "$max", types.MustMakeDocument("size.h", int32(10), "item", int32(100))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(10), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "red"), "low", int32(3)),
+			modified: true,
+		},
+		{
+			name:     "max of a document",
+			update:   types.MustMakeDocument("$max", types.MustMakeDocument("size", types.MustMakeDocument("h", int32(15)))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(15)), "tags", types.MustNewArray("blank", "red")),
+			modified: true,
+		},
+		{
+			name:     "rename into a nested path",
+			update:   types.MustMakeDocument("$rename", types.MustMakeDocument("item", "info.name", "size.uom", "unit", "missing", "other")),
+			expected: types.MustMakeDocument("_id", int32(1), "qty", int32(25), "size", types.MustMakeDocument("h", int32(14)), "tags", types.MustNewArray("blank", "red"), "info", types.MustMakeDocument("name", "journal"), "unit", "cm"),
+			modified: true,
+		},
+		{
+			name:     "rename missing field",
+			update:   types.MustMakeDocument("$rename", types.MustMakeDocument("missing", "other")),
+			expected: newDoc(),
+		},
+		{
+			name:   "rename within an array",
+			update: types.MustMakeDocument("$rename", types.MustMakeDocument("tags.0", "tag")),
+			err:    "BadValue (2): The source field cannot be an array element, 'tags.0' in doc with _id: 1 has an array field called 'tags'",
+		},
+		{
+			name:   "rename to the same path",
+			update: types.MustMakeDocument("$rename", types.MustMakeDocument("size", "size.h")),
+			err:    "BadValue (2): The source and target field for $rename must not be on the same path: size: \"size.h\"",
+		},
+		{
+			name:   "rename to _id",
+			update: types.MustMakeDocument("$rename", types.MustMakeDocument("item", "_id")),
+			err:    "performing an update on the path '_id' would modify the immutable field '_id'",
+		},
+		{
+			name:   "current timestamp",
+			update: types.MustMakeDocument("$currentDate", types.MustMakeDocument("updated", types.MustMakeDocument("$type", "timestamp"))),
+			err:    "NotImplemented (238): $currentDate with $type timestamp is not supported, timestamps can not be stored",
+		},
+		{
+			name:     "push",
+			update:   types.MustMakeDocument("$push", types.MustMakeDocument("tags", "green", "scores", int32(7))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "red", "green"), "scores", types.MustNewArray(int32(7))),
+			modified: true,
+		},
+		{
+			name:     "push an array",
+			update:   types.MustMakeDocument("$push", types.MustMakeDocument("tags", types.MustNewArray("a", "b"))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "red", types.MustNewArray("a", "b"))),
+			modified: true,
+		},
+		{
+			name: "push with position",
+			update: types.MustMakeDocument("$push", types.MustMakeDocument(
+				"tags", types.MustMakeDocument("$each", types.MustNewArray("a", "b"), "$position", int32(-1)),
+			)),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "a", "b", "red")),
+			modified: true,
+		},
+		{
+			name: "push with sort and slice",
+			update: types.MustMakeDocument("$push", types.MustMakeDocument(
+				"tags", types.MustMakeDocument("$each", types.MustNewArray("yellow", int32(1)), "$sort", int32(-1), "$slice", int32(-3)),
+			)),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("red", "blank", int32(1))),
+			modified: true,
+		},
+		{
+			name: "push documents sorted by a field",
+			update: types.MustMakeDocument("$push", types.MustMakeDocument(
+				"quizzes", types.MustMakeDocument(
+					"$each", types.MustNewArray(types.MustMakeDocument("wk", int32(2), "score", int32(8)), types.MustMakeDocument("wk", int32(1), "score", int32(9))),
+					"$sort", types.MustMakeDocument("score", int32(1)),
+					"$slice", int32(1),
+				),
+			)),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "red"), "quizzes", types.MustNewArray(types.MustMakeDocument("wk", int32(2), "score", int32(8)))),
+			modified: true,
+		},
+		{
+			name:   "push to a string",
+			update: types.MustMakeDocument("$push", types.MustMakeDocument("item", "a")),
+			err:    "BadValue (2): The field 'item' must be an array but is of type string in document {_id: 1}",
+		},
+		{
+			name:   "push with unknown modifier",
+			update: types.MustMakeDocument("$push", types.MustMakeDocument("tags", types.MustMakeDocument("$each", types.MustNewArray(), "$limit", int32(1)))),
+			err:    "BadValue (2): Unrecognized clause in $push: $limit",
+		},
+		{
+			name:     "add to set",
+			update:   types.MustMakeDocument("$addToSet", types.MustMakeDocument("tags", types.MustMakeDocument("$each", types.MustNewArray("red", "green", "green")))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank", "red", "green")),
+			modified: true,
+		},
+		{
+			name:     "add existing value to set",
+			update:   types.MustMakeDocument("$addToSet", types.MustMakeDocument("tags", "red")),
+			expected: newDoc(),
+		},
+		{
+			name:     "pull",
+			update:   types.MustMakeDocument("$pull", types.MustMakeDocument("tags", types.MustMakeDocument("$in", types.MustNewArray("red", "green")))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank")),
+			modified: true,
+		},
+		{
+			name:     "pull all and pop",
+			update:   types.MustMakeDocument("$pullAll", types.MustMakeDocument("tags", types.MustNewArray("red")), "$pop", types.MustMakeDocument("missing", int32(1))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("blank")),
+			modified: true,
+		},
+		{
+			name:     "pop first",
+			update:   types.MustMakeDocument("$pop", types.MustMakeDocument("tags", int32(-1))),
+			expected: types.MustMakeDocument("_id", int32(1), "item", "journal", "qty", int32(25), "size", types.MustMakeDocument("h", int32(14), "uom", "cm"), "tags", types.MustNewArray("red")),
+			modified: true,
+		},
+		{
+			name:   "pop invalid",
+			update: types.MustMakeDocument("$pop", types.MustMakeDocument("tags", int32(2))),
+			err:    "BadValue (2): $pop expects 1 or -1, found: 2",
+		},
+		{
+			name:     "set on insert",
+			update:   types.MustMakeDocument("$setOnInsert", types.MustMakeDocument("qty", int32(1))),
+			expected: newDoc(),
+		},
+		{
+			name:   "conflict",
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("size.h", int32(1)), "$unset", types.MustMakeDocument("size", "")),
+			err:    "ConflictingUpdateOperators (40): Updating the path 'size' would create a conflict at 'size'",
+		},
+	}
+
+	for _, tc := range applyUpdateTestCases {
+		doc := newDoc()
+		actual, modified, err := ApplyUpdate(doc, tc.update, types.Document{}, nil)
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: ApplyUpdate(%v) FAILED. Expected err = %s got err = %v", tc.name, tc.update, tc.err, err)
+			}
+			continue
+		}
+
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.modified, modified, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+		assert.Equal(t, newDoc(), doc, "%s: the original document was modified", tc.name)
+	}
+
+	t.Run("pull documents matching a filter", func(t *testing.T) {
+		doc := types.MustMakeDocument("_id", int32(1), "results", types.MustNewArray(
+			types.MustMakeDocument("item", "A", "score", int32(5)),
+			types.MustMakeDocument("item", "B", "score", int32(8)),
+			"B",
+		))
+
+		actual, modified, err := ApplyUpdate(doc, types.MustMakeDocument("$pull", types.MustMakeDocument("results", types.MustMakeDocument("score", types.MustMakeDocument("$gte", int32(8)), "item", "B"))), types.Document{}, nil)
+		assert.NoError(t, err)
+		assert.True(t, modified)
+		assert.Equal(t, types.MustMakeDocument("_id", int32(1), "results", types.MustNewArray(types.MustMakeDocument("item", "A", "score", int32(5)), "B")), actual)
+	})
+
+	t.Run("current date", func(t *testing.T) {
+		before := time.Now().Add(-time.Second)
+		actual, modified, err := ApplyUpdate(newDoc(), types.MustMakeDocument("$currentDate", types.MustMakeDocument("updated", true, "log.seen", types.MustMakeDocument("$type", "date"))), types.Document{}, nil)
+		assert.NoError(t, err)
+		assert.True(t, modified)
+
+		updated, ok := actual.Map()["updated"].(time.Time)
+		assert.True(t, ok)
+		assert.True(t, updated.After(before))
+		assert.Equal(t, updated, actual.Map()["log"].(types.Document).Map()["seen"])
+	})
+}
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// In SQL a comparison with a null or missing field is unknown, while in MongoDB only a few operators
+// like {field: null} or $exists match null and missing fields and all other operators are false for them.
+// The SQL of the operators matching null and missing fields is built to be never unknown. The SQL of all
+// other operators is made definite before it is negated, so the negation is true for null and missing fields.
+
+// nullSQL returns the predicate of {field: null}. Like in MongoDB it matches null and missing fields
+// and arrays with a null element. A field of a document within an array is only missing if the
+// document is traversed, so the field of the array itself does not match.
+func nullSQL(kSQL string) string {
+	kvSQL := kSQL + " IS NULL OR " + kSQL + " IS UNSET"
+	if elementwise(kSQL) {
+		kvSQL += " OR FOR ANY " + elementSQL + " IN " + kSQL + " SATISFIES " + elementSQL + " IS NULL END"
+	}
+
+	if i := strings.LastIndex(kSQL, ".\""); i != -1 && strings.HasSuffix(kSQL, "\"") {
+		return "(NOT IS_ARRAY(" + kSQL[:i] + ") AND (" + kvSQL + "))"
+	}
+
+	return "(" + kvSQL + ")"
+}
+
+// existsSQL returns the predicate of $exists. Like in MongoDB any value other than false, 0 and null counts as true.
+func existsSQL(kSQL string, value any) string {
+	if isTrue(value) {
+		return kSQL + " IS SET"
+	}
+
+	return kSQL + " IS UNSET"
+}
+
+// definite makes the predicate of an operator which does not match null and missing fields false
+// instead of unknown for them.
+func definite(kSQL, predicate string) string {
+	return "(" + predicate + " AND " + kSQL + " IS NOT NULL)"
+}
+
+// negation negates the predicate on the field. If the predicate is not null safe it is made definite first.
+func negation(kSQL, predicate string, safe bool) string {
+	if !safe {
+		predicate = definite(kSQL, predicate)
+	}
+
+	return "NOT (" + predicate + ")"
+}
+
+// nullSafe returns true if the SQL of the operator with the given value is never unknown for null and missing fields.
+// This is the case for the negations and all operators which can match null or missing fields.
+func nullSafe(op string, value any) bool {
+	switch strings.ToLower(op) {
+	case "$exists", "$ne", "$nin", "$not":
+		return true
+	case "$eq", "$gte", "$lte":
+		return value == nil
+	case "$in":
+		if list, ok := value.(*types.Array); ok {
+			for _, element := range arrayValues(list) {
+				if element == nil {
+					return true
+				}
+			}
+		}
+	case "$type":
+		aliases, _ := typeAliases(value)
+		for _, alias := range aliases {
+			if alias == "null" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nullSafeExpression returns true if the SQL of all operators of the expression is null safe.
+func nullSafeExpression(expr types.Document) bool {
+	for _, op := range expr.Keys() {
+		if op != "$options" && !nullSafe(op, expr.Map()[op]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// notExpression returns the expression negated by $not, which is a document or a regular expression.
+func notExpression(value any) (types.Document, error) {
+	switch value := value.(type) {
+	case types.Document:
+		return value, nil
+	case types.Regex:
+		return types.MustMakeDocument("$regex", value), nil
+	default:
+		return types.Document{}, NewErrorMessage(ErrBadValue, "$not needs a regex or a document")
+	}
+}
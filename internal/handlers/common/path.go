@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// elementAlias is the variable of FOR ANY for the elements of an array. Field names starting with $ are
+// operators in filters, so the alias can not clash with a field of the documents.
+const elementAlias = "$element"
+
+// elementSQL is the SQL of elementAlias.
+const elementSQL = "\"" + elementAlias + "\""
+
+// maxTraversedFields is the maximum number of fields of a dotted key which are resolved in arrays. Every
+// such field doubles the SQL of the predicate, so filters on longer keys are evaluated in memory.
+const maxTraversedFields = 4
+
+// traversable returns true if arrays on the path of a dotted key have to be traversed.
+// The elements of $elemMatch and $all and _id, which can not be an array, are not traversed.
+func traversable(key string) bool {
+	return strings.Contains(key, ".") && !strings.HasPrefix(key, elementAlias+".") && !strings.HasPrefix(key, "_id.")
+}
+
+// pathSQL returns the SQL of a predicate on the values of a key. Like in MongoDB a dotted key like
+// items.sku is resolved for every embedded document of an array on the path, so the predicate is
+// true if it is true for any of the values found. Numeric parts of the key are array indexes.
+func pathSQL(key string, predicate func(kSQL string) (string, error)) (string, error) {
+	if !traversable(key) {
+		kSQL, err := whereKey(key)
+		if err != nil {
+			return "", err
+		}
+		return predicate(kSQL)
+	}
+
+	path := strings.Split(key, ".")
+	if len(traversedFields(path)) > maxTraversedFields {
+		return "", memoryFilterError("the key " + key)
+	}
+
+	return resolvePath("\""+path[0]+"\"", path[1:], 1, predicate)
+}
+
+// traversedFields returns the indexes of the fields of the path which are resolved in arrays, that is all
+// fields but the first one which are no array indexes.
+func traversedFields(path []string) []int {
+	var res []int
+	for i := 1; i < len(path); i++ {
+		if _, err := strconv.Atoi(path[i]); err != nil {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// ArraysSQL returns the predicate which is true for the documents in which arrays have to be traversed to resolve
+// one of the dotted keys, because a field followed by a field name is an array. It is empty if no key traverses arrays.
+func ArraysSQL(keys []string) (string, error) {
+	var predicates []string
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !traversable(key) {
+			continue
+		}
+
+		path := strings.Split(key, ".")
+		for _, i := range traversedFields(path) {
+			kSQL, err := whereKey(strings.Join(path[:i], "."))
+			if err != nil {
+				return "", err
+			}
+
+			if predicate := "IS_ARRAY(" + kSQL + ")"; !seen[predicate] {
+				seen[predicate] = true
+				predicates = append(predicates, predicate)
+			}
+		}
+	}
+
+	return strings.Join(predicates, " OR "), nil
+}
+
+// resolvePath resolves the remaining path starting at the SQL of the resolved part. Every level of
+// traversed arrays uses its own element variable, so nested FOR ANY expressions do not clash.
+func resolvePath(base string, path []string, depth int, predicate func(kSQL string) (string, error)) (string, error) {
+	if len(path) == 0 {
+		return predicate(base)
+	}
+
+	if index, err := strconv.Atoi(path[0]); err == nil {
+		if index < 0 {
+			return "", fmt.Errorf("negative array index is not allowed")
+		}
+		return resolvePath(fmt.Sprintf("%s[%d]", base, index+1), path[1:], depth, predicate)
+	}
+
+	field := "\"" + path[0] + "\""
+
+	direct, err := resolvePath(base+"."+field, path[1:], depth, predicate)
+	if err != nil {
+		return "", err
+	}
+
+	element := fmt.Sprintf("\"%s%d\"", elementAlias, depth)
+	traversed, err := resolvePath(element+"."+field, path[1:], depth+1, predicate)
+	if err != nil {
+		return "", err
+	}
+
+	return "(" + direct + " OR FOR ANY " + element + " IN " + base + " SATISFIES " + traversed + " END)", nil
+}
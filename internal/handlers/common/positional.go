@@ -0,0 +1,242 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// identifierRegex matches the identifiers of $[<identifier>] and of array filters.
+var identifierRegex = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+
+// positionalPart returns the identifier of $[<identifier>], an empty identifier for $[] and
+// whether the part of a path is one of the positional operators $, $[] and $[<identifier>].
+func positionalPart(part string) (identifier string, ok bool) {
+	if part == "$" {
+		return "", true
+	}
+
+	if strings.HasPrefix(part, "$[") && strings.HasSuffix(part, "]") {
+		return part[2 : len(part)-1], true
+	}
+
+	return "", false
+}
+
+// isPositionalPath checks if the dotted key of an update contains a positional operator.
+func isPositionalPath(key string) bool {
+	for _, part := range strings.Split(key, ".") {
+		if _, ok := positionalPart(part); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// positionalKey returns the first dotted key of the update operators which contains a positional operator.
+func positionalKey(updateDoc types.Document) string {
+	for _, op := range updateDoc.Keys() {
+		fields, ok := updateDoc.Map()[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range fields.Keys() {
+			if isPositionalPath(key) {
+				return key
+			}
+		}
+	}
+
+	return ""
+}
+
+// parseArrayFilters returns the filters of the arrayFilters of an update by their identifier. Every
+// filter must use a single identifier like {"elem.qty": {$gt: 2}}.
+func parseArrayFilters(arrayFilters *types.Array) (map[string]types.Document, error) {
+	res := map[string]types.Document{}
+	if arrayFilters == nil {
+		return res, nil
+	}
+
+	for _, value := range arrayValues(arrayFilters) {
+		filter, ok := value.(types.Document)
+		if !ok {
+			return nil, NewErrorMessage(ErrTypeMismatch, "Each array filter must be an object, found %s", aliasFromType(value))
+		}
+
+		identifiers := filterIdentifiers(filter, map[string]struct{}{})
+		if len(identifiers) != 1 {
+			names := make([]string, 0, len(identifiers))
+			for identifier := range identifiers {
+				names = append(names, identifier)
+			}
+			sort.Strings(names)
+			return nil, NewErrorMessage(
+				ErrFailedToParse, "Error parsing array filter :: caused by :: Expected a single top-level field name, found '%s'", strings.Join(names, "' and '"),
+			)
+		}
+
+		for identifier := range identifiers {
+			if !identifierRegex.MatchString(identifier) {
+				return nil, NewErrorMessage(
+					ErrBadValue,
+					"Error parsing array filter :: caused by :: The top-level field name must be an alphanumeric string beginning with a lowercase letter, found '%s'",
+					identifier,
+				)
+			}
+			if _, ok := res[identifier]; ok {
+				return nil, NewErrorMessage(ErrFailedToParse, "Found multiple array filters with the same top-level field name %s", identifier)
+			}
+			res[identifier] = filter
+		}
+	}
+
+	return res, nil
+}
+
+// filterIdentifiers adds the top-level field names of the filter and of the filters within $and, $or and $nor.
+func filterIdentifiers(filter types.Document, identifiers map[string]struct{}) map[string]struct{} {
+	for _, key := range filter.Keys() {
+		if !strings.HasPrefix(key, "$") {
+			identifiers[strings.Split(key, ".")[0]] = struct{}{}
+			continue
+		}
+
+		if conditions, ok := filter.Map()[key].(*types.Array); ok {
+			for _, condition := range arrayValues(conditions) {
+				if condition, ok := condition.(types.Document); ok {
+					filterIdentifiers(condition, identifiers)
+				}
+			}
+		}
+	}
+
+	return identifiers
+}
+
+// CheckArrayFilters returns the error of MongoDB if the arrayFilters of an update are invalid, if an identifier
+// of $[<identifier>] has no array filter or if an array filter is not used by the update.
+func CheckArrayFilters(updateDoc types.Document, arrayFilters *types.Array) error {
+	filters, err := parseArrayFilters(arrayFilters)
+	if err != nil {
+		return err
+	}
+
+	used := map[string]struct{}{}
+	for _, op := range updateDoc.Keys() {
+		fields, ok := updateDoc.Map()[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range fields.Keys() {
+			for _, part := range strings.Split(key, ".") {
+				identifier, ok := positionalPart(part)
+				if !ok || identifier == "" {
+					continue
+				}
+				if _, ok = filters[identifier]; !ok {
+					return NewErrorMessage(ErrBadValue, "No array filter found for identifier '%s' in path '%s'", identifier, key)
+				}
+				used[identifier] = struct{}{}
+			}
+		}
+	}
+
+	for identifier := range filters {
+		if _, ok := used[identifier]; !ok {
+			return NewErrorMessage(ErrFailedToParse, "The array filter for identifier '%s' was not used in the update", identifier)
+		}
+	}
+
+	return nil
+}
+
+// positionalPaths returns the dotted keys of the elements updated by a key with positional operators. $ is the
+// index of the first element matching the conditions of the filter on the array, $[] are all elements and
+// $[<identifier>] are the elements matching the array filter of the identifier.
+func positionalPaths(doc types.Document, key string, filter types.Document, arrayFilters map[string]types.Document) ([]string, error) {
+	paths := [][]string{nil}
+	for i, part := range strings.Split(key, ".") {
+		identifier, ok := positionalPart(part)
+		if !ok {
+			for j := range paths {
+				paths[j] = append(paths[j], part)
+			}
+			continue
+		}
+
+		if i == 0 {
+			return nil, NewErrorMessage(ErrBadValue, "Cannot have positional (i.e. '$') element in the first position in path '%s'", key)
+		}
+
+		var res [][]string
+		for _, path := range paths {
+			prefix := strings.Join(path, ".")
+
+			if part == "$" {
+				index, err := positionalIndex(doc, prefix, filter)
+				if err != nil {
+					return nil, err
+				}
+				if index < 0 {
+					return nil, NewErrorMessage(ErrBadValue, "The positional operator did not find the match needed from the query.")
+				}
+				res = append(res, appendPart(path, strconv.Itoa(index)))
+				continue
+			}
+
+			value := updatePathValue(doc, path)
+			array, ok := value.(*types.Array)
+			switch {
+			case IsMissing(value):
+				return nil, NewErrorMessage(ErrBadValue, "The path '%s' must exist in the document in order to apply array updates.", prefix)
+			case !ok:
+				return nil, NewErrorMessage(ErrBadValue, "Cannot apply array updates to non-array element %s of type %s", prefix, aliasFromType(value))
+			}
+
+			arrayFilter, ok := arrayFilters[identifier]
+			if identifier != "" && !ok {
+				return nil, NewErrorMessage(ErrBadValue, "No array filter found for identifier '%s' in path '%s'", identifier, key)
+			}
+
+			for index, element := range arrayValues(array) {
+				if identifier != "" {
+					matches, err := MatchDocument(types.MustMakeDocument(identifier, element), arrayFilter)
+					if err != nil {
+						return nil, err
+					}
+					if !matches {
+						continue
+					}
+				}
+				res = append(res, appendPart(path, strconv.Itoa(index)))
+			}
+		}
+		paths = res
+	}
+
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		keys[i] = strings.Join(path, ".")
+	}
+
+	return keys, nil
+}
+
+// appendPart returns a copy of the path with the part appended, so paths sharing a prefix are not modified.
+func appendPart(path []string, part string) []string {
+	res := make([]string, len(path), len(path)+1)
+	copy(res, path)
+
+	return append(res, part)
+}
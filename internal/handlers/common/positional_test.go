@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCasePositionalUpdate struct {
+	name         string
+	filter       types.Document
+	update       types.Document
+	arrayFilters *types.Array
+	expected     types.Document
+	err          string
+}
+
+func TestPositionalUpdate(t *testing.T) {
+	t.Parallel()
+
+	item := func(sku string, qty int32) types.Document {
+		return types.MustMakeDocument("sku", sku, "qty", qty)
+	}
+	order := func(items ...types.Document) types.Document {
+		values := make([]any, len(items))
+		for i, item := range items {
+			values[i] = item
+		}
+		return types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray(values...), "tags", types.MustNewArray("new", "paid"))
+	}
+
+	positionalTestCases := []testCasePositionalUpdate{
+		{
+			name:     "matched element",
+			filter:   types.MustMakeDocument("_id", int32(1), "items.sku", "b"),
+			update:   types.MustMakeDocument("$set", types.MustMakeDocument("items.$.qty", int32(5))),
+			expected: order(item("a", 1), item("b", 5), item("c", 3)),
+		},
+		{
+			name:     "matched value",
+			filter:   types.MustMakeDocument("tags", "paid"),
+			update:   types.MustMakeDocument("$set", types.MustMakeDocument("tags.$", "shipped")),
+			expected: types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray(item("a", 1), item("b", 2), item("c", 3)), "tags", types.MustNewArray("new", "shipped")),
+		},
+		{
+			name:     "matched element with $elemMatch",
+			filter:   types.MustMakeDocument("items", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(1))))),
+			update:   types.MustMakeDocument("$inc", types.MustMakeDocument("items.$.qty", int32(-1))),
+			expected: order(item("a", 1), item("b", 1), item("c", 3)),
+		},
+		{
+			name:   "no matched element",
+			filter: types.MustMakeDocument("_id", int32(1)),
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("items.$.qty", int32(5))),
+			err:    "BadValue (2): The positional operator did not find the match needed from the query.",
+		},
+		{
+			name:     "all elements",
+			update:   types.MustMakeDocument("$mul", types.MustMakeDocument("items.$[].qty", int32(2))),
+			expected: order(item("a", 2), item("b", 4), item("c", 6)),
+		},
+		{
+			name:         "filtered elements",
+			update:       types.MustMakeDocument("$set", types.MustMakeDocument("items.$[line].qty", int32(0))),
+			arrayFilters: types.MustNewArray(types.MustMakeDocument("line.qty", types.MustMakeDocument("$gte", int32(2)))),
+			expected:     order(item("a", 1), item("b", 0), item("c", 0)),
+		},
+		{
+			name:         "filtered values",
+			update:       types.MustMakeDocument("$set", types.MustMakeDocument("tags.$[tag]", "old")),
+			arrayFilters: types.MustNewArray(types.MustMakeDocument("tag", "new")),
+			expected:     types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray(item("a", 1), item("b", 2), item("c", 3)), "tags", types.MustNewArray("old", "paid")),
+		},
+		{
+			name:         "filtered elements with array operator",
+			update:       types.MustMakeDocument("$unset", types.MustMakeDocument("items.$[line].qty", "")),
+			arrayFilters: types.MustNewArray(types.MustMakeDocument("line.sku", types.MustMakeDocument("$in", types.MustNewArray("a", "c")))),
+			expected:     order(types.MustMakeDocument("sku", "a"), item("b", 2), types.MustMakeDocument("sku", "c")),
+		},
+		{
+			name:   "all elements of a missing array",
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("lines.$[].qty", int32(1))),
+			err:    "BadValue (2): The path 'lines' must exist in the document in order to apply array updates.",
+		},
+		{
+			name:   "all elements of a document",
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("items.0.$[]", int32(1))),
+			err:    "BadValue (2): Cannot apply array updates to non-array element items.0 of type object",
+		},
+		{
+			name:   "missing array filter",
+			update: types.MustMakeDocument("$set", types.MustMakeDocument("items.$[line].qty", int32(0))),
+			err:    "BadValue (2): No array filter found for identifier 'line' in path 'items.$[line].qty'",
+		},
+		{
+			name:   "rename",
+			update: types.MustMakeDocument("$rename", types.MustMakeDocument("items.$[].qty", "amount")),
+			err:    "BadValue (2): The source field for $rename may not be dynamic: items.$[].qty",
+		},
+	}
+
+	for _, tc := range positionalTestCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			doc := order(item("a", 1), item("b", 2), item("c", 3))
+			actual, _, err := ApplyUpdate(doc, tc.update, tc.filter, tc.arrayFilters)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestCheckArrayFilters(t *testing.T) {
+	t.Parallel()
+
+	update := types.MustMakeDocument("$set", types.MustMakeDocument("items.$[line].qty", int32(0)))
+
+	err := CheckArrayFilters(update, types.MustNewArray(types.MustMakeDocument("line.qty", int32(1))))
+	assert.NoError(t, err)
+
+	err = CheckArrayFilters(update, nil)
+	assert.EqualError(t, err, "BadValue (2): No array filter found for identifier 'line' in path 'items.$[line].qty'")
+
+	err = CheckArrayFilters(update, types.MustNewArray(types.MustMakeDocument("line.qty", int32(1)), types.MustMakeDocument("other", int32(1))))
+	assert.EqualError(t, err, "FailedToParse (9): The array filter for identifier 'other' was not used in the update")
+
+	err = CheckArrayFilters(update, types.MustNewArray(types.MustMakeDocument("line.qty", int32(1), "Other", int32(1))))
+	assert.Error(t, err)
+
+	err = CheckArrayFilters(update, types.MustNewArray(types.MustMakeDocument("$or", types.MustNewArray(types.MustMakeDocument("line.qty", int32(1)), types.MustMakeDocument("line.sku", "a")))))
+	assert.NoError(t, err)
+
+	err = CheckArrayFilters(update, types.MustNewArray(types.MustMakeDocument("Line", int32(1))))
+	assert.EqualError(t, err, "BadValue (2): Error parsing array filter :: caused by :: The top-level field name must be an alphanumeric string beginning with a lowercase letter, found 'Line'")
+}
@@ -0,0 +1,303 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// Project is a $project stage of an aggregation pipeline. Besides including and excluding
+// fields it can compute new fields with expressions.
+type Project struct {
+	spec      types.Document
+	exclusion bool
+}
+
+// NewProject validates the specification of a $project stage.
+func NewProject(spec any) (*Project, error) {
+	doc, ok := spec.(types.Document)
+	if !ok {
+		return nil, NewErrorMessage(ErrBadValue, "$project specification must be an object")
+	}
+	if len(doc.Keys()) == 0 {
+		return nil, NewErrorMessage(ErrBadValue, "$project requires at least one output field")
+	}
+
+	var inclusion, exclusion bool
+	for _, k := range doc.Keys() {
+		v := doc.Map()[k]
+
+		if strings.Contains(k, ".") {
+			return nil, NewErrorMessage(ErrNotImplemented, "Projection on nested documents is not implemented, yet.")
+		}
+
+		if nested, ok := v.(types.Document); ok && (len(nested.Keys()) == 0 || !strings.HasPrefix(nested.Keys()[0], "$")) {
+			return nil, NewErrorMessage(ErrNotImplemented, "Projection on nested documents is not implemented, yet.")
+		}
+
+		flag, isFlag := projectionFlag(v)
+		switch {
+		case isFlag && !flag && k == "_id":
+			// _id can be excluded in an inclusion
+		case isFlag && !flag:
+			if inclusion {
+				return nil, NewErrorMessage(ErrProjectionExIn, "Cannot do exclusion on field %s in inclusion projection", k)
+			}
+			exclusion = true
+		default:
+			if exclusion {
+				return nil, NewErrorMessage(ErrProjectionInEx, "Cannot do inclusion on field %s in exclusion projection", k)
+			}
+			inclusion = true
+		}
+	}
+
+	return &Project{spec: doc, exclusion: !inclusion}, nil
+}
+
+// Spec returns the specification of the stage.
+func (p *Project) Spec() types.Document {
+	return p.spec
+}
+
+// SQL returns the projection of the SQL statement for the stage. An exclusion is performed
+// after the documents are read. It returns false if an expression can not be expressed in SQL.
+func (p *Project) SQL() (sql string, exclusion bool, ok bool) {
+	if p.exclusion {
+		return "*", true, true
+	}
+
+	var fields []string
+	if v, ok := p.spec.Map()["_id"]; !ok {
+		fields = append(fields, "\"_id\": \"_id\"")
+	} else if flag, isFlag := projectionFlag(v); !isFlag || flag {
+		// _id is always the first field
+		value, ok := p.fieldSQL("_id")
+		if !ok {
+			return "", false, false
+		}
+		fields = append(fields, value)
+	}
+
+	for _, k := range p.spec.Keys() {
+		if k == "_id" {
+			continue
+		}
+
+		value, ok := p.fieldSQL(k)
+		if !ok {
+			return "", false, false
+		}
+		fields = append(fields, value)
+	}
+
+	if len(fields) == 0 {
+		return "{}", false, true
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}", false, true
+}
+
+// fieldSQL returns the SQL of a single field of an inclusion.
+func (p *Project) fieldSQL(k string) (string, bool) {
+	if !isSQLName(k) {
+		return "", false
+	}
+
+	v := p.spec.Map()[k]
+	if _, isFlag := projectionFlag(v); isFlag {
+		return fmt.Sprintf("\"%s\": \"%s\"", k, k), true
+	}
+
+	value, ok := CompileExpression(v)
+	if !ok {
+		return "", false
+	}
+
+	return fmt.Sprintf("\"%s\": %s", k, value), true
+}
+
+// Documents performs the projection in memory.
+func (p *Project) Documents(docs []types.Document) ([]types.Document, error) {
+	if p.exclusion {
+		array := types.MakeArray(len(docs))
+		for _, doc := range docs {
+			if err := array.Append(doc); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+
+		if err := ProjectDocuments(array, p.spec, types.Document{}); err != nil {
+			return nil, err
+		}
+
+		res := make([]types.Document, len(docs))
+		for i := range res {
+			doc, err := array.Get(i)
+			if err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+			res[i] = doc.(types.Document)
+		}
+		return res, nil
+	}
+
+	res := make([]types.Document, len(docs))
+	for i, doc := range docs {
+		projected, err := p.projectDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = projected
+	}
+
+	return res, nil
+}
+
+// projectDocument returns a new document with _id, the included fields in the order of the
+// document and the computed fields in the order of the specification.
+func (p *Project) projectDocument(doc types.Document) (types.Document, error) {
+	res := types.MustMakeDocument()
+
+	set := func(k string, v any) error {
+		if IsMissing(v) {
+			return nil
+		}
+		if err := res.Set(k, v); err != nil {
+			return lazyerrors.Error(err)
+		}
+		return nil
+	}
+
+	idSpec, hasID := p.spec.Map()["_id"]
+	if flag, isFlag := projectionFlag(idSpec); !hasID || (isFlag && flag) {
+		if err := set("_id", documentPathValue(doc, []string{"_id"})); err != nil {
+			return res, err
+		}
+	} else if !isFlag {
+		v, err := EvaluateExpression(doc, idSpec)
+		if err != nil {
+			return res, err
+		}
+		if err = set("_id", v); err != nil {
+			return res, err
+		}
+	}
+
+	for _, k := range doc.Keys() {
+		if k == "_id" {
+			continue
+		}
+		if flag, isFlag := projectionFlag(p.spec.Map()[k]); isFlag && flag {
+			if err := set(k, doc.Map()[k]); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	for _, k := range p.spec.Keys() {
+		v := p.spec.Map()[k]
+		if _, isFlag := projectionFlag(v); isFlag || k == "_id" {
+			continue
+		}
+
+		v, err := EvaluateExpression(doc, v)
+		if err != nil {
+			return res, err
+		}
+		if err = set(k, v); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// projectionFlag returns the value of an inclusion or exclusion flag like true or 0.
+// It returns false as second value if the value is an expression.
+func projectionFlag(value any) (flag bool, isFlag bool) {
+	switch value.(type) {
+	case bool, int32, int64, float64:
+		return isTrue(value), true
+	default:
+		return false, false
+	}
+}
+
+// AddFields is an $addFields or $set stage of an aggregation pipeline.
+type AddFields struct {
+	fields types.Document
+}
+
+// NewAddFields validates the specification of an $addFields or $set stage.
+func NewAddFields(name string, spec any) (*AddFields, error) {
+	doc, ok := spec.(types.Document)
+	if !ok {
+		return nil, NewErrorMessage(ErrBadValue, "%s specification stage must be an object, got %T", name, spec)
+	}
+
+	for _, k := range doc.Keys() {
+		if k == "" || strings.HasPrefix(k, "$") {
+			return nil, NewErrorMessage(ErrBadValue, "Invalid %s :: caused by :: FieldPath field names may not start with '$'", name)
+		}
+	}
+
+	return &AddFields{fields: doc}, nil
+}
+
+// Documents adds the fields to copies of the documents. All expressions are evaluated on the input document.
+func (a *AddFields) Documents(docs []types.Document) ([]types.Document, error) {
+	res := make([]types.Document, len(docs))
+	for i, doc := range docs {
+		values := make([]any, len(a.fields.Keys()))
+		for j, k := range a.fields.Keys() {
+			v, err := EvaluateExpression(doc, a.fields.Map()[k])
+			if err != nil {
+				return nil, err
+			}
+			values[j] = v
+		}
+
+		res[i] = doc
+		for j, k := range a.fields.Keys() {
+			path := strings.Split(k, ".")
+			if IsMissing(values[j]) {
+				// the field is removed like with $$REMOVE
+				if _, ok := documentPathValue(res[i], path).(missingType); ok {
+					continue
+				}
+			}
+
+			updated, err := withAddedField(res[i], path, values[j])
+			if err != nil {
+				return nil, err
+			}
+			res[i] = updated
+		}
+	}
+
+	return res, nil
+}
+
+// withAddedField returns a copy of the document with the value at the path.
+// Embedded documents which do not exist, or are no documents, are created.
+func withAddedField(doc types.Document, path []string, value any) (types.Document, error) {
+	if len(path) > 1 {
+		if _, ok := doc.Map()[path[0]].(types.Document); !ok {
+			next := types.MustMakeDocument()
+			copied, err := withPathValue(doc, path[:1], next)
+			if err != nil {
+				return copied, err
+			}
+			doc = copied
+		}
+	}
+
+	return withPathValue(doc, path, value)
+}
@@ -21,6 +21,7 @@
 package common
 
 import (
+	"math"
 	"strconv"
 	"strings"
 
@@ -29,14 +30,12 @@ import (
 )
 
 // Projection checks if projection is an inclusion or exclusion.
-// If inclusion then the sql needed to perform inclusion is created.
-// If exclusion then the removal of fields will first happen after retrieval of documents.
+// If it is an inclusion of top-level fields then the sql needed to perform inclusion is created.
+// Any other projection, i.e. an exclusion, a dotted path, a projection operator or an expression,
+// is performed in memory with ProjectDocuments after retrieval of documents, which is returned as exclusion.
 func Projection(projection types.Document) (sql string, exclusion bool, err error) {
 	unimplementedFields := []string{
-		"$",
-		"$elemMatch",
 		"$meta",
-		"$slice",
 		"$comment",
 		"$rand",
 	}
@@ -56,7 +55,7 @@ func Projection(projection types.Document) (sql string, exclusion bool, err erro
 		return
 	}
 
-	if inclusion {
+	if inclusion && isSQLProjection(projection) {
 		sql = inclusionProjection(projection)
 		return
 	} else {
@@ -66,76 +65,132 @@ func Projection(projection types.Document) (sql string, exclusion bool, err erro
 	}
 }
 
-// isProjectionInclusion determines whether projection is inclusion or exclusion.
+// isSQLProjection returns true if the projection only includes top-level fields.
+func isSQLProjection(projection types.Document) bool {
+	for _, k := range projection.Keys() {
+		if _, isFlag := projectionFlag(projection.Map()[k]); !isFlag || strings.Contains(k, ".") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isProjectionInclusion determines whether projection is inclusion or exclusion. The positional $ projection,
+// $elemMatch and expressions are inclusions, $slice is neither an inclusion nor an exclusion.
 func isProjectionInclusion(projection types.Document) (inclusion bool, err error) {
-	var exclusion bool
+	projection, err = flattenProjection(projection)
+	if err != nil {
+		return
+	}
+
+	var exclusion, positional bool
 	for _, k := range projection.Keys() {
-		if k == "_id" { // _id is a special case where mixing exclusion and inclusion is allowed
-			var v any
-			v, err = projection.Get(k)
-			switch v := v.(type) {
-			case bool, int32, int64, float64:
-				if len(projection.Map()) != 1 {
-					continue
-				}
-			default:
-				err = lazyerrors.Errorf("unsupported operation %s %v (%T)", k, v, v)
+		v := projection.Map()[k]
+		if k == "" || strings.HasPrefix(k, "$") {
+			err = NewErrorMessage(ErrBadValue, "FieldPath field names may not start with '$'. Found: %s", k)
+			return
+		}
+
+		if strings.HasSuffix(k, ".$") {
+			if positional {
+				err = NewErrorMessage(ErrBadValue, "Cannot specify more than one positional proj. per query.")
+				return
+			}
+			if flag, isFlag := projectionFlag(v); !isFlag || !flag {
+				err = NewErrorMessage(ErrBadValue, "Cannot exclude array elements with the positional operator.")
 				return
 			}
+			positional = true
 		}
 
-		var v any
-		v, err = projection.Get(k)
-		if err != nil {
-			err = lazyerrors.Errorf("no value for %s.", k)
+		switch projectionOperator(v) {
+		case "$slice":
+			if _, _, err = sliceArguments(v.(types.Document).Map()["$slice"]); err != nil {
+				return
+			}
+			continue
+
+		case "$elemMatch":
+			if strings.Contains(k, ".") {
+				err = NewErrorMessage(ErrBadValue, "Cannot use $elemMatch projection on a nested field.")
+				return
+			}
+			if _, ok := v.(types.Document).Map()["$elemMatch"].(types.Document); !ok {
+				err = NewErrorMessage(ErrBadValue, "elemMatch: Invalid argument, object required, but got %T", v.(types.Document).Map()["$elemMatch"])
+				return
+			}
+		}
+
+		flag, isFlag := projectionFlag(v)
+		if k == "_id" && isFlag && len(projection.Keys()) != 1 {
+			// _id is a special case where mixing exclusion and inclusion is allowed
+			continue
+		}
+
+		if isFlag && !flag {
+			if inclusion {
+				err = NewErrorMessage(ErrProjectionExIn, "Cannot do exclusion on field %s in inclusion projection", k)
+				return
+			}
+			exclusion = true
+			continue
+		}
+
+		if exclusion {
+			err = NewErrorMessage(ErrProjectionInEx, "Cannot do inclusion on field %s in exclusion projection", k)
 			return
 		}
-		switch v := v.(type) {
-		case bool:
-			if v {
-				if exclusion {
-					err = NewErrorMessage(ErrProjectionInEx, "Cannot do inclusion on field %s in exclusion projection", k)
-					return
-				}
-				if strings.Contains(k, ".") {
-					err = lazyerrors.Errorf("Projection on nested documents is not implemented, yet.")
-					return
-				}
-				inclusion = true
-			} else {
-				if inclusion {
-					err = NewErrorMessage(ErrProjectionExIn, "Cannot do exclusion on field %s in inclusion projection", k)
-					return
-				}
-				exclusion = true
+		inclusion = true
+	}
+	return
+}
+
+// flattenProjection returns the projection with the fields of embedded documents like {a: {b: 1}} as
+// dotted paths like {"a.b": 1}. Projection operators and expressions like {a: {$slice: 1}} are kept.
+func flattenProjection(projection types.Document) (types.Document, error) {
+	res := types.MustMakeDocument()
+	for _, k := range projection.Keys() {
+		v := projection.Map()[k]
+		if nested, ok := v.(types.Document); ok && (len(nested.Keys()) == 0 || !strings.HasPrefix(nested.Keys()[0], "$")) {
+			if len(nested.Keys()) == 0 {
+				return res, NewErrorMessage(ErrBadValue, "An empty sub-projection is not a valid value. Found empty object at path %s", k)
 			}
 
-		case int32, int64, float64:
-			var equal types.CompareResult
-			equal = 0
-			if types.CompareScalars(v, int32(0)) == equal {
-				if inclusion {
-					err = NewErrorMessage(ErrProjectionExIn, "Cannot do exclusion on field %s in inclusion projection", k)
-					return
-				}
-				exclusion = true
-			} else {
-				if exclusion {
-					err = NewErrorMessage(ErrProjectionInEx, "Cannot do inclusion on field %s in exclusion projection", k)
-					return
-				}
-				if strings.Contains(k, ".") {
-					err = lazyerrors.Errorf("Projection on nested documents is not implemented, yet.")
-					return
+			flat, err := flattenProjection(nested)
+			if err != nil {
+				return res, err
+			}
+
+			for _, nk := range flat.Keys() {
+				if err = res.Set(k+"."+nk, flat.Map()[nk]); err != nil {
+					return res, lazyerrors.Error(err)
 				}
-				inclusion = true
 			}
-		default:
-			err = lazyerrors.Errorf("Only $set and $unset are supported for update operations")
-			return
+			continue
+		}
+
+		if err := res.Set(k, v); err != nil {
+			return res, lazyerrors.Error(err)
 		}
 	}
-	return
+
+	return res, nil
+}
+
+// projectionOperator returns $slice or $elemMatch if the value is one of these projection operators.
+func projectionOperator(value any) string {
+	doc, ok := value.(types.Document)
+	if !ok || len(doc.Keys()) != 1 {
+		return ""
+	}
+
+	switch op := doc.Keys()[0]; op {
+	case "$slice", "$elemMatch":
+		return op
+	default:
+		return ""
+	}
 }
 
 // inclusionProjection prepares the SQL statement for inclusion. This is using the json projection.
@@ -152,8 +207,6 @@ func inclusionProjection(projection types.Document) (sql string) {
 				sql += "\"_id\": \"_id\", "
 			}
 		case int32, int64, float64:
-			var equal types.CompareResult
-			equal = 0
 			if types.CompareScalars(id, int32(0)) != equal {
 				if len(projection.Map()) == 1 {
 					sql += "\"_id\": \"_id\"}"
@@ -192,8 +245,20 @@ func inclusionProjection(projection types.Document) (sql string) {
 }
 
 // ProjectDocuments will be used if it is an exclusion to performs the exclusion
-// on each document together with the function projectDocument.
-func ProjectDocuments(docs *types.Array, projection types.Document) (err error) {
+// on each document together with the function projectDocument. An inclusion is
+// only performed in memory for documents which were not selected with the projection SQL,
+// for instance a projection of dotted paths or with projection operators. The filter
+// is needed for the positional $ projection.
+func ProjectDocuments(docs *types.Array, projection types.Document, filter types.Document) (err error) {
+	inclusion, err := isProjectionInclusion(projection)
+	if err != nil {
+		return
+	}
+
+	if projection, err = flattenProjection(projection); err != nil {
+		return
+	}
+
 	for i := 0; i < docs.Len(); i++ {
 		doc, errGet := docs.GetPointer(i)
 		if errGet != nil {
@@ -201,7 +266,14 @@ func ProjectDocuments(docs *types.Array, projection types.Document) (err error)
 		}
 		switch docv := (*doc).(type) {
 		case types.Document:
-			err = projectDocument(&docv, projection)
+			if inclusion {
+				docv, err = includeFields(docv, projection, filter)
+			} else {
+				err = projectDocument(&docv, projection)
+			}
+			if err == nil {
+				err = sliceFields(&docv, projection)
+			}
 			*doc = docv
 		default:
 			err = lazyerrors.Errorf("Array of retrieved documents contains a type not being types.Document")
@@ -217,77 +289,13 @@ func ProjectDocuments(docs *types.Array, projection types.Document) (err error)
 func projectDocument(doc *types.Document, projection types.Document) (err error) {
 	projectionMap := projection.Map()
 	for field := range projectionMap {
-		if strings.Contains(field, ".") {
-			var next any = doc
-			var previousS string
-			var previousDoc types.Document
-			var previousArray *types.Array
-			var ppDoc types.Document
-			var ppS string
-			var notFound bool
-			var projErr error
-			arrayCount := 0
-		forLoop:
-			for _, s := range strings.Split(field, ".") {
-				switch j := next.(type) {
-				case *types.Document:
-					previousDoc = *j
-					previousS = s
-					next, projErr = j.Get(s)
-					if projErr != nil || next == nil {
-						notFound = true
-						break forLoop
-					}
-				case types.Document:
-					ppDoc = previousDoc
-					ppS = previousS
-					previousS = s
-					previousDoc = j
-					next, projErr = j.Get(s)
-					if projErr != nil || next == nil {
-						notFound = true
-						break forLoop
-					}
-					if arrayCount > 0 {
-						arrayCount--
-					}
-				case *types.Array:
-					ppDoc = previousDoc
-					ppS = previousS
-					previousS = s
-					previousArray = j
-					if sInt, convErr := strconv.Atoi(s); convErr == nil {
-						next, projErr = j.Get(sInt)
-					} else {
-						notFound = true
-						break forLoop
-					}
-
-					if projErr != nil {
-						notFound = true
-						break forLoop
-					}
-					arrayCount = 2
-				default:
-					notFound = true
-					continue
-				}
-			}
-			if notFound {
-				continue
-			}
-			if arrayCount == 0 {
-				previousDoc.Remove(previousS)
-				ppDoc.Set(ppS, previousDoc)
-			} else if arrayCount == 1 {
-				previousDoc.Remove(previousS)
-				sInt, _ := strconv.Atoi(ppS)
-				previousArray.Set(sInt, previousDoc)
-			} else if arrayCount == 2 {
-				sInt, _ := strconv.Atoi(previousS)
-				previousArray.Delete(sInt)
-			}
+		if _, isFlag := projectionFlag(projectionMap[field]); !isFlag {
+			// projection operators like $slice do not exclude the field
+			continue
+		}
 
+		if strings.Contains(field, ".") {
+			*doc = excludePath(*doc, strings.Split(field, ".")).(types.Document)
 		} else {
 			if field == "_id" {
 				idExclusion := projectionMap[field]
@@ -298,8 +306,6 @@ func projectDocument(doc *types.Document, projection types.Document) (err error)
 					}
 					continue
 				case int32, int64, float64:
-					var equal types.CompareResult
-					equal = 0
 					if types.CompareScalars(idExclusion, int32(0)) == equal {
 						doc.Remove(field)
 					}
@@ -312,3 +318,394 @@ func projectDocument(doc *types.Document, projection types.Document) (err error)
 
 	return nil
 }
+
+// excludePath removes the field at the path from a value. A numeric part of the path removes the
+// element of an array, any other part is removed from all embedded documents of an array.
+func excludePath(value any, path []string) any {
+	switch value := value.(type) {
+	case types.Document:
+		next, err := value.Get(path[0])
+		if err != nil {
+			return value
+		}
+
+		if len(path) == 1 {
+			value.Remove(path[0])
+			return value
+		}
+
+		_ = value.Set(path[0], excludePath(next, path[1:]))
+		return value
+
+	case *types.Array:
+		if index, err := strconv.Atoi(path[0]); err == nil {
+			element, err := value.Get(index)
+			if err != nil {
+				return value
+			}
+
+			if len(path) == 1 {
+				_ = value.Delete(index)
+				return value
+			}
+
+			_ = value.Set(index, excludePath(element, path[1:]))
+			return value
+		}
+
+		for i, element := range arrayValues(value) {
+			if doc, ok := element.(types.Document); ok {
+				_ = value.Set(i, excludePath(doc, path))
+			}
+		}
+		return value
+
+	default:
+		return value
+	}
+}
+
+// includeFields returns a new document only containing the fields of the inclusion and _id, unless _id is
+// excluded. The fields keep the order of the document, computed fields follow in the order of the projection.
+func includeFields(doc types.Document, projection types.Document, filter types.Document) (types.Document, error) {
+	tree := projectionTree{}
+	if _, ok := projection.Map()["_id"]; !ok {
+		tree.add([]string{"_id"})
+	}
+
+	for _, k := range projection.Keys() {
+		v := projection.Map()[k]
+		if flag, isFlag := projectionFlag(v); (isFlag && flag) || projectionOperator(v) != "" {
+			tree.add(strings.Split(strings.TrimSuffix(k, ".$"), "."))
+		}
+	}
+
+	included, err := tree.include(doc)
+	if err != nil {
+		return types.Document{}, err
+	}
+	res := included.(types.Document)
+
+	for _, k := range projection.Keys() {
+		v := projection.Map()[k]
+		path := strings.TrimSuffix(k, ".$")
+
+		var value any
+		switch _, isFlag := projectionFlag(v); {
+		case path != k:
+			value, err = positionalElement(doc, path, filter)
+		case projectionOperator(v) == "$elemMatch":
+			value, err = elemMatchElement(doc, k, v.(types.Document).Map()["$elemMatch"])
+		case projectionOperator(v) == "" && !isFlag:
+			value, err = EvaluateExpression(doc, v)
+		default:
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+
+		if res, err = withAddedField(res, strings.Split(path, "."), value); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// projectionTree is the tree of the paths of an inclusion. A nil subtree includes the whole field.
+type projectionTree map[string]projectionTree
+
+// add adds the path to the tree.
+func (t projectionTree) add(path []string) {
+	sub, ok := t[path[0]]
+	switch {
+	case len(path) == 1:
+		t[path[0]] = nil
+		return
+	case ok && sub == nil:
+		// the whole field is included already
+		return
+	case !ok:
+		sub = projectionTree{}
+		t[path[0]] = sub
+	}
+
+	sub.add(path[1:])
+}
+
+// include returns the included parts of the value. Like in MongoDB the included fields are taken from
+// all embedded documents of an array and other elements of the array are removed. It returns missing
+// if the value neither is a document nor an array.
+func (t projectionTree) include(value any) (any, error) {
+	switch value := value.(type) {
+	case types.Document:
+		res := types.MustMakeDocument()
+		for _, k := range value.Keys() {
+			sub, ok := t[k]
+			if !ok {
+				continue
+			}
+
+			v := value.Map()[k]
+			if sub != nil {
+				var err error
+				if v, err = sub.include(v); err != nil {
+					return nil, err
+				}
+				if IsMissing(v) {
+					continue
+				}
+			}
+
+			if err := res.Set(k, v); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		return res, nil
+
+	case *types.Array:
+		res := types.MakeArray(value.Len())
+		for _, element := range arrayValues(value) {
+			element, err := t.include(element)
+			if err != nil {
+				return nil, err
+			}
+			if IsMissing(element) {
+				continue
+			}
+
+			if err = res.Append(element); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		return res, nil
+
+	default:
+		return missing, nil
+	}
+}
+
+// positionalElement returns the first element of the array at the path matching the conditions of the filter on
+// the array like the positional $ projection of MongoDB. The element is returned as an array with a single element.
+func positionalElement(doc types.Document, path string, filter types.Document) (any, error) {
+	index, err := positionalIndex(doc, path, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if index < 0 {
+		return nil, NewErrorMessage(ErrBadValue, "Executor error during find command :: caused by :: positional operator '.$' couldn't find a matching element in the array")
+	}
+
+	element, err := documentPathValue(doc, strings.Split(path, ".")).(*types.Array).Get(index)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return types.MustNewArray(element), nil
+}
+
+// positionalIndex returns the index of the first element of the array at the path matching the conditions of the
+// filter on the array. It returns -1 if there is no array or no condition on it or if no element matches.
+func positionalIndex(doc types.Document, path string, filter types.Document) (int, error) {
+	conditions := arrayConditions(filter, path)
+	keys := strings.Split(path, ".")
+
+	array, ok := documentPathValue(doc, keys).(*types.Array)
+	if !ok || len(conditions) == 0 {
+		return -1, nil
+	}
+
+elements:
+	for i, element := range arrayValues(array) {
+		candidate, err := withPathValue(doc, keys, types.MustNewArray(element))
+		if err != nil {
+			return -1, err
+		}
+
+		for _, condition := range conditions {
+			matches, err := MatchDocument(candidate, condition)
+			if err != nil {
+				return -1, err
+			}
+			if !matches {
+				continue elements
+			}
+		}
+
+		return i, nil
+	}
+
+	return -1, nil
+}
+
+// arrayConditions returns the conditions of the filter on the field at the path or on fields within it.
+// Conditions within $and are included.
+func arrayConditions(filter types.Document, path string) []types.Document {
+	var conditions []types.Document
+	for _, k := range filter.Keys() {
+		v := filter.Map()[k]
+		switch {
+		case k == "$and":
+			and, ok := v.(*types.Array)
+			if !ok {
+				continue
+			}
+
+			for _, condition := range arrayValues(and) {
+				if condition, ok := condition.(types.Document); ok {
+					conditions = append(conditions, arrayConditions(condition, path)...)
+				}
+			}
+		case k == path || strings.HasPrefix(k, path+"."):
+			conditions = append(conditions, types.MustMakeDocument(k, v))
+		}
+	}
+
+	return conditions
+}
+
+// elemMatchElement returns the first element of the array field matching the condition as an array with a single
+// element. It returns missing if no element matches.
+func elemMatchElement(doc types.Document, field string, condition any) (any, error) {
+	array, ok := doc.Map()[field].(*types.Array)
+	if !ok {
+		return missing, nil
+	}
+
+	filter := types.MustMakeDocument(field, types.MustMakeDocument("$elemMatch", condition))
+	for _, element := range arrayValues(array) {
+		matches, err := MatchDocument(types.MustMakeDocument(field, types.MustNewArray(element)), filter)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			return types.MustNewArray(element), nil
+		}
+	}
+
+	return missing, nil
+}
+
+// sliceFields applies the $slice projections to the document.
+func sliceFields(doc *types.Document, projection types.Document) error {
+	for _, k := range projection.Keys() {
+		v := projection.Map()[k]
+		if projectionOperator(v) != "$slice" {
+			continue
+		}
+
+		skip, limit, err := sliceArguments(v.(types.Document).Map()["$slice"])
+		if err != nil {
+			return err
+		}
+
+		*doc = slicePath(*doc, strings.Split(k, "."), skip, limit).(types.Document)
+	}
+
+	return nil
+}
+
+// sliceArguments returns the number of elements to skip and the limit of $slice, which is a number or an array
+// [skip, limit]. A negative number returns the last elements of the array and a negative skip counts from the end.
+func sliceArguments(value any) (skip, limit int64, err error) {
+	array, ok := value.(*types.Array)
+	if !ok {
+		n, ok := sliceNumber(value)
+		if !ok {
+			return 0, 0, NewErrorMessage(ErrBadValue, "$slice only supports numbers and [skip, limit] arrays")
+		}
+		if n < 0 {
+			return n, -n, nil
+		}
+		return 0, n, nil
+	}
+
+	if array.Len() != 2 {
+		return 0, 0, NewErrorMessage(ErrBadValue, "$slice array wrong size")
+	}
+
+	values := arrayValues(array)
+	skip, skipOk := sliceNumber(values[0])
+	limit, limitOk := sliceNumber(values[1])
+	if !skipOk || !limitOk {
+		return 0, 0, NewErrorMessage(ErrBadValue, "$slice array argument must be of the form [skip, limit] with numbers")
+	}
+	if limit <= 0 {
+		return 0, 0, NewErrorMessage(ErrBadValue, "$slice limit must be positive")
+	}
+
+	return skip, limit, nil
+}
+
+// sliceNumber returns the value of an integral number of $slice.
+func sliceNumber(value any) (int64, bool) {
+	switch value := value.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		return int64(value), value == math.Trunc(value) && !math.IsInf(value, 0)
+	default:
+		return 0, false
+	}
+}
+
+// slicePath replaces the array at the path of the value with its slice. Like excludePath any part of the path
+// is applied to all embedded documents of an array.
+func slicePath(value any, path []string, skip, limit int64) any {
+	switch value := value.(type) {
+	case types.Document:
+		next, err := value.Get(path[0])
+		if err != nil {
+			return value
+		}
+
+		if len(path) == 1 {
+			if array, ok := next.(*types.Array); ok {
+				_ = value.Set(path[0], sliceArray(array, skip, limit))
+			}
+			return value
+		}
+
+		_ = value.Set(path[0], slicePath(next, path[1:], skip, limit))
+		return value
+
+	case *types.Array:
+		for i, element := range arrayValues(value) {
+			if doc, ok := element.(types.Document); ok {
+				_ = value.Set(i, slicePath(doc, path, skip, limit))
+			}
+		}
+		return value
+
+	default:
+		return value
+	}
+}
+
+// sliceArray returns at most limit elements of the array after skipping the given number of elements.
+func sliceArray(array *types.Array, skip, limit int64) *types.Array {
+	values := arrayValues(array)
+	n := int64(len(values))
+
+	start := skip
+	if start < 0 {
+		start += n
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > n {
+		start = n
+	}
+
+	end := start + limit
+	if end > n {
+		end = n
+	}
+
+	return types.MustNewArray(values[start:end]...)
+}
@@ -6,6 +6,7 @@ package common
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -33,8 +34,12 @@ func TestProjection(t *testing.T) {
 			e: expected{sql: "*", exclusion: true, err: nil},
 		},
 		{
-			name: "inclusion nested document error test", r: types.MustMakeDocument("field.nest", true),
-			e: expected{sql: "", exclusion: false, err: fmt.Errorf("Projection on nested documents is not implemented, yet.")},
+			name: "inclusion nested document in memory test", r: types.MustMakeDocument("field.nest", true),
+			e: expected{sql: "*", exclusion: true, err: nil},
+		},
+		{
+			name: "projection operator in memory test", r: types.MustMakeDocument("field", true, "array", types.MustMakeDocument("$slice", int32(2))),
+			e: expected{sql: "*", exclusion: true, err: nil},
 		},
 		{
 			name: "empty projection document test", r: types.MustMakeDocument(),
@@ -45,8 +50,16 @@ func TestProjection(t *testing.T) {
 			e: expected{sql: "{\"_id\": \"_id\", \"field\": \"field\"}", exclusion: false, err: nil},
 		},
 		{
-			name: "unimplemented operation error test", r: types.MustMakeDocument("$elemMatch", true),
-			e: expected{sql: "", exclusion: false, err: fmt.Errorf("NotImplemented (238): $elemMatch: support for field \"$elemMatch\" is not implemented yet")},
+			name: "unimplemented operation error test", r: types.MustMakeDocument("$meta", true),
+			e: expected{sql: "", exclusion: false, err: fmt.Errorf("NotImplemented (238): $meta: support for field \"$meta\" is not implemented yet")},
+		},
+		{
+			name: "positional exclusion error test", r: types.MustMakeDocument("array.$", false),
+			e: expected{sql: "", exclusion: false, err: fmt.Errorf("BadValue (2): Cannot exclude array elements with the positional operator.")},
+		},
+		{
+			name: "slice limit error test", r: types.MustMakeDocument("array", types.MustMakeDocument("$slice", types.MustNewArray(int32(1), int32(0)))),
+			e: expected{sql: "", exclusion: false, err: fmt.Errorf("BadValue (2): $slice limit must be positive")},
 		},
 	}
 
@@ -93,8 +106,20 @@ func TestIsProjectionInclusion(t *testing.T) {
 			e: expected{inclusion: true, err: nil},
 		},
 		{
-			name: "inclusion nested document error test", r: types.MustMakeDocument("field.nest", int32(1)),
-			e: expected{inclusion: false, err: fmt.Errorf("Projection on nested documents is not implemented, yet.")},
+			name: "inclusion nested document test", r: types.MustMakeDocument("field", types.MustMakeDocument("nest", int32(1))),
+			e: expected{inclusion: true, err: nil},
+		},
+		{
+			name: "exclusion with slice test", r: types.MustMakeDocument("field", int32(0), "array", types.MustMakeDocument("$slice", int32(-1))),
+			e: expected{inclusion: false, err: nil},
+		},
+		{
+			name: "inclusion with expression test", r: types.MustMakeDocument("total", types.MustMakeDocument("$add", types.MustNewArray("$a", "$b"))),
+			e: expected{inclusion: true, err: nil},
+		},
+		{
+			name: "expression in exclusion error test", r: types.MustMakeDocument("field", int32(0), "total", "$a"),
+			e: expected{inclusion: false, err: fmt.Errorf("Cannot do inclusion on field total in exclusion projection")},
 		},
 	}
 
@@ -184,7 +209,7 @@ func TestProjectDocuments(t *testing.T) {
 	}
 
 	for _, field := range projectDocumentsTestCases {
-		err := ProjectDocuments(field.r1, field.r2)
+		err := ProjectDocuments(field.r1, field.r2, types.MustMakeDocument())
 		gotDoc, docErr := field.r1.Get(0)
 		if docErr != nil {
 			t.Error(docErr)
@@ -273,3 +298,124 @@ outer_loop:
 		}
 	}
 }
+
+func TestExcludePath(t *testing.T) {
+	t.Parallel()
+
+	doc := types.MustMakeDocument("items", types.MustNewArray(
+		types.MustMakeDocument("sku", "a", "qty", int32(1)),
+		"scalar",
+		types.MustMakeDocument("qty", int32(2)),
+	))
+	expected := types.MustMakeDocument("items", types.MustNewArray(
+		types.MustMakeDocument("qty", int32(1)),
+		"scalar",
+		types.MustMakeDocument("qty", int32(2)),
+	))
+
+	if err := projectDocument(&doc, types.MustMakeDocument("items.sku", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("projectDocument FAILED. Expected %v got %v", expected, doc)
+	}
+}
+
+func TestFindProjection(t *testing.T) {
+	t.Parallel()
+
+	// the projection modifies the document, so each test case gets a new one
+	newDoc := func() types.Document {
+		return types.MustMakeDocument(
+			"_id", int32(1),
+			"name", "journal",
+			"size", types.MustMakeDocument("h", int32(14), "w", int32(21), "uom", "cm"),
+			"grades", types.MustNewArray(int32(80), int32(95), int32(87), int32(91)),
+			"items", types.MustNewArray(
+				types.MustMakeDocument("sku", "a", "qty", int32(1)),
+				"scalar",
+				types.MustMakeDocument("sku", "b", "qty", int32(5)),
+			),
+		)
+	}
+
+	projectionTestCases := []struct {
+		name       string
+		projection types.Document
+		filter     types.Document
+		expected   types.Document
+		err        string
+	}{
+		{
+			name:       "nested inclusion",
+			projection: types.MustMakeDocument("size.h", int32(1), "items", types.MustMakeDocument("qty", true)),
+			expected: types.MustMakeDocument("_id", int32(1), "size", types.MustMakeDocument("h", int32(14)), "items", types.MustNewArray(
+				types.MustMakeDocument("qty", int32(1)),
+				types.MustMakeDocument("qty", int32(5)),
+			)),
+		},
+		{
+			name:       "nested exclusion",
+			projection: types.MustMakeDocument("size", types.MustMakeDocument("uom", int32(0)), "items", int32(0), "grades", false),
+			expected:   types.MustMakeDocument("_id", int32(1), "name", "journal", "size", types.MustMakeDocument("h", int32(14), "w", int32(21))),
+		},
+		{
+			name:       "slice",
+			projection: types.MustMakeDocument("_id", int32(0), "name", int32(1), "grades", types.MustMakeDocument("$slice", int32(-2))),
+			expected:   types.MustMakeDocument("name", "journal", "grades", types.MustNewArray(int32(87), int32(91))),
+		},
+		{
+			name:       "slice with skip and limit in exclusion",
+			projection: types.MustMakeDocument("items", int32(0), "size", int32(0), "grades", types.MustMakeDocument("$slice", types.MustNewArray(int32(1), int32(2)))),
+			expected:   types.MustMakeDocument("_id", int32(1), "name", "journal", "grades", types.MustNewArray(int32(95), int32(87))),
+		},
+		{
+			name:       "elemMatch",
+			projection: types.MustMakeDocument("items", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(2))))),
+			expected:   types.MustMakeDocument("_id", int32(1), "items", types.MustNewArray(types.MustMakeDocument("sku", "b", "qty", int32(5)))),
+		},
+		{
+			name:       "elemMatch without match",
+			projection: types.MustMakeDocument("name", int32(1), "items", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("qty", int32(3)))),
+			expected:   types.MustMakeDocument("_id", int32(1), "name", "journal"),
+		},
+		{
+			name:       "positional",
+			projection: types.MustMakeDocument("grades.$", int32(1)),
+			filter:     types.MustMakeDocument("name", "journal", "grades", types.MustMakeDocument("$gte", int32(90))),
+			expected:   types.MustMakeDocument("_id", int32(1), "grades", types.MustNewArray(int32(95))),
+		},
+		{
+			name:       "positional without condition on the array",
+			projection: types.MustMakeDocument("grades.$", int32(1)),
+			filter:     types.MustMakeDocument("name", "journal"),
+			err:        "BadValue (2): Executor error during find command :: caused by :: positional operator '.$' couldn't find a matching element in the array",
+		},
+		{
+			name:       "expression",
+			projection: types.MustMakeDocument("_id", false, "name", int32(1), "area", types.MustMakeDocument("$multiply", types.MustNewArray("$size.h", "$size.w"))),
+			expected:   types.MustMakeDocument("name", "journal", "area", int32(294)),
+		},
+	}
+
+	for _, tc := range projectionTestCases {
+		docs := types.MustNewArray(newDoc())
+		err := ProjectDocuments(docs, tc.projection, tc.filter)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: ProjectDocuments FAILED. Expected error %s got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ProjectDocuments FAILED. Unexpected error %v", tc.name, err)
+			continue
+		}
+
+		got, _ := docs.Get(0)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: ProjectDocuments FAILED. Expected %v got %v", tc.name, tc.expected, got)
+		}
+	}
+}
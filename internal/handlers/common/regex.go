@@ -0,0 +1,203 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+)
+
+// regexMeta are the characters with a special meaning in a regular expression.
+const regexMeta = `\^$.|?*+()[]{}`
+
+// regex converts a regular expression of a filter to SQL. A pattern which only matches a literal
+// prefix is translated to LIKE, all other patterns to LIKE_REGEXPR with the options as flags.
+// The returned sign is the SQL operator.
+func regex(value any, options string) (vSQL string, sign string, err error) {
+	pattern, flags, err := regexPattern(value, options)
+	if err != nil {
+		return
+	}
+
+	// a pattern is only executed by SAP HANA if it can be evaluated in memory as well
+	if _, err = goRegexp(pattern, flags); err != nil {
+		return
+	}
+
+	if prefix, ok := regexPrefix(pattern, flags); ok {
+		vSQL, sign = likePrefix(prefix), " LIKE "
+		return
+	}
+
+	vSQL = "'" + strings.ReplaceAll(pattern, "'", "''") + "'"
+	if flags != "" {
+		vSQL += " FLAG '" + flags + "'"
+	}
+	sign = " LIKE_REGEXPR "
+
+	return
+}
+
+// regexPattern returns the pattern and the validated flags of a regular expression given as
+// string or as BSON regular expression. Options can either be part of the regular expression
+// or given with $options.
+func regexPattern(value any, options string) (pattern string, flags string, err error) {
+	switch value := value.(type) {
+	case string:
+		pattern = value
+	case types.Regex:
+		pattern = value.Pattern
+		if value.Options != "" {
+			if options != "" {
+				err = NewErrorMessage(ErrBadValue, "options set in both $regex and $options")
+				return
+			}
+			options = value.Options
+		}
+	default:
+		err = NewErrorMessage(ErrBadValue, "Expected either a JavaScript regular expression objects (i.e. /pattern/) or string containing a pattern. Got instead type %T", value)
+		return
+	}
+
+	if strings.ContainsRune(pattern, 0) {
+		err = NewErrorMessage(ErrRegexNullByte, "Regular expression cannot contain an embedded null byte")
+		return
+	}
+
+	// backtracking control verbs and callouts change how the pattern is executed by SAP HANA
+	for _, construct := range []string{"(*", "(?C"} {
+		if strings.Contains(pattern, construct) && !strings.Contains(pattern, `\`+construct) {
+			err = NewErrorMessage(ErrNotImplemented, "%s in regular expressions is not supported", construct)
+			return
+		}
+	}
+
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's', 'x':
+			if !strings.ContainsRune(flags, o) {
+				flags += string(o)
+			}
+		default:
+			err = NewErrorMessage(ErrRegexOptions, "invalid flag in regex options: %c", o)
+			return
+		}
+	}
+
+	return
+}
+
+// goRegexp compiles a pattern with the validated flags for the evaluation in memory. Go does not support
+// all constructs of the PCRE syntax of MongoDB and SAP HANA, like lookarounds, backreferences, atomic groups
+// and possessive quantifiers, so these patterns are rejected.
+func goRegexp(pattern, flags string) (*regexp.Regexp, error) {
+	if strings.ContainsRune(flags, 'x') {
+		pattern = extendedPattern(pattern)
+		flags = strings.ReplaceAll(flags, "x", "")
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err == nil {
+		return re, nil
+	}
+
+	var syntaxErr *syntax.Error
+	if errors.As(err, &syntaxErr) {
+		construct := syntaxErr.Expr
+
+		// Go parses a lookbehind as a named group
+		for _, lookbehind := range []string{"(?<=", "(?<!"} {
+			if strings.HasPrefix(construct, lookbehind) {
+				construct = lookbehind
+			}
+		}
+
+		switch syntaxErr.Code {
+		case syntax.ErrInvalidPerlOp, syntax.ErrInvalidNamedCapture, syntax.ErrInvalidEscape, syntax.ErrInvalidRepeatOp, syntax.ErrInvalidRepeatSize:
+			return nil, NewErrorMessage(ErrNotImplemented, "%s in regular expressions is not supported", construct)
+		}
+	}
+
+	return nil, NewErrorMessage(ErrBadValue, "invalid regular expression: %s", err)
+}
+
+// regexPrefix returns the literal prefix of a pattern like ^abc. It returns false if the pattern
+// contains anything else or the flags change how the prefix is matched.
+func regexPrefix(pattern, flags string) (string, bool) {
+	if !strings.HasPrefix(pattern, "^") || strings.ContainsAny(flags, "imx") {
+		return "", false
+	}
+
+	var prefix strings.Builder
+	var escaped bool
+	for _, r := range pattern[1:] {
+		switch {
+		case escaped:
+			// escaped letters and digits are character classes or references
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return "", false
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case strings.ContainsRune(regexMeta, r):
+			return "", false
+		}
+
+		prefix.WriteRune(r)
+	}
+
+	return prefix.String(), !escaped
+}
+
+// likePrefix returns the LIKE pattern matching all strings starting with the prefix.
+func likePrefix(prefix string) string {
+	escaped := strings.NewReplacer("^", "^^", "%", "^%", "_", "^_", "'", "''").Replace(prefix)
+	if escaped == strings.ReplaceAll(prefix, "'", "''") {
+		return "'" + escaped + "%'"
+	}
+
+	return "'" + escaped + "%' ESCAPE '^'"
+}
+
+// extendedPattern removes whitespace and comments from a pattern with the option x.
+func extendedPattern(pattern string) string {
+	var res strings.Builder
+	var class, escaped, comment bool
+	for _, r := range pattern {
+		switch {
+		case comment:
+			comment = r != '\n'
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case class:
+			class = r != ']'
+		case r == '[':
+			class = true
+		case r == '#':
+			comment = true
+			continue
+		case unicode.IsSpace(r):
+			continue
+		}
+
+		res.WriteRune(r)
+	}
+
+	return res.String()
+}
@@ -25,10 +25,16 @@ import (
 )
 
 type Storage interface {
+	MsgAggregate(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgCreateIndexes(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgDelete(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
+	MsgDistinct(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
+	MsgExplain(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgFindOrCount(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgFindAndModify(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
+	MsgGetMore(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
+	MsgKillCursors(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgInsert(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
 	MsgUpdate(context.Context, *wire.OpMsg) (*wire.OpMsg, error)
+	Close()
 }
@@ -6,19 +6,24 @@ package common
 
 import (
 	"context"
+	sqldb "database/sql"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/fjson"
-	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/hana"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
 )
 
+// RowQuerier queries a single row. It is implemented by *hana.Hpool and by transactions.
+type RowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sqldb.Row
+}
+
 // IsIdUnique will check if _id for a document is unique before insertion.
 // - err is an error thrown by a function used.
 // - errMsg is the error message used if id is not unique.
-func IsIdUnique(id any, db, collection string, ctx context.Context, hanapool *hana.Hpool) (unique bool, errMsg error, err error) {
+func IsIdUnique(id any, db, collection string, ctx context.Context, hanapool RowQuerier) (unique bool, errMsg error, err error) {
 	sql := "SELECT _id FROM \"%s\".\"%s\" "
 
 	whereSQL, errSQL := CreateWhereClause(types.MustMakeDocument([]any{"_id", id}...))
@@ -0,0 +1,341 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// Unwind is an $unwind stage of an aggregation pipeline.
+type Unwind struct {
+	path                       []string
+	includeArrayIndex          string
+	preserveNullAndEmptyArrays bool
+}
+
+// NewUnwind validates the specification of an $unwind stage.
+// It is either a field path like "$items" or a document with the field path in path.
+func NewUnwind(spec any) (*Unwind, error) {
+	var u Unwind
+	var path string
+	switch spec := spec.(type) {
+	case string:
+		path = spec
+
+	case types.Document:
+		for _, k := range spec.Keys() {
+			v := spec.Map()[k]
+
+			var ok bool
+			switch k {
+			case "path":
+				if path, ok = v.(string); !ok {
+					return nil, NewErrorMessage(ErrBadValue, "expected a string as the path for $unwind stage, got %T", v)
+				}
+			case "includeArrayIndex":
+				if u.includeArrayIndex, ok = v.(string); !ok {
+					return nil, NewErrorMessage(ErrBadValue, "expected a non-empty string for the includeArrayIndex option to $unwind stage, got %T", v)
+				}
+				if u.includeArrayIndex == "" || strings.HasPrefix(u.includeArrayIndex, "$") {
+					return nil, NewErrorMessage(ErrBadValue, "includeArrayIndex option to $unwind stage should not be prefixed with a '$': %s", u.includeArrayIndex)
+				}
+				if strings.Contains(u.includeArrayIndex, ".") {
+					return nil, NewErrorMessage(ErrNotImplemented, "includeArrayIndex option to $unwind stage with a dotted field is not supported: %s", u.includeArrayIndex)
+				}
+			case "preserveNullAndEmptyArrays":
+				if u.preserveNullAndEmptyArrays, ok = v.(bool); !ok {
+					return nil, NewErrorMessage(ErrBadValue, "expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage, got %T", v)
+				}
+			default:
+				return nil, NewErrorMessage(ErrBadValue, "unrecognized option to $unwind stage: %s", k)
+			}
+		}
+
+		if path == "" {
+			return nil, NewErrorMessage(ErrBadValue, "no path specified to $unwind stage")
+		}
+
+	default:
+		return nil, NewErrorMessage(ErrBadValue, "expected either a string or an object as specification for $unwind stage, got %T", spec)
+	}
+
+	if !strings.HasPrefix(path, "$") || len(path) == 1 {
+		return nil, NewErrorMessage(ErrBadValue, "path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	u.path = strings.Split(path[1:], ".")
+
+	return &u, nil
+}
+
+// Documents creates a document for each element of the array at the path of the stage.
+// It stops with the error of the context when the context is done.
+func (u *Unwind) Documents(ctx context.Context, docs []types.Document) ([]types.Document, error) {
+	res := make([]types.Document, 0, len(docs))
+	for i, doc := range docs {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+
+		value := documentPathValue(doc, u.path)
+
+		switch value := value.(type) {
+		case *types.Array:
+			if value.Len() == 0 {
+				if u.preserveNullAndEmptyArrays {
+					unwound, err := u.unwound(doc, missing, nil)
+					if err != nil {
+						return nil, err
+					}
+					res = append(res, unwound)
+				}
+				continue
+			}
+
+			for i, element := range arrayValues(value) {
+				unwound, err := u.unwound(doc, element, int64(i))
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, unwound)
+			}
+
+		case nil, missingType:
+			if u.preserveNullAndEmptyArrays {
+				unwound, err := u.unwound(doc, value, nil)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, unwound)
+			}
+
+		default:
+			// a value which is not an array is treated like an array with a single element
+			unwound, err := u.unwound(doc, value, nil)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, unwound)
+		}
+	}
+
+	return res, nil
+}
+
+// Commutes checks if a $match stage with the filter following the stage can be executed before it, because
+// the filter does not use the unwound field or the array index. Filters with other top-level operators
+// than $and, $or and $nor, like $expr, are not moved.
+func (u *Unwind) Commutes(filter types.Document) bool {
+	for _, key := range filter.Keys() {
+		switch key {
+		case "$and", "$or", "$nor":
+			conditions, ok := filter.Map()[key].(*types.Array)
+			if !ok {
+				return false
+			}
+			for _, condition := range arrayValues(conditions) {
+				condition, ok := condition.(types.Document)
+				if !ok || !u.Commutes(condition) {
+					return false
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") || !u.independent(strings.Split(key, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Prefilter returns the conditions of a $match stage following the stage which can be checked on the documents
+// before they are unwound, so only documents which can produce a matching document are selected. The result can
+// match more documents than the filter, which is applied after the stage as well. A condition on the unwound field
+// is used if it matches values but not their absence, like $ne or null do. It is checked on the elements of the
+// array, or the document is kept if an element is an array itself, since MongoDB does not traverse nested arrays.
+func (u *Unwind) Prefilter(filter types.Document) (types.Document, error) {
+	res, unwound := types.MustMakeDocument(), types.MustMakeDocument()
+	for _, key := range filter.Keys() {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		target := &res
+		path := strings.Split(key, ".")
+		switch {
+		case u.independent(path):
+		case isPathPrefix(u.path, path) && u.path[0] != u.includeArrayIndex && positiveCondition(filter.Map()[key]):
+			target = &unwound
+		default:
+			continue
+		}
+
+		if err := target.Set(key, filter.Map()[key]); err != nil {
+			return res, lazyerrors.Error(err)
+		}
+	}
+
+	if len(unwound.Keys()) == 0 {
+		return res, nil
+	}
+
+	nested := types.MustMakeDocument(
+		strings.Join(u.path, "."), types.MustMakeDocument("$elemMatch", types.MustMakeDocument("$type", "array")),
+	)
+	if err := res.Set("$or", types.MustNewArray(unwound, nested)); err != nil {
+		return res, lazyerrors.Error(err)
+	}
+
+	return res, nil
+}
+
+// independent checks if the field at the path is neither changed by the stage nor contains a changed field.
+func (u *Unwind) independent(path []string) bool {
+	if isPathPrefix(path, u.path) || isPathPrefix(u.path, path) {
+		return false
+	}
+
+	return u.includeArrayIndex == "" || path[0] != u.includeArrayIndex
+}
+
+// positiveCondition checks if the condition of a filter on a field can only be true for an existing value which is
+// not null: equality with such a scalar value or a regular expression, or comparisons of such values including $in.
+func positiveCondition(value any) bool {
+	doc, ok := value.(types.Document)
+	if !ok {
+		return positiveValue(value)
+	}
+
+	if len(doc.Keys()) == 0 {
+		return false
+	}
+
+	for _, op := range doc.Keys() {
+		switch operand := doc.Map()[op]; op {
+		case "$eq", "$gt", "$gte", "$lt", "$lte":
+			if !positiveValue(operand) {
+				return false
+			}
+		case "$in":
+			values, ok := operand.(*types.Array)
+			if !ok || values.Len() == 0 {
+				return false
+			}
+			for _, v := range arrayValues(values) {
+				if !positiveValue(v) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// positiveValue checks if the value is a scalar value other than null, including regular expressions.
+func positiveValue(value any) bool {
+	switch value.(type) {
+	case nil, types.NullType, missingType, types.Document, *types.Array:
+		return false
+	}
+
+	return true
+}
+
+// isPathPrefix checks if the path starts with the fields of the prefix.
+func isPathPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unwound returns a copy of the document with the value at the path and the array index.
+func (u *Unwind) unwound(doc types.Document, value any, index any) (types.Document, error) {
+	res, err := withPathValue(doc, u.path, value)
+	if err != nil {
+		return res, err
+	}
+
+	if u.includeArrayIndex != "" {
+		if err = res.Set(u.includeArrayIndex, index); err != nil {
+			return res, lazyerrors.Error(err)
+		}
+	}
+
+	return res, nil
+}
+
+// documentPathValue returns the value at the path only following embedded documents.
+func documentPathValue(doc types.Document, path []string) any {
+	value, err := doc.Get(path[0])
+	if err != nil {
+		return missing
+	}
+
+	if len(path) == 1 {
+		return value
+	}
+
+	next, ok := value.(types.Document)
+	if !ok {
+		return missing
+	}
+
+	return documentPathValue(next, path[1:])
+}
+
+// withPathValue returns a copy of the document with the value at the path. Documents on the path
+// are copied, so the original document is not modified. Missing removes the field.
+func withPathValue(doc types.Document, path []string, value any) (types.Document, error) {
+	res := types.MustMakeDocument()
+	for _, k := range doc.Keys() {
+		if err := res.Set(k, doc.Map()[k]); err != nil {
+			return res, lazyerrors.Error(err)
+		}
+	}
+
+	if len(path) == 1 {
+		if IsMissing(value) {
+			res.Remove(path[0])
+			return res, nil
+		}
+
+		if err := res.Set(path[0], value); err != nil {
+			return res, lazyerrors.Error(err)
+		}
+		return res, nil
+	}
+
+	next, ok := res.Map()[path[0]].(types.Document)
+	if !ok {
+		return res, nil
+	}
+
+	next, err := withPathValue(next, path[1:], value)
+	if err != nil {
+		return res, err
+	}
+
+	if err = res.Set(path[0], next); err != nil {
+		return res, lazyerrors.Error(err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnwindDocuments(t *testing.T) {
+	docs := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "order", types.MustMakeDocument("items", types.MustNewArray("a", "b"))),
+		types.MustMakeDocument("_id", int32(2), "order", types.MustMakeDocument("items", types.MustNewArray())),
+		types.MustMakeDocument("_id", int32(3), "order", types.MustMakeDocument("items", nil)),
+		types.MustMakeDocument("_id", int32(4), "order", types.MustMakeDocument()),
+		types.MustMakeDocument("_id", int32(5), "order", types.MustMakeDocument("items", "c")),
+	}
+
+	u, err := NewUnwind("$order.items")
+	require.NoError(t, err)
+
+	actual, err := u.Documents(context.Background(), docs)
+	require.NoError(t, err)
+
+	expected := []types.Document{
+		types.MustMakeDocument("_id", int32(1), "order", types.MustMakeDocument("items", "a")),
+		types.MustMakeDocument("_id", int32(1), "order", types.MustMakeDocument("items", "b")),
+		types.MustMakeDocument("_id", int32(5), "order", types.MustMakeDocument("items", "c")),
+	}
+	assert.Equal(t, expected, actual)
+
+	// the original documents are not modified
+	assert.Equal(t, types.MustMakeDocument("items", types.MustNewArray("a", "b")), docs[0].Map()["order"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = u.Documents(ctx, docs)
+	assert.Equal(t, context.Canceled, err)
+
+	u, err = NewUnwind(types.MustMakeDocument("path", "$order.items", "includeArrayIndex", "i", "preserveNullAndEmptyArrays", true))
+	require.NoError(t, err)
+
+	actual, err = u.Documents(context.Background(), docs)
+	require.NoError(t, err)
+
+	expected = []types.Document{
+		types.MustMakeDocument("_id", int32(1), "order", types.MustMakeDocument("items", "a"), "i", int64(0)),
+		types.MustMakeDocument("_id", int32(1), "order", types.MustMakeDocument("items", "b"), "i", int64(1)),
+		types.MustMakeDocument("_id", int32(2), "order", types.MustMakeDocument(), "i", nil),
+		types.MustMakeDocument("_id", int32(3), "order", types.MustMakeDocument("items", nil), "i", nil),
+		types.MustMakeDocument("_id", int32(4), "order", types.MustMakeDocument(), "i", nil),
+		types.MustMakeDocument("_id", int32(5), "order", types.MustMakeDocument("items", "c"), "i", nil),
+	}
+	assert.Equal(t, expected, actual)
+
+	_, err = NewUnwind("items")
+	assert.EqualError(t, err, "BadValue (2): path option to $unwind stage should be prefixed with a '$': items")
+
+	_, err = NewUnwind(types.MustMakeDocument("path", "$items", "includeArrayIndex", "meta.idx"))
+	assert.EqualError(t, err, "NotImplemented (238): includeArrayIndex option to $unwind stage with a dotted field is not supported: meta.idx")
+}
+
+func TestUnwindCommutes(t *testing.T) {
+	u, err := NewUnwind(types.MustMakeDocument("path", "$order.items", "includeArrayIndex", "i"))
+	require.NoError(t, err)
+
+	assert.True(t, u.Commutes(types.MustMakeDocument("status", "A", "order.date", int32(1))))
+	assert.True(t, u.Commutes(types.MustMakeDocument("$or", types.MustNewArray(types.MustMakeDocument("status", "A"), types.MustMakeDocument("order.itemsCount", int32(2))))))
+
+	assert.False(t, u.Commutes(types.MustMakeDocument("order.items", "a")))
+	assert.False(t, u.Commutes(types.MustMakeDocument("order.items.sku", "a")))
+	assert.False(t, u.Commutes(types.MustMakeDocument("order", types.MustMakeDocument("items", "a"))))
+	assert.False(t, u.Commutes(types.MustMakeDocument("i", int32(0))))
+	assert.False(t, u.Commutes(types.MustMakeDocument("$nor", types.MustNewArray(types.MustMakeDocument("order.items", "a")))))
+	assert.False(t, u.Commutes(types.MustMakeDocument("$expr", types.MustMakeDocument("$eq", types.MustNewArray("$status", "A")))))
+}
+
+func TestUnwindPrefilter(t *testing.T) {
+	u, err := NewUnwind(types.MustMakeDocument("path", "$order.items", "includeArrayIndex", "i"))
+	require.NoError(t, err)
+
+	nested := types.MustMakeDocument("order.items", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("$type", "array")))
+
+	prefilter, err := u.Prefilter(types.MustMakeDocument(
+		"status", "A",
+		"order.items.sku", "a",
+		"order.items.qty", types.MustMakeDocument("$gt", int32(1), "$lte", int32(5)),
+		"order.items.tags", types.MustMakeDocument("$in", types.MustNewArray("x", types.Regex{Pattern: "^y"})),
+		"i", int32(0),
+		"$expr", types.MustMakeDocument("$eq", types.MustNewArray("$status", "A")),
+	))
+	require.NoError(t, err)
+	expected := types.MustMakeDocument(
+		"status", "A",
+		"$or", types.MustNewArray(
+			types.MustMakeDocument(
+				"order.items.sku", "a",
+				"order.items.qty", types.MustMakeDocument("$gt", int32(1), "$lte", int32(5)),
+				"order.items.tags", types.MustMakeDocument("$in", types.MustNewArray("x", types.Regex{Pattern: "^y"})),
+			),
+			nested,
+		),
+	)
+	assert.Equal(t, expected, prefilter)
+
+	// conditions which match missing or null values can not be checked before the stage
+	prefilter, err = u.Prefilter(types.MustMakeDocument(
+		"order.items.sku", types.MustMakeDocument("$ne", "a"),
+		"order.items.qty", nil,
+		"order.items.tags", types.MustMakeDocument("$in", types.MustNewArray("x", nil)),
+		"order", types.MustMakeDocument("items", "a"),
+	))
+	require.NoError(t, err)
+	assert.Equal(t, types.MustMakeDocument(), prefilter)
+}
@@ -19,25 +19,6 @@ import (
 // Update creates needed SQL parts for SQL update statement.
 func Update(updateDoc types.Document) (updateSQL string, notWhereSQL string, err error) {
 	uninmplementedFields := []string{
-		"$currentDate",
-		"$inc",
-		"$min",
-		"$max",
-		"$mul",
-		"$rename",
-		"$setOnInsert",
-		"$",
-		"$[]",
-		"$[<identifier>]",
-		"$addToSet",
-		"$pop",
-		"$pull",
-		"$push",
-		"$pullAll",
-		"$each",
-		"$position",
-		"$slice",
-		"$sort",
 		"$bit",
 		"$addFields",
 		"$project",
@@ -51,6 +32,21 @@ func Update(updateDoc types.Document) (updateSQL string, notWhereSQL string, err
 
 	updateMap := updateDoc.Map()
 
+	if err = checkConflicts(updateDoc); err != nil {
+		return
+	}
+
+	// $setOnInsert only sets fields of documents inserted by an upsert, see Upsert
+	if _, ok := updateMap["$setOnInsert"]; ok && len(updateDoc.Keys()) == 1 {
+		return
+	}
+
+	// the elements updated by the positional operators $, $[] and $[<identifier>] are resolved in memory
+	if key := positionalKey(updateDoc); key != "" {
+		err = memoryUpdateError(key)
+		return
+	}
+
 	var isUnsetSQL string
 	var setDoc types.Document
 	var ok bool
@@ -61,6 +57,46 @@ func Update(updateDoc types.Document) (updateSQL string, notWhereSQL string, err
 		}
 	}
 
+	// $rename can not be computed by SAP HANA without setting missing fields to null and
+	// SAP HANA has no functions to modify arrays. An UPDATE of the document store can only set or unset
+	// a whole field, so even $push without modifiers can not append to an array in SQL.
+	for _, op := range append([]string{"$rename"}, arrayOperators...) {
+		if _, ok := updateMap[op]; ok {
+			err = memoryUpdateError(op)
+			return
+		}
+	}
+
+	// modified are the conditions of the documents modified by operators which do not modify every document
+	var assignments, modified []string
+	var always bool
+	for _, operatorSQL := range []func(map[string]any) ([]string, string, error){arithmeticSQL, boundarySQL, currentDateAssignments} {
+		var opAssignments []string
+		var modifiedSQL string
+		if opAssignments, modifiedSQL, err = operatorSQL(updateMap); err != nil {
+			return
+		}
+		if len(opAssignments) == 0 {
+			continue
+		}
+
+		assignments = append(assignments, opAssignments...)
+		if modifiedSQL == "" {
+			always = true
+		} else {
+			modified = append(modified, modifiedSQL)
+		}
+	}
+
+	if len(assignments) != 0 {
+		if updateSQL == "" {
+			updateSQL = " SET "
+		} else {
+			updateSQL += ", "
+		}
+		updateSQL += strings.Join(assignments, ", ")
+	}
+
 	var unSetSQL, isSetSQL string
 	if unSetDoc, ok := updateMap["$unset"].(types.Document); ok {
 		if unSetSQL, isSetSQL, err = createSetandUnsetSqlStmnt(unSetDoc, false); err != nil {
@@ -69,35 +105,347 @@ func Update(updateDoc types.Document) (updateSQL string, notWhereSQL string, err
 	}
 
 	if isUnsetSQL != "" && isSetSQL != "" { // If both setting and unsetting fields
-		notWhereSQL, err = CreateWhereClause(setDoc)
+		notWhereSQL, err = currentValuesSQL(setDoc)
 		if err != nil {
-			if strings.Contains(err.Error(), "value *types.Array not supported in filter") {
-				err = NewErrorMessage(ErrNotImplemented, "cannot update a field with array")
-				return
-			}
 			return
 		}
 
-		notWhereSQL = " AND ( NOT ( " + strings.Replace(notWhereSQL, "WHERE", "", 1) + ") OR (" + isUnsetSQL + " ) OR ( " + isSetSQL + " ))"
+		notWhereSQL = " AND ( NOT ( " + notWhereSQL + ") OR (" + isUnsetSQL + " ) OR ( " + isSetSQL + " ))"
 		updateSQL += ", " + unSetSQL
 	} else if isUnsetSQL != "" { // If only setting fields
-		notWhereSQL, err = CreateWhereClause(setDoc)
+		notWhereSQL, err = currentValuesSQL(setDoc)
 		if err != nil {
-			if strings.Contains(err.Error(), "value *types.Array not supported in filter") {
-				err = NewErrorMessage(ErrNotImplemented, "cannot update a field with array")
-				return
-			}
 			return
 		}
-		notWhereSQL = " AND ( NOT ( " + strings.Replace(notWhereSQL, "WHERE", "", 1) + ") OR (" + isUnsetSQL + " )) "
+		notWhereSQL = " AND ( NOT ( " + notWhereSQL + ") OR (" + isUnsetSQL + " )) "
 	} else if isSetSQL != "" { // If only unsetting fields
 		notWhereSQL = " AND ( " + isSetSQL + " )"
-		updateSQL = unSetSQL
-	} else {
+		if updateSQL == "" {
+			updateSQL = unSetSQL
+		} else {
+			updateSQL += ", " + unSetSQL
+		}
+	} else if len(assignments) == 0 {
 		err = NewErrorMessage(ErrCommandNotFound, "no such command: replaceOne")
 		return
 	}
 
+	// $inc, $mul and $currentDate modify every document unless $inc and $mul only create missing fields,
+	// $min and $max only modify documents with fields they replace
+	switch {
+	case len(assignments) == 0:
+	case always:
+		notWhereSQL = ""
+	case notWhereSQL == "":
+		notWhereSQL = " AND ( " + strings.Join(modified, " OR ") + " )"
+	default:
+		notWhereSQL = " AND (" + strings.TrimSpace(strings.TrimPrefix(notWhereSQL, " AND ")) + " OR " + strings.Join(modified, " OR ") + ")"
+	}
+
+	return
+}
+
+// checkConflicts returns an error if a field, or a field within it, is updated by more than one operator.
+func checkConflicts(updateDoc types.Document) error {
+	var paths []string
+	for _, op := range updateDoc.Keys() {
+		fields, ok := updateDoc.Map()[op].(types.Document)
+		if !ok || !strings.HasPrefix(op, "$") {
+			continue
+		}
+
+		// the fields of an operator are only checked against the fields of the previous operators
+		previous := paths
+		keys := fields.Keys()
+		if op == "$rename" {
+			for _, source := range fields.Keys() {
+				if target, ok := fields.Map()[source].(string); ok {
+					keys = append(keys, target)
+				}
+			}
+		}
+
+		for _, key := range keys {
+			for _, path := range previous {
+				conflict := path
+				if len(key) < len(path) {
+					conflict = key
+				}
+
+				if key == path || strings.HasPrefix(key, path+".") || strings.HasPrefix(path, key+".") {
+					return NewErrorMessage(ErrConflictingUpdateOperators, "Updating the path '%s' would create a conflict at '%s'", key, conflict)
+				}
+			}
+			paths = append(paths, key)
+		}
+	}
+
+	return nil
+}
+
+// arithmeticOperators are the update operators which compute the new value from the current number.
+var arithmeticOperators = []string{"$inc", "$mul"}
+
+// arithmeticSQL returns the assignments of $inc and $mul. The new value is computed by SAP HANA, so concurrent
+// updates do not get lost. Like in MongoDB, $inc sets a missing field to the increment and $mul to 0. The result
+// has the type of the stored number. The returned condition is the condition of modified documents if the
+// operators only modify some documents, i.e. an increment by 0 only creates missing fields.
+func arithmeticSQL(updateMap map[string]any) (assignments []string, modifiedSQL string, err error) {
+	var modified []string
+	var always bool
+	for _, op := range arithmeticOperators {
+		fields, ok := updateMap[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range fields.Keys() {
+			value := fields.Map()[key]
+			if !isNumber(value) {
+				verb := "increment"
+				if op == "$mul" {
+					verb = "multiply"
+				}
+				err = NewErrorMessage(ErrTypeMismatch, "Cannot %s with non-numeric argument: {%s: %v}", verb, key, value)
+				return
+			}
+
+			if strings.EqualFold(key, "_id") {
+				err = errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+				return
+			}
+
+			var kSQL, vSQL, missingSQL string
+			if kSQL, err = getUpdateKey(key); err != nil {
+				return
+			}
+			if vSQL, err = GetUpdateValue(value); err != nil {
+				return
+			}
+
+			neutral := int32(0)
+			if op == "$inc" {
+				assignments = append(assignments, kSQL+" = CASE WHEN "+kSQL+" IS NULL THEN "+vSQL+" ELSE "+kSQL+" + "+vSQL+" END")
+			} else {
+				neutral = 1
+				if missingSQL, err = GetUpdateValue(zeroOf(value)); err != nil {
+					return
+				}
+				assignments = append(assignments, kSQL+" = CASE WHEN "+kSQL+" IS NULL THEN "+missingSQL+" ELSE "+kSQL+" * "+vSQL+" END")
+			}
+
+			if compareValues(value, neutral) == equal {
+				modified = append(modified, kSQL+" IS UNSET")
+			} else {
+				always = true
+			}
+		}
+	}
+
+	if !always {
+		modifiedSQL = strings.Join(modified, " OR ")
+	}
+
+	return
+}
+
+// arrayOperators are the update operators which modify arrays.
+var arrayOperators = []string{"$push", "$addToSet", "$pull", "$pullAll", "$pop"}
+
+// boundaryOperators are the update operators which replace the current value if the value is less or greater.
+var boundaryOperators = []string{"$min", "$max"}
+
+// boundarySQL returns the assignments of $min and $max and the condition of modified documents. Like in
+// MongoDB a missing field is set to the value and values of different types are compared in the BSON
+// comparison order. Values SAP HANA can not compare, like documents, are compared in memory.
+func boundarySQL(updateMap map[string]any) (assignments []string, modifiedSQL string, err error) {
+	var modified []string
+	for _, op := range boundaryOperators {
+		fields, ok := updateMap[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range fields.Keys() {
+			value := fields.Map()[key]
+			if strings.EqualFold(key, "_id") {
+				err = errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+				return
+			}
+
+			var kSQL, vSQL, replaceSQL string
+			if kSQL, err = getUpdateKey(key); err != nil {
+				return
+			}
+			if replaceSQL, err = replaceConditionSQL(kSQL, op, value); err != nil {
+				return
+			}
+			if vSQL, err = GetUpdateValue(value); err != nil {
+				return
+			}
+
+			assignments = append(assignments, kSQL+" = CASE WHEN "+replaceSQL+" THEN "+vSQL+" ELSE "+kSQL+" END")
+			modified = append(modified, replaceSQL)
+		}
+	}
+
+	modifiedSQL = strings.Join(modified, " OR ")
+	return
+}
+
+// replaceConditionSQL returns the condition of fields which are replaced by the value of $min or $max.
+func replaceConditionSQL(kSQL, op string, value any) (string, error) {
+	sign := " < "
+	if op == "$min" {
+		sign = " > "
+	}
+
+	// null is the smallest value, so it only replaces missing fields or is replaced by any value
+	if value == nil {
+		if op == "$max" {
+			return kSQL + " IS UNSET", nil
+		}
+		return "(" + kSQL + " IS UNSET OR " + TypeOrderSQL(kSQL) + " > 1)", nil
+	}
+
+	check, vSQL, suffix, err := comparableSQL(value)
+	if err != nil {
+		return "", err
+	}
+	if check == "" {
+		return "", memoryUpdateError(op + " with " + aliasFromType(value))
+	}
+
+	return "(" + kSQL + " IS UNSET OR " + TypeOrderSQL(kSQL) + sign + strconv.Itoa(typeOrder(value)) +
+		" OR (" + fmt.Sprintf(check, kSQL) + " AND " + kSQL + suffix + sign + vSQL + "))", nil
+}
+
+// currentDateSQL is the current date of SAP HANA, which is stored like other dates as the milliseconds since the epoch.
+const currentDateSQL = "{\"$da\": TO_BIGINT(NANO100_BETWEEN(TO_TIMESTAMP('1970-01-01 00:00:00'), CURRENT_UTCTIMESTAMP) / 10000)}"
+
+// currentDateAssignments returns the assignments of $currentDate, which modifies every document.
+func currentDateAssignments(updateMap map[string]any) (assignments []string, modifiedSQL string, err error) {
+	fields, ok := updateMap["$currentDate"].(types.Document)
+	if !ok {
+		return
+	}
+
+	for _, key := range fields.Keys() {
+		if err = checkCurrentDate(fields.Map()[key]); err != nil {
+			return
+		}
+
+		if strings.EqualFold(key, "_id") {
+			err = errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+			return
+		}
+
+		var kSQL string
+		if kSQL, err = getUpdateKey(key); err != nil {
+			return
+		}
+		assignments = append(assignments, kSQL+" = "+currentDateSQL)
+	}
+
+	return
+}
+
+// zeroOf returns 0 with the type of the number.
+func zeroOf(value any) any {
+	switch value.(type) {
+	case int64:
+		return int64(0)
+	case float64:
+		return float64(0)
+	default:
+		return int32(0)
+	}
+}
+
+// NonNumericSQL returns the projection and the condition which select documents with an existing field updated
+// by $inc or $mul which is not a number. SAP HANA can not compute these updates, so the documents have to be
+// checked before the update. It returns empty strings if the update has no arithmetic operators.
+func NonNumericSQL(updateDoc types.Document) (projectionSQL string, conditionSQL string, err error) {
+	fields := []string{"\"_id\": \"_id\""}
+	var conditions []string
+	included := map[string]bool{}
+	for _, op := range arithmeticOperators {
+		opDoc, ok := updateDoc.Map()[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range opDoc.Keys() {
+			var kSQL string
+			if kSQL, err = getUpdateKey(key); err != nil {
+				return
+			}
+			conditions = append(conditions, "("+kSQL+" IS NOT NULL AND NOT IS_NUMBER("+kSQL+")) OR ("+kSQL+" IS NULL AND "+kSQL+" IS SET)")
+
+			// the whole top-level field is selected, NonNumericError finds the value in it
+			field := strings.Split(key, ".")[0]
+			if !included[field] && field != "_id" {
+				included[field] = true
+				fields = append(fields, fmt.Sprintf("\"%s\": \"%s\"", field, field))
+			}
+		}
+	}
+
+	if len(conditions) == 0 {
+		return
+	}
+
+	projectionSQL = "{" + strings.Join(fields, ", ") + "}"
+	conditionSQL = "(" + strings.Join(conditions, " OR ") + ")"
+	return
+}
+
+// NonNumericError returns the error of MongoDB for a document selected with NonNumericSQL.
+func NonNumericError(updateDoc types.Document, doc types.Document) error {
+	for _, op := range arithmeticOperators {
+		opDoc, ok := updateDoc.Map()[op].(types.Document)
+		if !ok {
+			continue
+		}
+
+		for _, key := range opDoc.Keys() {
+			path := strings.Split(key, ".")
+			value := documentPathValue(doc, path)
+			if IsMissing(value) || isNumber(value) {
+				continue
+			}
+
+			return NewErrorMessage(
+				ErrTypeMismatch,
+				"Cannot apply %s to a value of non-numeric type. {_id: %v} has the field '%s' of non-numeric type %s",
+				op, doc.Map()["_id"], path[len(path)-1], aliasFromType(value),
+			)
+		}
+	}
+
+	return lazyerrors.Errorf("no field of the document %v is non-numeric", doc)
+}
+
+// currentValuesSQL returns the condition of documents which already have the values of $set.
+// Unlike a filter, the values are compared exactly and not with the elements of arrays.
+func currentValuesSQL(setDoc types.Document) (sql string, err error) {
+	for i, key := range setDoc.Keys() {
+		value := setDoc.Map()[key]
+
+		var kSQL, vSQL, sign string
+		if kSQL, err = whereKey(key); err != nil {
+			return
+		}
+		if vSQL, sign, err = whereValue(value); err != nil {
+			return
+		}
+
+		if i != 0 {
+			sql += " AND "
+		}
+		sql += kSQL + sign + vSQL
+	}
+
 	return
 }
 
@@ -146,39 +494,10 @@ func createSetandUnsetSqlStmnt(doc types.Document, set bool) (updateSQL string,
 	return
 }
 
-// getUpdateKey prepares the key (field) for SQL statement.
+// getUpdateKey prepares the key (field) for SQL statement. Numeric parts of a dotted key are
+// array indexes at any depth.
 func getUpdateKey(key string) (updateKey string, err error) {
-	if strings.Contains(key, ".") {
-		splitKey := strings.Split(key, ".")
-
-		var isInt bool
-		for i, k := range splitKey {
-
-			if kInt, convErr := strconv.Atoi(k); convErr == nil {
-				if isInt {
-					err = NewErrorMessage(ErrNotImplemented, "not yet supporting indexing on an array inside of an array")
-					return
-				}
-				kIntSQL := "[" + "%d" + "]"
-				updateKey += fmt.Sprintf(kIntSQL, (kInt + 1))
-				isInt = true
-				continue
-			}
-
-			if i != 0 {
-				updateKey += "."
-			}
-
-			updateKey += "\"" + k + "\""
-
-			isInt = false
-
-		}
-	} else {
-		updateKey = "\"" + key + "\""
-	}
-
-	return
+	return whereKey(key)
 }
 
 // getUpdateValue prepares the value for SQL statement.
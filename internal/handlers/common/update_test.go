@@ -18,14 +18,14 @@ func TestMsgUpdate(t *testing.T) {
 		updateSQL, notWhereSQL, err := Update(types.MustMakeDocument("$set", types.MustMakeDocument("str_value", "value", "int32_value", int32(123), "int64_value", int64(223372036854775807), "float64_value", 64534.12432, "bool_value", true, "objID_value", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107}, "document_value", types.MustMakeDocument("string", "value", "int32", int32(2), "int64", int64(4543654563), "float", float64(543245.2245), "bool", true, "array", types.MustNewArray(int32(1), "2"), "nested_docu", types.MustMakeDocument("inside", "array"), "objID", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107}, "null", nil), "null_value", nil, "nested.field", "value", "nested.field.array.2", int32(12))))
 
 		assert.Equal(t, " SET \"str_value\" = 'value', \"int32_value\" = 123, \"int64_value\" = 223372036854775807, \"float64_value\" = 64534.124320, \"bool_value\" = to_json_boolean(true), \"objID_value\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'}, \"document_value\" = {\"string\": 'value', \"int32\": 2, \"int64\": 4543654563, \"float\": 543245.224500, \"bool\": to_json_boolean(true), \"array\": [1, '2'], \"nested_docu\": {\"inside\": 'array'}, \"objID\": {\"oid\":'62e2bd54510683f9c0bb0d6b'}, \"null\":  NULL }, \"null_value\" = NULL, \"nested\".\"field\" = 'value', \"nested\".\"field\".\"array\"[3] = 12", updateSQL)
-		assert.Equal(t, " AND ( NOT (   \"str_value\" = 'value' AND \"int32_value\" = 123 AND \"int64_value\" = 223372036854775807 AND \"float64_value\" = 64534.124320 AND \"bool_value\" = to_json_boolean(true) AND \"objID_value\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'} AND \"document_value\" = {\"string\": 'value', \"int32\": 2, \"int64\": 4543654563, \"float\": 543245.224500, \"bool\": to_json_boolean(true), \"array\": [1, '2'], \"nested_docu\": {\"inside\": 'array'}, \"objID\": {\"oid\":'62e2bd54510683f9c0bb0d6b'}, \"null\":  NULL } AND \"null_value\" IS NULL AND \"nested\".\"field\" = 'value' AND \"nested\".\"field\".\"array\"[3] = 12) OR (\"str_value\" IS UNSET OR \"int32_value\" IS UNSET OR \"int64_value\" IS UNSET OR \"float64_value\" IS UNSET OR \"bool_value\" IS UNSET OR \"objID_value\" IS UNSET OR \"document_value\" IS UNSET OR \"null_value\" IS UNSET OR \"nested\".\"field\" IS UNSET OR \"nested\".\"field\".\"array\"[3] IS UNSET )) ", notWhereSQL)
+		assert.Equal(t, " AND ( NOT ( \"str_value\" = 'value' AND \"int32_value\" = 123 AND \"int64_value\" = 223372036854775807 AND \"float64_value\" = 64534.124320 AND \"bool_value\" = to_json_boolean(true) AND \"objID_value\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'} AND \"document_value\" = {\"string\": 'value', \"int32\": 2, \"int64\": 4543654563, \"float\": 543245.224500, \"bool\": to_json_boolean(true), \"array\": [1, '2'], \"nested_docu\": {\"inside\": 'array'}, \"objID\": {\"oid\":'62e2bd54510683f9c0bb0d6b'}, \"null\":  NULL } AND \"null_value\" IS NULL AND \"nested\".\"field\" = 'value' AND \"nested\".\"field\".\"array\"[3] = 12) OR (\"str_value\" IS UNSET OR \"int32_value\" IS UNSET OR \"int64_value\" IS UNSET OR \"float64_value\" IS UNSET OR \"bool_value\" IS UNSET OR \"objID_value\" IS UNSET OR \"document_value\" IS UNSET OR \"null_value\" IS UNSET OR \"nested\".\"field\" IS UNSET OR \"nested\".\"field\".\"array\"[3] IS UNSET )) ", notWhereSQL)
 		assert.Nil(t, err)
 
 		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("array", types.MustNewArray(int32(1), "2"))))
 
 		assert.Equal(t, " SET \"array\" = [1, '2']", updateSQL)
-		assert.Equal(t, " WHERE ", notWhereSQL)
-		assert.EqualError(t, err, "NotImplemented (238): cannot update a field with array")
+		assert.Equal(t, " AND ( NOT ( \"array\" = [1, '2']) OR (\"array\" IS UNSET )) ", notWhereSQL)
+		assert.Nil(t, err)
 
 		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("_id", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107})))
 
@@ -33,11 +33,11 @@ func TestMsgUpdate(t *testing.T) {
 		assert.Equal(t, "", notWhereSQL)
 		assert.EqualError(t, err, `performing an update on the path '_id' would modify the immutable field '_id'`)
 
-		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("array.2.3", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107})))
+		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("array.2.3", int32(1))))
 
-		assert.Equal(t, " SET ", updateSQL)
-		assert.Equal(t, "", notWhereSQL)
-		assert.ErrorContains(t, err, "NotImplemented (238): not yet supporting indexing on an array inside of an array")
+		assert.Equal(t, " SET \"array\"[3][4] = 1", updateSQL)
+		assert.Equal(t, " AND ( NOT ( \"array\"[3][4] = 1) OR (\"array\"[3][4] IS UNSET )) ", notWhereSQL)
+		assert.Nil(t, err)
 
 		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("unsupported value", types.Binary{Subtype: types.BinarySubtype(byte(12)), B: []byte("hello")})))
 
@@ -68,7 +68,7 @@ func TestMsgUpdate(t *testing.T) {
 		updateSQL, notWhereSQL, err := Update(types.MustMakeDocument("$unset", types.MustMakeDocument("field1", "", "field2", int32(123)), "$set", types.MustMakeDocument("field3", int32(123))))
 
 		assert.Equal(t, " SET \"field3\" = 123,  UNSET \"field1\", \"field2\"", updateSQL)
-		assert.Equal(t, " AND ( NOT (   \"field3\" = 123) OR (\"field3\" IS UNSET ) OR ( \"field1\" IS SET OR \"field2\" IS SET ))", notWhereSQL)
+		assert.Equal(t, " AND ( NOT ( \"field3\" = 123) OR (\"field3\" IS UNSET ) OR ( \"field1\" IS SET OR \"field2\" IS SET ))", notWhereSQL)
 		assert.Nil(t, err)
 
 		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$unset", types.MustMakeDocument("_id", ""), "$set", types.MustMakeDocument("field", "value")))
@@ -79,8 +79,118 @@ func TestMsgUpdate(t *testing.T) {
 
 		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$unset", types.MustMakeDocument("field1", ""), "$set", types.MustMakeDocument("array", types.MustNewArray(int32(1), "2"))))
 
-		assert.Equal(t, " SET \"array\" = [1, '2']", updateSQL)
-		assert.Equal(t, " WHERE ", notWhereSQL)
-		assert.EqualError(t, err, "NotImplemented (238): cannot update a field with array")
+		assert.Equal(t, " SET \"array\" = [1, '2'],  UNSET \"field1\"", updateSQL)
+		assert.Equal(t, " AND ( NOT ( \"array\" = [1, '2']) OR (\"array\" IS UNSET ) OR ( \"field1\" IS SET ))", notWhereSQL)
+		assert.Nil(t, err)
+	})
+
+	t.Run("increment and multiply fields", func(t *testing.T) {
+		t.Parallel()
+
+		updateSQL, notWhereSQL, err := Update(types.MustMakeDocument("$inc", types.MustMakeDocument("qty", int32(2), "stats.views", int64(1)), "$mul", types.MustMakeDocument("price", float64(1.5))))
+
+		assert.Equal(t, " SET \"qty\" = CASE WHEN \"qty\" IS NULL THEN 2 ELSE \"qty\" + 2 END, \"stats\".\"views\" = CASE WHEN \"stats\".\"views\" IS NULL THEN 1 ELSE \"stats\".\"views\" + 1 END, \"price\" = CASE WHEN \"price\" IS NULL THEN 0.000000 ELSE \"price\" * 1.500000 END", updateSQL)
+		assert.Equal(t, "", notWhereSQL)
+		assert.Nil(t, err)
+
+		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("item", "value"), "$inc", types.MustMakeDocument("qty", int32(0))))
+
+		assert.Equal(t, " SET \"item\" = 'value', \"qty\" = CASE WHEN \"qty\" IS NULL THEN 0 ELSE \"qty\" + 0 END", updateSQL)
+		assert.Equal(t, " AND (( NOT ( \"item\" = 'value') OR (\"item\" IS UNSET )) OR \"qty\" IS UNSET)", notWhereSQL)
+		assert.Nil(t, err)
+
+		_, _, err = Update(types.MustMakeDocument("$inc", types.MustMakeDocument("qty", "1")))
+		assert.EqualError(t, err, "TypeMismatch (14): Cannot increment with non-numeric argument: {qty: 1}")
+
+		_, _, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("stats", types.MustMakeDocument()), "$inc", types.MustMakeDocument("stats.views", int32(1))))
+		assert.EqualError(t, err, "ConflictingUpdateOperators (40): Updating the path 'stats.views' would create a conflict at 'stats'")
+	})
+
+	t.Run("min, max and current date", func(t *testing.T) {
+		t.Parallel()
+
+		updateSQL, notWhereSQL, err := Update(types.MustMakeDocument("$max", types.MustMakeDocument("high", int32(10)), "$min", types.MustMakeDocument("low", "a")))
+
+		low := "(\"low\" IS UNSET OR " + TypeOrderSQL("\"low\"") + " > 3 OR (IS_STRING(\"low\") AND \"low\" > 'a'))"
+		high := "(\"high\" IS UNSET OR " + TypeOrderSQL("\"high\"") + " < 2 OR (IS_NUMBER(\"high\") AND \"high\" < 10))"
+		assert.Equal(t, " SET \"low\" = CASE WHEN "+low+" THEN 'a' ELSE \"low\" END, \"high\" = CASE WHEN "+high+" THEN 10 ELSE \"high\" END", updateSQL)
+		assert.Equal(t, " AND ( "+low+" OR "+high+" )", notWhereSQL)
+		assert.Nil(t, err)
+
+		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("item", "value"), "$max", types.MustMakeDocument("high", nil)))
+
+		assert.Equal(t, " SET \"item\" = 'value', \"high\" = CASE WHEN \"high\" IS UNSET THEN NULL ELSE \"high\" END", updateSQL)
+		assert.Equal(t, " AND (( NOT ( \"item\" = 'value') OR (\"item\" IS UNSET )) OR \"high\" IS UNSET)", notWhereSQL)
+		assert.Nil(t, err)
+
+		updateSQL, notWhereSQL, err = Update(types.MustMakeDocument("$currentDate", types.MustMakeDocument("updatedAt", true, "stats.seen", types.MustMakeDocument("$type", "date"))))
+
+		assert.Equal(t, " SET \"updatedAt\" = "+currentDateSQL+", \"stats\".\"seen\" = "+currentDateSQL, updateSQL)
+		assert.Equal(t, "", notWhereSQL)
+		assert.Nil(t, err)
+
+		_, _, err = Update(types.MustMakeDocument("$currentDate", types.MustMakeDocument("updatedAt", types.MustMakeDocument("$type", "timestamp"))))
+		assert.EqualError(t, err, "NotImplemented (238): $currentDate with $type timestamp is not supported, timestamps can not be stored")
+
+		_, _, err = Update(types.MustMakeDocument("$currentDate", types.MustMakeDocument("updatedAt", "now")))
+		assert.EqualError(t, err, "BadValue (2): string is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).")
+	})
+
+	t.Run("set on insert", func(t *testing.T) {
+		t.Parallel()
+
+		updateSQL, notWhereSQL, err := Update(types.MustMakeDocument("$setOnInsert", types.MustMakeDocument("created", "today")))
+		assert.Equal(t, "", updateSQL)
+		assert.Equal(t, "", notWhereSQL)
+		assert.Nil(t, err)
+
+		updateSQL, _, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(5)), "$setOnInsert", types.MustMakeDocument("created", "today")))
+		expected, _, _ := Update(types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(5))))
+		assert.Equal(t, expected, updateSQL)
+		assert.Nil(t, err)
+
+		_, _, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(5)), "$setOnInsert", types.MustMakeDocument("qty", int32(1))))
+		assert.EqualError(t, err, "ConflictingUpdateOperators (40): Updating the path 'qty' would create a conflict at 'qty'")
+	})
+
+	t.Run("updates applied in memory", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := Update(types.MustMakeDocument("$rename", types.MustMakeDocument("name", "info.name")))
+		assert.True(t, IsMemoryUpdate(err))
+
+		_, _, err = Update(types.MustMakeDocument("$max", types.MustMakeDocument("size", types.MustMakeDocument("h", int32(1)))))
+		assert.True(t, IsMemoryUpdate(err))
+
+		_, _, err = Update(types.MustMakeDocument("$push", types.MustMakeDocument("tags", types.MustMakeDocument("$each", types.MustNewArray("a"), "$slice", int32(-5)))))
+		assert.True(t, IsMemoryUpdate(err))
+
+		_, _, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(1)), "$pull", types.MustMakeDocument("tags", "a")))
+		assert.True(t, IsMemoryUpdate(err))
+
+		_, _, err = Update(types.MustMakeDocument("$set", types.MustMakeDocument("items.$[line].qty", int32(1))))
+		assert.True(t, IsMemoryUpdate(err))
+
+		_, _, err = Update(types.MustMakeDocument("$rename", types.MustMakeDocument("name", "info"), "$set", types.MustMakeDocument("info.name", "value")))
+		assert.EqualError(t, err, "ConflictingUpdateOperators (40): Updating the path 'info.name' would create a conflict at 'info'")
+	})
+
+	t.Run("check fields of increment", func(t *testing.T) {
+		t.Parallel()
+
+		update := types.MustMakeDocument("$inc", types.MustMakeDocument("qty", int32(1), "stats.views", int32(1)))
+		projectionSQL, conditionSQL, err := NonNumericSQL(update)
+
+		assert.Equal(t, "{\"_id\": \"_id\", \"qty\": \"qty\", \"stats\": \"stats\"}", projectionSQL)
+		assert.Equal(t, "((\"qty\" IS NOT NULL AND NOT IS_NUMBER(\"qty\")) OR (\"qty\" IS NULL AND \"qty\" IS SET) OR (\"stats\".\"views\" IS NOT NULL AND NOT IS_NUMBER(\"stats\".\"views\")) OR (\"stats\".\"views\" IS NULL AND \"stats\".\"views\" IS SET))", conditionSQL)
+		assert.Nil(t, err)
+
+		err = NonNumericError(update, types.MustMakeDocument("_id", int32(1), "qty", int32(3), "stats", types.MustMakeDocument("views", "many")))
+		assert.EqualError(t, err, "TypeMismatch (14): Cannot apply $inc to a value of non-numeric type. {_id: 1} has the field 'views' of non-numeric type string")
+
+		projectionSQL, conditionSQL, err = NonNumericSQL(types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(1))))
+		assert.Equal(t, "", projectionSQL)
+		assert.Equal(t, "", conditionSQL)
+		assert.Nil(t, err)
 	})
 }
@@ -88,11 +88,7 @@ func filterUpsert(filter *types.Document) (*types.Document, error) {
 func updateUpsert(updateDoc *types.Document, d *types.Document) (*types.Document, error) {
 	updateMap := updateDoc.Map()
 
-	setDoc, ok := updateMap["$set"].(types.Document)
-	if !ok {
-		return d, nil
-	}
-
+	setDoc, _ := updateMap["$set"].(types.Document)
 	for key, value := range setDoc.Map() {
 		if strings.HasPrefix(key, "$") {
 			continue
@@ -117,7 +113,44 @@ func updateUpsert(updateDoc *types.Document, d *types.Document) (*types.Document
 
 	}
 
-	return d, nil
+	// $inc and $mul are applied to the values from the query document, a missing field
+	// is set to the increment or to 0
+	for _, op := range arithmeticOperators {
+		opDoc, _ := updateMap[op].(types.Document)
+		for _, key := range opDoc.Keys() {
+			current := updatePathValue(*d, strings.Split(key, "."))
+			if !IsMissing(current) && !isNumber(current) {
+				return nil, NewErrorMessage(ErrTypeMismatch, "Cannot apply %s to a value of non-numeric type. The query has the field '%s' of non-numeric type %s", op, key, aliasFromType(current))
+			}
+		}
+	}
+
+	// the operators are applied to the document from the query like to a stored document
+	others := types.MustMakeDocument()
+	operators := append(append([]string{}, arithmeticOperators...), "$rename", "$currentDate")
+	for _, op := range append(append(operators, boundaryOperators...), arrayOperators...) {
+		if opDoc, ok := updateMap[op]; ok {
+			if err := others.Set(op, opDoc); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+	}
+	// $setOnInsert sets the fields of the inserted document like $set, including dotted paths
+	if setOnInsert, ok := updateMap["$setOnInsert"]; ok {
+		if err := others.Set("$set", setOnInsert); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+	if len(others.Keys()) == 0 {
+		return d, nil
+	}
+
+	res, _, err := ApplyUpdate(*d, others, types.Document{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
 }
 
 func generateObjectID() types.ObjectID {
@@ -43,6 +43,30 @@ func TestUpsert(t *testing.T) {
 			caseName: "update with upsert - update and filter with none equal key-value pair error", updateDoc: types.MustMakeDocumentPointer("$set", types.MustMakeDocument("name", "testing", "type", "normal", "number", int32(123))),
 			filter: types.MustMakeDocumentPointer("name", "test"), replace: false, e: upsertExpected{expDoc: nil, expErr: fmt.Errorf("Key-value pair name:test from query document is not equal to same key-value pair name:testing in update document")},
 		},
+		{
+			caseName: "update with upsert - inc and mul", updateDoc: types.MustMakeDocumentPointer("$inc", types.MustMakeDocument("qty", int32(2), "views", int64(1)), "$mul", types.MustMakeDocument("price", float64(1.5))),
+			filter: types.MustMakeDocumentPointer("name", "test", "qty", int32(3)), replace: false, e: upsertExpected{expDoc: types.MustMakeDocumentPointer("name", "test", "qty", int32(5), "views", int64(1), "price", float64(0)), expErr: nil},
+		},
+		{
+			caseName: "update with upsert - max and rename", updateDoc: types.MustMakeDocumentPointer("$max", types.MustMakeDocument("qty", int32(10), "views", int32(1)), "$rename", types.MustMakeDocument("name", "info.title")),
+			filter: types.MustMakeDocumentPointer("name", "test", "qty", int32(3)), replace: false, e: upsertExpected{expDoc: types.MustMakeDocumentPointer("qty", int32(10), "views", int32(1), "info", types.MustMakeDocument("title", "test")), expErr: nil},
+		},
+		{
+			caseName: "update with upsert - push and add to set", updateDoc: types.MustMakeDocumentPointer("$push", types.MustMakeDocument("scores", types.MustMakeDocument("$each", types.MustNewArray(int32(3), int32(1)), "$sort", int32(1))), "$addToSet", types.MustMakeDocument("tags", "a")),
+			filter: types.MustMakeDocumentPointer("name", "test"), replace: false, e: upsertExpected{expDoc: types.MustMakeDocumentPointer("name", "test", "scores", types.MustNewArray(int32(1), int32(3)), "tags", types.MustNewArray("a")), expErr: nil},
+		},
+		{
+			caseName: "update with upsert - set on insert", updateDoc: types.MustMakeDocumentPointer("$set", types.MustMakeDocument("qty", int32(5)), "$setOnInsert", types.MustMakeDocument("created", "today", "info.source", "upsert")),
+			filter: types.MustMakeDocumentPointer("name", "test"), replace: false, e: upsertExpected{expDoc: types.MustMakeDocumentPointer("name", "test", "qty", int32(5), "created", "today", "info", types.MustMakeDocument("source", "upsert")), expErr: nil},
+		},
+		{
+			caseName: "update with upsert - inc of non-numeric field from query error", updateDoc: types.MustMakeDocumentPointer("$inc", types.MustMakeDocument("name", int32(1))),
+			filter: types.MustMakeDocumentPointer("name", "test"), replace: false, e: upsertExpected{expDoc: nil, expErr: fmt.Errorf("Cannot apply $inc to a value of non-numeric type. The query has the field 'name' of non-numeric type string")},
+		},
+		{
+			caseName: "update with upsert - inc and mul of dotted fields", updateDoc: types.MustMakeDocumentPointer("$inc", types.MustMakeDocument("stats.views", int32(1)), "$mul", types.MustMakeDocument("stats.price", float64(2))),
+			filter: types.MustMakeDocumentPointer("name", "test"), replace: false, e: upsertExpected{expDoc: types.MustMakeDocumentPointer("name", "test", "stats", types.MustMakeDocument("views", int32(1), "price", float64(0))), expErr: nil},
+		},
 	}
 
 	for _, field := range upserCases {
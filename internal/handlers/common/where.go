@@ -22,9 +22,12 @@ package common
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/bson"
 
@@ -46,7 +49,7 @@ func CreateWhereClause(filter types.Document) (sql string, err error) {
 
 		// Stands for key-value SQL
 		var kvSQL string
-		kvSQL, err = wherePair(key, value)
+		kvSQL, err = wherePair(key, value, false)
 
 		if err != nil {
 			return
@@ -58,19 +61,232 @@ func CreateWhereClause(filter types.Document) (sql string, err error) {
 	return
 }
 
-// wherePair takes a {field: value} and converts it to SQL.
-func wherePair(key string, value any) (kvSQL string, err error) {
+// errMemoryFilter marks a filter which can not be translated to SQL, but can be evaluated in memory by MatchDocument.
+var errMemoryFilter = errors.New("the filter can only be evaluated in memory")
+
+// memoryFilterError returns the error for a filter which can only be evaluated in memory.
+func memoryFilterError(filter string) error {
+	return NewError(ErrNotImplemented, fmt.Errorf("%s can not be translated to SQL: %w", filter, errMemoryFilter))
+}
+
+// IsMemoryFilterError returns true if the error marks a filter which can only be evaluated in memory.
+func IsMemoryFilterError(err error) bool {
+	return errors.Is(err, errMemoryFilter)
+}
+
+// SplitFilter splits the filter into the part which is translated to SQL by CreateWhereClause
+// and the part which has to be evaluated in memory by MatchDocument. The SQL filter selects all
+// matching documents and possibly more.
+func SplitFilter(filter types.Document) (sqlFilter types.Document, memoryFilter types.Document, err error) {
+	sqlFilter, memoryFilter = types.MustMakeDocument(), types.MustMakeDocument()
+	for _, key := range filter.Keys() {
+		value := filter.Map()[key]
+
+		target := &sqlFilter
+		if _, err = wherePair(key, value, false); err != nil {
+			if !errors.Is(err, errMemoryFilter) {
+				return
+			}
+			err = nil
+			target = &memoryFilter
+		}
+
+		if target == &sqlFilter {
+			switch sqlMatches(key, value) {
+			case sqlSuperset:
+				if err = memoryFilter.Set(key, value); err != nil {
+					err = lazyerrors.Error(err)
+					return
+				}
+			case sqlPartial:
+				target = &memoryFilter
+			}
+		}
+
+		if err = target.Set(key, value); err != nil {
+			err = lazyerrors.Error(err)
+			return
+		}
+	}
+
+	return
+}
+
+// sqlMatch describes how the documents matched by the SQL of a condition relate to the documents
+// matched by MongoDB. SAP HANA compares JSON objects regardless of the order of their fields.
+type sqlMatch int
+
+const (
+	// sqlExact conditions match the same documents in SQL.
+	sqlExact sqlMatch = iota
+
+	// sqlSuperset conditions can match more documents in SQL, they are evaluated in memory again.
+	sqlSuperset
+
+	// sqlPartial conditions can miss documents in SQL, they are only evaluated in memory.
+	sqlPartial
+)
+
+// and returns the match of a combination of conditions.
+func (m sqlMatch) and(other sqlMatch) sqlMatch {
+	if other > m {
+		return other
+	}
+	return m
+}
+
+// not returns the match of the negated condition.
+func (m sqlMatch) not() sqlMatch {
+	if m == sqlExact {
+		return sqlExact
+	}
+	return sqlPartial
+}
+
+// sqlMatches returns how the SQL of the condition matches the documents. Conditions on embedded
+// documents match more documents in SQL, negated conditions on embedded documents fewer.
+func sqlMatches(key string, value any) sqlMatch {
+	switch strings.ToLower(key) {
+	case "$and", "$or", "$nor":
+		m := sqlExact
+		conditions, _ := value.(*types.Array)
+		for _, condition := range arrayValues(conditions) {
+			condition, _ := condition.(types.Document)
+			m = m.and(filterMatches(condition))
+		}
+
+		if strings.ToLower(key) == "$nor" {
+			return m.not()
+		}
+		return m
+
+	case "$expr":
+		// an expression can compare and negate document literals anywhere
+		if containsDocumentLiteral(value) {
+			return sqlPartial
+		}
+		return sqlExact
+	}
+
+	if doc, ok := value.(types.Document); ok && len(doc.Keys()) != 0 && strings.HasPrefix(doc.Keys()[0], "$") {
+		return operatorsMatch(doc)
+	}
+
+	if containsDocument(value) {
+		return sqlSuperset
+	}
+	return sqlExact
+}
+
+// filterMatches returns how the SQL of all conditions of the filter matches the documents.
+func filterMatches(filter types.Document) sqlMatch {
+	m := sqlExact
+	for _, k := range filter.Keys() {
+		m = m.and(sqlMatches(k, filter.Map()[k]))
+	}
+
+	return m
+}
+
+// operatorsMatch returns how the SQL of the operators of a field matches the documents.
+func operatorsMatch(operators types.Document) sqlMatch {
+	m := sqlExact
+	for _, op := range operators.Keys() {
+		operand := operators.Map()[op]
+
+		switch strings.ToLower(op) {
+		case "$ne", "$nin":
+			if containsDocument(operand) {
+				m = m.and(sqlPartial)
+			}
+
+		case "$not":
+			if operand, ok := operand.(types.Document); ok {
+				m = m.and(operatorsMatch(operand).not())
+			}
+
+		case "$elemmatch":
+			// the condition contains operators of the elements or a filter on their fields
+			operand, _ := operand.(types.Document)
+			for _, k := range operand.Keys() {
+				if strings.HasPrefix(k, "$") {
+					m = m.and(operatorsMatch(types.MustMakeDocument(k, operand.Map()[k])))
+					continue
+				}
+				m = m.and(sqlMatches(k, operand.Map()[k]))
+			}
+
+		default:
+			if containsDocument(operand) {
+				m = m.and(sqlSuperset)
+			}
+		}
+	}
+
+	return m
+}
+
+// containsDocumentLiteral returns true if the expression contains a document which is not an operator.
+func containsDocumentLiteral(expr any) bool {
+	switch expr := expr.(type) {
+	case types.Document:
+		keys := expr.Keys()
+		if len(keys) != 1 || !strings.HasPrefix(keys[0], "$") {
+			return true
+		}
+		return containsDocumentLiteral(expr.Map()[keys[0]])
+
+	case *types.Array:
+		for _, element := range arrayValues(expr) {
+			if containsDocumentLiteral(element) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsDocument returns true if the value is a document or an array containing a document.
+func containsDocument(value any) bool {
+	switch value := value.(type) {
+	case types.Document:
+		return true
+	case *types.Array:
+		for _, element := range arrayValues(value) {
+			if containsDocument(element) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wherePair takes a {field: value} and converts it to SQL. Within $nor, nor is true and the predicates
+// are made definite, so they are false instead of unknown for null and missing fields.
+func wherePair(key string, value any, nor bool) (kvSQL string, err error) {
+	if key == "$expr" {
+		kvSQL, err = exprExpression(value)
+		return
+	}
+
 	if strings.HasPrefix(key, "$") { // {$: value}
 
-		kvSQL, err = logicExpression(key, value)
+		kvSQL, err = logicExpression(key, value, nor)
 		return
 
 	}
 
+	return fieldPair(key, value, nor)
+}
+
+// fieldPair converts a {field: value} to SQL. Unlike wherePair it also accepts the element alias of FOR ANY.
+func fieldPair(key string, value any, nor bool) (kvSQL string, err error) {
 	switch value := value.(type) {
 	case types.Document:
 		if strings.HasPrefix(value.Keys()[0], "$") { // {field: {$: value}}
-			kvSQL, err = fieldExpression(key, value)
+			kvSQL, err = fieldExpression(key, value, nor)
 			return
 		}
 	}
@@ -84,57 +300,66 @@ func wherePair(key string, value any) (kvSQL string, err error) {
 		return
 	}
 
-	// kSQL: KeySQL
-	var kSQL string
-	kSQL, err = whereKey(key)
-	if err != nil {
-		return
-	}
+	kvSQL, err = pathSQL(key, func(kSQL string) (string, error) {
+		if value == nil {
+			return nullSQL(kSQL), nil
+		}
+
+		kvSQL := anyElement(kSQL, sign, vSQL)
+		if nor {
+			kvSQL = definite(kSQL, kvSQL)
+		}
+		return kvSQL, nil
+	})
 
-	kvSQL = kSQL + sign + vSQL
+	return
+}
 
-	if isNor {
-		kvSQL = "(" + kvSQL + " AND " + kSQL + " IS SET)"
+// anyElement returns the predicate of a field which is also true if the field is an array and any
+// of its elements fulfills the predicate, like values are compared with arrays in MongoDB.
+func anyElement(kSQL, sign, vSQL string) string {
+	// NULL is compared as it is
+	if strings.EqualFold(sign, " IS ") {
+		return kSQL + sign + vSQL
 	}
 
-	return
+	return anyElementOf(kSQL, func(field string) string {
+		return field + sign + vSQL
+	})
 }
 
-// whereKey prepares the key (field) for SQL.
-func whereKey(key string) (kSQL string, err error) {
-	if strings.Contains(key, ".") {
-		splitKey := strings.Split(key, ".")
-		var isInt bool
-		for i, k := range splitKey {
-
-			if kInt, convErr := strconv.Atoi(k); convErr == nil {
-				if isInt {
-					kSQL = ""
-					err = NewErrorMessage(ErrNotImplemented, "not yet supporting indexing on an array inside of an array")
-					return
-				}
-				if kInt < 0 {
-					kSQL = ""
-					err = fmt.Errorf("negative array index is not allowed")
-					return
-				}
-				kIntSQL := "[" + "%d" + "]"
-				kSQL += fmt.Sprintf(kIntSQL, (kInt + 1))
-				isInt = true
-				continue
-			}
+// anyElementOf returns the predicate built for the field, which is also true if the field is an array
+// and the predicate is true for any of its elements.
+func anyElementOf(kSQL string, predicate func(field string) string) string {
+	if !elementwise(kSQL) {
+		return predicate(kSQL)
+	}
 
-			if i != 0 {
-				kSQL += "."
-			}
+	return "(" + predicate(kSQL) + " OR FOR ANY " + elementSQL + " IN " + kSQL + " SATISFIES " + predicate(elementSQL) + " END)"
+}
 
-			kSQL += "\"" + k + "\""
+// elementwise returns true if the field is compared element by element if it is an array. _id can not be
+// an array and the elements of $elemMatch and $all are compared as they are.
+func elementwise(kSQL string) bool {
+	return kSQL != "\"_id\"" && !strings.HasPrefix(kSQL, elementSQL)
+}
 
-			isInt = false
+// whereKey prepares the key (field) for SQL. Numeric parts of a dotted key are array indexes.
+func whereKey(key string) (kSQL string, err error) {
+	for i, k := range strings.Split(key, ".") {
+		if kInt, convErr := strconv.Atoi(k); convErr == nil && i != 0 {
+			if kInt < 0 {
+				err = fmt.Errorf("negative array index is not allowed")
+				return "", err
+			}
+			kSQL += fmt.Sprintf("[%d]", kInt+1)
+			continue
+		}
 
+		if i != 0 {
+			kSQL += "."
 		}
-	} else {
-		kSQL = "\"" + key + "\""
+		kSQL += "\"" + k + "\""
 	}
 
 	return
@@ -152,7 +377,7 @@ func whereValue(value any) (vSQL string, sign string, err error) {
 		args = append(args, value)
 	case string:
 		vSQL = "'%s'"
-		args = append(args, value)
+		args = append(args, strings.ReplaceAll(value, "'", "''"))
 	case bool:
 		vSQL = "to_json_boolean(%t)"
 		args = append(args, value)
@@ -160,12 +385,11 @@ func whereValue(value any) (vSQL string, sign string, err error) {
 		vSQL = "NULL"
 		sign = " IS "
 		return
+	case time.Time:
+		vSQL = "%s"
+		args = append(args, dateSQL(value))
 	case types.Regex:
-		vSQL, err = regex(value)
-		if err != nil {
-			return
-		}
-		sign = " LIKE "
+		vSQL, sign, err = regex(value, "")
 		return
 	case types.ObjectID:
 		var bOBJ []byte
@@ -183,6 +407,11 @@ func whereValue(value any) (vSQL string, sign string, err error) {
 		var docValue string
 		docValue, err = whereDocument(value)
 		args = append(args, docValue)
+	case *types.Array:
+		vSQL = "%s"
+		var arraySQL string
+		arraySQL, err = PrepareArrayForSQL(value)
+		args = append(args, arraySQL)
 	default:
 		err = NewErrorMessage(ErrBadValue, "value %T not supported in filter", value)
 		return
@@ -223,7 +452,16 @@ func whereDocument(doc types.Document) (docSQL string, err error) {
 		case string:
 
 			docSQL += "'%s'"
-			args = append(args, value)
+			args = append(args, strings.ReplaceAll(value, "'", "''"))
+		case time.Time:
+			docSQL += "%s"
+			args = append(args, dateSQL(value))
+		case types.Regex:
+			docSQL += "%s"
+			args = append(args, regexValueSQL(value))
+		case types.Binary, types.Timestamp:
+			err = unstorableValueError(value)
+			return
 		case bool:
 
 			docSQL += "to_json_boolean(%t)"
@@ -268,6 +506,22 @@ func whereDocument(doc types.Document) (docSQL string, err error) {
 	return
 }
 
+// dateSQL returns the SQL of a date, which is stored as the milliseconds since the epoch in {"$da": milliseconds}.
+func dateSQL(t time.Time) string {
+	return fmt.Sprintf("{\"$da\": %d}", t.UnixMilli())
+}
+
+// regexValueSQL returns the SQL of a regular expression stored as a value, which is {"$r": pattern, "o": options}.
+func regexValueSQL(regex types.Regex) string {
+	return fmt.Sprintf("{\"$r\": '%s', \"o\": '%s'}", strings.ReplaceAll(regex.Pattern, "'", "''"), strings.ReplaceAll(regex.Options, "'", "''"))
+}
+
+// unstorableValueError returns the error for values in embedded documents and arrays which can not be stored in
+// SAP HANA. No stored value equals them, which is left to the evaluation in memory.
+func unstorableValueError(value any) error {
+	return memoryFilterError(fmt.Sprintf("%s in a document or an array", aliasFromType(value)))
+}
+
 // PrepareArrayForSQL prepares an array which is inside of a document for SQL.
 func PrepareArrayForSQL(a *types.Array) (sqlArray string, err error) {
 	var value any
@@ -284,10 +538,17 @@ func PrepareArrayForSQL(a *types.Array) (sqlArray string, err error) {
 		}
 
 		switch value := value.(type) {
-		case string, int32, int64, float64, types.ObjectID, nil, bool:
+		case string, int32, int64, float64, types.ObjectID, nil, bool, time.Time:
 			var sql string
 			sql, _, err = whereValue(value)
-			sqlArray += sql
+			sqlArray += "%s"
+			args = append(args, sql)
+		case types.Regex:
+			sqlArray += "%s"
+			args = append(args, regexValueSQL(value))
+		case types.Binary, types.Timestamp:
+			err = unstorableValueError(value)
+			return
 		case *types.Array:
 			var sql string
 			sql, err = PrepareArrayForSQL(value)
@@ -321,13 +582,8 @@ func PrepareArrayForSQL(a *types.Array) (sqlArray string, err error) {
 	return
 }
 
-var (
-	isNor      bool
-	norCounter int
-)
-
 // logicExpression converts expressions like $AND and $OR to the equivalent expressions in SQL.
-func logicExpression(key string, value any) (kvSQL string, err error) {
+func logicExpression(key string, value any, nor bool) (kvSQL string, err error) {
 	logicExprMap := map[string]string{
 		"$and": " AND ",
 		"$or":  " OR ",
@@ -346,18 +602,14 @@ func logicExpression(key string, value any) (kvSQL string, err error) {
 		return
 	}
 
-	var localIsNor bool
-	if strings.EqualFold(key, "$nor") {
-		localIsNor = true
-		isNor = true
-		norCounter++
-	}
+	localIsNor := strings.EqualFold(key, "$nor")
+	nor = nor || localIsNor
 
 	kvSQL += "("
 
 	switch value := value.(type) {
 	case *types.Array:
-		if value.Len() < 2 && !isNor {
+		if value.Len() < 2 && !nor {
 			err = fmt.Errorf("need minimum two expressions")
 			return
 		}
@@ -391,7 +643,7 @@ func logicExpression(key string, value any) (kvSQL string, err error) {
 					if err != nil {
 						return
 					}
-					exprSQL, err = wherePair(k, value)
+					exprSQL, err = wherePair(k, value, nor)
 					if err != nil {
 						return
 					}
@@ -417,141 +669,302 @@ func logicExpression(key string, value any) (kvSQL string, err error) {
 
 	kvSQL += ")"
 
-	if localIsNor {
-		norCounter--
-		if norCounter == 0 {
-			isNor = false
-		}
+	return
+}
+
+// exprExpression converts $expr to SQL. Only expressions with the same result in SQL are translated,
+// like comparisons of a field with a constant. All other expressions are evaluated in memory.
+func exprExpression(value any) (kvSQL string, err error) {
+	predicate, ok := compilePredicate(value)
+	if !ok {
+		err = memoryFilterError("$expr")
+		return
 	}
+
+	kvSQL = "(" + predicate + ")"
+
 	return
 }
 
 // fieldExpression converts expressions like $gt or $elemMatch to the equivalent expression in SQL.
 // Used for {field: {$: value}}.
-func fieldExpression(key string, value any) (kvSQL string, err error) {
-	fieldExprMap := map[string]string{
-		"$gt":        " > ",
-		"$gte":       " >= ",
-		"$lt":        " < ",
-		"$lte":       " <= ",
-		"$eq":        " = ",
-		"$ne":        " <> ",
-		"$exists":    " IS ",
-		"$size":      "CARDINALITY",
-		"$all":       "all",
-		"$elemmatch": "elemMatch",
-		"$not":       " NOT ",
-		"$regex":     " LIKE ",
-	}
-
-	var kSQL string
-	kSQL, err = whereKey(key)
+func fieldExpression(key string, value any, nor bool) (kvSQL string, err error) {
+	if traversable(key) {
+		return traversedFieldExpression(key, value, nor)
+	}
+
+	kSQL, err := whereKey(key)
 	if err != nil {
 		return
 	}
 
-	switch value := value.(type) {
-	case types.Document:
+	return fieldExpressionSQL(kSQL, value, nor)
+}
 
-		var exprValue any
-		var vSQL string
-		for i, k := range value.Keys() {
+// traversedFieldExpression converts the expressions on a dotted key which can traverse arrays.
+// Every expression is true if any value found at the path fulfills it. Negations like $ne are
+// true if no value found at the path fulfills the expression without the negation.
+func traversedFieldExpression(key string, value any, nor bool) (kvSQL string, err error) {
+	exprs, ok := value.(types.Document)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "In use of field expression a document was expected. Got instead: %T", value)
+		return
+	}
 
-			if i != 0 {
-				kvSQL += " AND "
+	var predicates []string
+	for _, k := range exprs.Keys() {
+		lowerK := strings.ToLower(k)
+		exprValue := exprs.Map()[k]
+
+		expr := types.MustMakeDocument(k, exprValue)
+		var negate bool
+		switch lowerK {
+		case "$options":
+			if _, ok := exprs.Map()["$regex"]; !ok {
+				err = NewErrorMessage(ErrBadValue, "$options needs a $regex")
+				return
 			}
-			kvSQL += kSQL
-
-			lowerK := strings.ToLower(k)
-
-			fieldExpr, ok := fieldExprMap[lowerK]
-			if !ok {
-				err = NewErrorMessage(ErrNotImplemented, "support for %s is not implemented yet", k)
+			continue
+		case "$regex":
+			if options, ok := exprs.Map()["$options"]; ok {
+				expr = types.MustMakeDocument(k, exprValue, "$options", options)
+			}
+		case "$ne":
+			expr, negate = types.MustMakeDocument("$eq", exprValue), true
+		case "$nin":
+			expr, negate = types.MustMakeDocument("$in", exprValue), true
+		case "$exists":
+			if !isTrue(exprValue) {
+				expr, negate = types.MustMakeDocument(k, true), true
+			}
+		case "$not":
+			if expr, err = notExpression(exprValue); err != nil {
 				return
 			}
+			negate = true
+		}
 
-			exprValue, err = value.Get(k)
+		var predicate string
+		predicate, err = pathSQL(key, func(kSQL string) (string, error) {
+			exprSQL, err := fieldExpressionSQL(kSQL, expr, nor)
 			if err != nil {
-				return
+				return "", err
 			}
-			var sign string
-			if lowerK == "$exists" {
-				switch exprValue := exprValue.(type) {
-				case bool:
-					if exprValue {
-						vSQL = "SET"
-					} else {
-						vSQL = "UNSET"
-					}
-				default:
-					// TODO: allow $exists to be other datatypes than boolean
-					err = fmt.Errorf("$exists only works with boolean")
-					return
-				}
-			} else if lowerK == "$size" {
-				kvSQL = fieldExpr + "(" + kvSQL + ")"
-				vSQL, fieldExpr, err = whereValue(exprValue)
-				if err != nil {
-					return
-				}
-			} else if lowerK == "$all" || lowerK == "$elemmatch" {
-				kvSQL, err = filterArray(kvSQL, fieldExpr, exprValue)
-				if err != nil {
-					return
-				}
-				continue
-			} else if lowerK == "$not" {
-				var fieldSQL string
-				expr := value.Map()[k]
-				fieldSQL, err = fieldExpression(key, expr)
-				fieldSQL = "(" + fieldExpr + fieldSQL + " OR " + kSQL + " IS UNSET) "
-				if err != nil {
-					err = NewErrorMessage(ErrBadValue, "wrong use of $not")
-					return
-				}
 
-				kvSQL = fieldSQL
+			// the negated expression must be false for null and missing fields
+			if negate && !nullSafeExpression(expr) && !nor {
+				exprSQL = definite(kSQL, exprSQL)
+			}
+			return exprSQL, nil
+		})
+		if err != nil {
+			return
+		}
+
+		if negate {
+			predicate = "NOT (" + predicate + ")"
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	kvSQL = strings.Join(predicates, " AND ")
+
+	return
+}
+
+// fieldExpressionSQL converts the expressions on the field with the given SQL.
+func fieldExpressionSQL(kSQL string, value any, nor bool) (kvSQL string, err error) {
+	fieldExprMap := map[string]string{
+		"$gt":           " > ",
+		"$gte":          " >= ",
+		"$lt":           " < ",
+		"$lte":          " <= ",
+		"$eq":           " = ",
+		"$ne":           " <> ",
+		"$exists":       " IS ",
+		"$size":         "CARDINALITY",
+		"$all":          "all",
+		"$elemmatch":    "elemMatch",
+		"$not":          " NOT ",
+		"$regex":        " LIKE ",
+		"$in":           " IN ",
+		"$nin":          " NOT IN ",
+		"$type":         "type",
+		"$mod":          "MOD",
+		"$bitsallset":   "bits",
+		"$bitsanyset":   "bits",
+		"$bitsallclear": "bits",
+		"$bitsanyclear": "bits",
+	}
+
+	exprs, ok := value.(types.Document)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "In use of field expression a document was expected. Got instead: %T", value)
+		return
+	}
+
+	var predicates []string
+	for _, k := range exprs.Keys() {
+		lowerK := strings.ToLower(k)
+		if lowerK == "$options" {
+			if _, ok := exprs.Map()["$regex"]; !ok {
+				err = NewErrorMessage(ErrBadValue, "$options needs a $regex")
 				return
-			} else if lowerK == "$ne" {
-				kvSQL = "(" + kvSQL
-				vSQL, sign, err = whereValue(exprValue)
-				if err != nil {
-					return
-				}
-				if strings.EqualFold(sign, " IS ") {
-					fieldExpr = " IS NOT "
-				}
+			}
+			continue
+		}
 
-				vSQL += " OR " + kSQL + " IS UNSET)"
-			} else if lowerK == "$regex" {
-				vSQL, err = regex(exprValue)
-			} else {
-				vSQL, sign, err = whereValue(exprValue)
-				if err != nil {
-					return
-				}
+		fieldExpr, ok := fieldExprMap[lowerK]
+		if !ok {
+			err = NewErrorMessage(ErrNotImplemented, "support for %s is not implemented yet", k)
+			return
+		}
 
-				if strings.EqualFold(sign, " IS ") {
-					fieldExpr = sign
-				}
+		exprValue := exprs.Map()[k]
+
+		var exprSQL string
+		switch lowerK {
+		case "$exists":
+			exprSQL = existsSQL(kSQL, exprValue)
+		case "$size":
+			var vSQL, sign string
+			if vSQL, sign, err = whereValue(exprValue); err != nil {
+				return
+			}
+			exprSQL = fieldExpr + "(" + kSQL + ")" + sign + vSQL
+		case "$type":
+			exprSQL, err = filterType(kSQL, exprValue)
+		case "$mod":
+			exprSQL, err = filterMod(kSQL, exprValue)
+		case "$bitsallset", "$bitsanyset", "$bitsallclear", "$bitsanyclear":
+			exprSQL, err = filterBits(kSQL, k, exprValue)
+		case "$in", "$nin":
+			exprSQL, err = filterIn(kSQL, exprValue, lowerK == "$nin")
+		case "$all", "$elemmatch":
+			exprSQL, err = filterArray(kSQL, fieldExpr, exprValue, nor)
+		case "$not":
+			var expr types.Document
+			if expr, err = notExpression(exprValue); err != nil {
+				return
+			}
+			if exprSQL, err = fieldExpressionSQL(kSQL, expr, nor); err != nil {
+				return
+			}
+			// within $nor the predicates are definite already
+			exprSQL = negation(kSQL, exprSQL, nullSafeExpression(expr) || nor)
+		case "$ne":
+			if exprSQL, err = fieldExpressionSQL(kSQL, types.MustMakeDocument("$eq", exprValue), nor); err != nil {
+				return
+			}
+			exprSQL = negation(kSQL, exprSQL, nullSafe("$eq", exprValue) || nor)
+		case "$regex":
+			options, ok := exprs.Map()["$options"]
+			if _, isString := options.(string); ok && !isString {
+				err = NewErrorMessage(ErrBadValue, "$options has to be a string")
+				return
 			}
+			optionsString, _ := options.(string)
 
-			kvSQL += fieldExpr + vSQL
-			if isNor {
-				kvSQL = "(" + kvSQL + " AND " + kSQL + " IS SET)"
+			var vSQL string
+			if vSQL, fieldExpr, err = regex(exprValue, optionsString); err != nil {
+				return
 			}
+			exprSQL = anyElement(kSQL, fieldExpr, vSQL)
+		default:
+			exprSQL, err = comparison(kSQL, lowerK, fieldExpr, exprValue)
+		}
+		if err != nil {
+			return
+		}
 
+		if nor && !nullSafe(k, exprValue) {
+			exprSQL = definite(kSQL, exprSQL)
 		}
+		predicates = append(predicates, exprSQL)
+	}
+
+	kvSQL = strings.Join(predicates, " AND ")
 
+	return
+}
+
+// comparison converts $eq, $gt, $gte, $lt and $lte. Like in MongoDB null is only equal to null and missing
+// fields and can not be greater or less than any value.
+func comparison(kSQL, op, sign string, value any) (kvSQL string, err error) {
+	if value == nil {
+		if op == "$gt" || op == "$lt" {
+			kvSQL = "1 = 0"
+			return
+		}
+		kvSQL = nullSQL(kSQL)
+		return
+	}
+
+	// arrays are compared element by element in MongoDB
+	if _, ok := value.(*types.Array); ok && op != "$eq" {
+		err = memoryFilterError(op)
+		return
+	}
+
+	if op == "$eq" {
+		var vSQL string
+		if vSQL, _, err = whereValue(value); err != nil {
+			return
+		}
+		kvSQL = anyElement(kSQL, sign, vSQL)
+		return
+	}
+
+	kvSQL, err = rangeComparison(kSQL, op, sign, value)
+
+	return
+}
+
+// rangeComparison converts $gt, $gte, $lt and $lte. Like in MongoDB only values of the same type bracket
+// are compared, so the field has to have the type of the value. ObjectIDs are compared by their hex string,
+// which has the same order as their bytes.
+func rangeComparison(kSQL, op, sign string, value any) (kvSQL string, err error) {
+	check, vSQL, suffix, err := comparableSQL(value)
+	if err != nil {
+		return
+	}
+	if check == "" {
+		err = memoryFilterError(op)
+		return
+	}
+
+	kvSQL = anyElementOf(kSQL, func(field string) string {
+		return "(" + fmt.Sprintf(check, field) + " AND " + field + suffix + sign + vSQL + ")"
+	})
+
+	return
+}
+
+// comparableSQL returns the type check of the field, the SQL of the value and the suffix of the field for
+// a comparison with the value in SQL. The check is empty if SAP HANA can not compare values of the type.
+func comparableSQL(value any) (check, vSQL, suffix string, err error) {
+	switch value := value.(type) {
+	case int32, int64, float64:
+		check = sqlTypeChecks["number"]
+	case string:
+		check = sqlTypeChecks["string"]
+	case bool:
+		check = sqlTypeChecks["bool"]
+	case types.ObjectID:
+		check = sqlTypeChecks["objectId"]
+		vSQL, suffix = "'"+hex.EncodeToString(value[:])+"'", ".\"oid\""
+		return
 	default:
-		err = NewErrorMessage(ErrBadValue, "In use of field expression a document was expected. Got instead: %T", value)
+		return
 	}
 
+	vSQL, _, err = whereValue(value)
+
 	return
 }
 
 // filterArray implements $all and $elemMatch using the FOR ANY.
-func filterArray(field string, arrayOperator string, filters any) (kvSQL string, err error) {
+func filterArray(field string, arrayOperator string, filters any, nor bool) (kvSQL string, err error) {
 	switch filters := filters.(type) {
 	case types.Document:
 		if strings.EqualFold(arrayOperator, "all") {
@@ -571,35 +984,16 @@ func filterArray(field string, arrayOperator string, filters any) (kvSQL string,
 			}
 			var sql string
 			if strings.Contains(doc.Keys()[0], "$") {
-				sql, err = wherePair("element", doc)
-
-				if strings.EqualFold(doc.Keys()[0], "$not") {
-					sqlSlice := strings.Split(sql, "OR")
-					sql = strings.Replace(sqlSlice[0], "(", "", 1)
-				}
-				if strings.Contains(sql, " IS SET") {
-					sqlSlice := strings.Split(sql, " AND ")
-					sql = strings.Replace(sqlSlice[0], "(", "", 1)
-				}
+				sql, err = fieldPair(elementAlias, doc, nor)
 			} else {
 				var value any
-				element := "element." + doc.Keys()[0]
+				element := elementAlias + "." + doc.Keys()[0]
 				value, err = doc.Get(doc.Keys()[0])
 				if err != nil {
 					return
 				}
 
-				sql, err = wherePair(element, value)
-				if _, ok := value.(types.Document); ok {
-					if _, getErr := value.(types.Document).Get("$not"); getErr == nil {
-						replaceIndex := strings.LastIndex(sql, "UNSET")
-						sql = sql[:replaceIndex] + strings.Replace(sql[replaceIndex:], "UNSET", "NULL", 1)
-					}
-				}
-				if strings.Contains(sql, " IS SET") {
-					sqlSlice := strings.Split(sql, " AND ")
-					sql = strings.Replace(sqlSlice[0], "(", "", 1)
-				}
+				sql, err = fieldPair(element, value, nor)
 			}
 
 			if err != nil {
@@ -607,7 +1001,7 @@ func filterArray(field string, arrayOperator string, filters any) (kvSQL string,
 			}
 
 			if i == 0 {
-				kvSQL += "FOR ANY \"element\" IN " + field + " SATISFIES "
+				kvSQL += "FOR ANY " + elementSQL + " IN " + field + " SATISFIES "
 			}
 			kvSQL += sql
 			i++
@@ -635,7 +1029,7 @@ func filterArray(field string, arrayOperator string, filters any) (kvSQL string,
 			if err != nil {
 				return
 			}
-			kvSQL += "FOR ANY \"element\" IN " + field + " SATISFIES \"element\" = " + value + " END "
+			kvSQL += "FOR ANY " + elementSQL + " IN " + field + " SATISFIES " + elementSQL + " = " + value + " END "
 		}
 	default:
 		err = NewErrorMessage(ErrBadValue, "If $all: Expected array. If $elemMatch: Expected document. Got instead: %T", filters)
@@ -645,115 +1039,211 @@ func filterArray(field string, arrayOperator string, filters any) (kvSQL string,
 	return
 }
 
-// regex converts $regex to the SQL equivalent regular expressions.
-func regex(value any) (vSQL string, err error) {
-	if regex, ok := value.(types.Regex); ok {
-		value = regex.Pattern
-		if regex.Options != "" {
-			err = NewErrorMessage(ErrNotImplemented, "The use of $options with regular expressions is not supported")
-			return
-		}
+// filterIn implements $in and $nin. Scalars are compared with an IN list, regular expressions with LIKE.
+// An array field matches if any of its elements is in the list, which is checked with anyElementOf.
+func filterIn(field string, values any, not bool) (kvSQL string, err error) {
+	array, ok := values.(*types.Array)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "$in needs an array")
+		return
 	}
 
-	var escape bool
-	switch value := value.(type) {
-	case string:
-		if strings.Contains(value, "(?i)") || strings.Contains(value, "(?-i)") {
-			err = NewErrorMessage(ErrNotImplemented, "The use of (?i) and (?-i) with regular expressions is not supported")
+	var list, predicates []string
+	var null bool
+	for i := 0; i < array.Len(); i++ {
+		var value any
+		value, err = array.Get(i)
+		if err != nil {
 			return
 		}
 
-		var dot bool
-		for i, s := range value {
-			if i == 0 {
-				if s == '^' {
-					continue
-				}
-				if s == '.' {
-					dot = true
-					continue
-				}
-				if s == '%' || s == '_' {
-					vSQL += "%" + "^" + string(s)
-					escape = true
-					continue
-				}
-				vSQL += "%" + string(s)
-				continue
+		switch value := value.(type) {
+		case nil:
+			null = true
+		case types.Regex:
+			var vSQL, sign string
+			if vSQL, sign, err = regex(value, ""); err != nil {
+				return
 			}
-
-			if dot && s != '*' && i == 1 {
-				vSQL += "%_"
-				if s != '.' {
-					dot = false
-				} else {
-					continue
-				}
+			predicates = append(predicates, anyElementOf(field, func(f string) string {
+				return f + sign + vSQL
+			}))
+		case *types.Array:
+			err = NewErrorMessage(ErrNotImplemented, "support for arrays in $in and $nin is not implemented yet")
+			return
+		default:
+			if doc, ok := value.(types.Document); ok && len(doc.Keys()) != 0 && strings.HasPrefix(doc.Keys()[0], "$") {
+				err = NewErrorMessage(ErrBadValue, "cannot nest $ under $in")
+				return
 			}
 
-			if i == len(value)-1 {
-				if dot && s != '*' {
-					vSQL += "_"
-					if s == '.' {
-						vSQL += "_%"
-						continue
-					} else {
-						dot = false
-					}
-				}
-				if s == '$' {
-					continue
-				}
-				if s == '*' && dot {
-					vSQL += "%%"
-					continue
-				}
-				if s == '.' {
-					vSQL += "_%"
-					continue
-				}
-				if s == '%' || s == '_' {
-					vSQL += "^" + string(s) + "%"
-					escape = true
-					continue
-				}
-				vSQL += string(s) + "%"
-				continue
+			var vSQL string
+			if vSQL, _, err = whereValue(value); err != nil {
+				return
 			}
+			list = append(list, vSQL)
+		}
+	}
 
-			if dot && s != '*' {
-				vSQL += "_"
-				if s == '.' {
-					continue
-				} else {
-					dot = false
-				}
-			}
+	if len(list) != 0 {
+		inList := "(" + strings.Join(list, ", ") + ")"
+		predicates = append([]string{anyElementOf(field, func(f string) string {
+			return f + " IN " + inList
+		})}, predicates...)
+	}
 
-			if s == '.' {
-				dot = true
-				continue
-			} else if s == '*' && dot {
-				vSQL += "%"
-				dot = false
-				continue
-			} else if s == '%' || s == '_' {
-				vSQL += "^" + string(s)
-				escape = true
-				continue
-			}
+	if null {
+		predicates = append(predicates, nullSQL(field))
+	}
 
-			vSQL += string(s)
+	// every predicate is a single comparison or enclosed in parentheses
+	disjunction := strings.Join(predicates, " OR ")
+	if len(predicates) > 1 {
+		disjunction = "(" + disjunction + ")"
+	}
 
-		}
+	switch {
+	case len(predicates) == 0 && not:
+		// an empty list matches no document, so $nin matches all documents
+		kvSQL = "1 = 1"
+	case len(predicates) == 0:
+		kvSQL = "1 = 0"
+	case not:
+		kvSQL = negation(field, disjunction, null)
 	default:
-		err = NewErrorMessage(ErrBadValue, "Expected either a JavaScript regular expression objects (i.e. /pattern/) or string containing a pattern. Got instead type %T", value)
+		kvSQL = disjunction
+	}
+
+	return
+}
+
+// sqlTypeChecks are the SQL predicates of the types which can be checked by SAP HANA.
+// ObjectIDs are stored as objects with the field oid.
+var sqlTypeChecks = map[string]string{
+	"number":   "IS_NUMBER(%[1]s)",
+	"string":   "IS_STRING(%[1]s)",
+	"object":   "(IS_OBJECT(%[1]s) AND %[1]s.\"oid\" IS UNSET)",
+	"objectId": "(IS_OBJECT(%[1]s) AND %[1]s.\"oid\" IS SET)",
+	"array":    "IS_ARRAY(%[1]s)",
+	"bool":     "IS_BOOLEAN(%[1]s)",
+	"null":     "(%[1]s IS NULL AND %[1]s IS SET)",
+}
+
+// filterType implements $type. SAP HANA does not distinguish between the numeric types,
+// so filters on int, long, double and decimal are evaluated in memory.
+func filterType(field string, value any) (kvSQL string, err error) {
+	aliases, err := typeAliases(value)
+	if err != nil {
+		return
+	}
+
+	var predicates []string
+	for _, alias := range aliases {
+		check, ok := sqlTypeChecks[alias]
+		if !ok {
+			err = memoryFilterError(fmt.Sprintf("$type %q", alias))
+			return
+		}
+
+		if alias == "array" {
+			predicates = append(predicates, fmt.Sprintf(check, field))
+			continue
+		}
+
+		// the elements of an array are checked as well
+		predicates = append(predicates, anyElementOf(field, func(f string) string {
+			return fmt.Sprintf(check, f)
+		}))
+	}
+
+	kvSQL = strings.Join(predicates, " OR ")
+	if len(predicates) > 1 {
+		kvSQL = "(" + kvSQL + ")"
+	}
+
+	return
+}
+
+// filterMod implements $mod. The values are truncated to integers like MongoDB does.
+func filterMod(field string, value any) (kvSQL string, err error) {
+	divisor, remainder, err := modArguments(value)
+	if err != nil {
+		return
+	}
+
+	mod := "MOD(CASE WHEN IS_NUMBER(%[1]s) THEN TO_BIGINT(%[1]s) END, %[2]d) = %[3]d"
+	kvSQL = anyElementOf(field, func(f string) string {
+		return fmt.Sprintf(mod, f, divisor, remainder)
+	})
+
+	return
+}
+
+// modArguments validates the divisor and the remainder of $mod.
+func modArguments(value any) (divisor, remainder int64, err error) {
+	array, ok := value.(*types.Array)
+	if !ok {
+		err = NewErrorMessage(ErrBadValue, "malformed mod, needs to be an array")
+		return
+	}
+
+	args := arrayValues(array)
+	switch {
+	case len(args) < 2:
+		err = NewErrorMessage(ErrBadValue, "malformed mod, not enough elements")
+		return
+	case len(args) > 2:
+		err = NewErrorMessage(ErrBadValue, "malformed mod, too many elements")
 		return
 	}
 
-	vSQL = "'" + vSQL + "'"
-	if escape {
-		vSQL += " ESCAPE '^' "
+	for i, name := range []string{"divisor", "remainder"} {
+		if !isNumber(args[i]) {
+			err = NewErrorMessage(ErrBadValue, "malformed mod, %s not a number", name)
+			return
+		}
+	}
+
+	divisor, remainder = toInt64(args[0]), toInt64(args[1])
+	if divisor == 0 {
+		err = NewErrorMessage(ErrBadValue, "divisor cannot be 0")
+	}
+
+	return
+}
+
+// filterBits implements $bitsAllSet, $bitsAnySet, $bitsAllClear and $bitsAnyClear for numbers.
+// A BinData bitmask or a bit position above 62 is evaluated in memory.
+func filterBits(field string, op string, value any) (kvSQL string, err error) {
+	positions, err := bitPositions(op, value)
+	if err != nil {
+		return
+	}
+
+	if _, ok := value.(types.Binary); ok {
+		err = memoryFilterError(op + " with BinData")
+		return
+	}
+
+	var mask int64
+	for _, position := range positions {
+		if position > 62 {
+			err = memoryFilterError(fmt.Sprintf("%s with bit position %d", op, position))
+			return
+		}
+		mask |= 1 << position
+	}
+
+	bits := fmt.Sprintf("BITAND(CASE WHEN IS_NUMBER(%[1]s) THEN TO_BIGINT(%[1]s) END, %[2]d)", field, mask)
+	switch strings.ToLower(op) {
+	case "$bitsallset":
+		kvSQL = fmt.Sprintf("%s = %d", bits, mask)
+	case "$bitsanyset":
+		kvSQL = bits + " <> 0"
+	case "$bitsallclear":
+		kvSQL = bits + " = 0"
+	case "$bitsanyclear":
+		kvSQL = fmt.Sprintf("%s <> %d", bits, mask)
 	}
 
 	return
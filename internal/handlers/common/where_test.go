@@ -6,8 +6,11 @@ package common
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
 )
@@ -28,22 +31,47 @@ func TestWhere(t *testing.T) {
 			"equal_document", types.MustMakeDocument("field", int32(123)),
 			"equal_float64", float64(123.123),
 			"equal_objId", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107},
-		), e: expectedWhereKey{sql: " WHERE \"equal_string\" = 'string' AND \"equal_int32\" = 1 AND \"equal_int64\" = 123123123123 AND \"equal_bool\" = to_json_boolean(true) AND " +
-			"\"equal_eq\" = 'equal' AND \"equal_document\" = {\"field\": 123} AND \"equal_float64\" = 123.123000 AND \"equal_objId\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'}", err: nil}},
+		), e: expectedWhereKey{sql: " WHERE (\"equal_string\" = 'string' OR FOR ANY \"$element\" IN \"equal_string\" SATISFIES \"$element\" = 'string' END) AND (\"equal_int32\" = 1 OR FOR ANY \"$element\" IN \"equal_int32\" SATISFIES \"$element\" = 1 END) AND " +
+			"(\"equal_int64\" = 123123123123 OR FOR ANY \"$element\" IN \"equal_int64\" SATISFIES \"$element\" = 123123123123 END) AND (\"equal_bool\" = to_json_boolean(true) OR FOR ANY \"$element\" IN \"equal_bool\" SATISFIES \"$element\" = to_json_boolean(true) END) AND " +
+			"(\"equal_eq\" = 'equal' OR FOR ANY \"$element\" IN \"equal_eq\" SATISFIES \"$element\" = 'equal' END) AND (\"equal_document\" = {\"field\": 123} OR FOR ANY \"$element\" IN \"equal_document\" SATISFIES \"$element\" = {\"field\": 123} END) AND " +
+			"(\"equal_float64\" = 123.123000 OR FOR ANY \"$element\" IN \"equal_float64\" SATISFIES \"$element\" = 123.123000 END) AND (\"equal_objId\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'} OR FOR ANY \"$element\" IN \"equal_objId\" SATISFIES \"$element\" = {\"oid\":'62e2bd54510683f9c0bb0d6b'} END)", err: nil}},
 		{name: "where comparison test", r: types.MustMakeDocument("greaterThan_int32", types.MustMakeDocument("$gt", int32(12)),
 			"lessThan_int64", types.MustMakeDocument("$lt", int64(123123)),
-		), e: expectedWhereKey{sql: " WHERE \"greaterThan_int32\" > 12 AND \"lessThan_int64\" < 123123", err: nil}},
+		), e: expectedWhereKey{sql: " WHERE ((IS_NUMBER(\"greaterThan_int32\") AND \"greaterThan_int32\" > 12) OR FOR ANY \"$element\" IN \"greaterThan_int32\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 12) END) AND ((IS_NUMBER(\"lessThan_int64\") AND \"lessThan_int64\" < 123123) OR FOR ANY \"$element\" IN \"lessThan_int64\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" < 123123) END)", err: nil}},
 		{
 			name: "logic expression test", r: types.MustMakeDocument("$or", types.MustNewArray(types.MustMakeDocument("field", "new"), types.MustMakeDocument("field2", true))),
-			e: expectedWhereKey{sql: " WHERE (\"field\" = 'new' OR \"field2\" = to_json_boolean(true))", err: nil},
+			e: expectedWhereKey{sql: " WHERE ((\"field\" = 'new' OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = 'new' END) OR (\"field2\" = to_json_boolean(true) OR FOR ANY \"$element\" IN \"field2\" SATISFIES \"$element\" = to_json_boolean(true) END))", err: nil},
 		},
 		{
-			name: "double array index error", r: types.MustMakeDocument("array.1.2", int32(1)),
-			e: expectedWhereKey{sql: " WHERE ", err: fmt.Errorf("NotImplemented (238): not yet supporting indexing on an array inside of an array")},
+			name: "double array index test", r: types.MustMakeDocument("array.1.2", int32(1)),
+			e: expectedWhereKey{sql: " WHERE (\"array\"[2][3] = 1 OR FOR ANY \"$element\" IN \"array\"[2][3] SATISFIES \"$element\" = 1 END)", err: nil},
 		},
 		{
-			name: "double array index error", r: types.MustMakeDocument("array.1", types.MustNewArray(int32(32))),
-			e: expectedWhereKey{sql: " WHERE ", err: fmt.Errorf("BadValue (2): value *types.Array not supported in filter")},
+			name: "dotted path through arrays test", r: types.MustMakeDocument("items.sku", "abc"),
+			e: expectedWhereKey{sql: " WHERE ((\"items\".\"sku\" = 'abc' OR FOR ANY \"$element\" IN \"items\".\"sku\" SATISFIES \"$element\" = 'abc' END) OR " +
+				"FOR ANY \"$element1\" IN \"items\" SATISFIES (\"$element1\".\"sku\" = 'abc' OR FOR ANY \"$element\" IN \"$element1\".\"sku\" SATISFIES \"$element\" = 'abc' END) END)", err: nil},
+		},
+		{
+			name: "null test", r: types.MustMakeDocument("field", nil),
+			e: expectedWhereKey{sql: " WHERE (\"field\" IS NULL OR \"field\" IS UNSET OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IS NULL END)", err: nil},
+		},
+		{
+			name: "null on dotted path test", r: types.MustMakeDocument("items.sku", nil),
+			e: expectedWhereKey{sql: " WHERE ((NOT IS_ARRAY(\"items\") AND (\"items\".\"sku\" IS NULL OR \"items\".\"sku\" IS UNSET OR FOR ANY \"$element\" IN \"items\".\"sku\" SATISFIES \"$element\" IS NULL END)) OR " +
+				"FOR ANY \"$element1\" IN \"items\" SATISFIES (NOT IS_ARRAY(\"$element1\") AND (\"$element1\".\"sku\" IS NULL OR \"$element1\".\"sku\" IS UNSET OR FOR ANY \"$element\" IN \"$element1\".\"sku\" SATISFIES \"$element\" IS NULL END)) END)", err: nil},
+		},
+		{
+			name: "field named like the element alias test", r: types.MustMakeDocument("element.sku", "abc"),
+			e: expectedWhereKey{sql: " WHERE ((\"element\".\"sku\" = 'abc' OR FOR ANY \"$element\" IN \"element\".\"sku\" SATISFIES \"$element\" = 'abc' END) OR " +
+				"FOR ANY \"$element1\" IN \"element\" SATISFIES (\"$element1\".\"sku\" = 'abc' OR FOR ANY \"$element\" IN \"$element1\".\"sku\" SATISFIES \"$element\" = 'abc' END) END)", err: nil},
+		},
+		{
+			name: "too many traversed fields test", r: types.MustMakeDocument("a.b.c.d.e.f", int32(1)),
+			e: expectedWhereKey{sql: " WHERE ", err: fmt.Errorf("the key a.b.c.d.e.f can not be translated to SQL")},
+		},
+		{
+			name: "array equality test", r: types.MustMakeDocument("array.1", types.MustNewArray(int32(32), "string")),
+			e: expectedWhereKey{sql: " WHERE (\"array\"[2] = [32, 'string'] OR FOR ANY \"$element\" IN \"array\"[2] SATISFIES \"$element\" = [32, 'string'] END)", err: nil},
 		},
 	}
 
@@ -66,6 +94,47 @@ func TestWhere(t *testing.T) {
 	}
 }
 
+func TestWhereConcurrent(t *testing.T) {
+	t.Parallel()
+
+	filters := []types.Document{
+		types.MustMakeDocument("$nor", types.MustNewArray(types.MustMakeDocument("field", types.MustMakeDocument("$ne", int32(1))))),
+		types.MustMakeDocument("field", types.MustMakeDocument("$ne", int32(1))),
+		types.MustMakeDocument("$nor", types.MustNewArray(types.MustMakeDocument("field", types.MustMakeDocument("$not", types.MustMakeDocument("$gt", int32(1)))))),
+		types.MustMakeDocument("field", types.MustMakeDocument("$not", types.MustMakeDocument("$gt", int32(1)))),
+	}
+
+	expected := make([]string, len(filters))
+	for i, filter := range filters {
+		sql, err := CreateWhereClause(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = sql
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				k := (i + j) % len(filters)
+				sql, err := CreateWhereClause(filters[k])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if sql != expected[k] {
+					t.Errorf("where(%v) FAILED. Expected sql = %s got sql = %s", filters[k], expected[k], sql)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 type testCaseWhereKey struct {
 	name string
 	r    string
@@ -85,7 +154,7 @@ func TestWhereKey(t *testing.T) {
 		{name: "field with array index test", r: "array.0", e: expectedWhereKey{sql: "\"array\"[1]", err: nil}},
 		{name: "mix multiple fields and index test", r: "oneField.array.0.twoField", e: expectedWhereKey{sql: "\"oneField\".\"array\"[1].\"twoField\"", err: nil}},
 		{name: "field with negative array index error test", r: "array.-1", e: expectedWhereKey{sql: "", err: fmt.Errorf("negative array index is not allowed")}},
-		{name: "double array index error test", r: "array.0.1", e: expectedWhereKey{sql: "", err: fmt.Errorf("NotImplemented (238): not yet supporting indexing on an array inside of an array")}},
+		{name: "double array index test", r: "array.0.1", e: expectedWhereKey{sql: "\"array\"[1][2]", err: nil}},
 	}
 
 	for _, field := range whereKeyTestCases {
@@ -122,17 +191,19 @@ func TestWhereValue(t *testing.T) {
 		{name: "boolean test", r: true, e: expectedWhereKey{sql: "to_json_boolean(true)", sign: " = ", err: nil}},
 		{name: "boolean test", r: true, e: expectedWhereKey{sql: "to_json_boolean(true)", sign: " = ", err: nil}},
 		{name: "nil test", r: nil, e: expectedWhereKey{sql: "NULL", sign: " IS ", err: nil}},
-		{name: "regex no begin and end sign test", r: types.Regex{Pattern: "pattern"}, e: expectedWhereKey{sql: "'%Pattern%'", sign: " LIKE ", err: nil}},
-		{name: "regex with begin and end sign test", r: types.Regex{Pattern: "^pattern$"}, e: expectedWhereKey{sql: "'Pattern'", sign: " LIKE ", err: nil}},
-		{name: "regex with begin and end sign test", r: types.Regex{Pattern: "^pa_tt_ern$"}, e: expectedWhereKey{sql: "'Pa^_tt^_ern' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex everything test", r: types.Regex{Pattern: "^pa_t.t_er.*n$"}, e: expectedWhereKey{sql: "'Pa^_t_t^_er%n' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex many dots at beginning test", r: types.Regex{Pattern: "...pa_t.t_er.*n$"}, e: expectedWhereKey{sql: "'%___Pa^_t_t^_er%n' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex many dots at end test", r: types.Regex{Pattern: "pa_t.t_er.*n..."}, e: expectedWhereKey{sql: "'%Pa^_t_t^_er%n___%' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex many dots in middle test", r: types.Regex{Pattern: "pa_t...t_er.*n"}, e: expectedWhereKey{sql: "'%Pa^_t___t^_er%n%' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex use of escape at begin and end test", r: types.Regex{Pattern: "_pa_t...t_er.*n%"}, e: expectedWhereKey{sql: "'%^_Pa^_t___t^_er%n^%%' ESCAPE '^' ", sign: " LIKE ", err: nil}},
-		{name: "regex option error test", r: types.Regex{Pattern: "_pa_t...t_er.*n%", Options: "m"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("The use of $options with regular expressions is not supported")}},
-		{name: "regex (i?) error test", r: types.Regex{Pattern: "patt(?i)ern"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("The use of (?i) and (?-i) with regular expressions is not supported")}},
-		{name: "regex (?-i) error test", r: types.Regex{Pattern: "pat(?-i)tern"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("The use of (?i) and (?-i) with regular expressions is not supported")}},
+		{name: "regex without anchor test", r: types.Regex{Pattern: "pattern"}, e: expectedWhereKey{sql: "'pattern'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex prefix test", r: types.Regex{Pattern: "^pattern"}, e: expectedWhereKey{sql: "'pattern%'", sign: " LIKE ", err: nil}},
+		{name: "regex prefix with escape test", r: types.Regex{Pattern: "^pa_t\\.t%ern"}, e: expectedWhereKey{sql: "'pa^_t.t^%ern%' ESCAPE '^'", sign: " LIKE ", err: nil}},
+		{name: "regex with begin and end sign test", r: types.Regex{Pattern: "^pattern$"}, e: expectedWhereKey{sql: "'^pattern$'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex everything test", r: types.Regex{Pattern: "^pa_t.t_er.*n\\d+$"}, e: expectedWhereKey{sql: "'^pa_t.t_er.*n\\d+$'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex quote test", r: types.Regex{Pattern: "it's"}, e: expectedWhereKey{sql: "'it''s'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex options test", r: types.Regex{Pattern: "^pattern", Options: "mi"}, e: expectedWhereKey{sql: "'^pattern' FLAG 'mi'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex inline option test", r: types.Regex{Pattern: "patt(?i)ern"}, e: expectedWhereKey{sql: "'patt(?i)ern'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "regex invalid option error test", r: types.Regex{Pattern: "pattern", Options: "g"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("invalid flag in regex options: g")}},
+		{name: "regex control verb error test", r: types.Regex{Pattern: "(*UTF8)pattern"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("(* in regular expressions is not supported")}},
+		{name: "regex null byte error test", r: types.Regex{Pattern: "pat\x00tern"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("Regular expression cannot contain an embedded null byte")}},
+		{name: "regex lookahead error test", r: types.Regex{Pattern: "pat(?=tern)"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("NotImplemented (238): (?= in regular expressions is not supported")}},
+		{name: "regex backreference error test", r: types.Regex{Pattern: "^(a)\\1"}, e: expectedWhereKey{sql: "", sign: "", err: fmt.Errorf("NotImplemented (238): \\1 in regular expressions is not supported")}},
 		{name: "ObjectID test", r: types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107}, e: expectedWhereKey{sql: "{\"oid\":'62e2bd54510683f9c0bb0d6b'}", sign: " = ", err: nil}},
 		{
 			name: "document test", r: types.MustMakeDocument(
@@ -176,7 +247,11 @@ func TestWhereDocument(t *testing.T) {
 		},
 		{
 			name: "not supported datatype test", r: types.MustMakeDocument("binary", types.Binary{Subtype: types.BinarySubtype(byte(12)), B: []byte("hello")}),
-			e: expectedWhereKey{sql: "{\"binary\": ", err: fmt.Errorf("BadValue (2): the document used in filter contains a datatype not yet supported: types.Binary")},
+			e: expectedWhereKey{sql: "{\"binary\": ", err: fmt.Errorf("NotImplemented (238): binData in a document or an array can not be translated to SQL")},
+		},
+		{
+			name: "stored representation test", r: types.MustMakeDocument("date", time.UnixMilli(1659000000000), "regex", types.Regex{Pattern: "^it's", Options: "i"}, "string", "it's"),
+			e: expectedWhereKey{sql: "{\"date\": {\"$da\": 1659000000000}, \"regex\": {\"$r\": '^it''s', \"o\": 'i'}, \"string\": 'it''s'}", err: nil},
 		},
 	}
 
@@ -212,7 +287,11 @@ func TestPrepareArraySQL(t *testing.T) {
 		},
 		{
 			name: "not support value test", r: types.MustNewArray(types.Binary{Subtype: types.BinarySubtype(byte(12)), B: []byte("hello")}),
-			e: expectedWhereKey{sql: "[", err: fmt.Errorf("The array used in filter contains a datatype not yet supported: types.Binary")},
+			e: expectedWhereKey{sql: "[", err: fmt.Errorf("NotImplemented (238): binData in a document or an array can not be translated to SQL")},
+		},
+		{
+			name: "stored representation test", r: types.MustNewArray(time.UnixMilli(1659000000000), types.Regex{Pattern: "a%s"}, "100%"),
+			e: expectedWhereKey{sql: "[{\"$da\": 1659000000000}, {\"$r\": 'a%s', \"o\": ''}, '100%']", err: nil},
 		},
 	}
 
@@ -244,19 +323,19 @@ func TestLogicExpression(t *testing.T) {
 	logicExpressionTestCases := []testCaseExpression{
 		{
 			name: "AND test", r1: "$and", r2: types.MustNewArray(types.MustMakeDocument("field1", int32(123)), types.MustMakeDocument("field2", "string")),
-			e: expectedWhereKey{sql: "(\"field1\" = 123 AND \"field2\" = 'string')", err: nil},
+			e: expectedWhereKey{sql: "((\"field1\" = 123 OR FOR ANY \"$element\" IN \"field1\" SATISFIES \"$element\" = 123 END) AND (\"field2\" = 'string' OR FOR ANY \"$element\" IN \"field2\" SATISFIES \"$element\" = 'string' END))", err: nil},
 		},
 		{
 			name: "OR test", r1: "$or", r2: types.MustNewArray(types.MustMakeDocument("field1", int32(123)), types.MustMakeDocument("field2", "string")),
-			e: expectedWhereKey{sql: "(\"field1\" = 123 OR \"field2\" = 'string')", err: nil},
+			e: expectedWhereKey{sql: "((\"field1\" = 123 OR FOR ANY \"$element\" IN \"field1\" SATISFIES \"$element\" = 123 END) OR (\"field2\" = 'string' OR FOR ANY \"$element\" IN \"field2\" SATISFIES \"$element\" = 'string' END))", err: nil},
 		},
 		{
 			name: "NOR test", r1: "$nor", r2: types.MustNewArray(types.MustMakeDocument("field1", int32(123)), types.MustMakeDocument("field2", "string")),
-			e: expectedWhereKey{sql: "( NOT ((\"field1\" = 123 AND \"field1\" IS SET)) AND NOT ((\"field2\" = 'string' AND \"field2\" IS SET)))", err: nil},
+			e: expectedWhereKey{sql: "( NOT (((\"field1\" = 123 OR FOR ANY \"$element\" IN \"field1\" SATISFIES \"$element\" = 123 END) AND \"field1\" IS NOT NULL)) AND NOT (((\"field2\" = 'string' OR FOR ANY \"$element\" IN \"field2\" SATISFIES \"$element\" = 'string' END) AND \"field2\" IS NOT NULL)))", err: nil},
 		},
 		{
 			name: "NOR with $elemMatch test", r1: "$nor", r2: types.MustNewArray(types.MustMakeDocument("array_field", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("field", types.MustMakeDocument("new", "doc"))))),
-			e: expectedWhereKey{sql: "( NOT (FOR ANY \"element\" IN \"array_field\" SATISFIES \"element\".\"field\" = {\"new\": 'doc'} END ))", err: nil},
+			e: expectedWhereKey{sql: "( NOT ((FOR ANY \"$element\" IN \"array_field\" SATISFIES (\"$element\".\"field\" = {\"new\": 'doc'} AND \"$element\".\"field\" IS NOT NULL) END  AND \"array_field\" IS NOT NULL)))", err: nil},
 		},
 		{
 			name: "not implemented expression", r1: "$text", r2: "Long text",
@@ -281,7 +360,7 @@ func TestLogicExpression(t *testing.T) {
 	}
 
 	for _, field := range logicExpressionTestCases {
-		sql, err := logicExpression(field.r1, field.r2)
+		sql, err := logicExpression(field.r1, field.r2, false)
 		if field.e.err != nil {
 			if !strings.EqualFold(sql, field.e.sql) || !strings.Contains(err.Error(), field.e.err.Error()) {
 				t.Errorf("%s: logicExpression(%s, %v) FAILED. Expected sql = %s and err = %v got sql = %s and err = %v", field.name,
@@ -300,27 +379,39 @@ func TestFieldExpression(t *testing.T) {
 	fieldExpressionTestCases := []testCaseExpression{
 		{
 			name: "greater than test", r1: "field", r2: types.MustMakeDocument("$gt", int32(9)),
-			e: expectedWhereKey{sql: "\"field\" > 9", err: nil},
+			e: expectedWhereKey{sql: "((IS_NUMBER(\"field\") AND \"field\" > 9) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 9) END)", err: nil},
 		},
 		{
 			name: "less than test", r1: "field", r2: types.MustMakeDocument("$lt", int32(9)),
-			e: expectedWhereKey{sql: "\"field\" < 9", err: nil},
+			e: expectedWhereKey{sql: "((IS_NUMBER(\"field\") AND \"field\" < 9) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" < 9) END)", err: nil},
 		},
 		{
 			name: "greater than or equal test", r1: "field", r2: types.MustMakeDocument("$gte", int32(9)),
-			e: expectedWhereKey{sql: "\"field\" >= 9", err: nil},
+			e: expectedWhereKey{sql: "((IS_NUMBER(\"field\") AND \"field\" >= 9) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" >= 9) END)", err: nil},
 		},
 		{
 			name: "less than or equal test", r1: "field", r2: types.MustMakeDocument("$lte", int32(9)),
-			e: expectedWhereKey{sql: "\"field\" <= 9", err: nil},
+			e: expectedWhereKey{sql: "((IS_NUMBER(\"field\") AND \"field\" <= 9) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" <= 9) END)", err: nil},
 		},
 		{
 			name: "equal test", r1: "field", r2: types.MustMakeDocument("$eq", int32(9)),
-			e: expectedWhereKey{sql: "\"field\" = 9", err: nil},
+			e: expectedWhereKey{sql: "(\"field\" = 9 OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = 9 END)", err: nil},
 		},
 		{
 			name: "not equal test", r1: "field", r2: types.MustMakeDocument("$ne", int32(9)),
-			e: expectedWhereKey{sql: "(\"field\" <> 9 OR \"field\" IS UNSET)", err: nil},
+			e: expectedWhereKey{sql: "NOT (((\"field\" = 9 OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = 9 END) AND \"field\" IS NOT NULL))", err: nil},
+		},
+		{
+			name: "equal null test", r1: "field", r2: types.MustMakeDocument("$eq", nil),
+			e: expectedWhereKey{sql: "(\"field\" IS NULL OR \"field\" IS UNSET OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IS NULL END)", err: nil},
+		},
+		{
+			name: "not equal null test", r1: "field", r2: types.MustMakeDocument("$ne", nil),
+			e: expectedWhereKey{sql: "NOT ((\"field\" IS NULL OR \"field\" IS UNSET OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IS NULL END))", err: nil},
+		},
+		{
+			name: "null is not greater than null test", r1: "field", r2: types.MustMakeDocument("$gt", nil),
+			e: expectedWhereKey{sql: "1 = 0", err: nil},
 		},
 		{
 			name: "exists test", r1: "field", r2: types.MustMakeDocument("$exists", true),
@@ -332,19 +423,138 @@ func TestFieldExpression(t *testing.T) {
 		},
 		{
 			name: "$all test", r1: "field", r2: types.MustMakeDocument("$all", types.MustNewArray(int32(9), "string")),
-			e: expectedWhereKey{sql: "FOR ANY \"element\" IN \"field\" SATISFIES \"element\" = 9 END  AND FOR ANY \"element\" IN \"field\" SATISFIES \"element\" = 'string' END ", err: nil},
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = 9 END  AND FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = 'string' END ", err: nil},
 		},
 		{
 			name: "$elemMatch test", r1: "field", r2: types.MustMakeDocument("$elemMatch", types.MustMakeDocument("$gt", int32(9))),
-			e: expectedWhereKey{sql: "FOR ANY \"element\" IN \"field\" SATISFIES \"element\" > 9 END ", err: nil},
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 9) END ", err: nil},
 		},
 		{
 			name: "not test", r1: "field", r2: types.MustMakeDocument("$not", types.MustMakeDocument("$gt", int32(9))),
-			e: expectedWhereKey{sql: "( NOT \"field\" > 9 OR \"field\" IS UNSET) ", err: nil},
+			e: expectedWhereKey{sql: "NOT ((((IS_NUMBER(\"field\") AND \"field\" > 9) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 9) END) AND \"field\" IS NOT NULL))", err: nil},
+		},
+		{
+			name: "not exists test", r1: "field", r2: types.MustMakeDocument("$not", types.MustMakeDocument("$exists", true)),
+			e: expectedWhereKey{sql: "NOT (\"field\" IS SET)", err: nil},
+		},
+		{
+			name: "not regex test", r1: "field", r2: types.MustMakeDocument("$not", types.Regex{Pattern: "^a"}),
+			e: expectedWhereKey{sql: "NOT (((\"field\" LIKE 'a%' OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" LIKE 'a%' END) AND \"field\" IS NOT NULL))", err: nil},
+		},
+		{
+			name: "$not without document or regex error test", r1: "field", r2: types.MustMakeDocument("$not", int32(1)),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("BadValue (2): $not needs a regex or a document")},
+		},
+		{
+			name: "$eq array test", r1: "field", r2: types.MustMakeDocument("$eq", types.MustNewArray(int32(1), int32(2))),
+			e: expectedWhereKey{sql: "(\"field\" = [1, 2] OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" = [1, 2] END)", err: nil},
+		},
+		{
+			name: "$gt array is evaluated in memory test", r1: "field", r2: types.MustMakeDocument("$gt", types.MustNewArray(int32(1))),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("NotImplemented (238): $gt can not be translated to SQL")},
+		},
+		{
+			name: "$lt string test", r1: "field", r2: types.MustMakeDocument("$lt", "m"),
+			e: expectedWhereKey{sql: "((IS_STRING(\"field\") AND \"field\" < 'm') OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_STRING(\"$element\") AND \"$element\" < 'm') END)", err: nil},
+		},
+		{
+			name: "$gte ObjectID test", r1: "_id", r2: types.MustMakeDocument("$gte", types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107}),
+			e: expectedWhereKey{sql: "((IS_OBJECT(\"_id\") AND \"_id\".\"oid\" IS SET) AND \"_id\".\"oid\" >= '62e2bd54510683f9c0bb0d6b')", err: nil},
+		},
+		{
+			name: "$gt document is evaluated in memory test", r1: "field", r2: types.MustMakeDocument("$gt", types.MustMakeDocument("a", int32(1))),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("NotImplemented (238): $gt can not be translated to SQL")},
+		},
+		{
+			name: "dotted path test", r1: "items.qty", r2: types.MustMakeDocument("$gt", int32(5)),
+			e: expectedWhereKey{sql: "(((IS_NUMBER(\"items\".\"qty\") AND \"items\".\"qty\" > 5) OR FOR ANY \"$element\" IN \"items\".\"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 5) END) OR " +
+				"FOR ANY \"$element1\" IN \"items\" SATISFIES ((IS_NUMBER(\"$element1\".\"qty\") AND \"$element1\".\"qty\" > 5) OR FOR ANY \"$element\" IN \"$element1\".\"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 5) END) END)", err: nil},
+		},
+		{
+			name: "negation on dotted path test", r1: "items.qty", r2: types.MustMakeDocument("$exists", false),
+			e: expectedWhereKey{sql: "NOT ((\"items\".\"qty\" IS SET OR FOR ANY \"$element1\" IN \"items\" SATISFIES \"$element1\".\"qty\" IS SET END))", err: nil},
 		},
 		{
 			name: "$regex test", r1: "field", r2: types.MustMakeDocument("$regex", "pattern"),
-			e: expectedWhereKey{sql: "\"field\" LIKE '%pattern%'", err: nil},
+			e: expectedWhereKey{sql: "(\"field\" LIKE_REGEXPR 'pattern' OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" LIKE_REGEXPR 'pattern' END)", err: nil},
+		},
+		{
+			name: "$regex with $options test", r1: "field", r2: types.MustMakeDocument("$options", "si", "$regex", "^pat.ern"),
+			e: expectedWhereKey{sql: "(\"field\" LIKE_REGEXPR '^pat.ern' FLAG 'si' OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" LIKE_REGEXPR '^pat.ern' FLAG 'si' END)", err: nil},
+		},
+		{
+			name: "$options in both error test", r1: "field", r2: types.MustMakeDocument("$regex", types.Regex{Pattern: "pattern", Options: "i"}, "$options", "m"),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("options set in both $regex and $options")},
+		},
+		{
+			name: "$options without $regex error test", r1: "field", r2: types.MustMakeDocument("$options", "i"),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("$options needs a $regex")},
+		},
+		{
+			name: "$in test", r1: "field", r2: types.MustMakeDocument("$in", types.MustNewArray(int32(9), "string")),
+			e: expectedWhereKey{sql: "(\"field\" IN (9, 'string') OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IN (9, 'string') END)", err: nil},
+		},
+		{
+			name: "$in with null and regex test", r1: "field", r2: types.MustMakeDocument("$in", types.MustNewArray(types.Regex{Pattern: "^a"}, nil)),
+			e: expectedWhereKey{sql: "((\"field\" LIKE 'a%' OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" LIKE 'a%' END) OR (\"field\" IS NULL OR \"field\" IS UNSET OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IS NULL END))", err: nil},
+		},
+		{
+			name: "$in on _id test", r1: "_id", r2: types.MustMakeDocument("$in", types.MustNewArray(int32(1), int32(2), types.Regex{Pattern: "^a"})),
+			e: expectedWhereKey{sql: "(\"_id\" IN (1, 2) OR \"_id\" LIKE 'a%')", err: nil},
+		},
+		{
+			name: "$nin test", r1: "field", r2: types.MustMakeDocument("$nin", types.MustNewArray(types.ObjectID{98, 226, 189, 84, 81, 6, 131, 249, 192, 187, 13, 107})),
+			e: expectedWhereKey{sql: "NOT (((\"field\" IN ({\"oid\":'62e2bd54510683f9c0bb0d6b'}) OR FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IN ({\"oid\":'62e2bd54510683f9c0bb0d6b'}) END) AND \"field\" IS NOT NULL))", err: nil},
+		},
+		{
+			name: "$in combined with other operator test", r1: "field", r2: types.MustMakeDocument("$gt", int32(1), "$in", types.MustNewArray()),
+			e: expectedWhereKey{sql: "((IS_NUMBER(\"field\") AND \"field\" > 1) OR FOR ANY \"$element\" IN \"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 1) END) AND 1 = 0", err: nil},
+		},
+		{
+			name: "$in not used with array error test", r1: "field", r2: types.MustMakeDocument("$in", int32(1)),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("BadValue (2): $in needs an array")},
+		},
+		{
+			name: "$type test", r1: "field", r2: types.MustMakeDocument("$type", types.MustNewArray("string", int32(10))),
+			e: expectedWhereKey{sql: "((IS_STRING(\"field\") OR FOR ANY \"$element\" IN \"field\" SATISFIES IS_STRING(\"$element\") END) OR " +
+				"((\"field\" IS NULL AND \"field\" IS SET) OR FOR ANY \"$element\" IN \"field\" SATISFIES (\"$element\" IS NULL AND \"$element\" IS SET) END))", err: nil},
+		},
+		{
+			name: "$type on _id test", r1: "_id", r2: types.MustMakeDocument("$type", "objectId"),
+			e: expectedWhereKey{sql: "(IS_OBJECT(\"_id\") AND \"_id\".\"oid\" IS SET)", err: nil},
+		},
+		{
+			name: "$type array test", r1: "field", r2: types.MustMakeDocument("$type", "array"),
+			e: expectedWhereKey{sql: "IS_ARRAY(\"field\")", err: nil},
+		},
+		{
+			name: "$type int is evaluated in memory test", r1: "field", r2: types.MustMakeDocument("$type", "int"),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("NotImplemented (238): $type \"int\" can not be translated to SQL")},
+		},
+		{
+			name: "$type unknown alias error test", r1: "field", r2: types.MustMakeDocument("$type", "text"),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("BadValue (2): Unknown type name alias: text")},
+		},
+		{
+			name: "$mod test", r1: "field", r2: types.MustMakeDocument("$mod", types.MustNewArray(float64(4.5), int32(1))),
+			e: expectedWhereKey{sql: "(MOD(CASE WHEN IS_NUMBER(\"field\") THEN TO_BIGINT(\"field\") END, 4) = 1 OR " +
+				"FOR ANY \"$element\" IN \"field\" SATISFIES MOD(CASE WHEN IS_NUMBER(\"$element\") THEN TO_BIGINT(\"$element\") END, 4) = 1 END)", err: nil},
+		},
+		{
+			name: "$mod divisor 0 error test", r1: "field", r2: types.MustMakeDocument("$mod", types.MustNewArray(int32(0), int32(1))),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("BadValue (2): divisor cannot be 0")},
+		},
+		{
+			name: "$bitsAllSet test", r1: "field", r2: types.MustMakeDocument("$bitsAllSet", types.MustNewArray(int32(1), int32(5))),
+			e: expectedWhereKey{sql: "BITAND(CASE WHEN IS_NUMBER(\"field\") THEN TO_BIGINT(\"field\") END, 34) = 34", err: nil},
+		},
+		{
+			name: "$bitsAnyClear test", r1: "field", r2: types.MustMakeDocument("$bitsAnyClear", int32(35)),
+			e: expectedWhereKey{sql: "BITAND(CASE WHEN IS_NUMBER(\"field\") THEN TO_BIGINT(\"field\") END, 35) <> 35", err: nil},
+		},
+		{
+			name: "$bitsAnySet negative bitmask error test", r1: "field", r2: types.MustMakeDocument("$bitsAnySet", int32(-1)),
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("BadValue (2): Expected a positive number in: $bitsAnySet: -1")},
 		},
 		{
 			name: "fieldExpression not used with document error test", r1: "field", r2: "should have been a document",
@@ -355,17 +565,21 @@ func TestFieldExpression(t *testing.T) {
 			e: expectedWhereKey{sql: "\"field\" IS UNSET", err: nil},
 		},
 		{
-			name: "$exists not used with boolean error test", r1: "field", r2: types.MustMakeDocument("$exists", int32(1)),
-			e: expectedWhereKey{sql: "\"field\"", err: fmt.Errorf("$exists only works with boolean")},
+			name: "$exists with number test", r1: "field", r2: types.MustMakeDocument("$exists", int32(1)),
+			e: expectedWhereKey{sql: "\"field\" IS SET", err: nil},
+		},
+		{
+			name: "$exists with null test", r1: "field", r2: types.MustMakeDocument("$exists", nil),
+			e: expectedWhereKey{sql: "\"field\" IS UNSET", err: nil},
 		},
 		{
 			name: "not supported expression error test", r1: "field", r2: types.MustMakeDocument("$geoWithin", "not supported"),
-			e: expectedWhereKey{sql: "\"field\"", err: fmt.Errorf("support for $geoWithin is not implemented yet")},
+			e: expectedWhereKey{sql: "", err: fmt.Errorf("support for $geoWithin is not implemented yet")},
 		},
 	}
 
 	for _, field := range fieldExpressionTestCases {
-		sql, err := fieldExpression(field.r1, field.r2)
+		sql, err := fieldExpression(field.r1, field.r2, false)
 
 		if field.e.err != nil {
 			if !strings.EqualFold(sql, field.e.sql) || !strings.Contains(err.Error(), field.e.err.Error()) {
@@ -381,6 +595,166 @@ func TestFieldExpression(t *testing.T) {
 	}
 }
 
+func TestArraysSQL(t *testing.T) {
+	sql, err := ArraysSQL([]string{"items.sku", "items.qty", "order.lines.0.sku", "_id.date", "size.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "IS_ARRAY(\"items\") OR IS_ARRAY(\"order\") OR IS_ARRAY(\"order\".\"lines\"[1])"
+	if sql != expected {
+		t.Errorf("ArraysSQL FAILED. Expected sql = %s got sql = %s", expected, sql)
+	}
+
+	if sql, err = ArraysSQL([]string{"_id.date"}); sql != "" || err != nil {
+		t.Errorf("ArraysSQL FAILED. Expected no sql got sql = %s and err = %v", sql, err)
+	}
+}
+
+func TestSplitFilter(t *testing.T) {
+	filter := types.MustMakeDocument(
+		"item", "journal",
+		"qty", types.MustMakeDocument("$type", "int"),
+		"$or", types.MustNewArray(
+			types.MustMakeDocument("size", types.MustMakeDocument("$bitsAllSet", types.Binary{B: []byte{1}})),
+			types.MustMakeDocument("size", int32(1)),
+		),
+		"tags", types.MustMakeDocument("$type", "array"),
+	)
+
+	sqlFilter, memoryFilter, err := SplitFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSQL := types.MustMakeDocument("item", "journal", "tags", types.MustMakeDocument("$type", "array"))
+	if !reflect.DeepEqual(sqlFilter, expectedSQL) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected SQL filter %v got %v", filter, expectedSQL, sqlFilter)
+	}
+
+	expectedMemory := types.MustMakeDocument("qty", filter.Map()["qty"], "$or", filter.Map()["$or"])
+	if !reflect.DeepEqual(memoryFilter, expectedMemory) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected memory filter %v got %v", filter, expectedMemory, memoryFilter)
+	}
+
+	// embedded documents are compared in SAP HANA and again in memory
+	filter = types.MustMakeDocument(
+		"size", types.MustMakeDocument("h", int32(14), "w", int32(21)),
+		"$or", types.MustNewArray(
+			types.MustMakeDocument("dim", types.MustMakeDocument("$eq", types.MustNewArray(types.MustMakeDocument("h", int32(1))))),
+			types.MustMakeDocument("qty", int32(1)),
+		),
+		"item", types.MustMakeDocument("$ne", types.MustMakeDocument("name", "journal")),
+	)
+
+	sqlFilter, memoryFilter, err = SplitFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSQL = types.MustMakeDocument("size", filter.Map()["size"], "$or", filter.Map()["$or"])
+	if !reflect.DeepEqual(sqlFilter, expectedSQL) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected SQL filter %v got %v", filter, expectedSQL, sqlFilter)
+	}
+
+	// negated conditions on embedded documents are only evaluated in memory
+	if !reflect.DeepEqual(memoryFilter, filter) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected memory filter %v got %v", filter, filter, memoryFilter)
+	}
+
+	dim := types.MustMakeDocument("h", int32(1))
+	filter = types.MustMakeDocument(
+		"a", types.MustMakeDocument("$in", types.MustNewArray(dim, int32(1))),
+		"b", types.MustMakeDocument("$all", types.MustNewArray(dim)),
+		"c", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("dim", dim)),
+		"d", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("$gt", int32(1))),
+		"e", types.MustMakeDocument("$nin", types.MustNewArray(dim)),
+		"f", types.MustMakeDocument("$not", types.MustMakeDocument("$eq", dim)),
+		"g", types.MustMakeDocument("$elemMatch", types.MustMakeDocument("dim", types.MustMakeDocument("$ne", dim))),
+		"$nor", types.MustNewArray(types.MustMakeDocument("dim", dim)),
+		"$expr", types.MustMakeDocument("$ne", types.MustNewArray("$dim", dim)),
+		"h", types.MustMakeDocument("$not", types.MustMakeDocument("$gt", int32(1))),
+	)
+
+	if sqlFilter, memoryFilter, err = SplitFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSQL = types.MustMakeDocument(
+		"a", filter.Map()["a"], "b", filter.Map()["b"], "c", filter.Map()["c"], "d", filter.Map()["d"], "h", filter.Map()["h"],
+	)
+	if !reflect.DeepEqual(sqlFilter, expectedSQL) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected SQL filter %v got %v", filter, expectedSQL, sqlFilter)
+	}
+
+	expectedMemory = types.MustMakeDocument(
+		"a", filter.Map()["a"], "b", filter.Map()["b"], "c", filter.Map()["c"], "e", filter.Map()["e"], "f", filter.Map()["f"],
+		"g", filter.Map()["g"], "$nor", filter.Map()["$nor"], "$expr", filter.Map()["$expr"],
+	)
+	if !reflect.DeepEqual(memoryFilter, expectedMemory) {
+		t.Errorf("SplitFilter(%v) FAILED. Expected memory filter %v got %v", filter, expectedMemory, memoryFilter)
+	}
+
+	// a key with too many fields in arrays is evaluated in memory
+	filter = types.MustMakeDocument("item", "journal", "a.b.c.d.e.f", int32(1))
+	if sqlFilter, memoryFilter, err = SplitFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(memoryFilter, types.MustMakeDocument("a.b.c.d.e.f", int32(1))) {
+		t.Errorf("SplitFilter(%v) FAILED. Got memory filter %v", filter, memoryFilter)
+	}
+
+	if _, _, err = SplitFilter(types.MustMakeDocument("qty", types.MustMakeDocument("$mod", int32(1)))); err == nil {
+		t.Errorf("SplitFilter FAILED. Expected error for malformed $mod")
+	}
+}
+
+func TestExprExpression(t *testing.T) {
+	exprTestCases := []struct {
+		name string
+		expr any
+		sql  string
+		err  string
+	}{
+		{
+			name: "comparison with constant", expr: types.MustMakeDocument("$gt", types.MustNewArray("$qty", int32(20))),
+			sql: "(((IS_NUMBER(\"qty\") AND \"qty\" > 20) OR NOT (IS_NUMBER(\"qty\") OR \"qty\" IS NULL)))",
+		},
+		{
+			name: "logical expression", expr: types.MustMakeDocument("$and", types.MustNewArray(types.MustMakeDocument("$eq", types.MustNewArray("$item", "journal")), true)),
+			sql: "(((IS_STRING(\"item\") AND \"item\" = 'journal') AND 1 = 1))",
+		},
+		{
+			name: "comparison of two fields", expr: types.MustMakeDocument("$gt", types.MustNewArray("$spent", "$budget")),
+			err: "NotImplemented (238): $expr can not be translated to SQL: the filter can only be evaluated in memory",
+		},
+		{
+			name: "comparison of a dotted path", expr: types.MustMakeDocument("$gt", types.MustNewArray("$size.h", int32(10))),
+			err: "NotImplemented (238): $expr can not be translated to SQL: the filter can only be evaluated in memory",
+		},
+	}
+
+	for _, tc := range exprTestCases {
+		sql, err := exprExpression(tc.expr)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: exprExpression(%v) FAILED. Expected err = %s got err = %v", tc.name, tc.expr, tc.err, err)
+			}
+			continue
+		}
+
+		if err != nil || sql != tc.sql {
+			t.Errorf("%s: exprExpression(%v) FAILED. Expected sql = %s got sql = %s and err = %v", tc.name, tc.expr, tc.sql, sql, err)
+		}
+	}
+
+	filter := types.MustMakeDocument("item", "journal", "$expr", types.MustMakeDocument("$gt", types.MustNewArray("$spent", "$budget")))
+	sqlFilter, memoryFilter, err := SplitFilter(filter)
+	if err != nil || !reflect.DeepEqual(sqlFilter, types.MustMakeDocument("item", "journal")) || memoryFilter.Keys()[0] != "$expr" {
+		t.Errorf("SplitFilter(%v) FAILED. Expected $expr in memory filter got %v, %v and err = %v", filter, sqlFilter, memoryFilter, err)
+	}
+}
+
 type testCaseFilterArray struct {
 	name string
 	r1   string
@@ -393,15 +767,27 @@ func TestFilterArray(t *testing.T) {
 	filterArrayTestCases := []testCaseFilterArray{
 		{
 			name: "$elemMatch with comparison test", r1: "\"nested\".\"field\"", r2: "elemMatch", r3: types.MustMakeDocument("$gte", int32(9)),
-			e: expectedWhereKey{sql: "FOR ANY \"element\" IN \"nested\".\"field\" SATISFIES \"element\" >= 9 END ", err: nil},
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"nested\".\"field\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" >= 9) END ", err: nil},
 		},
 		{
 			name: "$elemMatch with field: value test", r1: "\"nested\".\"field\"", r2: "elemMatch", r3: types.MustMakeDocument("field", float64(14.241234)),
-			e: expectedWhereKey{sql: "FOR ANY \"element\" IN \"nested\".\"field\" SATISFIES \"element\".\"field\" = 14.241234 END ", err: nil},
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"nested\".\"field\" SATISFIES \"$element\".\"field\" = 14.241234 END ", err: nil},
+		},
+		{
+			name: "$elemMatch with $in test", r1: "\"field\"", r2: "elemMatch", r3: types.MustMakeDocument("$in", types.MustNewArray(int32(1), int32(2))),
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"field\" SATISFIES \"$element\" IN (1, 2) END ", err: nil},
+		},
+		{
+			name: "$elemMatch with $type test", r1: "\"field\"", r2: "elemMatch", r3: types.MustMakeDocument("$type", "string"),
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"field\" SATISFIES IS_STRING(\"$element\") END ", err: nil},
+		},
+		{
+			name: "$elemMatch with $mod test", r1: "\"field\"", r2: "elemMatch", r3: types.MustMakeDocument("$mod", types.MustNewArray(int32(2), int32(0))),
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"field\" SATISFIES MOD(CASE WHEN IS_NUMBER(\"$element\") THEN TO_BIGINT(\"$element\") END, 2) = 0 END ", err: nil},
 		},
 		{
 			name: "$all test", r1: "\"nested\".\"field\"", r2: "all", r3: types.MustNewArray("field", float64(14.241234)),
-			e: expectedWhereKey{sql: "FOR ANY \"element\" IN \"nested\".\"field\" SATISFIES \"element\" = 'field' END  AND FOR ANY \"element\" IN \"nested\".\"field\" SATISFIES \"element\" = 14.241234 END ", err: nil},
+			e: expectedWhereKey{sql: "FOR ANY \"$element\" IN \"nested\".\"field\" SATISFIES \"$element\" = 'field' END  AND FOR ANY \"$element\" IN \"nested\".\"field\" SATISFIES \"$element\" = 14.241234 END ", err: nil},
 		},
 		{
 			name: "not using array with $all error test", r1: "field", r2: "all", r3: "should have been array",
@@ -418,7 +804,7 @@ func TestFilterArray(t *testing.T) {
 	}
 
 	for _, field := range filterArrayTestCases {
-		sql, err := filterArray(field.r1, field.r2, field.r3)
+		sql, err := filterArray(field.r1, field.r2, field.r3, false)
 
 		if field.e.err != nil {
 			if !strings.EqualFold(sql, field.e.sql) || !strings.Contains(err.Error(), field.e.err.Error()) {
@@ -436,22 +822,24 @@ func TestFilterArray(t *testing.T) {
 
 func TestRegex(t *testing.T) {
 	regexTestCases := []testCaseWhereValue{
-		{name: "test regex", r: "pattern", e: expectedWhereKey{sql: "'%pattern%'", err: nil}},
+		{name: "test regex", r: "pattern", e: expectedWhereKey{sql: "'pattern'", sign: " LIKE_REGEXPR ", err: nil}},
+		{name: "test prefix", r: "^it's \\^100%", e: expectedWhereKey{sql: "'it''s ^^100^%%' ESCAPE '^'", sign: " LIKE ", err: nil}},
+		{name: "test escaped class", r: "^\\d", e: expectedWhereKey{sql: "'^\\d'", sign: " LIKE_REGEXPR ", err: nil}},
 		{name: "wrong value for $regex", r: int32(2), e: expectedWhereKey{sql: "", err: fmt.Errorf("Expected either a JavaScript regular expression objects (i.e. /pattern/) or string containing a pattern. Got instead type int32")}},
 	}
 
 	for _, field := range regexTestCases {
-		sql, err := regex(field.r)
+		sql, sign, err := regex(field.r, "")
 
 		if field.e.err != nil {
-			if !strings.EqualFold(sql, field.e.sql) || !strings.Contains(err.Error(), field.e.err.Error()) {
-				t.Errorf("%s: where(%v) FAILED. Expected sql = %s and err = %v got sql = %s and err = %v", field.name,
+			if sql != field.e.sql || err == nil || !strings.Contains(err.Error(), field.e.err.Error()) {
+				t.Errorf("%s: regex(%v) FAILED. Expected sql = %s and err = %v got sql = %s and err = %v", field.name,
 					field.r, field.e.sql, field.e.err, sql, err)
 			}
 		} else {
-			if !strings.EqualFold(sql, field.e.sql) || err != field.e.err {
-				t.Errorf("%s: where(%v) FAILED. Expected sql = %s and err = %v got sql = %s and err = %v", field.name,
-					field.r, field.e.sql, field.e.err, sql, err)
+			if sql != field.e.sql || sign != field.e.sign || err != nil {
+				t.Errorf("%s: regex(%v) FAILED. Expected sql = %s, sign = %s got sql = %s, sign = %s and err = %v", field.name,
+					field.r, field.e.sql, field.e.sign, sql, sign, err)
 			}
 		}
 	}
@@ -27,25 +27,26 @@ import (
 )
 
 // nextRow iterates each retrieved document and returns them unmarshaled
-func nextRow(rows *sql.Rows) (*types.Document, error) {
+// together with the size of the retrieved JSON document in bytes.
+func nextRow(rows *sql.Rows) (*types.Document, int, error) {
 	if !rows.Next() {
 		err := rows.Err()
 		if err != nil {
 			err = lazyerrors.Error(err)
 		}
-		return nil, err
+		return nil, 0, err
 	}
 
 	var b []byte
 	if err := rows.Scan(&b); err != nil {
-		return nil, lazyerrors.Error(err)
+		return nil, 0, lazyerrors.Error(err)
 	}
 
 	var doc bson.Document
 	if err := doc.UnmarshalJSON(b); err != nil {
-		return nil, lazyerrors.Error(err)
+		return nil, 0, lazyerrors.Error(err)
 	}
 
 	d := types.MustConvertDocument(&doc)
-	return &d, nil
+	return &d, len(b), nil
 }
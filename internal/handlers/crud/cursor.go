@@ -0,0 +1,386 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/bson"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+const (
+	// defaultBatchSize is the number of documents returned in the first batch if no batchSize is given.
+	defaultBatchSize = 101
+
+	// defaultCursorTimeout is the time after which an idle cursor is closed. Same as in MongoDB.
+	defaultCursorTimeout = 10 * time.Minute
+
+	// maxCursors is the number of cursors a client connection can keep open, as every open
+	// cursor holds the rows of its query and with them a connection to SAP HANA.
+	maxCursors = 100
+)
+
+// cursor keeps the rows of a query open so the remaining documents can be fetched with getMore.
+// A cursor of an aggregation with stages processed in memory holds the remaining documents in docs instead.
+type cursor struct {
+	id         int64
+	ns         string
+	rows       *sql.Rows
+	ctx        *cursorContext
+	docs       []types.Document
+	held       *types.Document
+	heldSize   int
+	projection types.Document
+	filter     types.Document
+	exclusion  bool
+	noTimeout  bool
+	timer      *time.Timer
+}
+
+// cursorRegistry holds the open cursors of one client connection.
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[int64]*cursor
+	timeout time.Duration
+}
+
+// newCursorRegistry creates an empty cursorRegistry.
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{
+		cursors: map[int64]*cursor{},
+		timeout: defaultCursorTimeout,
+	}
+}
+
+// register adds the cursor to the registry and returns its id.
+// It returns an error if the connection already has maxCursors open cursors.
+func (r *cursorRegistry) register(c *cursor) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cursors) >= maxCursors {
+		return 0, common.NewErrorMessage(
+			common.ErrBadValue,
+			"Too many open cursors: at most %d cursors can be open per connection, exhaust or kill a cursor first", maxCursors,
+		)
+	}
+
+	for c.id == 0 {
+		id := newCursorID()
+		if _, ok := r.cursors[id]; !ok {
+			c.id = id
+		}
+	}
+
+	r.add(c)
+	return c.id, nil
+}
+
+// take removes the cursor with the given id from the registry so it can be used without
+// being closed by the idle timeout. It returns nil if there is no such cursor.
+func (r *cursorRegistry) take(id int64) *cursor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil
+	}
+
+	delete(r.cursors, id)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	return c
+}
+
+// release puts a cursor back into the registry after it has been taken.
+func (r *cursorRegistry) release(c *cursor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(c)
+}
+
+// kill closes the cursor with the given id. It returns false if there is no such cursor.
+func (r *cursorRegistry) kill(id int64) bool {
+	c := r.take(id)
+	if c == nil {
+		return false
+	}
+
+	c.close()
+	return true
+}
+
+// closeAll closes all cursors of the registry.
+func (r *cursorRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, c := range r.cursors {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.close()
+		delete(r.cursors, id)
+	}
+}
+
+// add stores the cursor and starts its idle timeout. The caller must hold the lock.
+func (r *cursorRegistry) add(c *cursor) {
+	r.cursors[c.id] = c
+
+	if c.noTimeout {
+		return
+	}
+
+	c.timer = time.AfterFunc(r.timeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		// the cursor might have been taken or replaced in the meantime
+		if r.cursors[c.id] != c {
+			return
+		}
+
+		delete(r.cursors, c.id)
+		c.close()
+	})
+}
+
+// close releases the rows of the cursor and the context of its query.
+func (c *cursor) close() {
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	if c.ctx != nil {
+		c.ctx.cancel(context.Canceled)
+	}
+	c.docs = nil
+	c.held = nil
+}
+
+// startBatch starts the time limit of the cursor's query for reading the next batch.
+func (c *cursor) startBatch(maxTime time.Duration) {
+	if c.ctx != nil {
+		c.ctx.startBatch(maxTime)
+	}
+}
+
+// stopBatch stops the time limit of the cursor's query, so the time until the next batch does not count.
+func (c *cursor) stopBatch() {
+	if c.ctx != nil {
+		c.ctx.stopBatch()
+	}
+}
+
+// nextBatch reads up to batchSize documents from the cursor. If batchSize is 0
+// documents are read until the maximum BSON document size is reached. A document
+// which does not fit into the batch anymore is held back for the next batch.
+// The returned bool is true when no more documents are left.
+func (c *cursor) nextBatch(batchSize int32) (*types.Array, bool, error) {
+	docs := types.MakeArray(0)
+
+	var size int
+	for batchSize == 0 || int32(docs.Len()) < batchSize {
+		doc, docSize, err := c.next()
+		if err != nil {
+			return nil, false, lazyerrors.Error(err)
+		}
+
+		if doc == nil {
+			return docs, true, c.projectBatch(docs)
+		}
+
+		// a batch always contains at least one document
+		if docs.Len() != 0 && size+docSize > bson.MaxDocumentLen {
+			c.held, c.heldSize = doc, docSize
+			break
+		}
+
+		if err = docs.Append(*doc); err != nil {
+			return nil, false, lazyerrors.Error(err)
+		}
+		size += docSize
+	}
+
+	return docs, false, c.projectBatch(docs)
+}
+
+// next returns the next document of the cursor or nil if there are no more documents.
+func (c *cursor) next() (*types.Document, int, error) {
+	if c.held != nil {
+		doc, size := c.held, c.heldSize
+		c.held, c.heldSize = nil, 0
+		return doc, size, nil
+	}
+
+	if c.rows != nil {
+		return nextRow(c.rows)
+	}
+
+	if len(c.docs) == 0 {
+		return nil, 0, nil
+	}
+
+	doc := c.docs[0]
+	c.docs = c.docs[1:]
+
+	// the size is only used to limit the batch, so the size of the document as BSON is good enough
+	bsonDoc, err := bson.ConvertDocument(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b, err := bsonDoc.MarshalBinary()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &doc, len(b), nil
+}
+
+// all reads all remaining documents of the cursor and closes it.
+func (c *cursor) all() ([]types.Document, error) {
+	defer c.close()
+
+	docs := types.MakeArray(0)
+	for {
+		doc, _, err := c.next()
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+
+		if doc == nil {
+			break
+		}
+
+		if err = docs.Append(*doc); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+
+	if err := c.projectBatch(docs); err != nil {
+		return nil, err
+	}
+
+	res := make([]types.Document, docs.Len())
+	for i := range res {
+		doc, err := docs.Get(i)
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+		res[i] = doc.(types.Document)
+	}
+
+	return res, nil
+}
+
+// projectBatch applies an exclusion projection, or any other projection performed in memory, to the documents of a batch.
+func (c *cursor) projectBatch(docs *types.Array) error {
+	if !c.exclusion {
+		return nil
+	}
+
+	if err := common.ProjectDocuments(docs, c.projection, c.filter); err != nil {
+		return lazyerrors.Error(err)
+	}
+
+	return nil
+}
+
+// createCursorResponse returns the first batch of the cursor. The cursor is registered
+// for getMore unless it is exhausted or only a single batch is requested.
+func (h *storage) createCursorResponse(c *cursor, batchSize int32, singleBatch bool) (*wire.OpMsg, error) {
+	// batchSize 0 creates the cursor without returning any documents
+	docs := types.MakeArray(0)
+	var exhausted bool
+	if batchSize != 0 {
+		var err error
+		docs, exhausted, err = c.nextBatch(batchSize)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	c.stopBatch()
+
+	var id int64
+	if exhausted || singleBatch {
+		c.close()
+	} else {
+		var err error
+		if id, err = h.cursors.register(c); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	var resp wire.OpMsg
+	err := resp.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"firstBatch", docs,
+				"id", id,
+				"ns", c.ns,
+			),
+			"ok", float64(1),
+		)},
+	})
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return &resp, nil
+}
+
+// getBatchSize returns the batchSize of a find or getMore command.
+// If batchSize is not given, defaultSize is returned.
+func getBatchSize(docMap map[string]any, defaultSize int32) (int32, error) {
+	value, ok := docMap["batchSize"]
+	if !ok {
+		return defaultSize, nil
+	}
+
+	var batchSize int32
+	switch value := value.(type) {
+	case int32:
+		batchSize = value
+	case int64:
+		batchSize = int32(value)
+	case float64:
+		if !anyIsInt(value) {
+			return 0, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'batchSize' is the wrong type '%T', expected an integer", value)
+		}
+		batchSize = int32(value)
+	default:
+		return 0, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'batchSize' is the wrong type '%T', expected an integer", value)
+	}
+
+	if batchSize < 0 {
+		return 0, common.NewErrorMessage(common.ErrBadValue, "BatchSize value must be non-negative, but received: %d", batchSize)
+	}
+
+	return batchSize, nil
+}
+
+// newCursorID generates a random positive cursor id.
+func newCursorID() int64 {
+	var id uint64
+	common.NoError(binary.Read(rand.Reader, binary.BigEndian, &id))
+
+	return int64(id >> 1)
+}
@@ -0,0 +1,425 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/bson"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// maxLookupValues is the maximum number of local values or of bindings of variables which are used
+// to restrict a single query on the foreign collection. More are queried in batches.
+const maxLookupValues = 1000
+
+// localSQL selects the documents which are passed to the first stage of a pipeline processed in memory.
+type localSQL struct {
+	p          *pipeline
+	db         string
+	collection string
+}
+
+// lookupWhereClause creates the WHERE-clause selecting the foreign documents of a $lookup equality match
+// with a subquery of the local field. Values which are not selected by the subquery are compared separately.
+func (l *localSQL) lookupWhereClause(lookup *lookup, values []any) (string, error) {
+	subquery := func(columnSQL string) (string, error) {
+		return l.p.selectSQL(columnSQL, "", l.db, l.collection)
+	}
+
+	return common.LookupWhereClause(lookup.localField, lookup.foreignField, subquery, values)
+}
+
+// lookup is a $lookup stage of an aggregation pipeline.
+type lookup struct {
+	from         string
+	localField   string
+	foreignField string
+	as           string
+	let          types.Document
+	pipeline     *types.Array
+}
+
+// newLookup validates the specification of a $lookup stage.
+func newLookup(spec any) (*lookup, error) {
+	doc, ok := spec.(types.Document)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrFailedToParse, "the $lookup specification must be an Object")
+	}
+
+	var l lookup
+	for _, k := range doc.Keys() {
+		v := doc.Map()[k]
+
+		switch k {
+		case "from", "localField", "foreignField", "as":
+			s, ok := v.(string)
+			if !ok {
+				return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup argument '%s' must be a string, is type %T", k, v)
+			}
+
+			switch k {
+			case "from":
+				l.from = s
+			case "localField":
+				l.localField = s
+			case "foreignField":
+				l.foreignField = s
+			case "as":
+				l.as = s
+			}
+
+		case "let":
+			if l.let, ok = v.(types.Document); !ok {
+				return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup argument 'let' must be an object, is type %T", v)
+			}
+
+		case "pipeline":
+			if l.pipeline, ok = v.(*types.Array); !ok {
+				return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup argument 'pipeline' must be an array, is type %T", v)
+			}
+
+		default:
+			return nil, common.NewErrorMessage(common.ErrFailedToParse, "unknown argument to $lookup: %s", k)
+		}
+	}
+
+	if l.from == "" {
+		return nil, common.NewErrorMessage(common.ErrFailedToParse, "must specify 'from' field for a $lookup")
+	}
+
+	if l.as == "" {
+		return nil, common.NewErrorMessage(common.ErrFailedToParse, "must specify 'as' field for a $lookup")
+	}
+
+	if (l.localField == "") != (l.foreignField == "") {
+		return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	}
+
+	if l.pipeline == nil {
+		if l.localField == "" {
+			return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+		}
+		if l.let.Map() != nil {
+			return nil, common.NewErrorMessage(common.ErrFailedToParse, "$lookup with 'let' must also specify 'pipeline'")
+		}
+	} else if _, err := newPipeline(l.pipeline, nil); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// lookup joins the documents with the documents of the foreign collection. If the documents were
+// selected by SQL, local is the statement which selected them, else it is nil.
+func (h *storage) lookup(ctx context.Context, db string, l *lookup, docs []types.Document, local *localSQL) ([]types.Document, error) {
+	if len(docs) == 0 {
+		return docs, nil
+	}
+
+	if l.pipeline == nil {
+		foreign, err := h.lookupForeign(ctx, db, l, docs, local)
+		if err != nil {
+			return nil, err
+		}
+
+		return common.LookupDocuments(docs, foreign, l.localField, l.foreignField, l.as)
+	}
+
+	// documents with the same variables and local values share the result of the pipeline
+	bindings := map[string]*lookupBinding{}
+	var keys []string
+	docKeys := make([]string, len(docs))
+	for i := range docs {
+		vars := types.MustMakeDocument()
+		for _, k := range l.let.Keys() {
+			v, err := common.EvaluateExpression(docs[i], l.let.Map()[k])
+			if err != nil {
+				return nil, err
+			}
+			if common.IsMissing(v) {
+				v = nil
+			}
+			if err = vars.Set(k, v); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+
+		stages := bindPipeline(l.pipeline, vars)
+		localValues := types.MakeArray(0)
+		if l.localField != "" {
+			values := common.LookupValues(docs[i:i+1], l.localField)
+			stages = types.MustNewArray(append([]any{types.MustMakeDocument("$match", lookupFilter(l.foreignField, values))}, stagesValues(stages)...)...)
+			localValues = types.MustNewArray(values...)
+		}
+
+		key, err := lookupCacheKey(vars, localValues)
+		if err != nil {
+			return nil, err
+		}
+
+		docKeys[i] = key
+		if _, ok := bindings[key]; !ok {
+			bindings[key] = &lookupBinding{stages: stages}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 1 {
+		// the whole pipeline is pushed down as far as possible
+		b := bindings[keys[0]]
+		foreign, err := h.aggregateDocuments(ctx, db, l.from, b.stages)
+		if err != nil {
+			return nil, err
+		}
+		b.foreign = foreign
+	} else {
+		for start := 0; start < len(keys); start += maxLookupValues {
+			end := start + maxLookupValues
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			batch := make([]*lookupBinding, 0, end-start)
+			for _, key := range keys[start:end] {
+				batch = append(batch, bindings[key])
+			}
+
+			if err := h.lookupBatch(ctx, db, l.from, batch); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i := range docs {
+		if err := common.SetLookupResult(&docs[i], bindings[docKeys[i]].foreign, l.as); err != nil {
+			return nil, err
+		}
+	}
+
+	return docs, nil
+}
+
+// lookupForeign returns the foreign documents which can match the local field of the documents of an equality
+// match. If the documents were selected by SQL, the foreign documents are selected with a subquery of the local
+// documents, else with the local values in batches of maxLookupValues.
+func (h *storage) lookupForeign(ctx context.Context, db string, l *lookup, docs []types.Document, local *localSQL) ([]types.Document, error) {
+	if local != nil {
+		if unselected := common.LookupSubqueryValues(docs, l.localField); len(unselected) <= maxLookupValues {
+			whereSQL, err := local.lookupWhereClause(l, unselected)
+			switch {
+			case err == nil:
+				return h.queryDocuments(ctx, db, l.from, whereSQL)
+			case !common.IsMemoryFilterError(err):
+				return nil, err
+			}
+			// a foreign field which can only be compared in memory is looked up in batches
+		}
+	}
+
+	// a foreign document can match values of several batches
+	values := common.LookupValues(docs, l.localField)
+	var res []types.Document
+	seen := map[string]bool{}
+	for start := 0; start < len(values); start += maxLookupValues {
+		end := start + maxLookupValues
+		if end > len(values) {
+			end = len(values)
+		}
+
+		stages := types.MustNewArray(types.MustMakeDocument("$match", lookupFilter(l.foreignField, values[start:end])))
+		foreign, err := h.aggregateDocuments(ctx, db, l.from, stages)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, doc := range foreign {
+			key, err := documentKey(types.MustMakeDocument("_id", doc.Map()["_id"]))
+			if err != nil {
+				return nil, err
+			}
+			if !seen[key] {
+				seen[key] = true
+				res = append(res, doc)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// queryDocuments returns the documents of a collection selected by the WHERE-clause.
+func (h *storage) queryDocuments(ctx context.Context, db, collection, whereSQL string) ([]types.Document, error) {
+	// a collection which does not exist has no documents
+	if exists, err := h.hanaPool.NamespaceExists(ctx, db, collection); err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := h.hanaPool.QueryContext(ctx, fmt.Sprintf("SELECT * FROM \"%s\".\"%s\"", db, collection)+whereSQL)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return (&cursor{rows: rows}).all()
+}
+
+// lookupBinding is a distinct binding of the variables and local values of a $lookup pipeline.
+type lookupBinding struct {
+	stages  *types.Array
+	foreign []types.Document
+}
+
+// lookupBatch runs the pipelines of a batch of bindings with a single query. The foreign documents are selected
+// by the leading $match stages of all pipelines, then every pipeline is processed in memory on these documents.
+func (h *storage) lookupBatch(ctx context.Context, db, from string, batch []*lookupBinding) error {
+	filters := types.MakeArray(len(batch))
+	selectAll := false
+	stages := make([][]stage, len(batch))
+	for i, b := range batch {
+		matches := types.MakeArray(0)
+		for _, value := range stagesValues(b.stages) {
+			s, err := parseStage(value)
+			if err != nil {
+				return err
+			}
+
+			if len(stages[i]) == matches.Len() && s.name == "$match" && len(s.value.(types.Document).Keys()) != 0 {
+				if err = matches.Append(s.value); err != nil {
+					return lazyerrors.Error(err)
+				}
+			}
+			stages[i] = append(stages[i], s)
+		}
+
+		if matches.Len() == 0 {
+			selectAll = true
+		}
+		if err := filters.Append(types.MustMakeDocument("$and", matches)); err != nil {
+			return lazyerrors.Error(err)
+		}
+	}
+
+	query := types.MakeArray(1)
+	if !selectAll {
+		if err := query.Append(types.MustMakeDocument("$match", types.MustMakeDocument("$or", filters))); err != nil {
+			return lazyerrors.Error(err)
+		}
+	}
+
+	foreign, err := h.aggregateDocuments(ctx, db, from, query)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range batch {
+		if b.foreign, err = h.processStages(ctx, db, stages[i], common.CopyDocuments(foreign), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookupCacheKey returns a key which is equal for equal variables and local values.
+func lookupCacheKey(vars types.Document, localValues *types.Array) (string, error) {
+	return documentKey(types.MustMakeDocument("vars", vars, "local", localValues))
+}
+
+// documentKey returns a key which is equal for equal documents.
+func documentKey(value types.Document) (string, error) {
+	doc, err := bson.ConvertDocument(value)
+	if err != nil {
+		return "", lazyerrors.Error(err)
+	}
+
+	b, err := doc.MarshalBinary()
+	if err != nil {
+		return "", lazyerrors.Error(err)
+	}
+
+	return string(b), nil
+}
+
+// lookupFilter creates the filter for the foreign collection which selects all documents
+// matching one of the given values.
+func lookupFilter(foreignField string, values []any) types.Document {
+	filters := types.MakeArray(len(values))
+	for _, v := range values {
+		_ = filters.Append(types.MustMakeDocument(foreignField, v))
+	}
+
+	if filters.Len() == 1 {
+		filter, _ := filters.Get(0)
+		return filter.(types.Document)
+	}
+
+	return types.MustMakeDocument("$or", filters)
+}
+
+// bindPipeline replaces the variables of a $lookup pipeline like "$$name" by their values.
+// Variables are only replaced in expressions, a $match stage only contains expressions in $expr.
+func bindPipeline(pipeline *types.Array, vars types.Document) *types.Array {
+	res := types.MakeArray(pipeline.Len())
+	for _, s := range stagesValues(pipeline) {
+		inExpr := true
+		if doc, ok := s.(types.Document); ok && len(doc.Keys()) == 1 && doc.Keys()[0] == "$match" {
+			inExpr = false
+		}
+		_ = res.Append(bindVariables(s, vars, inExpr))
+	}
+
+	return res
+}
+
+// bindVariables replaces the variables in a value of a stage.
+func bindVariables(value any, vars types.Document, inExpr bool) any {
+	switch value := value.(type) {
+	case string:
+		if !inExpr || !strings.HasPrefix(value, "$$") {
+			return value
+		}
+
+		if _, ok := vars.Map()[strings.Split(value[2:], ".")[0]]; !ok {
+			return value
+		}
+
+		v, _ := common.EvaluateExpression(vars, value[1:])
+		if common.IsMissing(v) {
+			v = nil
+		}
+		return types.MustMakeDocument("$literal", v)
+
+	case types.Document:
+		res := types.MustMakeDocument()
+		for _, k := range value.Keys() {
+			_ = res.Set(k, bindVariables(value.Map()[k], vars, inExpr || k == "$expr"))
+		}
+		return res
+
+	case *types.Array:
+		res := types.MakeArray(value.Len())
+		for _, v := range stagesValues(value) {
+			_ = res.Append(bindVariables(v, vars, inExpr))
+		}
+		return res
+
+	default:
+		return value
+	}
+}
+
+// stagesValues returns the elements of an array.
+func stagesValues(array *types.Array) []any {
+	res := make([]any, array.Len())
+	for i := range res {
+		res[i], _ = array.Get(i)
+	}
+
+	return res
+}
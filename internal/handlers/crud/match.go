@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/hana"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// querier runs queries. It is implemented by *hana.Hpool and by transactions.
+type querier interface {
+	common.RowQuerier
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// writeFilter splits the filter of an update, a delete or a findAndModify by common.SplitFilter. It returns
+// the WHERE clause selecting the candidates and the filter the candidates have to match in memory.
+func writeFilter(filter types.Document) (whereSQL string, memoryFilter types.Document, err error) {
+	sqlFilter, memoryFilter, err := common.SplitFilter(filter)
+	if err != nil {
+		return "", memoryFilter, err
+	}
+
+	whereSQL, err = common.CreateWhereClause(sqlFilter)
+
+	return whereSQL, memoryFilter, err
+}
+
+// selectMatching runs the query and returns the selected documents which match the filter in memory.
+// It stops after the first matching document if single is true.
+func selectMatching(ctx context.Context, q querier, query string, memoryFilter types.Document, single bool) ([]types.Document, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	defer rows.Close()
+
+	var docs []types.Document
+	for {
+		doc, _, err := nextRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return docs, nil
+		}
+
+		matches, err := common.MatchDocument(*doc, memoryFilter)
+		if err != nil {
+			return nil, err
+		}
+		if !matches {
+			continue
+		}
+
+		docs = append(docs, *doc)
+		if single {
+			return docs, nil
+		}
+	}
+}
+
+// countMatching returns the number of documents selected by the WHERE clause which match the filter in memory.
+func countMatching(ctx context.Context, q querier, db, collection, whereSQL string, memoryFilter types.Document) (int32, error) {
+	if len(memoryFilter.Keys()) == 0 {
+		var n int32
+		countSQL := fmt.Sprintf("SELECT count(*) FROM \"%s\".\"%s\"", db, collection) + whereSQL
+		if err := q.QueryRowContext(ctx, countSQL).Scan(&n); err != nil {
+			return 0, lazyerrors.Error(err)
+		}
+		return n, nil
+	}
+
+	docs, err := selectMatching(ctx, q, fmt.Sprintf("SELECT * FROM \"%s\".\"%s\"", db, collection)+whereSQL, memoryFilter, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(len(docs)), nil
+}
+
+// deleteInMemory deletes the documents selected by the WHERE clause which match the filter in memory.
+// The documents are locked within a transaction, so they can not be modified between the check and
+// the deletion. It returns the number of deleted documents.
+func deleteInMemory(ctx context.Context, pool *hana.Hpool, db, collection, whereSQL string, memoryFilter types.Document, single bool) (int32, error) {
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+	defer tx.Rollback() //nolint:errcheck // does nothing after Commit
+
+	docs, err := selectMatching(ctx, tx, selectForUpdateSQL(db, collection, whereSQL, false), memoryFilter, single)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, doc := range docs {
+		id, err := common.GetUpdateValue(doc.Map()["_id"])
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err = tx.ExecContext(ctx, deleteStmt(db, collection, " WHERE \"_id\" = "+id)); err != nil {
+			return 0, lazyerrors.Error(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+
+	return int32(len(docs)), nil
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+)
+
+// getMaxTime returns the time limit given by maxTimeMS. Without maxTimeMS or with 0 there is no time limit.
+func getMaxTime(docMap map[string]any) (time.Duration, error) {
+	var ms float64
+	switch value := docMap["maxTimeMS"].(type) {
+	case nil:
+		return 0, nil
+	case int32:
+		ms = float64(value)
+	case int64:
+		ms = float64(value)
+	case float64:
+		if value != math.Trunc(value) {
+			return 0, common.NewErrorMessage(common.ErrBadValue, "maxTimeMS has non-integral value")
+		}
+		ms = value
+	default:
+		return 0, common.NewErrorMessage(common.ErrBadValue, "maxTimeMS must be a number")
+	}
+
+	if ms < 0 || ms > math.MaxInt32 {
+		return 0, common.NewErrorMessage(common.ErrBadValue, "%v value for maxTimeMS is out of range", ms)
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// withMaxTime returns a context which is canceled when the time limit is exceeded, so the running
+// SAP HANA statement is canceled. The returned error is then converted to MaxTimeMSExpired.
+// Without a time limit the context is returned unchanged.
+func withMaxTime(ctx context.Context, maxTime time.Duration) (context.Context, context.CancelFunc) {
+	if maxTime == 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, maxTime)
+}
+
+// cursorContext is the context of the query of a cursor. Like maxTimeMS in MongoDB, its time limit only runs
+// while the query is executed and a batch is read, the time between the batches of a cursor does not count.
+// An exceeded time limit cancels the context with context.DeadlineExceeded, which is returned as MaxTimeMSExpired.
+type cursorContext struct {
+	context.Context
+
+	done chan struct{}
+
+	mu    sync.Mutex
+	err   error
+	timer *time.Timer
+}
+
+// newCursorContext returns a cursorContext which is also canceled when the parent context is done.
+func newCursorContext(parent context.Context) *cursorContext {
+	c := &cursorContext{Context: parent, done: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-parent.Done():
+			c.cancel(parent.Err())
+		case <-c.done:
+		}
+	}()
+
+	return c
+}
+
+// Done implements context.Context.
+func (c *cursorContext) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err implements context.Context.
+func (c *cursorContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// startBatch starts the time limit for executing the query or reading a batch. Without a time limit it does nothing.
+func (c *cursorContext) startBatch(maxTime time.Duration) {
+	if maxTime == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer = time.AfterFunc(maxTime, func() {
+		c.cancel(context.DeadlineExceeded)
+	})
+}
+
+// stopBatch stops the time limit when a batch has been read.
+func (c *cursorContext) stopBatch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// cancel cancels the context with the given error, so the running SAP HANA statement is canceled.
+func (c *cursorContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
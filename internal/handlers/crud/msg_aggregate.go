@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+// MsgAggregate runs an aggregation pipeline on a collection and returns a cursor to the resulting documents.
+// The leading stages of the pipeline are pushed down to SAP HANA, the remaining stages are processed in memory.
+func (h *storage) MsgAggregate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
+	unimplementedFields := []string{
+		"explain",
+		"bypassDocumentValidation",
+		"readConcern",
+		"collation",
+		"hint",
+		"writeConcern",
+		"let",
+	}
+
+	document, err := msg.Document()
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	if err := common.Unimplemented(&document, unimplementedFields...); err != nil {
+		return nil, err
+	}
+
+	common.Ignored(&document, h.l, "allowDiskUse", "comment")
+
+	m := document.Map()
+
+	var localCtx locatCtx
+	var ok bool
+	if localCtx.db, ok = m["$db"].(string); !ok {
+		return nil, fmt.Errorf("database not found or wrong type")
+	}
+
+	if localCtx.collection, ok = m["aggregate"].(string); !ok {
+		return nil, common.NewErrorMessage(common.ErrNotImplemented, "aggregate: only aggregations on a collection are supported")
+	}
+
+	stages, ok := m["pipeline"].(*types.Array)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'pipeline' is the wrong type '%T', expected type 'array'", m["pipeline"])
+	}
+
+	cursorDoc, ok := m["cursor"].(types.Document)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrFailedToParse, "The 'cursor' option is required, except for aggregate with the explain argument")
+	}
+
+	batchSize, err := getBatchSize(cursorDoc.Map(), defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTime, err := getMaxTime(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// the context is canceled when the cursor is closed, the time limit applies to the first batch
+	cursorCtx := newCursorContext(ctx)
+	cursorCtx.startBatch(maxTime)
+	c, err := h.queryPipeline(cursorCtx, localCtx.db, localCtx.collection, stages)
+	if err != nil {
+		cursorCtx.cancel(context.Canceled)
+		return nil, err
+	}
+	c.ctx = cursorCtx
+
+	return h.createCursorResponse(c, batchSize, false)
+}
+
+// queryPipeline runs the pipeline on a collection and returns a cursor to the resulting documents.
+// If stages have to be processed in memory, all documents are read and processed before the cursor is returned.
+func (h *storage) queryPipeline(ctx context.Context, db, collection string, stages *types.Array) (*cursor, error) {
+	p, err := h.collectionPipeline(ctx, db, collection, stages)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cursor{ns: db + "." + collection}
+
+	// a collection which does not exist has no documents
+	if namespaceExists, err := h.hanaPool.NamespaceExists(ctx, db, collection); err == nil {
+		if !namespaceExists {
+			return c, nil
+		}
+	} else {
+		return nil, err
+	}
+
+	sql, exclusion, err := p.sql(db, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.rows, err = h.hanaPool.QueryContext(ctx, sql); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	c.projection = p.projection
+	c.exclusion = exclusion
+
+	if len(p.stages) == 0 {
+		return c, nil
+	}
+
+	docs, err := c.all()
+	if err != nil {
+		return nil, err
+	}
+
+	if docs, err = h.processStages(ctx, db, p.stages, docs, p.localSQL(db, collection)); err != nil {
+		return nil, err
+	}
+
+	return &cursor{ns: c.ns, docs: docs}, nil
+}
+
+// aggregateDocuments runs the pipeline on a collection and returns all resulting documents.
+func (h *storage) aggregateDocuments(ctx context.Context, db, collection string, stages *types.Array) ([]types.Document, error) {
+	c, err := h.queryPipeline(ctx, db, collection, stages)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.all()
+}
+
+// collectionPipeline parses the stages of a pipeline on a collection. A $sort on dotted keys, which is the
+// first stage processed in memory, is pushed down if no document of the collection has an array on their
+// paths, because SQL sorts by the value at such a path like MongoDB.
+func (h *storage) collectionPipeline(ctx context.Context, db, collection string, stages *types.Array) (*pipeline, error) {
+	p, err := newPipeline(stages, nil)
+	if err != nil || len(p.stages) == 0 || p.stages[0].name != "$sort" {
+		return p, err
+	}
+
+	keys := dottedKeys(p.stages[0].value.(types.Document))
+	flatKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		flatKeys[key] = true
+	}
+
+	flat, err := newPipeline(stages, flatKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// the $sort is not pushed down for other reasons
+	if len(p.sort.Keys()) != 0 || len(flat.sort.Keys()) == 0 {
+		return p, nil
+	}
+
+	arraysSQL, err := common.ArraysSQL(keys)
+	if err != nil || arraysSQL == "" {
+		return flat, err
+	}
+
+	// a collection which does not exist has no arrays
+	if exists, err := h.hanaPool.NamespaceExists(ctx, db, collection); err != nil || !exists {
+		return flat, err
+	}
+
+	var n int64
+	sql := fmt.Sprintf("SELECT COUNT(*) FROM (SELECT * FROM \"%s\".\"%s\" WHERE %s LIMIT 1)", db, collection, arraysSQL)
+	if err = h.hanaPool.QueryRowContext(ctx, sql).Scan(&n); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	if n != 0 {
+		return p, nil
+	}
+
+	return flat, nil
+}
@@ -0,0 +1,466 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgAggregate(t *testing.T) {
+	ctx, storage, mock, err := setupTestUtil(t)
+	require.NoError(t, err)
+
+	t.Run("pushdown of leading stages", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 2, "item": "b", "qty": 20}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE ((IS_NUMBER(\"qty\") AND \"qty\" > 10) OR FOR ANY \"$element\" IN \"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 10) END) ORDER BY CASE WHEN \"qty\" IS NULL THEN 1 WHEN IS_NUMBER(\"qty\") THEN 2 WHEN IS_STRING(\"qty\") THEN 3 WHEN (IS_OBJECT(\"qty\") AND \"qty\".\"oid\" IS UNSET) THEN 4 WHEN IS_ARRAY(\"qty\") THEN 5 WHEN (IS_OBJECT(\"qty\") AND \"qty\".\"oid\" IS SET) THEN 7 WHEN IS_BOOLEAN(\"qty\") THEN 8 ELSE 12 END DESC, \"qty\".\"oid\" DESC, \"qty\" DESC LIMIT 1 OFFSET 1 ").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "testCollection",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$match", types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(10)))),
+					types.MustMakeDocument("$sort", types.MustMakeDocument("qty", int32(-1))),
+					types.MustMakeDocument("$skip", int32(1)),
+					types.MustMakeDocument("$limit", int32(1)),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"firstBatch", types.MustNewArray(
+					types.MustMakeDocument("_id", int32(2), "item", "b", "qty", int32(20)),
+				),
+				"id", int64(0),
+				"ns", "testDatabase.testCollection",
+			),
+			"ok", float64(1),
+		)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("stages processed in memory", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "item": "a", "qty": 5}`)).
+			AddRow([]byte(`{"_id": 2, "item": "b", "qty": 20}`)).
+			AddRow([]byte(`{"_id": 3, "item": "c", "qty": 15}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" LIMIT 3 ").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "testCollection",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$limit", int32(3)),
+					types.MustMakeDocument("$match", types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(10)))),
+					types.MustMakeDocument("$sort", types.MustMakeDocument("qty", int32(1))),
+					types.MustMakeDocument("$project", types.MustMakeDocument("_id", false, "item", true)),
+				),
+				"cursor", types.MustMakeDocument("batchSize", int32(1)),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		cursor := actual.Map()["cursor"].(types.Document)
+		id := cursor.Map()["id"].(int64)
+		assert.NotZero(t, id)
+		assert.Equal(t, types.MustNewArray(types.MustMakeDocument("item", "c")), cursor.Map()["firstBatch"])
+
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"getMore", id,
+				"collection", "testCollection",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err = storage.MsgGetMore(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ = msg.Document()
+		cursor = actual.Map()["cursor"].(types.Document)
+		assert.Equal(t, int64(0), cursor.Map()["id"])
+		assert.Equal(t, types.MustNewArray(types.MustMakeDocument("item", "b")), cursor.Map()["nextBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("match around unwind", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "status": "A", "customer": "x", "items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 2}]}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE ((\"status\" = 'A' OR FOR ANY \"$element\" IN \"status\" SATISFIES \"$element\" = 'A' END) AND (\"customer\" = 'x' OR FOR ANY \"$element\" IN \"customer\" SATISFIES \"$element\" = 'x' END) AND " +
+			"((((IS_NUMBER(\"items\".\"qty\") AND \"items\".\"qty\" > 1) OR FOR ANY \"$element\" IN \"items\".\"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 1) END) OR " +
+			"FOR ANY \"$element1\" IN \"items\" SATISFIES ((IS_NUMBER(\"$element1\".\"qty\") AND \"$element1\".\"qty\" > 1) OR FOR ANY \"$element\" IN \"$element1\".\"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 1) END) END) OR " +
+			"FOR ANY \"$element\" IN \"items\" SATISFIES IS_ARRAY(\"$element\") END ))").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "testCollection",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$match", types.MustMakeDocument("status", "A")),
+					types.MustMakeDocument("$unwind", "$items"),
+					types.MustMakeDocument("$match", types.MustMakeDocument("customer", "x")),
+					types.MustMakeDocument("$match", types.MustMakeDocument("items.qty", types.MustMakeDocument("$gt", int32(1)))),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustNewArray(
+			types.MustMakeDocument("_id", int32(1), "status", "A", "customer", "x", "items", types.MustMakeDocument("sku", "b", "qty", int32(2))),
+		)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["firstBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("group pushed down", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": "x", "total": 5}`)).
+			AddRow([]byte(`{"_id": "y", "total": 30}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT {\"_id\": \"customer\", \"total\": COALESCE(SUM(CASE WHEN IS_NUMBER(\"qty\") THEN \"qty\" END), 0)} FROM \"testDatabase\".\"testCollection\" WHERE (\"status\" = 'A' OR FOR ANY \"$element\" IN \"status\" SATISFIES \"$element\" = 'A' END) GROUP BY \"customer\"").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "testCollection",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$match", types.MustMakeDocument("status", "A")),
+					types.MustMakeDocument("$group", types.MustMakeDocument(
+						"_id", "$customer",
+						"total", types.MustMakeDocument("$sum", "$qty"),
+					)),
+					types.MustMakeDocument("$sort", types.MustMakeDocument("total", int32(-1))),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		expected := types.MustNewArray(
+			types.MustMakeDocument("_id", "y", "total", int32(30)),
+			types.MustMakeDocument("_id", "x", "total", int32(5)),
+		)
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["firstBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("expressions", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "item": "a", "total": 50}`)).
+			AddRow([]byte(`{"_id": 2, "item": "b", "total": 5}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\", \"item\": \"item\", \"total\": (\"qty\" * \"price\")} FROM \"testDatabase\".\"testCollection\"").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "testCollection",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$project", types.MustMakeDocument(
+						"item", int32(1),
+						"total", types.MustMakeDocument("$multiply", types.MustNewArray("$qty", "$price")),
+					)),
+					types.MustMakeDocument("$addFields", types.MustMakeDocument(
+						"size", types.MustMakeDocument("$cond", types.MustNewArray(
+							types.MustMakeDocument("$gte", types.MustNewArray("$total", int32(10))), "large", "small",
+						)),
+					)),
+					types.MustMakeDocument("$unset", "total"),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		expected := types.MustNewArray(
+			types.MustMakeDocument("_id", int32(1), "item", "a", "size", "large"),
+			types.MustMakeDocument("_id", int32(2), "item", "b", "size", "small"),
+		)
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["firstBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		orderRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "customer": 10}`)).
+			AddRow([]byte(`{"_id": 2, "customer": 20}`)).
+			AddRow([]byte(`{"_id": 3, "customer": 10}`))
+		customerRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 10, "name": "a"}`))
+
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = ").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			if i == 0 {
+				mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"orders\"").WillReturnRows(orderRows)
+			}
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"customers\" WHERE (\"_id\" IN (SELECT \"customer\" FROM \"testDatabase\".\"orders\"))").WillReturnRows(customerRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "orders",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$lookup", types.MustMakeDocument(
+						"from", "customers",
+						"localField", "customer",
+						"foreignField", "_id",
+						"as", "customers",
+					)),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		customer := types.MustMakeDocument("_id", int32(10), "name", "a")
+		expected := types.MustNewArray(
+			types.MustMakeDocument("_id", int32(1), "customer", int32(10), "customers", types.MustNewArray(customer)),
+			types.MustMakeDocument("_id", int32(2), "customer", int32(20), "customers", types.MakeArray(0)),
+			types.MustMakeDocument("_id", int32(3), "customer", int32(10), "customers", types.MustNewArray(customer)),
+		)
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["firstBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("lookup in batches", func(t *testing.T) {
+		orderRows := mock.NewRows([]string{"document"})
+		for i := 0; i <= maxLookupValues; i++ {
+			orderRows.AddRow([]byte(fmt.Sprintf(`{"_id": %d, "customer": %d}`, i, i)))
+		}
+		customer := []byte(`{"_id": 5, "name": "a", "orders": [5, 1000]}`)
+
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = ").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			if i == 0 {
+				mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"orders\"").WillReturnRows(orderRows)
+			}
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"customers\" WHERE ").WillReturnRows(mock.NewRows([]string{"document"}).AddRow(customer))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = ").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"customers\" WHERE ").WillReturnRows(mock.NewRows([]string{"document"}).AddRow(customer))
+
+		// the documents are not selected by SQL after a stage processed in memory
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "orders",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$addFields", types.MustMakeDocument("order", "$_id")),
+					types.MustMakeDocument("$lookup", types.MustMakeDocument(
+						"from", "customers",
+						"localField", "customer",
+						"foreignField", "orders",
+						"as", "customers",
+					)),
+				),
+				"cursor", types.MustMakeDocument("batchSize", int32(10)),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		firstBatch := actual.Map()["cursor"].(types.Document).Map()["firstBatch"].(*types.Array)
+		doc, err := firstBatch.Get(5)
+		require.NoError(t, err)
+		assert.Equal(t, 1, doc.(types.Document).Map()["customers"].(*types.Array).Len())
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("lookup pipeline with batched bindings", func(t *testing.T) {
+		orderRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "customer": 10}`)).
+			AddRow([]byte(`{"_id": 2, "customer": 20}`)).
+			AddRow([]byte(`{"_id": 3, "customer": 10}`))
+		customerRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 10, "name": "a"}`)).
+			AddRow([]byte(`{"_id": 20, "name": "b"}`))
+
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = ").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			if i == 0 {
+				mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"orders\"").WillReturnRows(orderRows)
+			}
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"customers\" WHERE (((IS_NUMBER(\"_id\") AND \"_id\" = 10)) OR ((IS_NUMBER(\"_id\") AND \"_id\" = 20)))").WillReturnRows(customerRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"aggregate", "orders",
+				"pipeline", types.MustNewArray(
+					types.MustMakeDocument("$lookup", types.MustMakeDocument(
+						"from", "customers",
+						"let", types.MustMakeDocument("customer", "$customer"),
+						"pipeline", types.MustNewArray(
+							types.MustMakeDocument("$match", types.MustMakeDocument("$expr", types.MustMakeDocument("$eq", types.MustNewArray("$_id", "$$customer")))),
+							types.MustMakeDocument("$project", types.MustMakeDocument("_id", int32(0))),
+						),
+						"as", "customers",
+					)),
+				),
+				"cursor", types.MustMakeDocument(),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgAggregate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		a := types.MustNewArray(types.MustMakeDocument("name", "a"))
+		expected := types.MustNewArray(
+			types.MustMakeDocument("_id", int32(1), "customer", int32(10), "customers", a),
+			types.MustMakeDocument("_id", int32(2), "customer", int32(20), "customers", types.MustNewArray(types.MustMakeDocument("name", "b"))),
+			types.MustMakeDocument("_id", int32(3), "customer", int32(10), "customers", a),
+		)
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["firstBatch"])
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("invalid pipelines", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			pipeline *types.Array
+			err      string
+		}{
+			"unrecognized stage": {
+				pipeline: types.MustNewArray(types.MustMakeDocument("$foo", int32(1))),
+				err:      "Location40324 (40324): Unrecognized pipeline stage name: '$foo'",
+			},
+			"more than one field": {
+				pipeline: types.MustNewArray(types.MustMakeDocument("$skip", int32(1), "$limit", int32(1))),
+				err:      "Location40323 (40323): A pipeline stage specification object must contain exactly one field.",
+			},
+			"negative limit": {
+				pipeline: types.MustNewArray(types.MustMakeDocument("$limit", int32(-1))),
+				err:      "BadValue (2): the limit must be positive",
+			},
+			"lookup without as": {
+				pipeline: types.MustNewArray(types.MustMakeDocument("$lookup", types.MustMakeDocument("from", "customers", "pipeline", types.MustNewArray()))),
+				err:      "FailedToParse (9): must specify 'as' field for a $lookup",
+			},
+			"unsupported stage": {
+				pipeline: types.MustNewArray(types.MustMakeDocument("$facet", types.MustMakeDocument())),
+				err:      "NotImplemented (238): support for $facet is not implemented yet",
+			},
+		} {
+			var reqMsg wire.OpMsg
+			err = reqMsg.SetSections(wire.OpMsgSection{
+				Documents: []types.Document{types.MustMakeDocument(
+					"aggregate", "testCollection",
+					"pipeline", tc.pipeline,
+					"cursor", types.MustMakeDocument(),
+					"$db", "testDatabase",
+				)},
+			})
+			require.NoError(t, err)
+
+			_, err = storage.MsgAggregate(ctx, &reqMsg)
+			assert.EqualError(t, err, tc.err, name)
+		}
+	})
+}
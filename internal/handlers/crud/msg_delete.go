@@ -43,6 +43,13 @@ func (h *storage) MsgDelete(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 	}
 	common.Ignored(&document, h.l, "ordered")
 
+	maxTime, err := getMaxTime(document.Map())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
 	m := document.Map()
 
 	collection := m[document.Command()].(string)
@@ -83,23 +90,26 @@ func (h *storage) MsgDelete(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 		d := doc.(types.Document).Map()
 
-		sql := fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", db, collection)
-
 		limit, _ := d["limit"].(int32)
 
-		var delSQL string
-		var args []any
-		if limit != 0 { // if deleteOne()
-			qSQL := fmt.Sprintf("SELECT {\"_id\": \"_id\"} FROM \"%s\".\"%s\"", db, collection)
+		whereSQL, memoryFilter, err := writeFilter(d["q"].(types.Document))
+		if err != nil {
+			return nil, err
+		}
 
-			whereSQL, err := common.CreateWhereClause(d["q"].(types.Document))
+		if len(memoryFilter.Keys()) != 0 {
+			n, err := deleteInMemory(ctx, h.hanaPool, db, collection, whereSQL, memoryFilter, limit != 0)
 			if err != nil {
 				return nil, err
 			}
 
-			qSQL += whereSQL + " LIMIT 1"
+			deleted += n
+			continue
+		}
 
-			row := h.hanaPool.QueryRowContext(ctx, qSQL)
+		var delSQL string
+		if limit != 0 { // if deleteOne()
+			row := h.hanaPool.QueryRowContext(ctx, selectIdStmt(db, collection, whereSQL))
 
 			var objectID []byte
 			err = row.Scan(&objectID)
@@ -118,20 +128,13 @@ func (h *storage) MsgDelete(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 				return nil, err
 			}
 
-			args = append(args, deleteId)
-			delSQL = " WHERE \"_id\" = %s"
+			delSQL = " WHERE \"_id\" = " + deleteId
 
 		} else { // if deleteMany()
-			delSQL, err = common.CreateWhereClause(d["q"].(types.Document))
-			if err != nil {
-				return nil, lazyerrors.Error(err)
-			}
+			delSQL = whereSQL
 		}
 
-		sql += delSQL
-
-		sqlExec := fmt.Sprintf(sql, args...)
-		tag, err := h.hanaPool.ExecContext(ctx, sqlExec)
+		tag, err := h.hanaPool.ExecContext(ctx, deleteStmt(db, collection, delSQL))
 		if err != nil {
 			// TODO check error code
 			return nil, common.NewErrorMessage(common.ErrNamespaceNotFound, "MsgDelete: ns not found: %w", err)
@@ -158,3 +161,8 @@ func (h *storage) MsgDelete(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 	return &reply, nil
 }
+
+// deleteStmt returns the statement deleting the documents matching the WHERE clause.
+func deleteStmt(db, collection, whereSQL string) string {
+	return fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", db, collection) + whereSQL
+}
@@ -71,7 +71,7 @@ func TestMsgDelete(t *testing.T) {
 
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
-		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test'").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnResult(sqlmock.NewResult(1, 1))
 
 		deleteReq := types.MustMakeDocument(
 			"delete", "testCollection",
@@ -116,7 +116,7 @@ func TestMsgDelete(t *testing.T) {
 
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
-		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test' LIMIT 1").WillReturnRows(idRow)
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) LIMIT 1").WillReturnRows(idRow)
 		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 123").WillReturnResult(sqlmock.NewResult(1, 1))
 
 		deleteReq := types.MustMakeDocument(
@@ -154,4 +154,124 @@ func TestMsgDelete(t *testing.T) {
 			t.Errorf("there were unfulfilled expectations: %s", err)
 		}
 	})
+
+	t.Run("deleteOne with an embedded document in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"size\" = ").
+			WillReturnRows(sqlmock.NewRows([]string{"document"}).
+				AddRow([]byte(`{"_id": 1, "size": {"w": 21, "h": 14}}`)).
+				AddRow([]byte(`{"_id": 2, "size": {"h": 14, "w": 21}}`)).
+				AddRow([]byte(`{"_id": 3, "size": {"h": 14, "w": 21}}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		deleteReq := types.MustMakeDocument(
+			"delete", "testCollection",
+			"deletes", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("size", types.MustMakeDocument("h", int32(14), "w", int32(21))),
+					"limit", int32(1),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{deleteReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgDelete(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("deleteMany with $type int in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) FOR UPDATE").
+			WillReturnRows(sqlmock.NewRows([]string{"document"}).
+				AddRow([]byte(`{"_id": 1, "item": "test", "qty": 1}`)).
+				AddRow([]byte(`{"_id": 2, "item": "test", "qty": 1.5}`)).
+				AddRow([]byte(`{"_id": 3, "item": "test", "qty": 3}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 3").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		deleteReq := types.MustMakeDocument(
+			"delete", "testCollection",
+			"deletes", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "test", "qty", types.MustMakeDocument("$type", "int")),
+					"limit", int32(0),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{deleteReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgDelete(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(2), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("deleteMany with a long path in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) FOR UPDATE").
+			WillReturnRows(sqlmock.NewRows([]string{"document"}).
+				AddRow([]byte(`{"_id": 1, "item": "test", "a": [{"b": {"c": [{"d": {"e": {"f": 1}}}]}}]}`)).
+				AddRow([]byte(`{"_id": 2, "item": "test", "a": {"b": 1}}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		deleteReq := types.MustMakeDocument(
+			"delete", "testCollection",
+			"deletes", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "test", "a.b.c.d.e.f", int32(1)),
+					"limit", int32(0),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{deleteReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgDelete(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
 }
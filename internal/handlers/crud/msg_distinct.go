@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+// MsgDistinct returns the distinct values of a field for the documents matched by the query.
+func (h *storage) MsgDistinct(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
+	document, err := msg.Document()
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	if err := common.Unimplemented(&document, "collation", "readConcern"); err != nil {
+		return nil, err
+	}
+	common.Ignored(&document, h.l, "comment")
+
+	maxTime, err := getMaxTime(document.Map())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
+	m := document.Map()
+
+	var localCtx locatCtx
+	var ok bool
+	if localCtx.db, ok = m["$db"].(string); !ok {
+		return nil, fmt.Errorf("database not found or wrong type")
+	}
+
+	if localCtx.collection, ok = m["distinct"].(string); !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "collection name has invalid type %T", m["distinct"])
+	}
+
+	key, ok := m["key"].(string)
+	if !ok {
+		if _, exists := m["key"]; !exists {
+			return nil, common.NewErrorMessage(common.ErrFailedToParse, "BSON field 'distinct.key' is missing but a required field")
+		}
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'distinct.key' is the wrong type '%T', expected type 'string'", m["key"])
+	}
+
+	if query, exists := m["query"]; exists && query != nil {
+		if localCtx.filter, ok = query.(types.Document); !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'distinct.query' is the wrong type '%T', expected type 'object'", query)
+		}
+	}
+
+	values := types.MakeArray(0)
+
+	// a collection which does not exist has no values
+	if namespaceExists, err := h.hanaPool.NamespaceExists(ctx, localCtx.db, localCtx.collection); err == nil && namespaceExists {
+		projectionSQL, err := common.DistinctProjection(key)
+		if err != nil {
+			return nil, err
+		}
+
+		_, memoryFilter, err := common.SplitFilter(localCtx.filter)
+		if err != nil {
+			return nil, err
+		}
+
+		var docs []types.Document
+		if len(memoryFilter.Keys()) == 0 {
+			whereStmt, err := common.CreateWhereClause(localCtx.filter)
+			if err != nil {
+				return nil, err
+			}
+
+			sql := fmt.Sprintf("SELECT DISTINCT %s FROM \"%s\".\"%s\"", projectionSQL, localCtx.db, localCtx.collection) + whereStmt
+
+			rows, err := h.hanaPool.QueryContext(ctx, sql)
+			if err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+
+			if docs, err = (&cursor{rows: rows}).all(); err != nil {
+				return nil, err
+			}
+		} else {
+			// the whole documents are needed to evaluate the filter in memory
+			stages := types.MustNewArray(types.MustMakeDocument("$match", localCtx.filter))
+			matched, err := h.aggregateDocuments(ctx, localCtx.db, localCtx.collection, stages)
+			if err != nil {
+				return nil, err
+			}
+			docs = common.DistinctDocuments(matched, key)
+		}
+
+		if values, err = common.DistinctValues(docs, key); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var reply wire.OpMsg
+	err = reply.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"values", values,
+			"ok", float64(1),
+		)},
+	})
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return &reply, nil
+}
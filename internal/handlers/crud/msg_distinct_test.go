@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"testing"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgDistinct(t *testing.T) {
+	ctx, storage, mock, err := setupTestUtil(t)
+	require.NoError(t, err)
+
+	docRows := mock.NewRows([]string{"document"}).
+		AddRow([]byte(`{"value": {"tags": "a"}}`)).
+		AddRow([]byte(`{"value": {"tags": ["b", "a"]}}`)).
+		AddRow([]byte(`{"value": [{"tags": 1}, {"tags": ["c"]}, {"sku": "d"}]}`)).
+		AddRow([]byte(`{"value": {"tags": null}}`)).
+		AddRow([]byte(`{"value": null}`)).
+		AddRow([]byte(`{}`))
+	row1 := mock.NewRows([]string{"count"}).AddRow(1)
+	row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+	mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+	mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+	mock.ExpectQuery("SELECT DISTINCT {\"value\": \"item\"} FROM \"testDatabase\".\"testCollection\" WHERE ((IS_NUMBER(\"qty\") AND \"qty\" > 10) OR FOR ANY \"$element\" IN \"qty\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" > 10) END)").WillReturnRows(docRows)
+
+	var reqMsg wire.OpMsg
+	err = reqMsg.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"distinct", "testCollection",
+			"key", "item.tags",
+			"query", types.MustMakeDocument("qty", types.MustMakeDocument("$gt", int32(10))),
+			"$db", "testDatabase",
+		)},
+	})
+	require.NoError(t, err)
+
+	msg, err := storage.MsgDistinct(ctx, &reqMsg)
+	require.NoError(t, err)
+
+	expected := types.MustMakeDocument(
+		"values", types.MustNewArray("a", "b", int32(1), "c", nil),
+		"ok", float64(1),
+	)
+
+	actual, _ := msg.Document()
+	assert.Equal(t, expected, actual)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
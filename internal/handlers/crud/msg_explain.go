@@ -0,0 +1,625 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+// explainVerbosities are the verbosity modes of explain. The value tells if the command is executed.
+var explainVerbosities = map[string]bool{
+	"queryPlanner":      false,
+	"executionStats":    true,
+	"allPlansExecution": true,
+}
+
+// explainedCommand contains the SQL statements of an explained command.
+type explainedCommand struct {
+	db         string
+	collection string
+	filter     types.Document
+	statements []string
+
+	// stages are the names of the aggregation stages processed in memory
+	stages []string
+
+	// execute runs the reading part of the command without modifying any document
+	// and returns the number of documents returned or matched by the command.
+	execute func(ctx context.Context) (int64, error)
+}
+
+// MsgExplain returns the SQL statements of a find, count, update, delete, findAndModify or aggregate command.
+// With the verbosity executionStats or allPlansExecution the reading part of the command is executed and
+// the execution plans of the statements are added. Documents are never modified.
+func (h *storage) MsgExplain(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
+	document, err := msg.Document()
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	common.Ignored(&document, h.l, "comment")
+
+	m := document.Map()
+
+	maxTime, err := getMaxTime(m)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
+	db, ok := m["$db"].(string)
+	if !ok {
+		return nil, fmt.Errorf("database not found or wrong type")
+	}
+
+	command, ok := m["explain"].(types.Document)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'explain' is the wrong type '%T', expected type 'object'", m["explain"])
+	}
+
+	verbosity := "allPlansExecution"
+	if v, ok := m["verbosity"]; ok {
+		if verbosity, ok = v.(string); !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'verbosity' is the wrong type '%T', expected type 'string'", v)
+		}
+	}
+	execute, ok := explainVerbosities[verbosity]
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrBadValue, "verbosity string must be one of {'queryPlanner', 'executionStats', 'allPlansExecution'}")
+	}
+
+	explained, err := h.explainCommand(ctx, db, command)
+	if err != nil {
+		return nil, err
+	}
+
+	winningPlan := types.MustMakeDocument(
+		"stage", "SAP_HANA_SQL",
+		"statements", stringArray(explained.statements),
+	)
+	if len(explained.stages) != 0 {
+		if err = winningPlan.Set("inMemoryStages", stringArray(explained.stages)); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+
+	res := types.MustMakeDocument(
+		"queryPlanner", types.MustMakeDocument(
+			"namespace", explained.db+"."+explained.collection,
+			"parsedQuery", explained.filter,
+			"winningPlan", winningPlan,
+			"rejectedPlans", types.MustNewArray(),
+		),
+	)
+
+	if execute {
+		stats, err := h.explainExecution(ctx, explained)
+		if err != nil {
+			return nil, err
+		}
+		if err = res.Set("executionStats", stats); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+
+	if err = res.Set("command", command); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	if err = res.Set("ok", float64(1)); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	var reply wire.OpMsg
+	err = reply.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{res},
+	})
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return &reply, nil
+}
+
+// explainCommand creates the SQL statements of the explained command with the builders of its handler.
+func (h *storage) explainCommand(ctx context.Context, db string, command types.Document) (*explainedCommand, error) {
+	name := command.Command()
+
+	// the explained command has no $db field of its own
+	doc := types.MustMakeDocument()
+	for _, k := range command.Keys() {
+		if err := doc.Set(k, command.Map()[k]); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+	if err := doc.Set("$db", db); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	m := doc.Map()
+
+	collection, ok := m[name].(string)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrBadValue, "explain: collection name has invalid type %T", m[name])
+	}
+
+	e := &explainedCommand{db: db, collection: collection, filter: types.MustMakeDocument()}
+
+	switch name {
+	case "find", "count":
+		var localCtx locatCtx
+		if err := localCtx.setDBAndCollection(m); err != nil {
+			return nil, err
+		}
+
+		// a filter which can not be translated to SQL completely is run as aggregation pipeline
+		stages, err := findStages(m)
+		if err != nil {
+			return nil, err
+		}
+		if stages != nil {
+			if err = h.explainPipeline(ctx, e, stages); err != nil {
+				return nil, err
+			}
+			if filter, ok := m["filter"].(types.Document); ok {
+				e.filter = filter
+			}
+			if filter, ok := m["query"].(types.Document); ok && name == "count" {
+				e.filter = filter
+			}
+			break
+		}
+
+		statement, err := createSqlStmt(m, &localCtx)
+		if err != nil {
+			return nil, err
+		}
+		e.statements = []string{statement}
+		if localCtx.filter.Map() != nil {
+			e.filter = localCtx.filter
+		}
+
+		if name == "count" {
+			e.execute = func(ctx context.Context) (n int64, err error) {
+				err = h.hanaPool.QueryRowContext(ctx, statement).Scan(&n)
+				return
+			}
+			break
+		}
+		e.execute = func(ctx context.Context) (int64, error) {
+			return h.countRows(ctx, statement)
+		}
+
+	case "aggregate":
+		stages, ok := m["pipeline"].(*types.Array)
+		if !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'pipeline' is the wrong type '%T', expected type 'array'", m["pipeline"])
+		}
+
+		if err := h.explainPipeline(ctx, e, stages); err != nil {
+			return nil, err
+		}
+
+	case "update", "delete":
+		field := name + "s"
+		writes, ok := m[field].(*types.Array)
+		if !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field '%s' is the wrong type '%T', expected type 'array'", field, m[field])
+		}
+		if writes.Len() != 1 {
+			return nil, common.NewErrorMessage(common.ErrBadValue, "explained write batches must be of size 1")
+		}
+
+		write, err := writes.Get(0)
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+		w, ok := write.(types.Document)
+		if !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field '%s' must contain objects", field)
+		}
+		if e.filter, ok = w.Map()["q"].(types.Document); !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'q' is the wrong type '%T', expected type 'object'", w.Map()["q"])
+		}
+
+		whereSQL, memoryFilter, err := writeFilter(e.filter)
+		if err != nil {
+			return nil, err
+		}
+
+		// the documents selected by SQL are matched by the rest of the filter in memory
+		filtered := len(memoryFilter.Keys()) != 0
+		if filtered {
+			e.stages = []string{"$match"}
+		}
+
+		var single bool
+		if name == "update" {
+			u, ok := w.Map()["u"].(types.Document)
+			if !ok {
+				return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'u' is the wrong type '%T', expected type 'object'", w.Map()["u"])
+			}
+			updateSQL, notWhereSQL, err := common.Update(u)
+			memoryUpdate := common.IsMemoryUpdate(err)
+			if err != nil && !memoryUpdate {
+				return nil, err
+			}
+
+			single = w.Map()["multi"] != true
+			switch {
+			case updateSQL == "" && !memoryUpdate:
+				// an update with only $setOnInsert does not modify existing documents
+			case memoryUpdate || filtered:
+				e.statements = memoryUpdateStatements(db, collection, whereSQL, single && !filtered)
+			case single:
+				e.statements = []string{
+					selectIdStmt(db, collection, whereSQL+notWhereSQL),
+					updateStmt(db, collection, updateSQL, "WHERE \"_id\" = ?"),
+				}
+			default:
+				e.statements = []string{updateStmt(db, collection, updateSQL, whereSQL+notWhereSQL)}
+			}
+			if w.Map()["upsert"] == true {
+				// the document is inserted if no document matches
+				e.statements = append(e.statements, fmt.Sprintf("INSERT INTO \"%s\".\"%s\" VALUES (?)", db, collection))
+			}
+		} else {
+			limit, _ := w.Map()["limit"].(int32)
+			single = limit != 0
+			if filtered {
+				e.statements = []string{
+					selectForUpdateSQL(db, collection, whereSQL, false),
+					deleteStmt(db, collection, " WHERE \"_id\" = ?"),
+				}
+			} else if single {
+				e.statements = []string{
+					selectIdStmt(db, collection, whereSQL),
+					deleteStmt(db, collection, " WHERE \"_id\" = ?"),
+				}
+			} else {
+				e.statements = []string{deleteStmt(db, collection, whereSQL)}
+			}
+		}
+
+		countSQL := fmt.Sprintf("SELECT COUNT(*) FROM \"%s\".\"%s\"", db, collection) + whereSQL
+		e.execute = func(ctx context.Context) (n int64, err error) {
+			if filtered {
+				matched, err := countMatching(ctx, h.hanaPool, db, collection, whereSQL, memoryFilter)
+				n = int64(matched)
+				if err != nil {
+					return 0, err
+				}
+			} else if err = h.hanaPool.QueryRowContext(ctx, countSQL).Scan(&n); err != nil {
+				return 0, lazyerrors.Error(err)
+			}
+			if single && n > 1 {
+				n = 1
+			}
+			return n, nil
+		}
+
+	case "findAndModify":
+		var params findAndModifyParams
+		if err := params.fillFindAndModifyParams(&doc); err != nil {
+			return nil, err
+		}
+		e.filter = *params.filter
+
+		statement, err := createQuery(ctx, &params)
+		if err != nil {
+			return nil, err
+		}
+		e.statements = []string{statement}
+
+		// the first selected document matching the rest of the filter in memory is modified
+		filtered := len(params.memoryFilter.Keys()) != 0
+		if filtered {
+			e.stages = []string{"$match"}
+		}
+
+		insertSQL := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" VALUES (?)", db, collection)
+		switch {
+		case params.remove && filtered:
+			e.statements = append(e.statements,
+				selectForUpdateSQL(db, collection, " WHERE \"_id\" = ?", false), deleteStmt(db, collection, " WHERE \"_id\" = ?"),
+			)
+		case params.remove:
+			e.statements = append(e.statements, deleteStmt(db, collection, " WHERE \"_id\" = ?"))
+		case params.replace:
+			e.statements = append(e.statements, deleteStmt(db, collection, " WHERE \"_id\" = ?"), insertSQL)
+		case params.update != nil:
+			updateSQL, _, err := common.Update(*params.update)
+			switch {
+			case common.IsMemoryUpdate(err) || (err == nil && updateSQL != "" && filtered):
+				e.statements = append(e.statements, memoryUpdateStatements(db, collection, " WHERE \"_id\" = ?", !filtered)...)
+			case err != nil:
+				return nil, err
+			case updateSQL == "":
+			default:
+				e.statements = append(e.statements, fmt.Sprintf("UPDATE \"%s\".\"%s\"", db, collection)+updateSQL+" WHERE \"_id\" = ?")
+			}
+		}
+		if params.upsert && !params.replace {
+			// the document is inserted if no document matches
+			e.statements = append(e.statements, insertSQL)
+		}
+
+		e.execute = func(ctx context.Context) (int64, error) {
+			if filtered {
+				docs, err := selectMatching(ctx, h.hanaPool, statement, params.memoryFilter, true)
+				return int64(len(docs)), err
+			}
+			return h.countRows(ctx, statement)
+		}
+
+	default:
+		return nil, common.NewErrorMessage(common.ErrNotImplemented, "explain: command %q is not supported", name)
+	}
+
+	return e, nil
+}
+
+// explainPipeline sets the statements of an aggregation pipeline, including the queries of its $lookup stages.
+func (h *storage) explainPipeline(ctx context.Context, e *explainedCommand, stages *types.Array) error {
+	p, err := h.collectionPipeline(ctx, e.db, e.collection, stages)
+	if err != nil {
+		return err
+	}
+
+	statement, _, err := p.sql(e.db, e.collection)
+	if err != nil {
+		return err
+	}
+
+	lookups, err := lookupStatements(e.db, p.stages, p.localSQL(e.db, e.collection))
+	if err != nil {
+		return err
+	}
+
+	e.statements = append([]string{statement}, lookups...)
+	if e.filter, err = p.filter(); err != nil {
+		return err
+	}
+	for _, s := range p.stages {
+		e.stages = append(e.stages, s.name)
+	}
+
+	e.execute = func(ctx context.Context) (int64, error) {
+		c, err := h.queryPipeline(ctx, e.db, e.collection, stages)
+		if err != nil {
+			return 0, err
+		}
+		docs, err := c.all()
+		return int64(len(docs)), err
+	}
+
+	return nil
+}
+
+// lookupStatements returns the statements of the queries of the $lookup stages which are processed in memory.
+// The values of localField which are not selected by a subquery are the parameter of the statement and the
+// variables of let are null, as both are only known when the pipeline is executed.
+func lookupStatements(db string, stages []stage, local *localSQL) ([]string, error) {
+	var res []string
+	for i, s := range stages {
+		l, ok := s.value.(*lookup)
+		if !ok {
+			continue
+		}
+
+		if l.pipeline == nil {
+			var whereSQL string
+			var err error
+			if i == 0 && local != nil {
+				whereSQL, err = local.lookupWhereClause(l, nil)
+			} else {
+				whereSQL, err = common.LookupWhereClause(l.localField, l.foreignField, func(string) (string, error) { return "?", nil }, nil)
+			}
+			if common.IsMemoryFilterError(err) {
+				// the foreign field is compared in memory
+				whereSQL, err = "", nil
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, fmt.Sprintf("SELECT * FROM \"%s\".\"%s\"", db, l.from)+whereSQL)
+			continue
+		}
+
+		vars := types.MustMakeDocument()
+		for _, k := range l.let.Keys() {
+			if err := vars.Set(k, nil); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+
+		p, err := newPipeline(bindPipeline(l.pipeline, vars), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		statement, _, err := p.sql(db, l.from)
+		if err != nil {
+			return nil, err
+		}
+
+		nested, err := lookupStatements(db, p.stages, p.localSQL(db, l.from))
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(append(res, statement), nested...)
+	}
+
+	return res, nil
+}
+
+// explainExecution executes the reading part of the explained command and returns
+// its statistics together with the SAP HANA execution plans of the statements.
+func (h *storage) explainExecution(ctx context.Context, e *explainedCommand) (types.Document, error) {
+	plans := types.MakeArray(len(e.statements))
+
+	// a collection which does not exist has no documents and no plans
+	exists, err := h.hanaPool.NamespaceExists(ctx, e.db, e.collection)
+	if err != nil {
+		return types.Document{}, err
+	}
+	if !exists {
+		return types.MustMakeDocument(
+			"executionSuccess", true,
+			"nReturned", int32(0),
+			"executionTimeMillis", int32(0),
+			"sqlPlans", plans,
+		), nil
+	}
+
+	start := time.Now()
+	n, err := e.execute(ctx)
+	if err != nil {
+		return types.Document{}, err
+	}
+	elapsed := time.Since(start)
+
+	// the explained plans are stored for the session, so all statements use the same connection
+	conn, err := h.hanaPool.Conn(ctx)
+	if err != nil {
+		return types.Document{}, lazyerrors.Error(err)
+	}
+	defer conn.Close()
+
+	for _, statement := range e.statements {
+		plan, err := explainPlan(ctx, conn, statement)
+		if err != nil {
+			return types.Document{}, err
+		}
+
+		if err = plans.Append(types.MustMakeDocument("statement", statement, "plan", plan)); err != nil {
+			return types.Document{}, lazyerrors.Error(err)
+		}
+	}
+
+	return types.MustMakeDocument(
+		"executionSuccess", true,
+		"nReturned", int32(n),
+		"executionTimeMillis", int32(elapsed.Milliseconds()),
+		"sqlPlans", plans,
+	), nil
+}
+
+// explainPlan runs EXPLAIN PLAN for the statement and returns the operators of the plan in the order of
+// EXPLAIN_PLAN_TABLE. The rows of the plan are deleted afterwards.
+func explainPlan(ctx context.Context, conn *sql.Conn, statement string) (plan *types.Array, err error) {
+	name := fmt.Sprintf("MONGODB_EXPLAIN_%d", newCursorID())
+
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("EXPLAIN PLAN SET STATEMENT_NAME = '%s' FOR %s", name, statement)); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	defer func() {
+		_, deleteErr := conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM EXPLAIN_PLAN_TABLE WHERE STATEMENT_NAME = '%s'", name))
+		if deleteErr != nil && err == nil {
+			plan, err = nil, lazyerrors.Error(deleteErr)
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(
+		"SELECT OPERATOR_NAME, OPERATOR_DETAILS, TABLE_NAME, OUTPUT_SIZE, SUBTREE_COST, LEVEL FROM EXPLAIN_PLAN_TABLE "+
+			"WHERE STATEMENT_NAME = '%s' ORDER BY OPERATOR_ID", name,
+	))
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	defer rows.Close()
+
+	plan = types.MakeArray(0)
+	for rows.Next() {
+		var operatorName, operatorDetails, tableName sql.NullString
+		var outputSize, subtreeCost sql.NullFloat64
+		var level sql.NullInt32
+		if err = rows.Scan(&operatorName, &operatorDetails, &tableName, &outputSize, &subtreeCost, &level); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+
+		operator := types.MustMakeDocument("operatorName", operatorName.String)
+		if operatorDetails.Valid && operatorDetails.String != "" {
+			if err = operator.Set("operatorDetails", operatorDetails.String); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		if tableName.Valid && tableName.String != "" {
+			if err = operator.Set("tableName", tableName.String); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		if outputSize.Valid {
+			if err = operator.Set("outputSize", outputSize.Float64); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		if subtreeCost.Valid {
+			if err = operator.Set("subtreeCost", subtreeCost.Float64); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+		if level.Valid {
+			if err = operator.Set("level", level.Int32); err != nil {
+				return nil, lazyerrors.Error(err)
+			}
+		}
+
+		if err = plan.Append(operator); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return plan, nil
+}
+
+// countRows runs the query and returns the number of rows.
+func (h *storage) countRows(ctx context.Context, query string) (int64, error) {
+	rows, err := h.hanaPool.QueryContext(ctx, query)
+	if err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+
+	return n, nil
+}
+
+// memoryUpdateStatements returns the statements of an update which is applied in memory by updateInMemory.
+func memoryUpdateStatements(db, collection, whereSQL string, single bool) []string {
+	return []string{
+		selectForUpdateSQL(db, collection, whereSQL, single),
+		fmt.Sprintf("DELETE FROM \"%s\".\"%s\" WHERE \"_id\" = ?", db, collection),
+		fmt.Sprintf("INSERT INTO \"%s\".\"%s\" VALUES (?)", db, collection),
+	}
+}
+
+// stringArray converts strings to an array.
+func stringArray(values []string) *types.Array {
+	array := make([]any, len(values))
+	for i, v := range values {
+		array[i] = v
+	}
+	return types.MustNewArray(array...)
+}
@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgExplain(t *testing.T) {
+	ctx, storage, mock, err := setupTestUtil(t)
+	require.NoError(t, err)
+
+	t.Run("queryPlanner", func(t *testing.T) {
+		command := types.MustMakeDocument(
+			"find", "testCollection",
+			"filter", types.MustMakeDocument("item", "test"),
+			"sort", types.MustMakeDocument("qty", int32(-1)),
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"explain", command,
+				"verbosity", "queryPlanner",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgExplain(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"queryPlanner", types.MustMakeDocument(
+				"namespace", "testDatabase.testCollection",
+				"parsedQuery", types.MustMakeDocument("item", "test"),
+				"winningPlan", types.MustMakeDocument(
+					"stage", "SAP_HANA_SQL",
+					"statements", types.MustNewArray(
+						"SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) ORDER BY CASE WHEN \"qty\" IS NULL THEN 1 WHEN IS_NUMBER(\"qty\") THEN 2 WHEN IS_STRING(\"qty\") THEN 3 WHEN (IS_OBJECT(\"qty\") AND \"qty\".\"oid\" IS UNSET) THEN 4 WHEN IS_ARRAY(\"qty\") THEN 5 WHEN (IS_OBJECT(\"qty\") AND \"qty\".\"oid\" IS SET) THEN 7 WHEN IS_BOOLEAN(\"qty\") THEN 8 ELSE 12 END DESC, \"qty\".\"oid\" DESC, \"qty\" DESC",
+					),
+				),
+				"rejectedPlans", types.MustNewArray(),
+			),
+			"command", command,
+			"ok", float64(1),
+		)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("executionStats", func(t *testing.T) {
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+		countRow := mock.NewRows([]string{"count"}).AddRow(3)
+		selectPlan := mock.NewRows([]string{"OPERATOR_NAME", "OPERATOR_DETAILS", "TABLE_NAME", "OUTPUT_SIZE", "SUBTREE_COST", "LEVEL"}).
+			AddRow("LIMIT", nil, nil, 1.0, 0.5, 1).
+			AddRow("COLUMN TABLE", "FILTER CONDITION: ...", "testCollection", 3.0, 0.4, 2)
+		deletePlan := mock.NewRows([]string{"OPERATOR_NAME", "OPERATOR_DETAILS", "TABLE_NAME", "OUTPUT_SIZE", "SUBTREE_COST", "LEVEL"}).
+			AddRow("DELETE", nil, "testCollection", 1.0, 0.1, 1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(countRow)
+		mock.ExpectExec("EXPLAIN PLAN SET STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT OPERATOR_NAME, OPERATOR_DETAILS, TABLE_NAME, OUTPUT_SIZE, SUBTREE_COST, LEVEL FROM EXPLAIN_PLAN_TABLE").WillReturnRows(selectPlan)
+		mock.ExpectExec("DELETE FROM EXPLAIN_PLAN_TABLE WHERE STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("EXPLAIN PLAN SET STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT OPERATOR_NAME, OPERATOR_DETAILS, TABLE_NAME, OUTPUT_SIZE, SUBTREE_COST, LEVEL FROM EXPLAIN_PLAN_TABLE").WillReturnRows(deletePlan)
+		mock.ExpectExec("DELETE FROM EXPLAIN_PLAN_TABLE WHERE STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"explain", types.MustMakeDocument(
+					"delete", "testCollection",
+					"deletes", types.MustNewArray(types.MustMakeDocument(
+						"q", types.MustMakeDocument("item", "test"),
+						"limit", int32(1),
+					)),
+				),
+				"verbosity", "executionStats",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgExplain(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		winningPlan := actual.Map()["queryPlanner"].(types.Document).Map()["winningPlan"].(types.Document)
+		assert.Equal(t, types.MustNewArray(
+			"SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) LIMIT 1",
+			"DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = ?",
+		), winningPlan.Map()["statements"])
+
+		stats := actual.Map()["executionStats"].(types.Document)
+		assert.Equal(t, true, stats.Map()["executionSuccess"])
+		assert.Equal(t, int32(1), stats.Map()["nReturned"])
+
+		plans := stats.Map()["sqlPlans"].(*types.Array)
+		require.Equal(t, 2, plans.Len())
+		deleteStatement, err := plans.Get(1)
+		require.NoError(t, err)
+		assert.Equal(t, types.MustMakeDocument(
+			"statement", "DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = ?",
+			"plan", types.MustNewArray(types.MustMakeDocument(
+				"operatorName", "DELETE",
+				"tableName", "testCollection",
+				"outputSize", 1.0,
+				"subtreeCost", 0.1,
+				"level", int32(1),
+			)),
+		), deleteStatement)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+	t.Run("pipeline with lookup", func(t *testing.T) {
+		command := types.MustMakeDocument(
+			"aggregate", "orders",
+			"pipeline", types.MustNewArray(
+				types.MustMakeDocument("$match", types.MustMakeDocument("_id", int32(1))),
+				types.MustMakeDocument("$lookup", types.MustMakeDocument(
+					"from", "customers",
+					"localField", "customer",
+					"foreignField", "_id",
+					"as", "customers",
+				)),
+				types.MustMakeDocument("$lookup", types.MustMakeDocument(
+					"from", "items",
+					"let", types.MustMakeDocument("order", "$_id"),
+					"pipeline", types.MustNewArray(
+						types.MustMakeDocument("$match", types.MustMakeDocument("$expr", types.MustMakeDocument("$eq", types.MustNewArray("$order", "$$order")))),
+					),
+					"as", "items",
+				)),
+			),
+			"cursor", types.MustMakeDocument(),
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"explain", command,
+				"verbosity", "queryPlanner",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgExplain(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		winningPlan := actual.Map()["queryPlanner"].(types.Document).Map()["winningPlan"].(types.Document)
+		assert.Equal(t, types.MustNewArray(
+			"SELECT * FROM \"testDatabase\".\"orders\" WHERE \"_id\" = 1",
+			"SELECT * FROM \"testDatabase\".\"customers\" WHERE (\"_id\" IN (SELECT \"customer\" FROM \"testDatabase\".\"orders\" WHERE \"_id\" = 1))",
+			"SELECT * FROM \"testDatabase\".\"items\"",
+		), winningPlan.Map()["statements"])
+		assert.Equal(t, types.MustNewArray("$lookup", "$lookup"), winningPlan.Map()["inMemoryStages"])
+	})
+
+	t.Run("find processed in memory", func(t *testing.T) {
+		command := types.MustMakeDocument(
+			"find", "testCollection",
+			"filter", types.MustMakeDocument("item", "test"),
+			"sort", types.MustMakeDocument("size.h", int32(1)),
+		)
+
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+		arraysRow := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT COUNT(*) FROM (SELECT * FROM \"testDatabase\".\"testCollection\" WHERE IS_ARRAY(\"size\") LIMIT 1)").WillReturnRows(arraysRow)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"explain", command,
+				"verbosity", "queryPlanner",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgExplain(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		queryPlanner := actual.Map()["queryPlanner"].(types.Document)
+		assert.Equal(t, types.MustMakeDocument("item", "test"), queryPlanner.Map()["parsedQuery"])
+		winningPlan := queryPlanner.Map()["winningPlan"].(types.Document)
+		assert.Equal(t, types.MustNewArray("$sort"), winningPlan.Map()["inMemoryStages"])
+	})
+
+	t.Run("plan is not deleted", func(t *testing.T) {
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+		countRow := mock.NewRows([]string{"count"}).AddRow(3)
+		selectPlan := mock.NewRows([]string{"OPERATOR_NAME", "OPERATOR_DETAILS", "TABLE_NAME", "OUTPUT_SIZE", "SUBTREE_COST", "LEVEL"}).
+			AddRow("COLUMN TABLE", nil, "testCollection", 3.0, 0.4, 1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"testDatabase\".\"testCollection\"").WillReturnRows(countRow)
+		mock.ExpectExec("EXPLAIN PLAN SET STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT OPERATOR_NAME, OPERATOR_DETAILS, TABLE_NAME, OUTPUT_SIZE, SUBTREE_COST, LEVEL FROM EXPLAIN_PLAN_TABLE").WillReturnRows(selectPlan)
+		mock.ExpectExec("DELETE FROM EXPLAIN_PLAN_TABLE WHERE STATEMENT_NAME = 'MONGODB_EXPLAIN_").WillReturnError(fmt.Errorf("insufficient privilege"))
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"explain", types.MustMakeDocument("count", "testCollection"),
+				"verbosity", "executionStats",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		_, err = storage.MsgExplain(ctx, &reqMsg)
+		assert.ErrorContains(t, err, "insufficient privilege")
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
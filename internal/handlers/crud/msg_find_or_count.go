@@ -24,7 +24,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"strings"
+	"time"
 
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
 
@@ -45,18 +47,15 @@ type locatCtx struct {
 // or count the number of documents that matches the query filter.
 func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
 	unimplementedFields := []string{
-		"skip",
 		"returnKey",
 		"showRecordId",
 		"tailable",
 		"oplogReplay",
-		"noCursorTimeout",
 		"awaitData",
 		"allowPartialResults",
 		"collation",
 		"let",
 		"hint",
-		"maxTimeMS",
 		"readConcern",
 		"max",
 		"min",
@@ -71,9 +70,14 @@ func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.Op
 		return nil, err
 	}
 
-	common.Ignored(&document, h.l, "singleBatch", "allowDiskUse", "batchSize")
+	common.Ignored(&document, h.l, "allowDiskUse")
 
 	docMap := document.Map()
+
+	maxTime, err := getMaxTime(docMap)
+	if err != nil {
+		return nil, err
+	}
 	if isPrintShardingStatus(docMap) {
 		return nil, common.NewErrorMessage(common.ErrCommandNotFound, "no such command: printShardingStatus")
 	}
@@ -93,6 +97,15 @@ func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.Op
 		return nil, err
 	}
 
+	// a filter which can not be translated to SQL completely is run as aggregation pipeline
+	stages, err := findStages(docMap)
+	if err != nil {
+		return nil, err
+	}
+	if stages != nil {
+		return h.findOrCountPipeline(ctx, docMap, stages, maxTime, &localCtx)
+	}
+
 	sql, err := createSqlStmt(docMap, &localCtx)
 	if err != nil {
 		return nil, err
@@ -107,7 +120,7 @@ func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.Op
 				Documents: []types.Document{types.MustMakeDocument(
 					"cursor", types.MustMakeDocument(
 						"firstBatch", types.MustMakeDocument(),
-						"id", int64(0), // TODO
+						"id", int64(0),
 						"ns", localCtx.db+"."+collection,
 					),
 					"ok", float64(1),
@@ -126,7 +139,7 @@ func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.Op
 							"_id", "featureCompatibilityVersion",
 							"version", "5.0",
 						),
-						"id", int64(0), // TODO
+						"id", int64(0),
 						"ns", localCtx.db+"."+collection,
 					),
 					"ok", float64(1),
@@ -139,12 +152,140 @@ func (h *storage) MsgFindOrCount(ctx context.Context, msg *wire.OpMsg) (*wire.Op
 		}
 	}
 
-	rows, err := h.hanaPool.QueryContext(ctx, sql)
+	// the context is canceled when the rows are closed, i.e. by the cursor, the time limit applies to the first batch
+	cursorCtx := newCursorContext(ctx)
+	cursorCtx.startBatch(maxTime)
+	rows, err := h.hanaPool.QueryContext(cursorCtx, sql)
 	if err != nil {
+		cursorCtx.cancel(context.Canceled)
 		return nil, lazyerrors.Error(err)
 	}
 
-	return createResponse(docMap, rows, &localCtx)
+	return h.createResponse(docMap, rows, cursorCtx, &localCtx)
+}
+
+// findStages returns the find or count as stages of an aggregation pipeline if a part of its filter
+// has to be evaluated or its documents have to be sorted in memory. It returns nil if the whole
+// command can be translated to SQL.
+func findStages(docMap map[string]any) (*types.Array, error) {
+	_, isCount := docMap["count"]
+
+	filter, _ := docMap["filter"].(types.Document)
+	if isCount {
+		filter, _ = docMap["query"].(types.Document)
+	}
+
+	_, memoryFilter, err := common.SplitFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, _ := docMap["sort"].(types.Document)
+	if len(memoryFilter.Keys()) == 0 && (isCount || !sortInMemory(sort, nil)) {
+		return nil, nil
+	}
+
+	// validates limit and skip
+	if _, err = createLimitStmt(docMap); err != nil {
+		return nil, err
+	}
+
+	stages := types.MustNewArray(types.MustMakeDocument("$match", filter))
+	appendStage := func(name string, value any) error {
+		if err := stages.Append(types.MustMakeDocument(name, value)); err != nil {
+			return lazyerrors.Error(err)
+		}
+		return nil
+	}
+
+	if len(sort.Keys()) != 0 && !isCount {
+		if err = appendStage("$sort", sort); err != nil {
+			return nil, err
+		}
+	}
+
+	skip, _ := getInteger(docMap, "skip")
+	if skip != 0 {
+		if err = appendStage("$skip", skip); err != nil {
+			return nil, err
+		}
+	}
+
+	limit, _ := getInteger(docMap, "limit")
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit != 0 {
+		if err = appendStage("$limit", limit); err != nil {
+			return nil, err
+		}
+	}
+
+	// any other projection is performed in memory by the cursor
+	if projection, ok := docMap["projection"].(types.Document); ok && len(projection.Keys()) != 0 && !isCount {
+		_, inMemory, err := common.Projection(projection)
+		if err != nil {
+			return nil, err
+		}
+
+		if !inMemory {
+			if err = appendStage("$project", projection); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return stages, nil
+}
+
+// findOrCountPipeline runs the stages created by findStages and returns a cursor or the count of the documents.
+func (h *storage) findOrCountPipeline(ctx context.Context, docMap map[string]any, stages *types.Array, maxTime time.Duration, localCtx *locatCtx) (*wire.OpMsg, error) {
+	// the context is canceled when the cursor is closed, the time limit applies to the first batch
+	cursorCtx := newCursorContext(ctx)
+	cursorCtx.startBatch(maxTime)
+	c, err := h.queryPipeline(cursorCtx, localCtx.db, localCtx.collection, stages)
+	if err != nil {
+		cursorCtx.cancel(context.Canceled)
+		return nil, err
+	}
+	c.ctx = cursorCtx
+
+	if projection, ok := docMap["projection"].(types.Document); ok && !localCtx.count {
+		if _, inMemory, _ := common.Projection(projection); inMemory {
+			c.projection = projection
+			c.filter, _ = docMap["filter"].(types.Document)
+			c.exclusion = true
+		}
+	}
+
+	if localCtx.count {
+		docs, err := c.all()
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &wire.OpMsg{}
+		err = resp.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"n", int32(len(docs)),
+				"ok", float64(1),
+			)},
+		})
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+		return resp, nil
+	}
+
+	batchSize, err := getBatchSize(docMap, defaultBatchSize)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	c.noTimeout, _ = docMap["noCursorTimeout"].(bool)
+
+	singleBatch, _ := docMap["singleBatch"].(bool)
+	return h.createCursorResponse(c, batchSize, singleBatch)
 }
 
 func createSqlStmt(docMap map[string]any, ctx *locatCtx) (sql string, err error) {
@@ -169,6 +310,12 @@ func createSqlStmt(docMap map[string]any, ctx *locatCtx) (sql string, err error)
 	if err != nil {
 		return
 	}
+
+	if ctx.count && limitStmt != "" {
+		// limit and skip of a count restrict the counted documents and not the single row of the result
+		sql = fmt.Sprintf("SELECT COUNT(*) FROM (SELECT * FROM \"%s\".\"%s\"%s%s)", ctx.db, ctx.collection, whereStmt, limitStmt)
+		return
+	}
 	sql += limitStmt
 
 	return
@@ -205,22 +352,10 @@ func createOrderByStmt(docMap map[string]any) (sql string, err error) {
 
 		for i, sortKey := range sort.Keys() {
 			if i != 0 {
-				sql += ","
+				sql += ", "
 			}
 
-			if strings.Contains(sortKey, ".") {
-				split := strings.Split(sortKey, ".")
-				sql += " "
-				for j, s := range split {
-					if (len(split) - 1) == j {
-						sql += "\"" + s + "\""
-					} else {
-						sql += "\"" + s + "\"."
-					}
-				}
-			} else {
-				sql += "\"" + sortKey + "\" "
-			}
+			kSQL := "\"" + strings.Join(strings.Split(sortKey, "."), "\".\"") + "\""
 
 			order, ok := sortMap[sortKey].(int32)
 			if !ok {
@@ -230,73 +365,123 @@ func createOrderByStmt(docMap map[string]any) (sql string, err error) {
 				}
 				order = int32(sortMap[sortKey].(float64))
 			}
+
+			var direction string
 			if order == 1 {
-				sql += " ASC"
+				direction = " ASC"
 			} else if order == -1 {
-				sql += " DESC"
+				direction = " DESC"
 			} else {
 				err = common.NewErrorMessage(common.ErrSortBadValue, "cannot use value %s for sort", sortMap[sortKey])
+				return
 			}
+
+			// values are ordered by the BSON comparison order of their types first,
+			// ObjectIDs are stored as objects and ordered by their hex string
+			sql += common.TypeOrderSQL(kSQL) + direction + ", " + kSQL + ".\"oid\"" + direction + ", " + kSQL + direction
 		}
 	}
 	return
 }
 
+// createLimitStmt creates the LIMIT and OFFSET of the statement from limit and skip.
 func createLimitStmt(docMap map[string]any) (sql string, err error) {
-	limit, _ := docMap["limit"].(int32)
+	limit, err := getInteger(docMap, "limit")
+	if err != nil {
+		return
+	}
+
+	if limit < 0 {
+		if _, isCount := docMap["count"]; !isCount {
+			err = common.NewErrorMessage(common.ErrNotImplemented, "MsgFind: negative limit values are not supported")
+			return
+		}
+		// count uses the absolute value of a negative limit
+		limit = -limit
+	}
+
+	skip, err := getInteger(docMap, "skip")
+	if err != nil {
+		return
+	}
+
+	if skip < 0 {
+		err = common.NewErrorMessage(common.ErrBadValue, "BSON field 'skip' value must be >= 0, actual value '%d'", skip)
+		return
+	}
+
+	sort, _ := docMap["sort"].(types.Document)
+	sql = limitOffsetStmt(limit, skip, len(sort.Keys()) != 0)
+	return
+}
+
+// getInteger returns the value of an integer field like limit or skip. An undefined field is 0.
+func getInteger(docMap map[string]any, field string) (int64, error) {
+	switch value := docMap[field].(type) {
+	case nil:
+		return 0, nil
+	case int32:
+		return int64(value), nil
+	case int64:
+		return value, nil
+	case float64:
+		if value != math.Trunc(value) || math.IsInf(value, 0) {
+			return 0, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field '%s' is the wrong type 'double', expected an integer", field)
+		}
+		return int64(value), nil
+	default:
+		return 0, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field '%s' is the wrong type '%T', expected an integer", field, value)
+	}
+}
+
+// limitOffsetStmt creates the LIMIT and OFFSET of the SQL statement. A limit of 0 means no limit.
+// SAP HANA does not accept an OFFSET without LIMIT, so the maximum number of rows is used in that case.
+// Without an order the skipped rows may differ between two statements, so unsorted rows are ordered by _id.
+func limitOffsetStmt(limit, offset int64, sorted bool) (sql string) {
+	if offset != 0 && !sorted {
+		sql = " ORDER BY \"_id\""
+	}
+
 	switch {
-	case limit == 0:
-		// undefined or zero - no limit
-	case limit > 0:
+	case offset == 0 && limit == 0:
+	case offset == 0:
 		sql += fmt.Sprintf(" LIMIT %d ", limit)
+	case limit == 0:
+		sql += fmt.Sprintf(" LIMIT %d OFFSET %d ", math.MaxInt32, offset)
 	default:
-		err = common.NewErrorMessage(common.ErrNotImplemented, "MsgFind: negative limit values are not supported")
+		sql += fmt.Sprintf(" LIMIT %d OFFSET %d ", limit, offset)
 	}
 	return
 }
 
-func createResponse(docMap map[string]any, rows *sql.Rows, localCtx *locatCtx) (resp *wire.OpMsg, err error) {
+func (h *storage) createResponse(docMap map[string]any, rows *sql.Rows, cursorCtx *cursorContext, localCtx *locatCtx) (resp *wire.OpMsg, err error) {
 	resp = &wire.OpMsg{}
 	_, isFindOp := docMap["find"].(string)
-	defer rows.Close()
-	if isFindOp { //nolint:nestif // FIXME: I have no idead to fix this lint
-		var docs types.Array
-		var aDoc *types.Document
-
-		for {
-			aDoc, err = nextRow(rows)
-			if err != nil {
-				return nil, lazyerrors.Error(err)
-			} else if aDoc == nil {
-				break
-			}
-
-			if err = docs.Append(*aDoc); err != nil {
-				return nil, lazyerrors.Error(err)
-			}
+	if isFindOp {
+		projection, _ := docMap["projection"].(types.Document)
+		c := &cursor{
+			ns:         localCtx.db + "." + localCtx.collection,
+			rows:       rows,
+			ctx:        cursorCtx,
+			projection: projection,
+			filter:     localCtx.filter,
+			exclusion:  localCtx.exclusion,
 		}
 
-		if localCtx.exclusion {
-			err = common.ProjectDocuments(&docs, docMap["projection"].(types.Document))
-			if err != nil {
-				return nil, lazyerrors.Error(err)
-			}
-		}
-
-		err = resp.SetSections(wire.OpMsgSection{
-			Documents: []types.Document{types.MustMakeDocument(
-				"cursor", types.MustMakeDocument(
-					"firstBatch", &docs,
-					"id", int64(0), // TODO
-					"ns", localCtx.db+"."+localCtx.collection,
-				),
-				"ok", float64(1),
-			)},
-		})
+		var batchSize int32
+		batchSize, err = getBatchSize(docMap, defaultBatchSize)
 		if err != nil {
-			return nil, lazyerrors.Error(err)
+			c.close()
+			return nil, err
 		}
+		c.noTimeout, _ = docMap["noCursorTimeout"].(bool)
+
+		singleBatch, _ := docMap["singleBatch"].(bool)
+		return h.createCursorResponse(c, batchSize, singleBatch)
 	} else {
+		defer cursorCtx.cancel(context.Canceled)
+		defer rows.Close()
+
 		var count int32
 		for rows.Next() {
 			err = rows.Scan(&count)
@@ -330,7 +515,7 @@ func namespaceNotExisting(localCtx *locatCtx) (*wire.OpMsg, error) {
 			Documents: []types.Document{types.MustMakeDocument(
 				"cursor", types.MustMakeDocument(
 					"firstBatch", types.MustNewArray(),
-					"id", int64(0), // TODO
+					"id", int64(0),
 					"ns", localCtx.db+"."+localCtx.collection,
 				),
 				"ok", float64(1),
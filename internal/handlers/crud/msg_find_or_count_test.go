@@ -7,6 +7,7 @@ package crud
 import (
 	"testing"
 
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
 	"github.com/stretchr/testify/assert"
@@ -99,14 +100,145 @@ func TestMsgFindOrCound(t *testing.T) {
 		}
 	})
 
-	t.Run("find documents with where, order by, limit, and projection", func(t *testing.T) {
-		idRow := mock.NewRows([]string{"document"}).AddRow([]byte{123, 34, 95, 105, 100, 34, 58, 32, 49, 50, 51, 125})
+	t.Run("count with skip and limit", func(t *testing.T) {
+		countRow := mock.NewRows([]string{"count"}).AddRow(2)
 		row1 := mock.NewRows([]string{"count"}).AddRow(1)
 		row2 := mock.NewRows([]string{"count"}).AddRow(1)
 
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
-		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test' ORDER BY  \"phone\".\"number\" ASC LIMIT 1").WillReturnRows(idRow)
+		mock.ExpectQuery("SELECT COUNT(*) FROM (SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) ORDER BY \"_id\" LIMIT 2 OFFSET 5 )").WillReturnRows(countRow)
+
+		countReq := types.MustMakeDocument(
+			"count", "testCollection",
+			"query", types.MustMakeDocument("item", "test"),
+			"limit", int32(2),
+			"skip", float64(5),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{countReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(2), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("find documents with filter evaluated in memory", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "item": "test", "qty": 1.5}`)).
+			AddRow([]byte(`{"_id": 2, "item": "test", "qty": 2}`)).
+			AddRow([]byte(`{"_id": 3, "item": "test", "qty": 3}`))
+
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(docRows)
+
+		findReq := types.MustMakeDocument(
+			"find", "testCollection",
+			"filter", types.MustMakeDocument("item", "test", "qty", types.MustMakeDocument("$type", "int")),
+			"limit", int32(1),
+			"projection", types.MustMakeDocument("item", int32(0)),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{findReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"firstBatch", types.MustNewArray(
+					types.MustMakeDocument("_id", int32(2), "qty", int32(2)),
+				),
+				"id", int64(0),
+				"ns", "testDatabase.testCollection",
+			),
+			"ok", float64(1),
+		)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("find documents with positional projection in memory", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "item": "test", "grades": [80, 95, 95], "qty": 3}`))
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"grades\" = 95 OR FOR ANY \"$element\" IN \"grades\" SATISFIES \"$element\" = 95 END)").WillReturnRows(docRows)
+
+		findReq := types.MustMakeDocument(
+			"find", "testCollection",
+			"filter", types.MustMakeDocument("grades", int32(95)),
+			"projection", types.MustMakeDocument("item", int32(1), "grades.$", int32(1)),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{findReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"firstBatch", types.MustNewArray(
+					types.MustMakeDocument("_id", int32(1), "item", "test", "grades", types.MustNewArray(int32(95))),
+				),
+				"id", int64(0),
+				"ns", "testDatabase.testCollection",
+			),
+			"ok", float64(1),
+		)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("find documents with where, dotted sort in memory, limit, and projection", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 123, "item": "test", "phone": [{"number": 3}, {"number": 1}]}`)).
+			AddRow([]byte(`{"_id": 456, "item": "test", "phone": {"number": 2}}`))
+
+		for i := 0; i < 3; i++ {
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			if i == 1 {
+				// the documents have arrays on the path of the sort
+				mock.ExpectQuery("SELECT COUNT(*) FROM (SELECT * FROM \"testDatabase\".\"testCollection\" WHERE IS_ARRAY(\"phone\") LIMIT 1)").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+			}
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(docRows)
 
 		deleteReq := types.MustMakeDocument(
 			"find", "testCollection",
@@ -153,3 +285,68 @@ func TestMsgFindOrCound(t *testing.T) {
 		}
 	})
 }
+
+func TestMsgFindDottedSort(t *testing.T) {
+	ctx, storage, mock, err := setupTestUtil(t)
+	require.NoError(t, err)
+
+	docRows := mock.NewRows([]string{"document"}).
+		AddRow([]byte(`{"_id": 456, "item": "test", "phone": {"number": 2}}`))
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		if i == 1 {
+			// no document has an array on the path of the sort
+			mock.ExpectQuery("SELECT COUNT(*) FROM (SELECT * FROM \"testDatabase\".\"testCollection\" WHERE IS_ARRAY(\"phone\") LIMIT 1)").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+		}
+	}
+	mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) ORDER BY CASE WHEN \"phone\".\"number\" IS NULL THEN 1 WHEN IS_NUMBER(\"phone\".\"number\") THEN 2 WHEN IS_STRING(\"phone\".\"number\") THEN 3 WHEN (IS_OBJECT(\"phone\".\"number\") AND \"phone\".\"number\".\"oid\" IS UNSET) THEN 4 WHEN IS_ARRAY(\"phone\".\"number\") THEN 5 WHEN (IS_OBJECT(\"phone\".\"number\") AND \"phone\".\"number\".\"oid\" IS SET) THEN 7 WHEN IS_BOOLEAN(\"phone\".\"number\") THEN 8 ELSE 12 END ASC, \"phone\".\"number\".\"oid\" ASC, \"phone\".\"number\" ASC LIMIT 1 ").WillReturnRows(docRows)
+
+	var reqMsg wire.OpMsg
+	err = reqMsg.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"find", "testCollection",
+			"filter", types.MustMakeDocument("item", "test"),
+			"sort", types.MustMakeDocument("phone.number", int32(1)),
+			"limit", int32(1),
+			"$db", "testDatabase",
+		)},
+	})
+	require.NoError(t, err)
+
+	msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+	require.NoError(t, err)
+
+	actual, _ := msg.Document()
+	cursor := actual.Map()["cursor"].(types.Document)
+	assert.Equal(t, types.MustNewArray(types.MustMakeDocument("_id", int32(456), "item", "test", "phone", types.MustMakeDocument("number", int32(2)))), cursor.Map()["firstBatch"])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateLimitStmt(t *testing.T) {
+	limitTestCases := []struct {
+		name   string
+		docMap map[string]any
+		sql    string
+		err    error
+	}{
+		{"no limit", map[string]any{"find": "c"}, "", nil},
+		{"limit", map[string]any{"find": "c", "limit": int32(3)}, " LIMIT 3 ", nil},
+		{"skip without limit", map[string]any{"find": "c", "skip": int64(10)}, " ORDER BY \"_id\" LIMIT 2147483647 OFFSET 10 ", nil},
+		{"skip and limit", map[string]any{"find": "c", "skip": int32(10), "limit": float64(5)}, " ORDER BY \"_id\" LIMIT 5 OFFSET 10 ", nil},
+		{"skip with sort", map[string]any{"find": "c", "skip": int32(10), "sort": types.MustMakeDocument("a", int32(1))}, " LIMIT 2147483647 OFFSET 10 ", nil},
+		{"negative limit of count", map[string]any{"count": "c", "limit": int32(-4)}, " LIMIT 4 ", nil},
+		{"negative skip", map[string]any{"find": "c", "skip": int32(-1)}, "", common.NewErrorMessage(common.ErrBadValue, "BSON field 'skip' value must be >= 0, actual value '-1'")},
+		{"skip of wrong type", map[string]any{"find": "c", "skip": "1"}, "", common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'skip' is the wrong type 'string', expected an integer")},
+	}
+
+	for _, tc := range limitTestCases {
+		sql, err := createLimitStmt(tc.docMap)
+		assert.Equal(t, tc.sql, sql, tc.name)
+		assert.Equal(t, tc.err, err, tc.name)
+	}
+}
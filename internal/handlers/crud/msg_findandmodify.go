@@ -30,6 +30,11 @@ type findAndModifyParams struct {
 	upsert     bool
 	upsertDoc  *types.Document
 	docID      any
+
+	arrayFilters *types.Array
+
+	// memoryFilter is the part of the filter evaluated in memory
+	memoryFilter types.Document
 }
 
 // MsgFindAndModify finds documents in a collection or view and modifys or deletes them.
@@ -40,10 +45,8 @@ func (h *storage) MsgFindAndModify(ctx context.Context, msg *wire.OpMsg) (*wire.
 	}
 
 	unimplementedFields := []string{
-		"arrayFilter",
 		"commented",
 		"let",
-		"maxTimeMS",
 	}
 	if err := common.Unimplemented(&document, unimplementedFields...); err != nil {
 		return nil, err
@@ -58,6 +61,13 @@ func (h *storage) MsgFindAndModify(ctx context.Context, msg *wire.OpMsg) (*wire.
 	}
 	common.Ignored(&document, h.l, ignoredFields...)
 
+	maxTime, err := getMaxTime(document.Map())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
 	var params findAndModifyParams
 	err = params.fillFindAndModifyParams(&document)
 	if err != nil {
@@ -184,23 +194,35 @@ func findDocument(ctx context.Context, params *findAndModifyParams, db *hana.Hpo
 		return nil, err
 	}
 
-	var docByte []byte
-	row := db.QueryRowContext(ctx, sql)
-
-	err = row.Scan(&docByte)
-	if err != nil {
-		if err == sqldb.ErrNoRows {
+	var d types.Document
+	if len(params.memoryFilter.Keys()) != 0 {
+		docs, err := selectMatching(ctx, db, sql, params.memoryFilter, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 {
 			return nil, nil
 		}
-		return nil, lazyerrors.Error(err)
-	}
+		d = docs[0]
+	} else {
+		var docByte []byte
+		row := db.QueryRowContext(ctx, sql)
 
-	var doc bson.Document
-	if err := doc.UnmarshalJSON(docByte); err != nil {
-		return nil, lazyerrors.Error(err)
-	}
+		err = row.Scan(&docByte)
+		if err != nil {
+			if err == sqldb.ErrNoRows {
+				return nil, nil
+			}
+			return nil, lazyerrors.Error(err)
+		}
 
-	d := types.MustConvertDocument(&doc)
+		var doc bson.Document
+		if err := doc.UnmarshalJSON(docByte); err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+
+		d = types.MustConvertDocument(&doc)
+	}
 
 	params.docID, err = d.Get("_id")
 	if err != nil {
@@ -261,13 +283,16 @@ func findNewDocument(ctx context.Context, params *findAndModifyParams, db *hana.
 	return &d, nil
 }
 
+// createQuery returns the query selecting the document to modify and sets the filter which the selected
+// documents have to match in memory. Without such a filter, the first selected document is modified.
 func createQuery(ctx context.Context, params *findAndModifyParams) (string, error) {
 	sql := fmt.Sprintf("SELECT * FROM \"%s\".\"%s\"", params.db, params.collection)
 
-	whereSQL, err := common.CreateWhereClause(*params.filter)
+	whereSQL, memoryFilter, err := writeFilter(*params.filter)
 	if err != nil {
-		return "", lazyerrors.Error(err)
+		return "", err
 	}
+	params.memoryFilter = memoryFilter
 
 	orderSQL, err := createOrderBy(params)
 	if err != nil {
@@ -276,7 +301,9 @@ func createQuery(ctx context.Context, params *findAndModifyParams) (string, erro
 
 	sql += whereSQL + orderSQL
 
-	sql += " LIMIT 1"
+	if len(memoryFilter.Keys()) == 0 {
+		sql += " LIMIT 1"
+	}
 
 	return sql, nil
 }
@@ -285,50 +312,28 @@ func createOrderBy(params *findAndModifyParams) (sql string, err error) {
 	if params.sort == nil {
 		return "", nil
 	}
-	sortMap := params.sort.Map()
-	if len(sortMap) != 0 {
-		sql += " ORDER BY "
 
-		for i, sortKey := range params.sort.Keys() {
-			if i != 0 {
-				sql += ","
-			}
+	return createOrderByStmt(map[string]any{"sort": *params.sort})
+}
 
-			if strings.Contains(sortKey, ".") {
-				split := strings.Split(sortKey, ".")
-				sql += " "
-				for j, s := range split {
-					if (len(split) - 1) == j {
-						sql += "\"" + s + "\""
-					} else {
-						sql += "\"" + s + "\"."
-					}
-				}
-			} else {
-				sql += "\"" + sortKey + "\" "
-			}
+func removeDocument(ctx context.Context, params *findAndModifyParams, db *hana.Hpool) error {
+	if len(params.memoryFilter.Keys()) == 0 {
+		return deleteDocument(ctx, params, db)
+	}
 
-			order, ok := sortMap[sortKey].(int32)
-			if !ok {
-				if !anyIsInt(sortMap[sortKey]) {
-					err = common.NewErrorMessage(common.ErrSortBadValue, "cannot use type %T for sort", sortMap[sortKey])
-					return
-				}
-				order = int32(sortMap[sortKey].(float64))
-			}
-			if order == 1 {
-				sql += " ASC"
-			} else if order == -1 {
-				sql += " DESC"
-			} else {
-				err = common.NewErrorMessage(common.ErrSortBadValue, "cannot use value %s for sort", sortMap[sortKey])
-			}
-		}
+	whereSQL, err := common.CreateWhereClause(types.MustMakeDocument("_id", params.docID))
+	if err != nil {
+		return lazyerrors.Error(err)
 	}
-	return
+
+	// the document is checked again while it is locked
+	_, err = deleteInMemory(ctx, db, params.db, params.collection, whereSQL, params.memoryFilter, true)
+
+	return err
 }
 
-func removeDocument(ctx context.Context, params *findAndModifyParams, db *hana.Hpool) error {
+// deleteDocument deletes the found document.
+func deleteDocument(ctx context.Context, params *findAndModifyParams, db *hana.Hpool) error {
 	sql := fmt.Sprintf("DELETE FROM \"%s\".\"%s\"", params.db, params.collection)
 
 	whereSQL, err := common.CreateWhereClause(types.MustMakeDocument("_id", params.docID))
@@ -352,11 +357,27 @@ func updateDocument(ctx context.Context, params *findAndModifyParams, db *hana.H
 		return lazyerrors.Error(err)
 	}
 
+	// the document matching a filter evaluated in memory is checked again while it is locked
 	updateSQL, _, err := common.Update(*params.update)
+	if common.IsMemoryUpdate(err) || len(params.memoryFilter.Keys()) != 0 {
+		_, err = updateInMemory(
+			ctx, db, params.db, params.collection, whereSQL, params.memoryFilter, *params.filter, *params.update, params.arrayFilters, true,
+		)
+		return err
+	}
 	if err != nil {
 		return lazyerrors.Error(err)
 	}
 
+	// an update with only $setOnInsert does not modify existing documents
+	if updateSQL == "" {
+		return nil
+	}
+
+	if err = checkNumericFields(ctx, db, params.db, params.collection, whereSQL, *params.update); err != nil {
+		return err
+	}
+
 	sql += updateSQL + whereSQL
 
 	_, err = db.ExecContext(ctx, sql)
@@ -366,7 +387,7 @@ func updateDocument(ctx context.Context, params *findAndModifyParams, db *hana.H
 
 func replaceDocument(ctx context.Context, params *findAndModifyParams, db *hana.Hpool) error {
 
-	err := removeDocument(ctx, params, db)
+	err := deleteDocument(ctx, params, db)
 	if err != nil {
 		return err
 	}
@@ -493,6 +514,16 @@ func (params *findAndModifyParams) fillFindAndModifyParams(doc *types.Document)
 		return lazyerrors.Errorf("argument \"update\" cannot be specified when \"remove\" is true")
 	}
 
+	var err error
+	if params.arrayFilters, err = getArrayFilters("findAndModify", docMap); err != nil {
+		return err
+	}
+	if updateSet && !params.replace {
+		if err = common.CheckArrayFilters(*params.update, params.arrayFilters); err != nil {
+			return err
+		}
+	}
+
 	var sortDoc types.Document
 	sort, ok := docMap["sort"]
 	if ok {
@@ -518,7 +549,10 @@ func (params *findAndModifyParams) fillFindAndModifyParams(doc *types.Document)
 }
 
 func checkIfReplace(doc *types.Document) (bool, error) {
-	supportedUpdateCmds := map[string]struct{}{"$set": {}, "$unset": {}}
+	supportedUpdateCmds := map[string]struct{}{
+		"$set": {}, "$unset": {}, "$inc": {}, "$mul": {}, "$min": {}, "$max": {}, "$rename": {}, "$currentDate": {},
+		"$push": {}, "$addToSet": {}, "$pull": {}, "$pullAll": {}, "$pop": {}, "$setOnInsert": {},
+	}
 
 	for k := range doc.Map() {
 		if strings.HasPrefix(k, "$") {
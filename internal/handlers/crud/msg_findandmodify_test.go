@@ -130,6 +130,51 @@ func TestMsgFindAndModify(t *testing.T) {
 		}
 	})
 
+	t.Run("find document by an embedded document in memory, remove and return removed document", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDB'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDB' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		// SAP HANA matches the embedded document regardless of the order of its fields
+		mock.ExpectQuery("SELECT * FROM \"testDB\".\"testCollection\" WHERE (\"size\" = ").WillReturnRows(mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1, "size": {"w": 21, "h": 14}}`)).
+			AddRow([]byte(`{"_id": 2, "size": {"h": 14, "w": 21}}`)))
+
+		// the document is checked again while it is locked
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDB\".\"testCollection\" WHERE \"_id\" = 2 FOR UPDATE").
+			WillReturnRows(mock.NewRows([]string{"document"}).AddRow([]byte(`{"_id": 2, "size": {"h": 14, "w": 21}}`)))
+		mock.ExpectExec("DELETE FROM \"testDB\".\"testCollection\" WHERE \"_id\" = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		req := types.MustMakeDocument(
+			"findAndModify", "testCollection",
+			"query", types.MustMakeDocument("size", types.MustMakeDocument("h", int32(14), "w", int32(21))),
+			"remove", true,
+			"$db", "testDB",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{req},
+		})
+		require.NoError(t, err)
+
+		resp, err := storage.MsgFindAndModify(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"lastErrorObject", types.MustMakeDocument("n", int32(1)),
+			"value", types.MustMakeDocument("_id", int32(2), "size", types.MustMakeDocument("h", int32(14), "w", int32(21))),
+			"ok", float64(1),
+		)
+		actual, _ := resp.Document()
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
 	t.Run("find document while sorting, replace and return old document", func(t *testing.T) {
 
 		findDoc := mock.NewRows([]string{"document"}).AddRow([]byte("{\"_id\": 123, \"item\": \"test\"}"))
@@ -139,7 +184,7 @@ func TestMsgFindAndModify(t *testing.T) {
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDB'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDB' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
 
-		mock.ExpectQuery("SELECT * FROM \"testDB\".\"testCollection\" WHERE \"_id\" = 123 ORDER BY \"item\"  ASC LIMIT 1").WillReturnRows(findDoc)
+		mock.ExpectQuery("SELECT * FROM \"testDB\".\"testCollection\" WHERE \"_id\" = 123 ORDER BY CASE WHEN \"item\" IS NULL THEN 1 WHEN IS_NUMBER(\"item\") THEN 2 WHEN IS_STRING(\"item\") THEN 3 WHEN (IS_OBJECT(\"item\") AND \"item\".\"oid\" IS UNSET) THEN 4 WHEN IS_ARRAY(\"item\") THEN 5 WHEN (IS_OBJECT(\"item\") AND \"item\".\"oid\" IS SET) THEN 7 WHEN IS_BOOLEAN(\"item\") THEN 8 ELSE 12 END ASC, \"item\".\"oid\" ASC, \"item\" ASC LIMIT 1").WillReturnRows(findDoc)
 		mock.ExpectExec("DELETE FROM \"testDB\".\"testCollection\" WHERE \"_id\" = 123").WillReturnResult(sqlmock.NewResult(1, 1))
 		mock.ExpectExec("INSERT INTO \"testDB\".\"testCollection\" VALUES ($1) ").WillReturnResult(sqlmock.NewResult(1, 1))
 
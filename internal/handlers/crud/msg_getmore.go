@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+// MsgGetMore returns the next batch of documents of a cursor created by find.
+func (h *storage) MsgGetMore(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
+	document, err := msg.Document()
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	common.Ignored(&document, h.l, "comment")
+
+	m := document.Map()
+
+	id, ok := m["getMore"].(int64)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'getMore' is the wrong type '%T', expected type 'long'", m["getMore"])
+	}
+
+	db, ok := m["$db"].(string)
+	if !ok {
+		return nil, fmt.Errorf("database not found or wrong type")
+	}
+
+	collection, ok := m["collection"].(string)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'collection' is the wrong type '%T', expected type 'string'", m["collection"])
+	}
+
+	batchSize, err := getBatchSize(m, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTime, err := getMaxTime(m)
+	if err != nil {
+		return nil, err
+	}
+
+	c := h.cursors.take(id)
+	if c == nil {
+		return nil, common.NewErrorMessage(common.ErrCursorNotFound, "cursor id %d not found", id)
+	}
+
+	if ns := db + "." + collection; ns != c.ns {
+		h.cursors.release(c)
+		return nil, common.NewErrorMessage(common.ErrUnauthorized, "Requested getMore on namespace '%s', but cursor belongs to a different namespace %s", ns, c.ns)
+	}
+
+	// the time limit of getMore only applies to reading this batch
+	c.startBatch(maxTime)
+	docs, exhausted, err := c.nextBatch(batchSize)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	c.stopBatch()
+
+	if exhausted {
+		c.close()
+		id = 0
+	} else {
+		h.cursors.release(c)
+	}
+
+	var reply wire.OpMsg
+	err = reply.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"nextBatch", docs,
+				"id", id,
+				"ns", c.ns,
+			),
+			"ok", float64(1),
+		)},
+	})
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return &reply, nil
+}
@@ -0,0 +1,295 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgGetMore(t *testing.T) {
+	ctx, storage, mock, err := setupTestUtil(t)
+	require.NoError(t, err)
+
+	t.Run("find with batchSize and getMore", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1}`)).
+			AddRow([]byte(`{"_id": 2}`)).
+			AddRow([]byte(`{"_id": 3}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\"").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"find", "testCollection",
+				"filter", types.MustMakeDocument(),
+				"batchSize", int32(2),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		cursor := actual.Map()["cursor"].(types.Document)
+		id := cursor.Map()["id"].(int64)
+		assert.NotZero(t, id)
+		assert.Equal(t, types.MustNewArray(
+			types.MustMakeDocument("_id", int32(1)),
+			types.MustMakeDocument("_id", int32(2)),
+		), cursor.Map()["firstBatch"])
+
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"getMore", id,
+				"collection", "testCollection",
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err = storage.MsgGetMore(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"cursor", types.MustMakeDocument(
+				"nextBatch", types.MustNewArray(
+					types.MustMakeDocument("_id", int32(3)),
+				),
+				"id", int64(0),
+				"ns", "testDatabase.testCollection",
+			),
+			"ok", float64(1),
+		)
+
+		actual, _ = msg.Document()
+		assert.Equal(t, expected, actual)
+
+		// the cursor is exhausted and therefore closed
+		_, err = storage.MsgGetMore(ctx, &reqMsg)
+		assert.EqualError(t, err, fmt.Sprintf("CursorNotFound (43): cursor id %d not found", id))
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("killCursors", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1}`)).
+			AddRow([]byte(`{"_id": 2}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\"").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"find", "testCollection",
+				"filter", types.MustMakeDocument(),
+				"batchSize", int32(1),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		id := actual.Map()["cursor"].(types.Document).Map()["id"].(int64)
+		assert.NotZero(t, id)
+
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"killCursors", "testCollection",
+				"cursors", types.MustNewArray(id, int64(42)),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err = storage.MsgKillCursors(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		expected := types.MustMakeDocument(
+			"cursorsKilled", types.MustNewArray(id),
+			"cursorsNotFound", types.MustNewArray(int64(42)),
+			"cursorsAlive", types.MustNewArray(),
+			"cursorsUnknown", types.MustNewArray(),
+			"ok", float64(1),
+		)
+
+		actual, _ = msg.Document()
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("idle cursor timeout", func(t *testing.T) {
+		db, dbMock, err := sqlmock.New()
+		require.NoError(t, err)
+
+		docRows := dbMock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1}`)).
+			AddRow([]byte(`{"_id": 2}`))
+		dbMock.ExpectQuery("SELECT").WillReturnRows(docRows)
+
+		rows, err := db.QueryContext(ctx, "SELECT * FROM \"testDatabase\".\"testCollection\"")
+		require.NoError(t, err)
+
+		registry := newCursorRegistry()
+		registry.timeout = time.Millisecond
+
+		id, err := registry.register(&cursor{ns: "testDatabase.testCollection", rows: rows})
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			registry.mu.Lock()
+			defer registry.mu.Unlock()
+
+			_, ok := registry.cursors[id]
+			return !ok
+		}, time.Second, time.Millisecond)
+
+		id, err = registry.register(&cursor{ns: "testDatabase.testCollection", rows: rows, noTimeout: true})
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		assert.NotNil(t, registry.take(id))
+	})
+	t.Run("too many open cursors", func(t *testing.T) {
+		registry := newCursorRegistry()
+		for i := 0; i < maxCursors; i++ {
+			_, err := registry.register(&cursor{ns: "testDatabase.testCollection"})
+			require.NoError(t, err)
+		}
+
+		_, err := registry.register(&cursor{ns: "testDatabase.testCollection"})
+		assert.EqualError(t, err, "BadValue (2): Too many open cursors: at most 100 cursors can be open per connection, exhaust or kill a cursor first")
+
+		registry.closeAll()
+		_, err = registry.register(&cursor{ns: "testDatabase.testCollection"})
+		assert.NoError(t, err)
+	})
+	t.Run("batches of large documents", func(t *testing.T) {
+		large := func(id int32, n int) types.Document {
+			return types.MustMakeDocument("_id", id, "data", strings.Repeat("x", n))
+		}
+		c := &cursor{docs: []types.Document{large(1, 6<<20), large(2, 6<<20), large(3, 6<<20), large(4, 20<<20)}}
+
+		for i, expected := range [][]int32{{1, 2}, {3}, {4}} {
+			docs, exhausted, err := c.nextBatch(0)
+			require.NoError(t, err)
+			assert.Equal(t, i == 2, exhausted)
+
+			ids := make([]int32, docs.Len())
+			for j := range ids {
+				doc, err := docs.Get(j)
+				require.NoError(t, err)
+				ids[j] = doc.(types.Document).Map()["_id"].(int32)
+			}
+			assert.Equal(t, expected, ids)
+		}
+	})
+	t.Run("maxTimeMS does not count the time between batches", func(t *testing.T) {
+		docRows := mock.NewRows([]string{"document"}).
+			AddRow([]byte(`{"_id": 1}`)).
+			AddRow([]byte(`{"_id": 2}`))
+		row1 := mock.NewRows([]string{"count"}).AddRow(1)
+		row2 := mock.NewRows([]string{"count"}).AddRow(1)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\"").WillReturnRows(docRows)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"find", "testCollection",
+				"batchSize", int32(1),
+				"maxTimeMS", int32(20),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgFindOrCount(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		id := actual.Map()["cursor"].(types.Document).Map()["id"].(int64)
+		assert.NotZero(t, id)
+
+		time.Sleep(50 * time.Millisecond)
+
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"getMore", id,
+				"collection", "testCollection",
+				"maxTimeMS", int32(20),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		msg, err = storage.MsgGetMore(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ = msg.Document()
+		expected := types.MustNewArray(types.MustMakeDocument("_id", int32(2)))
+		assert.Equal(t, expected, actual.Map()["cursor"].(types.Document).Map()["nextBatch"])
+	})
+
+	t.Run("maxTimeMS of a batch", func(t *testing.T) {
+		cursorCtx := newCursorContext(ctx)
+		cursorCtx.startBatch(20 * time.Millisecond)
+		cursorCtx.stopBatch()
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, cursorCtx.Err())
+
+		cursorCtx.startBatch(time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return cursorCtx.Err() != nil
+		}, time.Second, time.Millisecond)
+
+		protoErr, recoverable := common.ProtocolError(cursorCtx.Err())
+		assert.True(t, recoverable)
+		assert.Equal(t, common.NewErrorMessage(common.ErrMaxTimeMSExpired, "operation exceeded time limit"), protoErr)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{types.MustMakeDocument(
+				"getMore", int64(1),
+				"collection", "testCollection",
+				"maxTimeMS", int32(-1),
+				"$db", "testDatabase",
+			)},
+		})
+		require.NoError(t, err)
+
+		_, err = storage.MsgGetMore(ctx, &reqMsg)
+		assert.EqualError(t, err, "BadValue (2): -1 value for maxTimeMS is out of range")
+	})
+}
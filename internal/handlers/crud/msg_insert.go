@@ -45,6 +45,13 @@ func (h *storage) MsgInsert(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 	common.Ignored(&document, h.l, "ordered")
 
+	maxTime, err := getMaxTime(document.Map())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
 	m := document.Map()
 
 	collection := m[document.Command()].(string)
@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/wire"
+)
+
+// MsgKillCursors closes the given cursors.
+func (h *storage) MsgKillCursors(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg, error) {
+	document, err := msg.Document()
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	common.Ignored(&document, h.l, "comment")
+
+	m := document.Map()
+
+	ids, ok := m["cursors"].(*types.Array)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'cursors' is the wrong type '%T', expected type 'array'", m["cursors"])
+	}
+
+	killed := types.MakeArray(0)
+	notFound := types.MakeArray(0)
+	for i := 0; i < ids.Len(); i++ {
+		v, err := ids.Get(i)
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+
+		id, ok := v.(int64)
+		if !ok {
+			return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field 'cursors' contains an element of type '%T', expected type 'long'", v)
+		}
+
+		if h.cursors.kill(id) {
+			err = killed.Append(id)
+		} else {
+			err = notFound.Append(id)
+		}
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+	}
+
+	var reply wire.OpMsg
+	err = reply.SetSections(wire.OpMsgSection{
+		Documents: []types.Document{types.MustMakeDocument(
+			"cursorsKilled", killed,
+			"cursorsNotFound", notFound,
+			"cursorsAlive", types.MakeArray(0),
+			"cursorsUnknown", types.MakeArray(0),
+			"ok", float64(1),
+		)},
+	})
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return &reply, nil
+}
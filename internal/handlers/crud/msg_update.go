@@ -22,9 +22,14 @@ package crud
 
 import (
 	"context"
+	sqldb "database/sql"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/bson"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/fjson"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/hana"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
 	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
@@ -39,10 +44,8 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 	}
 
 	unimplementedFields := []string{
-		"upsert",
 		"writeConcern",
 		"collation",
-		"arrayFilter",
 		"hint",
 		"commented",
 		"bypassDocumentValidation",
@@ -54,6 +57,13 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 	common.Ignored(&document, h.l, "ordered")
 
+	maxTime, err := getMaxTime(document.Map())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withMaxTime(ctx, maxTime)
+	defer cancel()
+
 	m := document.Map()
 	collection := m["update"].(string)
 	db := m["$db"].(string)
@@ -63,7 +73,11 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 	}
 
 	if exists, err := h.hanaPool.NamespaceExists(ctx, db, collection); err == nil {
-		if !exists {
+		if !exists && hasUpsert(docs) {
+			if err = h.hanaPool.CreateNamespaceIfNotExists(ctx, db, collection); err != nil {
+				return nil, err
+			}
+		} else if !exists {
 			docs = types.MustNewArray()
 		}
 	} else {
@@ -71,6 +85,7 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 	}
 
 	var selected, updated, matched int32
+	upserted := types.MustNewArray()
 	for i := 0; i < docs.Len(); i++ {
 		doc, err := docs.Get(i)
 		if err != nil {
@@ -79,32 +94,78 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 		docM := doc.(types.Document).Map()
 
-		whereSQL, err := common.CreateWhereClause(docM["q"].(types.Document))
+		filter := docM["q"].(types.Document)
+		whereSQL, memoryFilter, err := writeFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		arrayFilters, err := getArrayFilters("update.updates", docM)
 		if err != nil {
 			return nil, err
 		}
+		if err = common.CheckArrayFilters(docM["u"].(types.Document), arrayFilters); err != nil {
+			return nil, err
+		}
+
 		// notWhereSQL makes sure we do not update documents which do not need an update
 		updateSQL, notWhereSQL, err := common.Update(docM["u"].(types.Document))
-		if err != nil {
+		memoryUpdate := common.IsMemoryUpdate(err)
+		if err != nil && !memoryUpdate {
 			return nil, err
 		}
 
+		// the documents matching a filter evaluated in memory are updated in memory as well
+		inMemory := memoryUpdate || len(memoryFilter.Keys()) != 0
+
 		// Get amount of documents that fits the filter. MatchCount
-		countSQL := fmt.Sprintf("SELECT count(*) FROM \"%s\".\"%s\"", db, collection) + whereSQL
-		countRow := h.hanaPool.QueryRowContext(ctx, countSQL)
+		if matched, err = countMatching(ctx, h.hanaPool, db, collection, whereSQL, memoryFilter); err != nil {
+			return nil, err
+		}
 
-		err = countRow.Scan(&matched)
-		if err != nil {
-			return nil, lazyerrors.Error(err)
+		if matched == 0 && docM["upsert"] == true {
+			id, err := upsertInTransaction(ctx, h.hanaPool, db, collection, whereSQL, memoryFilter, filter, docM["u"].(types.Document))
+			if err != nil {
+				return nil, err
+			}
+
+			if id != nil {
+				if err = upserted.Append(types.MustMakeDocument("index", int32(i), "_id", id)); err != nil {
+					return nil, lazyerrors.Error(err)
+				}
+				selected++
+				continue
+			}
+
+			// a concurrent upsert inserted a matching document
+			if matched, err = countMatching(ctx, h.hanaPool, db, collection, whereSQL, memoryFilter); err != nil {
+				return nil, err
+			}
+		}
+
+		// an update with only $setOnInsert does not modify existing documents
+		if updateSQL == "" && !memoryUpdate {
+			selected += matched
+			continue
+		}
+
+		if inMemory {
+			modified, err := updateInMemory(
+				ctx, h.hanaPool, db, collection, whereSQL, memoryFilter, filter, docM["u"].(types.Document), arrayFilters, docM["multi"] != true,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			updated += modified
+			selected += matched
+			continue
 		}
 
-		var args []any
 		if docM["multi"] != true { // If updateOne()
 
 			// We get the _id of the one document to update.
-			sql := fmt.Sprintf("SELECT {\"_id\": \"_id\"} FROM \"%s\".\"%s\"", db, collection)
-			sql += whereSQL + notWhereSQL + " LIMIT 1"
-			row := h.hanaPool.QueryRowContext(ctx, sql)
+			row := h.hanaPool.QueryRowContext(ctx, selectIdStmt(db, collection, whereSQL+notWhereSQL))
 
 			var objectID []byte
 
@@ -125,17 +186,15 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 				return nil, err
 			}
 
-			whereSQL = "WHERE \"_id\" = %s"
-			var emptySlice []any
-			args = append(emptySlice, updateId)
+			whereSQL = "WHERE \"_id\" = " + updateId
 			notWhereSQL = ""
 		}
 
-		sql := fmt.Sprintf("UPDATE \"%s\".\"%s\" ", db, collection)
-
-		sql += updateSQL + " " + fmt.Sprintf(whereSQL, args...) + notWhereSQL
+		if err = checkNumericFields(ctx, h.hanaPool, db, collection, whereSQL+notWhereSQL, docM["u"].(types.Document)); err != nil {
+			return nil, err
+		}
 
-		tag, err := h.hanaPool.ExecContext(ctx, sql)
+		tag, err := h.hanaPool.ExecContext(ctx, updateStmt(db, collection, updateSQL, whereSQL+notWhereSQL))
 		if err != nil {
 			return nil, err
 		}
@@ -152,13 +211,14 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 		}
 	}
 
+	res := types.MustMakeDocument("n", selected, "nModified", updated, "ok", float64(1))
+	if upserted.Len() != 0 {
+		res = types.MustMakeDocument("n", selected, "upserted", upserted, "nModified", updated, "ok", float64(1))
+	}
+
 	var reply wire.OpMsg
 	err = reply.SetSections(wire.OpMsgSection{
-		Documents: []types.Document{types.MustMakeDocument(
-			"n", selected,
-			"nModified", updated,
-			"ok", float64(1),
-		)},
+		Documents: []types.Document{res},
 	})
 	if err != nil {
 		return nil, lazyerrors.Error(err)
@@ -166,3 +226,196 @@ func (h *storage) MsgUpdate(ctx context.Context, msg *wire.OpMsg) (*wire.OpMsg,
 
 	return &reply, nil
 }
+
+// selectIdStmt returns the statement selecting the _id of the first document matching the WHERE clause.
+func selectIdStmt(db, collection, whereSQL string) string {
+	return fmt.Sprintf("SELECT {\"_id\": \"_id\"} FROM \"%s\".\"%s\"", db, collection) + whereSQL + " LIMIT 1"
+}
+
+// updateStmt returns the statement updating the documents matching the WHERE clause.
+func updateStmt(db, collection, updateSQL, whereSQL string) string {
+	return fmt.Sprintf("UPDATE \"%s\".\"%s\" ", db, collection) + updateSQL + " " + whereSQL
+}
+
+// hasUpsert checks if one of the update statements is an upsert.
+func hasUpsert(docs *types.Array) bool {
+	for i := 0; i < docs.Len(); i++ {
+		doc, err := docs.Get(i)
+		if err != nil {
+			continue
+		}
+		if doc, ok := doc.(types.Document); ok && doc.Map()["upsert"] == true {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upsertInTransaction inserts the document created from the filter and the update by common.Upsert if no document
+// matches the WHERE clause and the memory filter. The collection has no unique key on _id, so concurrent upserts must
+// not check for matching documents at the same time, even if they run in different instances of the compatibility
+// layer: the collection is locked within the transaction, which SAP HANA holds until the commit. It returns the _id
+// of the inserted document or nil if a matching document was inserted in the meantime.
+func upsertInTransaction(ctx context.Context, pool *hana.Hpool, db, collection, whereSQL string, memoryFilter, filter, update types.Document) (any, error) {
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	defer tx.Rollback() //nolint:errcheck // does nothing after Commit
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE \"%s\".\"%s\" IN EXCLUSIVE MODE", db, collection)); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	matched, err := countMatching(ctx, tx, db, collection, whereSQL, memoryFilter)
+	if err != nil {
+		return nil, err
+	}
+	if matched != 0 {
+		return nil, nil
+	}
+
+	doc, err := common.Upsert(&update, &filter, false)
+	if err != nil {
+		return nil, err
+	}
+
+	id := doc.Map()["_id"]
+	unique, errMsg, err := common.IsIdUnique(id, db, collection, ctx, tx)
+	if err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+	if !unique {
+		return nil, errMsg
+	}
+
+	b, err := bson.MustConvertDocument(doc).MarshalJSONHANA()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO \"%s\".\"%s\" VALUES ($1)", db, collection), b); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, lazyerrors.Error(err)
+	}
+
+	return id, nil
+}
+
+// checkNumericFields returns the error of MongoDB if a document selected by the WHERE clause has a field
+// updated by $inc or $mul which is not a number.
+func checkNumericFields(ctx context.Context, pool *hana.Hpool, db, collection, whereSQL string, update types.Document) error {
+	projectionSQL, conditionSQL, err := common.NonNumericSQL(update)
+	if err != nil || conditionSQL == "" {
+		return err
+	}
+
+	if whereSQL = strings.TrimSpace(whereSQL); whereSQL == "" {
+		whereSQL = "WHERE " + conditionSQL
+	} else {
+		whereSQL += " AND " + conditionSQL
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM \"%s\".\"%s\" ", projectionSQL, db, collection) + whereSQL + " LIMIT 1"
+
+	var docByte []byte
+	if err = pool.QueryRowContext(ctx, sql).Scan(&docByte); err != nil {
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return nil
+		}
+		return lazyerrors.Error(err)
+	}
+
+	doc, err := fjson.Unmarshal(docByte)
+	if err != nil {
+		return lazyerrors.Error(err)
+	}
+
+	return common.NonNumericError(update, doc.(types.Document))
+}
+
+// getArrayFilters returns the arrayFilters of an update statement or nil if there are none.
+func getArrayFilters(field string, m map[string]any) (*types.Array, error) {
+	value, ok := m["arrayFilters"]
+	if !ok {
+		return nil, nil
+	}
+
+	arrayFilters, ok := value.(*types.Array)
+	if !ok {
+		return nil, common.NewErrorMessage(common.ErrTypeMismatch, "BSON field '%s.arrayFilters' is the wrong type '%T', expected type 'array'", field, value)
+	}
+
+	return arrayFilters, nil
+}
+
+// selectForUpdateSQL returns the statement selecting and locking the documents of an update applied in memory.
+func selectForUpdateSQL(db, collection, whereSQL string, single bool) string {
+	sql := fmt.Sprintf("SELECT * FROM \"%s\".\"%s\"", db, collection) + whereSQL
+	if single {
+		sql += " LIMIT 1"
+	}
+
+	return sql + " FOR UPDATE"
+}
+
+// updateInMemory applies an update which SAP HANA can not execute, or which selects the documents by a filter
+// evaluated in memory, to the documents selected by the WHERE clause which match the memory filter and replaces
+// the modified documents. The documents are locked within a transaction, so concurrent updates are not lost.
+// The filter and the arrayFilters resolve the positional operators. It returns the number of modified documents.
+func updateInMemory(
+	ctx context.Context, pool *hana.Hpool, db, collection, whereSQL string, memoryFilter, filter, update types.Document,
+	arrayFilters *types.Array, single bool,
+) (int32, error) {
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+	defer tx.Rollback() //nolint:errcheck // does nothing after Commit
+
+	// the first document matching the memory filter is not necessarily the first selected one
+	limit := single && len(memoryFilter.Keys()) == 0
+	docs, err := selectMatching(ctx, tx, selectForUpdateSQL(db, collection, whereSQL, limit), memoryFilter, single)
+	if err != nil {
+		return 0, err
+	}
+
+	var modified int32
+	for _, doc := range docs {
+		updated, ok, err := common.ApplyUpdate(doc, update, filter, arrayFilters)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		id, err := common.GetUpdateValue(doc.Map()["_id"])
+		if err != nil {
+			return 0, err
+		}
+
+		b, err := bson.MustConvertDocument(updated).MarshalJSONHANA()
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM \"%s\".\"%s\" WHERE \"_id\" = ", db, collection)+id); err != nil {
+			return 0, lazyerrors.Error(err)
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO \"%s\".\"%s\" VALUES ($1)", db, collection), b); err != nil {
+			return 0, lazyerrors.Error(err)
+		}
+		modified++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, lazyerrors.Error(err)
+	}
+
+	return modified, nil
+}
@@ -25,8 +25,8 @@ func TestMsgUpdate(t *testing.T) {
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
 
-		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test'").WillReturnRows(row)
-		mock.ExpectExec("UPDATE \"testDatabase\".\"testCollection\"  SET \"item\" = 'new test'  WHERE \"item\" = 'test' AND ( NOT (   \"item\" = 'new test') OR (\"item\" IS UNSET )) ").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(row)
+		mock.ExpectExec("UPDATE \"testDatabase\".\"testCollection\"  SET \"item\" = 'new test'  WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) AND ( NOT ( \"item\" = 'new test') OR (\"item\" IS UNSET )) ").WillReturnResult(sqlmock.NewResult(1, 1))
 
 		updateReq := types.MustMakeDocument(
 			"update", "testCollection",
@@ -79,8 +79,8 @@ func TestMsgUpdate(t *testing.T) {
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row2)
 
-		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test'").WillReturnRows(countRow)
-		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE \"item\" = 'test' AND ( NOT (   \"item\" = 'new test') OR (\"item\" IS UNSET )) ").WillReturnRows(idRow)
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(countRow)
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) AND ( NOT ( \"item\" = 'new test') OR (\"item\" IS UNSET )) ").WillReturnRows(idRow)
 		mock.ExpectExec("UPDATE \"testDatabase\".\"testCollection\"  SET \"item\" = 'new test' WHERE \"_id\" = 123").WillReturnResult(sqlmock.NewResult(1, 1))
 
 		updateReq := types.MustMakeDocument(
@@ -124,4 +124,412 @@ func TestMsgUpdate(t *testing.T) {
 		}
 	})
 
+	t.Run("updateMany with $inc", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\", \"qty\": \"qty\"} FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) AND ((\"qty\" IS NOT NULL AND NOT IS_NUMBER(\"qty\")) OR (\"qty\" IS NULL AND \"qty\" IS SET)) LIMIT 1").WillReturnRows(mock.NewRows([]string{"document"}))
+		mock.ExpectExec("UPDATE \"testDatabase\".\"testCollection\"  SET \"qty\" = CASE WHEN \"qty\" IS NULL THEN 5 ELSE \"qty\" + 5 END  WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnResult(sqlmock.NewResult(2, 2))
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "test"),
+					"u", types.MustMakeDocument("$inc", types.MustMakeDocument("qty", int32(5))),
+					"multi", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(2), "nModified", int32(2), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with $inc of a non-numeric field", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\"} FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) LIMIT 1").WillReturnRows(sqlmock.NewRows([]string{"_id"}).AddRow("{\"_id\": 123}"))
+		mock.ExpectQuery("SELECT {\"_id\": \"_id\", \"qty\": \"qty\"} FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 123 AND ((\"qty\" IS NOT NULL AND NOT IS_NUMBER(\"qty\")) OR (\"qty\" IS NULL AND \"qty\" IS SET)) LIMIT 1").WillReturnRows(mock.NewRows([]string{"document"}).AddRow([]byte(`{"_id": 123, "qty": "many"}`)))
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "test"),
+					"u", types.MustMakeDocument("$inc", types.MustMakeDocument("qty", int32(5))),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		_, err = storage.MsgUpdate(ctx, &reqMsg)
+		assert.EqualError(t, err, "TypeMismatch (14): Cannot apply $inc to a value of non-numeric type. {_id: 123} has the field 'qty' of non-numeric type string")
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateMany with $rename in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END)").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"item\" = 'test' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'test' END) FOR UPDATE").
+			WillReturnRows(mock.NewRows([]string{"document"}).AddRow([]byte(`{"_id": 1, "item": "test", "name": "first"}`)).AddRow([]byte(`{"_id": 2, "item": "test"}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":1,"item":"test","info":{"name":"first"}}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "test"),
+					"u", types.MustMakeDocument("$rename", types.MustMakeDocument("name", "info.name")),
+					"multi", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(2), "nModified", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with an embedded document in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		// SAP HANA matches the embedded document regardless of the order of its fields
+		rows := func() *sqlmock.Rows {
+			return mock.NewRows([]string{"document"}).
+				AddRow([]byte(`{"_id": 1, "size": {"w": 21, "h": 14}}`)).
+				AddRow([]byte(`{"_id": 2, "size": {"h": 14, "w": 21}}`))
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"size\" = ").WillReturnRows(rows())
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE (\"size\" = ").WillReturnRows(rows())
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":2,"size":{"h":14,"w":21},"item":"new"}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("size", types.MustMakeDocument("h", int32(14), "w", int32(21))),
+					"u", types.MustMakeDocument("$set", types.MustMakeDocument("item", "new")),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "nModified", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateMany with $expr in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		rows := func() *sqlmock.Rows {
+			return mock.NewRows([]string{"document"}).
+				AddRow([]byte(`{"_id": 1, "spent": 10, "budget": 20}`)).
+				AddRow([]byte(`{"_id": 2, "spent": 30, "budget": 20}`))
+		}
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\"").WillReturnRows(rows())
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" FOR UPDATE").WillReturnRows(rows())
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":2,"spent":30,"budget":20,"over":true}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("$expr", types.MustMakeDocument("$gt", types.MustNewArray("$spent", "$budget"))),
+					"u", types.MustMakeDocument("$set", types.MustMakeDocument("over", true)),
+					"multi", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "nModified", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with $push in memory", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1 LIMIT 1 FOR UPDATE").
+			WillReturnRows(mock.NewRows([]string{"document"}).AddRow([]byte(`{"_id": 1, "scores": [4, 9]}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":1,"scores":[4,7,9]}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("_id", int32(1)),
+					"u", types.MustMakeDocument("$push", types.MustMakeDocument("scores", types.MustMakeDocument("$each", types.MustNewArray(int32(7)), "$sort", int32(1)))),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "nModified", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with positional operator", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT * FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1 LIMIT 1 FOR UPDATE").
+			WillReturnRows(mock.NewRows([]string{"document"}).AddRow([]byte(`{"_id": 1, "items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 2}]}`)))
+		mock.ExpectExec("DELETE FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":1,"items":[{"sku":"a","qty":1},{"sku":"b","qty":5}]}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("_id", int32(1)),
+					"u", types.MustMakeDocument("$set", types.MustMakeDocument("items.$[line].qty", int32(5))),
+					"arrayFilters", types.MustNewArray(types.MustMakeDocument("line.sku", "b")),
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "nModified", int32(1), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with upsert", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectBegin()
+		mock.ExpectExec("LOCK TABLE \"testDatabase\".\"testCollection\" IN EXCLUSIVE MODE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery("SELECT _id FROM \"testDatabase\".\"testCollection\"  WHERE \"_id\" = 1 LIMIT 1").WillReturnRows(mock.NewRows([]string{"_id"}))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs([]byte(`{"_id":1,"qty":5,"created":"today"}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("_id", int32(1)),
+					"u", types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(5)), "$setOnInsert", types.MustMakeDocument("created", "today")),
+					"upsert", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		expected := types.MustMakeDocument(
+			"n", int32(1),
+			"upserted", types.MustNewArray(types.MustMakeDocument("index", int32(0), "_id", int32(1))),
+			"nModified", int32(0),
+			"ok", float64(1),
+		)
+		assert.Equal(t, expected, actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with upsert without _id", func(t *testing.T) {
+		whereSQL := " WHERE (\"item\" = 'new' OR FOR ANY \"$element\" IN \"item\" SATISFIES \"$element\" = 'new' END)"
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\"" + whereSQL).WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectBegin()
+		mock.ExpectExec("LOCK TABLE \"testDatabase\".\"testCollection\" IN EXCLUSIVE MODE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\"" + whereSQL).WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery("SELECT _id FROM \"testDatabase\".\"testCollection\"  WHERE \"_id\" = ").WillReturnRows(mock.NewRows([]string{"_id"}))
+		mock.ExpectExec("INSERT INTO \"testDatabase\".\"testCollection\" VALUES ($1)").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("item", "new"),
+					"u", types.MustMakeDocument("$set", types.MustMakeDocument("qty", int32(5))),
+					"upsert", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		upserted, err := actual.Get("upserted")
+		require.NoError(t, err)
+		assert.Equal(t, 1, upserted.(*types.Array).Len())
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("updateOne with only $setOnInsert of an existing document", func(t *testing.T) {
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'testDatabase'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'testDatabase' AND table_name = 'testCollection' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		mock.ExpectQuery("SELECT count(*) FROM \"testDatabase\".\"testCollection\" WHERE \"_id\" = 1").WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+
+		updateReq := types.MustMakeDocument(
+			"update", "testCollection",
+			"updates", types.MustNewArray(
+				types.MustMakeDocument(
+					"q", types.MustMakeDocument("_id", int32(1)),
+					"u", types.MustMakeDocument("$setOnInsert", types.MustMakeDocument("created", "today")),
+					"upsert", true,
+				),
+			),
+			"$db", "testDatabase",
+		)
+
+		var reqMsg wire.OpMsg
+		err = reqMsg.SetSections(wire.OpMsgSection{
+			Documents: []types.Document{updateReq},
+		})
+		require.NoError(t, err)
+
+		msg, err := storage.MsgUpdate(ctx, &reqMsg)
+		require.NoError(t, err)
+
+		actual, _ := msg.Document()
+		assert.Equal(t, types.MustMakeDocument("n", int32(1), "nModified", int32(0), "ok", float64(1)), actual)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
 }
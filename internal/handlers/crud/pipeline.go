@@ -0,0 +1,525 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/handlers/common"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/types"
+	"github.com/SAP/sap-hana-compatibility-layer-for-mongodb-wire-protocol/internal/util/lazyerrors"
+)
+
+// unsupportedStages are aggregation stages known from MongoDB which are not supported, yet.
+var unsupportedStages = map[string]bool{
+	"$bucket":          true,
+	"$bucketAuto":      true,
+	"$collStats":       true,
+	"$count":           true,
+	"$densify":         true,
+	"$facet":           true,
+	"$fill":            true,
+	"$geoNear":         true,
+	"$graphLookup":     true,
+	"$indexStats":      true,
+	"$merge":           true,
+	"$out":             true,
+	"$redact":          true,
+	"$replaceRoot":     true,
+	"$replaceWith":     true,
+	"$sample":          true,
+	"$setWindowFields": true,
+	"$sortByCount":     true,
+	"$unionWith":       true,
+}
+
+// stage is a single stage of an aggregation pipeline like {$match: {...}}.
+type stage struct {
+	name  string
+	value any
+}
+
+// pipeline is an aggregation pipeline. The leading stages which can be expressed in SQL
+// are pushed down to SAP HANA, all following stages are processed in memory.
+type pipeline struct {
+	match      []types.Document
+	sort       types.Document
+	projection types.Document
+	project    *common.Project
+	skip       int64
+	limit      int64
+	hasLimit   bool
+	group      *common.Group
+
+	// flatKeys are the dotted keys which are resolved without traversing arrays, so they can be sorted by SQL
+	flatKeys map[string]bool
+
+	// stages are processed in memory on the documents returned by SAP HANA
+	stages []stage
+}
+
+// newPipeline parses the stages of an aggregation pipeline and decides which of them are pushed down.
+// A $sort on dotted keys is only pushed down if all of them are flatKeys.
+func newPipeline(stages *types.Array, flatKeys map[string]bool) (*pipeline, error) {
+	p := pipeline{flatKeys: flatKeys}
+	for i := 0; i < stages.Len(); i++ {
+		value, err := stages.Get(i)
+		if err != nil {
+			return nil, lazyerrors.Error(err)
+		}
+
+		s, err := parseStage(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p.stages) == 0 && p.push(s) {
+			continue
+		}
+
+		// a $match which does not use the field of an $unwind is pushed down in front of it, else
+		// the documents which can not produce a matching document are filtered out in SAP HANA
+		if s.name == "$match" && len(p.stages) == 1 && p.stages[0].name == "$unwind" {
+			unwind := p.stages[0].value.(*common.Unwind)
+			if unwind.Commutes(s.value.(types.Document)) && p.push(s) {
+				continue
+			}
+
+			prefilter, err := unwind.Prefilter(s.value.(types.Document))
+			if err != nil {
+				return nil, err
+			}
+			p.prefilter(prefilter)
+		}
+
+		p.stages = append(p.stages, s)
+	}
+
+	return &p, nil
+}
+
+// parseStage validates a stage of the pipeline.
+func parseStage(value any) (stage, error) {
+	doc, ok := value.(types.Document)
+	if !ok {
+		return stage{}, common.NewErrorMessage(common.ErrTypeMismatch, "Each element of the 'pipeline' array must be an object")
+	}
+
+	if len(doc.Keys()) != 1 {
+		return stage{}, common.NewErrorMessage(common.ErrStageSpecification, "A pipeline stage specification object must contain exactly one field.")
+	}
+
+	s := stage{name: doc.Keys()[0]}
+	s.value = doc.Map()[s.name]
+
+	switch s.name {
+	case "$match":
+		if _, ok := s.value.(types.Document); !ok {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "the match filter must be an expression in an object")
+		}
+
+	case "$sort":
+		sortDoc, ok := s.value.(types.Document)
+		if !ok {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "the $sort key specification must be an object")
+		}
+		if len(sortDoc.Keys()) == 0 {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "$sort stage must have at least one sort key")
+		}
+
+	case "$project":
+		project, err := common.NewProject(s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = project
+
+	case "$addFields", "$set":
+		addFields, err := common.NewAddFields(s.name, s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = addFields
+
+	case "$unset":
+		// $unset is an exclusion $project
+		var fields []any
+		switch value := s.value.(type) {
+		case string:
+			fields = []any{value}
+		case *types.Array:
+			fields = stagesValues(value)
+		}
+
+		spec := types.MustMakeDocument()
+		for _, f := range fields {
+			field, ok := f.(string)
+			if !ok || field == "" {
+				return stage{}, common.NewErrorMessage(common.ErrBadValue, "$unset specification must be a string or an array containing only string values")
+			}
+			if err := spec.Set(field, int32(0)); err != nil {
+				return stage{}, lazyerrors.Error(err)
+			}
+		}
+
+		if len(spec.Keys()) == 0 {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "$unset specification must be a string or an array with at least one field")
+		}
+
+		project, err := common.NewProject(spec)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = project
+
+	case "$group":
+		group, err := common.NewGroup(s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = group
+
+	case "$unwind":
+		unwind, err := common.NewUnwind(s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = unwind
+
+	case "$lookup":
+		l, err := newLookup(s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		s.value = l
+
+	case "$skip", "$limit":
+		n, err := stageNumber(s.name, s.value)
+		if err != nil {
+			return stage{}, err
+		}
+		if s.name == "$limit" && n <= 0 {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "the limit must be positive")
+		}
+		if n < 0 {
+			return stage{}, common.NewErrorMessage(common.ErrBadValue, "invalid argument to $skip stage: value cannot be negative")
+		}
+		s.value = n
+
+	default:
+		if unsupportedStages[s.name] {
+			return stage{}, common.NewErrorMessage(common.ErrNotImplemented, "support for %s is not implemented yet", s.name)
+		}
+		return stage{}, common.NewErrorMessage(common.ErrStageUnrecognized, "Unrecognized pipeline stage name: '%s'", s.name)
+	}
+
+	return s, nil
+}
+
+// stageNumber converts the argument of $skip or $limit to an integer.
+func stageNumber(name string, value any) (int64, error) {
+	switch value := value.(type) {
+	case int32:
+		return int64(value), nil
+	case int64:
+		return value, nil
+	case float64:
+		if value != math.Trunc(value) || math.IsInf(value, 0) {
+			return 0, common.NewErrorMessage(common.ErrBadValue, "invalid argument to %s stage: cannot represent as a 64-bit integer", name)
+		}
+		return int64(value), nil
+	default:
+		return 0, common.NewErrorMessage(common.ErrBadValue, "invalid argument to %s stage: expected a number", name)
+	}
+}
+
+// push tries to push the stage down to SAP HANA. It returns false if the stage has to be processed in memory.
+func (p *pipeline) push(s stage) bool {
+	// the result of a GROUP BY is processed in memory
+	if p.group != nil {
+		return false
+	}
+
+	switch s.name {
+	case "$match":
+		if len(p.projection.Keys()) != 0 || p.skip != 0 || p.hasLimit {
+			return false
+		}
+
+		// filters which can not be translated to SQL are processed in memory
+		sqlFilter, memoryFilter, err := common.SplitFilter(s.value.(types.Document))
+		if err != nil || (len(sqlFilter.Keys()) == 0 && len(memoryFilter.Keys()) != 0) {
+			return false
+		}
+
+		p.match = append(p.match, sqlFilter)
+		if len(memoryFilter.Keys()) != 0 {
+			// the remaining filter is the first stage processed in memory
+			p.stages = append(p.stages, stage{name: "$match", value: memoryFilter})
+		}
+
+	case "$sort":
+		if len(p.sort.Keys()) != 0 || len(p.projection.Keys()) != 0 || p.skip != 0 || p.hasLimit {
+			return false
+		}
+
+		if _, err := createOrderByStmt(map[string]any{"sort": s.value}); err != nil || sortInMemory(s.value.(types.Document), p.flatKeys) {
+			return false
+		}
+
+		p.sort = s.value.(types.Document)
+
+	case "$project", "$unset":
+		if p.project != nil {
+			return false
+		}
+
+		project := s.value.(*common.Project)
+		if _, _, ok := project.SQL(); !ok {
+			return false
+		}
+
+		p.project = project
+		p.projection = project.Spec()
+
+	case "$group":
+		if len(p.sort.Keys()) != 0 || len(p.projection.Keys()) != 0 || p.skip != 0 || p.hasLimit {
+			return false
+		}
+
+		if _, _, ok := s.value.(*common.Group).SQL(); !ok {
+			return false
+		}
+
+		p.group = s.value.(*common.Group)
+
+	case "$skip":
+		n := s.value.(int64)
+		p.skip += n
+		if p.hasLimit {
+			p.limit -= n
+			if p.limit < 0 {
+				p.limit = 0
+			}
+		}
+
+	case "$limit":
+		n := s.value.(int64)
+		if !p.hasLimit || n < p.limit {
+			p.limit = n
+		}
+		p.hasLimit = true
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// prefilter pushes down the part of the filter which can be executed in SAP HANA like a $match, but
+// without processing the rest in memory. The caller has to apply the whole filter in memory.
+func (p *pipeline) prefilter(filter types.Document) {
+	if len(filter.Keys()) == 0 || p.group != nil || len(p.projection.Keys()) != 0 || p.skip != 0 || p.hasLimit {
+		return
+	}
+
+	sqlFilter, _, err := common.SplitFilter(filter)
+	if err != nil || len(sqlFilter.Keys()) == 0 {
+		return
+	}
+
+	p.match = append(p.match, sqlFilter)
+}
+
+// filter returns the filter of all pushed down $match stages.
+func (p *pipeline) filter() (types.Document, error) {
+	switch len(p.match) {
+	case 0:
+		return types.MustMakeDocument(), nil
+	case 1:
+		return p.match[0], nil
+	}
+
+	filters := types.MakeArray(len(p.match))
+	for _, m := range p.match {
+		if err := filters.Append(m); err != nil {
+			return types.Document{}, lazyerrors.Error(err)
+		}
+	}
+
+	return types.MustMakeDocument("$and", filters), nil
+}
+
+// sql creates the SELECT statement of the pushed down stages.
+func (p *pipeline) sql(db, collection string) (sql string, exclusion bool, err error) {
+	projectionSQL := "*"
+	if p.project != nil {
+		projectionSQL, exclusion, _ = p.project.SQL()
+	}
+
+	var groupBySQL string
+	if p.group != nil {
+		projectionSQL, groupBySQL, _ = p.group.SQL()
+	}
+
+	sql, err = p.selectSQL(projectionSQL, groupBySQL, db, collection)
+	return
+}
+
+// selectSQL creates the SELECT statement of the pushed down stages with the given projection.
+func (p *pipeline) selectSQL(projectionSQL, groupBySQL, db, collection string) (sql string, err error) {
+	sql = fmt.Sprintf("SELECT %s FROM \"%s\".\"%s\"", projectionSQL, db, collection)
+
+	filter, err := p.filter()
+	if err != nil {
+		return
+	}
+
+	whereStmt, err := common.CreateWhereClause(filter)
+	if err != nil {
+		return
+	}
+	sql += whereStmt + groupBySQL
+
+	orderByStmt, err := createOrderByStmt(map[string]any{"sort": p.sort})
+	if err != nil {
+		return
+	}
+	sql += orderByStmt
+
+	if p.hasLimit && p.limit == 0 {
+		// a $skip behind a $limit skipped all documents
+		sql += " LIMIT 0 "
+		return
+	}
+
+	sql += limitOffsetStmt(p.limit, p.skip, orderByStmt != "")
+
+	return
+}
+
+// localSQL returns the SQL of the documents passed to the first stage processed in memory. It returns
+// nil if the documents are not the stored documents, because a projection or a group was pushed down.
+func (p *pipeline) localSQL(db, collection string) *localSQL {
+	if p.project != nil || p.group != nil {
+		return nil
+	}
+
+	return &localSQL{p: p, db: db, collection: collection}
+}
+
+// processStages runs the stages which are not pushed down on the given documents. If the documents
+// were selected by the given SQL, a leading $lookup uses it to select the foreign documents.
+func (h *storage) processStages(ctx context.Context, db string, stages []stage, docs []types.Document, local *localSQL) ([]types.Document, error) {
+	var err error
+	for i, s := range stages {
+		// $lookup is the only stage which needs to query SAP HANA
+		if s.name == "$lookup" {
+			if i > 0 {
+				local = nil
+			}
+			docs, err = h.lookup(ctx, db, s.value.(*lookup), docs, local)
+		} else {
+			docs, err = processStage(ctx, s, docs)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return docs, nil
+}
+
+// processStage runs a single stage in memory. It stops with the error of the context when
+// the context is done, i.e. when the time limit set by maxTimeMS is exceeded.
+func processStage(ctx context.Context, s stage, docs []types.Document) ([]types.Document, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch s.name {
+	case "$match":
+		res := make([]types.Document, 0, len(docs))
+		for _, doc := range docs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			matches, err := common.MatchDocument(doc, s.value.(types.Document))
+			if err != nil {
+				return nil, err
+			}
+			if matches {
+				res = append(res, doc)
+			}
+		}
+		return res, nil
+
+	case "$sort":
+		if err := common.SortDocuments(ctx, docs, s.value.(types.Document)); err != nil {
+			return nil, err
+		}
+		return docs, nil
+
+	case "$project", "$unset":
+		return s.value.(*common.Project).Documents(docs)
+
+	case "$addFields", "$set":
+		return s.value.(*common.AddFields).Documents(docs)
+
+	case "$group":
+		return s.value.(*common.Group).Documents(ctx, docs)
+
+	case "$unwind":
+		return s.value.(*common.Unwind).Documents(ctx, docs)
+
+	case "$skip":
+		n := s.value.(int64)
+		if n >= int64(len(docs)) {
+			return docs[:0], nil
+		}
+		return docs[n:], nil
+
+	case "$limit":
+		n := s.value.(int64)
+		if n < int64(len(docs)) {
+			docs = docs[:n]
+		}
+		return docs, nil
+
+	default:
+		return nil, lazyerrors.Errorf("unexpected stage %s", s.name)
+	}
+}
+
+// sortInMemory returns true if the documents have to be sorted in memory. MongoDB sorts by the smallest
+// or largest value found at a dotted key, which traverses arrays, and SQL can not sort like this. Dotted
+// keys which are resolved without traversing arrays are sorted by SQL.
+func sortInMemory(sort types.Document, flatKeys map[string]bool) bool {
+	for _, key := range sort.Keys() {
+		if strings.Contains(key, ".") && !flatKeys[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dottedKeys returns the dotted keys of a sort.
+func dottedKeys(sort types.Document) []string {
+	var res []string
+	for _, key := range sort.Keys() {
+		if strings.Contains(key, ".") {
+			res = append(res, key)
+		}
+	}
+
+	return res
+}
@@ -31,11 +31,18 @@ import (
 type storage struct {
 	hanaPool *hana.Hpool
 	l        *zap.Logger
+	cursors  *cursorRegistry
 }
 
 func NewStorage(hanaPool *hana.Hpool, l *zap.Logger) common.Storage {
 	return &storage{
 		hanaPool: hanaPool,
 		l:        l,
+		cursors:  newCursorRegistry(),
 	}
 }
+
+// Close closes all cursors which are still open.
+func (h *storage) Close() {
+	h.cursors.closeAll()
+}
@@ -64,6 +64,11 @@ func New(opts *NewOpts) *Handler {
 	}
 }
 
+// Close frees the resources of the handler like open cursors.
+func (h *Handler) Close() {
+	h.crud.Close()
+}
+
 // Handle handles the message.
 //
 // Message handlers should:
@@ -202,7 +207,7 @@ func (h *Handler) msgStorage(ctx context.Context, msg *wire.OpMsg) (common.Stora
 	command := document.Command()
 
 	switch command {
-	case "delete", "find", "count", "findAndModify", "update", "insert", "createindexes":
+	case "delete", "find", "count", "findAndModify", "update", "insert", "createindexes", "getMore", "killCursors", "aggregate", "distinct", "explain":
 		return h.crud, nil
 	default:
 		panic(fmt.Sprintf("unhandled command %q", command))
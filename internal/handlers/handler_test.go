@@ -143,7 +143,7 @@ func TestFind(t *testing.T) {
 		mock.ExpectQuery("SELECT object_count FROM m_feature_usage WHERE component_name = 'DOCSTORE' AND feature_name = 'COLLECTIONS'").WillReturnRows(row1)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"SCHEMAS\" WHERE SCHEMA_NAME = 'databaseName'").WillReturnRows(row3)
 		mock.ExpectQuery("SELECT COUNT(*) FROM \"PUBLIC\".\"M_TABLES\" WHERE SCHEMA_NAME = 'databaseName' AND table_name = 'actor' AND TABLE_TYPE = 'COLLECTION'").WillReturnRows(row4)
-		mock.ExpectQuery("SELECT * FROM \"databaseName\".\"actor\" WHERE \"last_name\" = 'Doe' AND \"actor_id\" \u003e 50 AND \"actor_id\" \u003c 100").WillReturnRows(row2)
+		mock.ExpectQuery("SELECT * FROM \"databaseName\".\"actor\" WHERE (\"last_name\" = 'Doe' OR FOR ANY \"$element\" IN \"last_name\" SATISFIES \"$element\" = 'Doe' END) AND ((IS_NUMBER(\"actor_id\") AND \"actor_id\" \u003e 50) OR FOR ANY \"$element\" IN \"actor_id\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" \u003e 50) END) AND ((IS_NUMBER(\"actor_id\") AND \"actor_id\" \u003c 100) OR FOR ANY \"$element\" IN \"actor_id\" SATISFIES (IS_NUMBER(\"$element\") AND \"$element\" \u003c 100) END)").WillReturnRows(row2)
 
 		actual := handle(ctx, t, handler, reqDoc)
 		expected := types.MustMakeDocument(
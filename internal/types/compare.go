@@ -37,6 +37,14 @@ const (
 	notEqual // but not less or greater; for example, two NaNs
 )
 
+// The results of CompareScalars for other packages.
+const (
+	Equal    = equal
+	Less     = less
+	Greater  = greater
+	NotEqual = notEqual
+)
+
 // compareScalars compares two scalar values.
 func CompareScalars(a, b any) CompareResult {
 	if a == nil {